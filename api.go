@@ -23,6 +23,7 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/RoaringBitmap/roaring"
 	"github.com/google/zoekt/query"
 )
 
@@ -47,6 +48,15 @@ type FileMatch struct {
 	// Sourcegraph.
 	RepositoryID uint32
 
+	// RepositoryRank is the rank of Repository that was used to
+	// score this match. It is exposed for debugging result ordering.
+	RepositoryRank uint16
+
+	// MatchCount is the number of non-overlapping matches in the
+	// file. It is only set if SearchOptions.FileMatchesOnly is set,
+	// which leaves LineMatches empty.
+	MatchCount int
+
 	// Only set if requested
 	Content []byte
 
@@ -56,6 +66,11 @@ type FileMatch struct {
 	// Detected language of the result.
 	Language string
 
+	// SkipReason is set if the content of the file was not indexed, eg.
+	// because it is too large or binary. It is the Document.SkipReason
+	// the file was indexed with.
+	SkipReason string
+
 	// SubRepositoryName is the globally unique name of the repo,
 	// if it came from a subrepository
 	SubRepositoryName string
@@ -66,6 +81,14 @@ type FileMatch struct {
 
 	// Commit SHA1 (hex) of the (sub)repo holding the file.
 	Version string
+	// Siblings holds other paths in the directory of FileName. It is
+	// only set for filename matches, if SearchOptions.FileNameSiblings
+	// is set.
+	Siblings []string
+
+	// ModTime is the Document.ModTime the file was indexed with. It is
+	// zero if unknown.
+	ModTime time.Time
 }
 
 // LineMatch holds the matches within a single line in a file.
@@ -83,6 +106,25 @@ type LineMatch struct {
 	// within the file, does not take rank of file into account
 	Score         float64
 	LineFragments []LineFragmentMatch
+
+	// FileScore is the amount this line contributed to
+	// FileMatch.Score. Only set if SearchOptions.LineScores is
+	// set. The remainder of FileMatch.Score comes from file-level
+	// signals such as document order and repository rank.
+	FileScore float64
+
+	// Before and After are the lines surrounding Line, up to
+	// SearchOptions.ContextLines of each, in file order. They are not
+	// set for file name matches. The context of nearby matches may
+	// overlap.
+	Before []ContextLine
+	After  []ContextLine
+}
+
+// ContextLine is a line surrounding a LineMatch.
+type ContextLine struct {
+	Line       []byte
+	LineNumber int
 }
 
 type Symbol struct {
@@ -137,9 +179,18 @@ type Stats struct {
 	// gathered enough matches.
 	FilesSkipped int
 
+	// Shards that the search was sent to, after filtering by repository.
+	// Only the first result of a sharded search sets it, so that it adds
+	// up to the total.
+	ShardsTotal int
+
 	// Shards that we scanned to find matches.
 	ShardsScanned int
 
+	// Shards that returned at least one file. Compared to ShardsScanned,
+	// it tells whether matches are concentrated in a few shards.
+	ShardsWithMatches int
+
 	// Shards that we did not process because a query was canceled.
 	ShardsSkipped int
 
@@ -147,12 +198,20 @@ type Stats struct {
 	// by the bloom or ngram filter indicating it had no matches.
 	ShardsSkippedFilter int
 
+	// Shards that were cut off by SearchOptions.MaxShardWallTime.
+	ShardTimeouts int
+
 	// Number of non-overlapping matches
 	MatchCount int
 
 	// Number of candidate matches as a result of searching ngrams.
 	NgramMatches int
 
+	// Number of substrings per shard that the bloom filter ruled out,
+	// and that it could not rule out.
+	BloomRejected int
+	BloomAdmitted int
+
 	// Wall clock time for queued search.
 	Wait time.Duration
 
@@ -170,10 +229,15 @@ func (s *Stats) Add(o Stats) {
 	s.FilesSkipped += o.FilesSkipped
 	s.MatchCount += o.MatchCount
 	s.NgramMatches += o.NgramMatches
+	s.BloomRejected += o.BloomRejected
+	s.BloomAdmitted += o.BloomAdmitted
 	s.ShardFilesConsidered += o.ShardFilesConsidered
+	s.ShardsTotal += o.ShardsTotal
 	s.ShardsScanned += o.ShardsScanned
+	s.ShardsWithMatches += o.ShardsWithMatches
 	s.ShardsSkipped += o.ShardsSkipped
 	s.ShardsSkippedFilter += o.ShardsSkippedFilter
+	s.ShardTimeouts += o.ShardTimeouts
 	s.Wait += o.Wait
 }
 
@@ -192,10 +256,15 @@ func (s *Stats) Zero() bool {
 		s.FilesSkipped > 0 ||
 		s.MatchCount > 0 ||
 		s.NgramMatches > 0 ||
+		s.BloomRejected > 0 ||
+		s.BloomAdmitted > 0 ||
 		s.ShardFilesConsidered > 0 ||
+		s.ShardsTotal > 0 ||
 		s.ShardsScanned > 0 ||
+		s.ShardsWithMatches > 0 ||
 		s.ShardsSkipped > 0 ||
 		s.ShardsSkippedFilter > 0 ||
+		s.ShardTimeouts > 0 ||
 		s.Wait > 0)
 }
 
@@ -226,6 +295,43 @@ type SearchResult struct {
 	// FragmentNames holds a repo => template string map, for
 	// the line number fragment.
 	LineFragments map[string]string
+
+	// IndexFormatVersions holds an index format version => count
+	// map of the shards that contributed files to the result. More
+	// than one entry means results came from mixed shard versions.
+	IndexFormatVersions map[int]int
+
+	// RepoMatchDensity is only set if SearchOptions.RepoMatchDensity
+	// is set. Shards report every repository they hold, so that the
+	// sizes of repositories spanning several shards add up. Use
+	// SortRepoMatchDensity to rank the merged entries.
+	RepoMatchDensity []RepoMatchDensity
+}
+
+// RepoMatchDensity holds the number of matches in a repository along with
+// the size of the repository, so repositories can be ranked by how much
+// they use a pattern rather than by how large they are.
+type RepoMatchDensity struct {
+	Repository string
+
+	// MatchCount is the number of non-overlapping matches in the files
+	// of the repository, before SearchOptions.MaxLineMatches truncates
+	// them. It is the same with SearchOptions.FileMatchesOnly, where it
+	// is the sum of FileMatch.MatchCount. A file that matches by its
+	// name alone counts as one match.
+	MatchCount int
+
+	// Lines is the number of newlines indexed for the repository.
+	Lines uint64
+}
+
+// Density returns the number of matches per thousand lines.
+func (r *RepoMatchDensity) Density() float64 {
+	lines := r.Lines
+	if lines == 0 {
+		lines = 1
+	}
+	return float64(r.MatchCount) * 1000 / float64(lines)
 }
 
 // RepositoryBranch describes an indexed branch, which is a name
@@ -363,6 +469,10 @@ type IndexMetadata struct {
 	LanguageMap           map[string]byte
 	ZoektVersion          string
 	ID                    string
+
+	// SymbolsOnly is set if the shard only stores the symbols of its
+	// documents, see IndexBuilder.SymbolsOnly.
+	SymbolsOnly bool `json:",omitempty"`
 }
 
 // Statistics of a (collection of) repositories.
@@ -382,6 +492,11 @@ type RepoStats struct {
 	// ContentBytes is the amount of RAM used for raw content.
 	ContentBytes int64
 
+	// IndexFileBytes is the size of the index files on disk. It is only
+	// set by List if ListOptions.IncludeIndexBytes is set. Repositories
+	// in a compound shard each get an equal part of its size.
+	IndexFileBytes int64
+
 	// Sourcegraph specific stats below. These are not as efficient to calculate
 	// as the above statistics. We experimentally measured about a 10% slower
 	// shard load time. However, we find these values very useful to track and
@@ -404,6 +519,16 @@ type RepoStats struct {
 	// OtherBranchesNewLinesCount is the number of newlines "\n" in all branches
 	// except the default branch.
 	OtherBranchesNewLinesCount uint64
+
+	// Languages breaks down Documents and ContentBytes by language. It is
+	// only set by List if ListOptions.Languages is set.
+	Languages map[string]LanguageStats
+}
+
+// LanguageStats holds the size of the documents of a single language.
+type LanguageStats struct {
+	Documents    int
+	ContentBytes int64
 }
 
 func (s *RepoStats) Add(o *RepoStats) {
@@ -413,11 +538,22 @@ func (s *RepoStats) Add(o *RepoStats) {
 	s.IndexBytes += o.IndexBytes
 	s.Documents += o.Documents
 	s.ContentBytes += o.ContentBytes
+	s.IndexFileBytes += o.IndexFileBytes
 
 	// Sourcegraph specific
 	s.NewLinesCount += o.NewLinesCount
 	s.DefaultBranchNewLinesCount += o.DefaultBranchNewLinesCount
 	s.OtherBranchesNewLinesCount += o.OtherBranchesNewLinesCount
+
+	if len(o.Languages) > 0 && s.Languages == nil {
+		s.Languages = make(map[string]LanguageStats, len(o.Languages))
+	}
+	for lang, ls := range o.Languages {
+		cur := s.Languages[lang]
+		cur.Documents += ls.Documents
+		cur.ContentBytes += ls.ContentBytes
+		s.Languages[lang] = cur
+	}
 }
 
 type RepoListEntry struct {
@@ -438,10 +574,33 @@ type RepoList struct {
 
 	Crashes int
 
+	// Incomplete is true if the context expired before every shard was
+	// listed. Repos and Minimal then hold the repositories found so far.
+	Incomplete bool
+
 	// Minimal response to a List request. Returned when ListOptions.Minimal is true.
 	Minimal map[uint32]*MinimalRepoListEntry
 }
 
+// StreamListEvent holds the repositories listed by one shard of a
+// streamed List. The entries are shared with the shard, and must not be
+// modified.
+type StreamListEvent struct {
+	// Repos of the shard. A repository spread over several shards is
+	// sent once per shard, with the stats of that shard. Unset if
+	// ListOptions.Minimal is true.
+	Repos []*RepoListEntry
+
+	// Minimal entries of the shard whose IDs weren't sent before. Only
+	// set if ListOptions.Minimal is true.
+	Minimal map[uint32]*MinimalRepoListEntry
+
+	Crashes int
+
+	// Err is set on the last event if listing failed.
+	Err error
+}
+
 type Searcher interface {
 	Search(ctx context.Context, q query.Q, opts *SearchOptions) (*SearchResult, error)
 
@@ -457,6 +616,13 @@ type Searcher interface {
 type ListOptions struct {
 	// Return only Minimal data per repo that Sourcegraph frontend needs.
 	Minimal bool
+
+	// Languages populates RepoStats.Languages of each repository.
+	Languages bool
+
+	// IncludeIndexBytes populates RepoStats.IndexFileBytes of each
+	// repository.
+	IncludeIndexBytes bool
 }
 
 func (o *ListOptions) String() string {
@@ -471,6 +637,15 @@ type SearchOptions struct {
 	// Return the whole file.
 	Whole bool
 
+	// ContentRange, if set, returns this byte range of the content of
+	// each matching file in FileMatch.Content, instead of the whole
+	// file. Only the range is read. It is cut off at the end of the
+	// file, so a short or empty Content means there is no more. A
+	// client that got the line matches of a large file can fetch more
+	// of it this way, searching for the file with eg.
+	// query.FileChecksum.
+	ContentRange *ContentRange
+
 	// Maximum number of matches: skip all processing an index
 	// shard after we found this many non-overlapping matches.
 	ShardMaxMatchCount int
@@ -489,10 +664,138 @@ type SearchOptions struct {
 	// Abort the search after this much time has passed.
 	MaxWallTime time.Duration
 
+	// MaxShardWallTime, if set, stops searching a single shard after
+	// this much time has passed, while the other shards carry on. Such
+	// shards are counted in Stats.ShardTimeouts.
+	MaxShardWallTime time.Duration
+
 	// Trim the number of results after collating and sorting the
 	// results
 	MaxDocDisplayCount int
 
+	// RepoIDs, if set, restricts the search to repositories with
+	// these IDs. This is cheaper than a query.BranchesRepos for
+	// callers that already hold a large set of IDs.
+	RepoIDs *roaring.Bitmap
+
+	// MaxFilePaths, if set, only returns the paths of the first
+	// MaxFilePaths matching files. Line matches are not computed,
+	// and searching stops once enough files have matched.
+	MaxFilePaths int
+
+	// FileNameOnly matches the text atoms of the query against file
+	// names only, and returns the matching files without line matches.
+	// Atoms that need the content, like symbols, match nothing. No
+	// content is read from the shard.
+	FileNameOnly bool
+
+	// FileMatchesOnly returns the matching files with their
+	// FileMatch.MatchCount, but without line matches. Lines are not
+	// extracted from the content.
+	FileMatchesOnly bool
+
+	// MaxFileSize skips documents whose content is larger than
+	// this many bytes. Zero means no limit.
+	MaxFileSize int
+
+	// RepoMatchDensity reports the number of matches per repository
+	// in SearchResult.RepoMatchDensity.
+	RepoMatchDensity bool
+
+	// FileNameSiblings is the maximum number of paths from the same
+	// directory to return in FileMatch.Siblings for filename matches.
+	FileNameSiblings int
+
+	// ReverseLineOrder returns the line matches of each file in
+	// descending line order instead of by score, eg. to show the most
+	// recent entries of a log file first.
+	ReverseLineOrder bool
+
+	// MaxLineMatches, if set, caps the number of line matches returned
+	// per file. The cap applies after ordering, so with ReverseLineOrder
+	// the last MaxLineMatches matches of the file are kept.
+	MaxLineMatches int
+
+	// MaxContentBytes, if set, caps the total size of FileMatch.Content
+	// and LineMatch.Line in the result. Once the next one would exceed
+	// the cap, no more content is returned, but matches are still
+	// counted in Stats. It is enforced across all shards of a sharded
+	// searcher.
+	MaxContentBytes int64
+
+	// NgramSkipFraction, if positive, makes the search ignore content
+	// ngrams that are in more than this fraction of the documents of a
+	// shard when selecting candidate documents, since they hardly narrow
+	// them down. If a substring only has such ngrams, all content is
+	// scanned for it.
+	NgramSkipFraction float64
+
+	// MaxMatchesPerRepo, if set, caps the number of files a single
+	// repository contributes to the result, so that a large repository
+	// can't crowd out the others. A sharded searcher keeps the best
+	// files of each repository across all its shards, before applying
+	// MaxDocDisplayCount, and removes the dropped files from Stats.
+	// Files beyond the cap don't count towards TotalMaxMatchCount, so
+	// they don't stop the search of other repositories. Streamed
+	// results aren't sent in rank order, so StreamSearch rejects it.
+	MaxMatchesPerRepo int
+
+	// ExcludeTests drops test files from the result of a sharded
+	// searcher, and from its Stats. Test files are recognized by their
+	// path, eg. foo_test.go or testdata/foo.txt, or by IsTestFile.
+	ExcludeTests bool
+
+	// IsTestFile, if set, replaces the built-in heuristic of
+	// ExcludeTests. It is called with the path of a file relative to
+	// the repository root. Like other functions, it isn't sent over
+	// RPC, so remote searchers use the built-in heuristic.
+	IsTestFile func(name string) bool
+
+	// ContextLines is the number of lines before and after each line
+	// match to return in LineMatch.Before and LineMatch.After, like
+	// grep -C.
+	ContextLines int
+
+	// WholeLine only reports content matches that span a complete line,
+	// like grep -x: regexps are anchored to the start and end of lines,
+	// and the "\r" of "\r\n" line endings is not part of the line.
+	// Files without such a match are dropped, unless they match by file
+	// name. It does not apply to query.Symbol, or with MaxFilePaths or
+	// FileNameOnly, which don't look at lines.
+	WholeLine bool
+
+	// IncludeSymbols reports content matches that lie within a symbol
+	// definition as symbol matches, with LineFragmentMatch.SymbolInfo
+	// set. Otherwise only query.Symbol matches carry symbol
+	// information.
+	IncludeSymbols bool
+
+	// OmitSymbolInfo leaves LineFragmentMatch.SymbolInfo unset, also for
+	// query.Symbol matches, which saves reading the symbol metadata for
+	// clients that don't show it. It takes precedence over
+	// IncludeSymbols, and doesn't change which files match or their
+	// scores.
+	OmitSymbolInfo bool
+
+	// LineScores populates LineMatch.FileScore with the
+	// contribution of each line to the score of its file.
+	LineScores bool
+
+	// Weights adjusts the scores of matches. The zero value scores
+	// matches as usual.
+	Weights ScoreWeights
+
+	// SortBy is the order of SearchResult.Files. Results are always cut
+	// off by score first, so eg. SortByFilePath orders the best matches
+	// by path. It does not apply to streamed results.
+	SortBy SortOrder
+
+	// StreamBatchSize, if larger than 1, coalesces streamed results
+	// until they hold at least this many files, the search completes
+	// or TotalMaxMatchCount is exceeded. This reduces the number of
+	// events, eg. flushes of an event stream.
+	StreamBatchSize int
+
 	// Trace turns on opentracing for this request if true and if the Jaeger address was provided as
 	// a command-line flag
 	Trace bool
@@ -501,6 +804,40 @@ type SearchOptions struct {
 	SpanContext map[string]string
 }
 
+// ContentRange is a range of bytes of the content of a file.
+type ContentRange struct {
+	Start  uint32
+	Length uint32
+}
+
+// ScoreWeights are added to the score of a match, which makes up the
+// score of its line and file. They may be negative to demote matches,
+// though the best line of a file never lowers the file score below what
+// a line without any score would give.
+type ScoreWeights struct {
+	// FileNameMatch is added for matches in the file name.
+	FileNameMatch float64
+
+	// SymbolMatch is added for matches within a symbol definition.
+	SymbolMatch float64
+
+	// WordBoundary is added for matches that start and end at word
+	// boundaries.
+	WordBoundary float64
+}
+
+// SortOrder is an order for the files of a search result.
+type SortOrder int
+
+const (
+	// SortByScore sorts files by decreasing score.
+	SortByScore SortOrder = iota
+	// SortByFilePath sorts files by FileMatch.FileName.
+	SortByFilePath
+	// SortByRecency sorts files by decreasing FileMatch.ModTime.
+	SortByRecency
+)
+
 func (s *SearchOptions) String() string {
 	return fmt.Sprintf("%#v", s)
 }
@@ -34,7 +34,9 @@ package zoekt // import "github.com/google/zoekt"
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"hash/crc32"
 	"math"
 	"math/bits"
@@ -46,6 +48,9 @@ import (
 type bloom struct {
 	hasher bloomHash
 	bits   []uint8
+
+	// base is the size of bits before shrinking, or 0 if unknown.
+	base int
 }
 
 type bloomHash func([]byte) []uint32
@@ -71,11 +76,11 @@ const bloomDefaultLoad = 0.42
 var crcTab = crc32.MakeTable(crc32.Castagnoli)
 
 func makeBloomFilterEmpty() bloom {
-	return bloom{bloomDefaultHash, make([]uint8, bloomSizeBase)}
+	return makeBloomFilterWithHasher(bloomDefaultHash)
 }
 
 func makeBloomFilterWithHasher(hash bloomHash) bloom {
-	return bloom{hash, make([]uint8, bloomSizeBase)}
+	return bloom{hasher: hash, bits: make([]uint8, bloomSizeBase), base: bloomSizeBase}
 }
 
 func (b *bloom) Len() int {
@@ -114,7 +119,60 @@ func (b *bloom) maybeHasBytes(xs []byte) bool {
 	if b.hasher == nil {
 		return true
 	}
-	return b.maybeHas(b.hasher(xs))
+	return b.maybeHas(bloomQueryProbes(b.hasher, xs))
+}
+
+// Bounds on the bloom filter probes for a single query term, so that a
+// huge literal doesn't cost a huge amount of hashing per shard. A word
+// cut short by bloomMaxQueryBytes only yields fragments that are also
+// fragments of the full word, and testing a subset of the probes only
+// raises the false positive rate, so the trigram index still prunes
+// correctly.
+const (
+	bloomMaxQueryBytes  = 256
+	bloomMaxQueryProbes = 512
+)
+
+// bloomQueryHashers maps hashers whose probes don't all follow from the
+// substrings of a query term to the hasher a query term is tested with.
+// A filter built by the former has all probes of the latter for any text
+// that contains the term.
+var bloomQueryHashers = map[uintptr]bloomHash{
+	reflect.ValueOf(bloomHasherCRCBlocked64B8K3SubTokens).Pointer(): bloomQueryHasherSubTokens,
+}
+
+// bloomQueryProbes returns the probes of hash for a query term.
+func bloomQueryProbes(hash bloomHash, term []byte) []uint32 {
+	if qh, ok := bloomQueryHashers[reflect.ValueOf(hash).Pointer()]; ok {
+		hash = qh
+	}
+	if len(term) > bloomMaxQueryBytes {
+		n := bloomMaxQueryBytes
+		for n > 0 && !utf8.RuneStart(term[n]) {
+			n--
+		}
+		term = term[:n]
+	}
+	probes := hash(term)
+	if len(probes) > bloomMaxQueryProbes {
+		probes = probes[:bloomMaxQueryProbes]
+	}
+	return probes
+}
+
+// EstimateDistinct estimates the number of distinct word fragments that
+// were added to the filter from its load factor, as -(m/k)*ln(1-X/m) for
+// m bits of which X are set. The number of probes per fragment k depends
+// on the hasher, and is taken from bloomHasherProbes. The estimate is
+// +Inf for a saturated filter, and 0 for a filter without a known hasher.
+func (b *bloom) EstimateDistinct() float64 {
+	id, ok := bloomHasherIds[reflect.ValueOf(b.hasher).Pointer()]
+	if !ok || len(b.bits) == 0 {
+		return 0
+	}
+	m := float64(b.Len())
+	k := float64(bloomHasherProbes[id-1])
+	return -(m / k) * math.Log(1-b.load())
 }
 
 func (b *bloom) load() float64 {
@@ -153,7 +211,38 @@ func (b *bloom) shrinkToSize(target float64) bloom {
 	if divisor != 0 { // avoid divide by zero for empty filter (b.load() is 0)
 		factor = int(math.Log(1-target) / divisor)
 	}
+	return b.shrinkByFactor(factor)
+}
 
+// shrinkToFPR returns a resized bloom filter whose false positive rate for
+// a word fragment is close to fpr. The size is derived from the estimated
+// number of distinct fragments in b, so that filters holding few fragments
+// shrink more than ones holding many.
+func (b *bloom) shrinkToFPR(fpr float64) bloom {
+	id, ok := bloomHasherIds[reflect.ValueOf(b.hasher).Pointer()]
+	if fpr <= 0.0 || fpr >= 1.0 || !ok {
+		return *b
+	}
+
+	// A fragment is a false positive if all of its k probes hit set
+	// bits, so the filter should have a load of fpr^(1/k). Holding n
+	// fragments, m bits have a load of 1-exp(-k*n/m).
+	k := float64(bloomHasherProbes[id-1])
+	target := math.Pow(fpr, 1/k)
+	n := b.EstimateDistinct()
+	if math.IsInf(n, 1) {
+		return *b
+	}
+	factor := len(b.bits)
+	if m := -k * n / math.Log(1-target); m >= 1 {
+		factor = int(float64(b.Len()) / m)
+	}
+	return b.shrinkByFactor(factor)
+}
+
+// shrinkByFactor returns b shrunk by the largest factor of its size that is
+// at most factor.
+func (b *bloom) shrinkByFactor(factor int) bloom {
 	// We can only shrink the bloom filter to a size that is a factor of the
 	// input size. This is made easier by bloomSizeBase being highly composite.
 	for factor > 0 && len(b.bits)%factor != 0 {
@@ -163,7 +252,7 @@ func (b *bloom) shrinkToSize(target float64) bloom {
 	if factor <= 1 {
 		return *b
 	}
-	out := bloom{b.hasher, make([]uint8, len(b.bits)/factor)}
+	out := bloom{hasher: b.hasher, bits: make([]uint8, len(b.bits)/factor), base: b.base}
 	j := 0
 	for i := 0; i < len(b.bits); i++ {
 		out.bits[j] |= b.bits[i]
@@ -176,35 +265,202 @@ func (b *bloom) shrinkToSize(target float64) bloom {
 	return out
 }
 
+// union returns a bloom filter that maybe has every item of b or o.
+func (b *bloom) union(o *bloom) (bloom, error) {
+	return b.combine(o, func(x, y uint8) uint8 { return x | y })
+}
+
+// intersect returns a bloom filter that maybe has the items in both b and
+// o. Its false positive rate can be higher than that of a filter built
+// from the common items alone.
+func (b *bloom) intersect(o *bloom) (bloom, error) {
+	return b.combine(o, func(x, y uint8) uint8 { return x & y })
+}
+
+// combine merges the bits of b and o with op. Both filters must have the
+// same size, base size and hasher, or their bits don't correspond.
+func (b *bloom) combine(o *bloom, op func(x, y uint8) uint8) (bloom, error) {
+	if len(b.bits) != len(o.bits) {
+		return bloom{}, fmt.Errorf("bloom filter sizes differ: %d != %d", len(b.bits), len(o.bits))
+	}
+	if b.base != 0 && o.base != 0 && b.base != o.base {
+		return bloom{}, fmt.Errorf("bloom filter base sizes differ: %d != %d", b.base, o.base)
+	}
+	if reflect.ValueOf(b.hasher).Pointer() != reflect.ValueOf(o.hasher).Pointer() {
+		return bloom{}, errors.New("bloom filter hashers differ")
+	}
+	out := bloom{hasher: b.hasher, bits: make([]uint8, len(b.bits)), base: b.base}
+	if out.base == 0 {
+		out.base = o.base
+	}
+	for i := range out.bits {
+		out.bits[i] = op(b.bits[i], o.bits[i])
+	}
+	return out, nil
+}
+
+// write writes b in the version 1 encoding, which is used for the bloom
+// sections of index shards so that older readers can load them.
 func (b bloom) write(w *writer) {
 	// header: serialization version, hasher id
 	w.Write([]byte{1, bloomHasherIds[reflect.ValueOf(b.hasher).Pointer()]})
 	w.Write(b.bits)
 }
 
+// writeV2 writes b in the version 2 encoding, which also records the size
+// of the filter before shrinking and the shrink factor.
+func (b bloom) writeV2(w *writer) {
+	// header: serialization version, hasher id, base size, factor
+	w.Write([]byte{2, bloomHasherIds[reflect.ValueOf(b.hasher).Pointer()]})
+	base := b.base
+	if base == 0 {
+		base = len(b.bits)
+	}
+	factor := 0
+	if len(b.bits) > 0 {
+		factor = base / len(b.bits)
+	}
+	w.U32(uint32(base))
+	w.U32(uint32(factor))
+	w.Write(b.bits)
+}
+
+// bloomHeaderSizeV2 is the size of the version 2 header.
+const bloomHeaderSizeV2 = 10
+
 func makeBloomFilterFromEncoded(buf []byte) (bloom, error) {
 	b := bloom{}
-	if len(buf) < 2 || buf[0] != 1 {
+	if len(buf) < 2 {
 		return b, errors.New("invalid bloom filter encoding (wrong size/version)")
 	}
 	if buf[1] <= 0 || int(buf[1]) > len(bloomHashers) {
 		return b, errors.New("invalid bloom filter encoding (unknown hasher type)")
 	}
 	b.hasher = bloomHashers[buf[1]-1]
-	b.bits = buf[2:]
+
+	switch buf[0] {
+	case 1:
+		b.bits = buf[2:]
+		// Version 1 filters were always shrunk from bloomSizeBase.
+		if len(b.bits) > 0 && bloomSizeBase%len(b.bits) == 0 {
+			b.base = bloomSizeBase
+		}
+	case 2:
+		if len(buf) < bloomHeaderSizeV2 {
+			return bloom{}, errors.New("invalid bloom filter encoding (short header)")
+		}
+		base := binary.BigEndian.Uint32(buf[2:])
+		factor := binary.BigEndian.Uint32(buf[6:])
+		b.bits = buf[bloomHeaderSizeV2:]
+		if factor == 0 || uint64(base) != uint64(factor)*uint64(len(b.bits)) {
+			return bloom{}, fmt.Errorf("invalid bloom filter encoding (base size %d is not %d times size %d)", base, factor, len(b.bits))
+		}
+		b.base = int(base)
+	default:
+		return bloom{}, fmt.Errorf("invalid bloom filter encoding (unknown version %d)", buf[0])
+	}
 	return b, nil
 }
 
+// BloomFilter is a standalone bloom filter over case-insensitive word
+// fragments, using the same hashing as the filters stored in index shards.
+// Words shorter than 4 characters are not tracked, so MaybeContains is
+// always true for them.
+type BloomFilter struct {
+	b bloom
+}
+
+// NewBloomFilter returns an empty filter. It starts out large; call
+// Shrink once all data has been added.
+func NewBloomFilter() *BloomFilter {
+	return &BloomFilter{b: makeBloomFilterEmpty()}
+}
+
+// Add adds the word fragments of data to the filter.
+func (f *BloomFilter) Add(data []byte) {
+	f.b.addBytes(data)
+}
+
+// MaybeContains returns false if word was definitely not added to the
+// filter.
+func (f *BloomFilter) MaybeContains(word []byte) bool {
+	return f.b.maybeHasBytes(word)
+}
+
+// Shrink returns a smaller copy of the filter with a load factor close to
+// targetLoad. Values outside of (0, 1) return the filter unchanged.
+func (f *BloomFilter) Shrink(targetLoad float64) *BloomFilter {
+	return &BloomFilter{b: f.b.shrinkToSize(targetLoad)}
+}
+
+// GobEncode implements gob.GobEncoder.
+func (f *BloomFilter) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+	w := &writer{w: &buf}
+	f.b.writeV2(w)
+	return buf.Bytes(), w.err
+}
+
+// GobDecode implements gob.GobDecoder. It accepts both the version 1
+// encoding used in index shards and the version 2 encoding written by
+// GobEncode.
+func (f *BloomFilter) GobDecode(data []byte) error {
+	b, err := makeBloomFilterFromEncoded(append([]byte{}, data...))
+	if err != nil {
+		return err
+	}
+	f.b = b
+	return nil
+}
+
 // bloomHasherIds maps from function pointers to hash numbers, to allow
 // backwards compatible hash function changes.
 var bloomHasherIds = map[uintptr]byte{
-	reflect.ValueOf(bloomHasherCRCBlocked64B8K3).Pointer(): 1,
+	reflect.ValueOf(bloomHasherCRCBlocked64B8K3).Pointer():          1,
+	reflect.ValueOf(bloomHasherCRCBlocked64B8K3Min3).Pointer():      2,
+	reflect.ValueOf(bloomHasherCRCBlocked64B8K3Unicode).Pointer():   3,
+	reflect.ValueOf(bloomHasherCRCBlocked64B8K3SubTokens).Pointer(): 4,
 }
 
 // bloomHashers maps from hash identifierss stored in encoded bloom filters to
 // hash functions, to allo backwards compatible hash function evolution.
 var bloomHashers = []bloomHash{
 	bloomHasherCRCBlocked64B8K3,
+	bloomHasherCRCBlocked64B8K3Min3,
+	bloomHasherCRCBlocked64B8K3Unicode,
+	bloomHasherCRCBlocked64B8K3SubTokens,
+}
+
+// bloomHasherProbes holds the number of probes each hash function sets
+// per word fragment, indexed like bloomHashers.
+var bloomHasherProbes = []int{
+	3,
+	3,
+	3,
+	3,
+}
+
+// minWordLength returns the length of the shortest query term for which
+// b can have probes. Shorter terms must not be tested against b.
+func (b *bloom) minWordLength() int {
+	if reflect.ValueOf(b.hasher).Pointer() == reflect.ValueOf(bloomHasherCRCBlocked64B8K3Min3).Pointer() {
+		return 3
+	}
+	return bloomHashMinWordLength
+}
+
+// bloomHasherCRCBlockedMinN returns the registered variant of
+// bloomHasherCRCBlocked64B8K3 that hashes words of at least minLength
+// runes. Hashers are identified by their function pointer in encoded
+// filters, so only lengths with a registered hasher are supported.
+func bloomHasherCRCBlockedMinN(minLength int) (bloomHash, error) {
+	switch minLength {
+	case 3:
+		return bloomHasherCRCBlocked64B8K3Min3, nil
+	case bloomHashMinWordLength:
+		return bloomHasherCRCBlocked64B8K3, nil
+	}
+	return nil, fmt.Errorf("no bloom hasher for minimum word length %d", minLength)
 }
 
 // The following functions and constants *must not* be changed unless you can prove
@@ -231,6 +487,11 @@ func initBloomWordTab() [128 / 64]uint64 {
 }
 
 func findNextWord(i int, in []byte) (int, []byte) {
+	return findNextWordLen(i, in, bloomHashMinWordLength)
+}
+
+// findNextWordLen is findNextWord with a configurable minimum word length.
+func findNextWordLen(i int, in []byte, minLength int) (int, []byte) {
 	// Dropping the unicode case-folding requirement would
 	// improve performance here. There are *exactly* two Unicode
 	// codepoints that map down to ASCII:
@@ -259,7 +520,7 @@ func findNextWord(i int, in []byte) (int, []byte) {
 			i += sz
 		}
 		// Skip short words.
-		if runeLength < bloomHashMinWordLength {
+		if runeLength < minLength {
 			continue
 		}
 		return i, bytes.ToLower(in[wordStart:i])
@@ -312,3 +573,175 @@ func bloomHasherCRCBlocked64B8K3(in []byte) []uint32 {
 	}
 	return out
 }
+
+// bloomHasherCRCBlocked64B8K3Min3 is bloomHasherCRCBlocked64B8K3 with
+// fragments of length 3-6 instead of 4-7. Short tokens such as
+// three-letter words then contribute probes, so the filter can also
+// reject 3-byte patterns, see bloom.minWordLength. The price is roughly a third
+// more probes per word, so a filter at the same load factor is
+// correspondingly larger, and for the same size the FPR rises.
+func bloomHasherCRCBlocked64B8K3Min3(in []byte) []uint32 {
+	return bloomHasherCRCBlocked64B8K3Len(in, 3)
+}
+
+// bloomHasherCRCBlocked64B8K3Len hashes word fragments of length
+// minLength to minLength+3 into 512-bit blocks selected by the first
+// minLength bytes of the fragment, with 3 probes per fragment.
+func bloomHasherCRCBlocked64B8K3Len(in []byte, minLength int) []uint32 {
+	out := []uint32{}
+	for i := 0; i < len(in); {
+		var s []byte
+		i, s = findNextWordLen(i, in, minLength)
+		for i := 0; i <= len(s)-minLength; i++ {
+			if '0' <= s[i] && s[i] <= '9' {
+				continue
+			}
+			base := crc32.Checksum(s[i:i+minLength], crcTab) * 512
+			for j := i + minLength; j < i+minLength+4 && j <= len(s); j++ {
+				h := crc32.Checksum(s[i:j], crcTab)
+				out = append(out,
+					base|h%512, base|(h>>9)%512,
+					base|(h>>18)%512,
+				)
+			}
+		}
+	}
+	return out
+}
+
+// findNextUnicodeWord is like findNextWord, but treats any Unicode letter
+// or digit as a word character, not just ASCII ones. It returns the
+// lowercased word along with the byte offset of each of its runes, plus
+// the end offset.
+func findNextUnicodeWord(i int, in []byte) (int, []byte, []int) {
+	isWord := func(c rune) bool {
+		return c == '_' || unicode.IsLetter(c) || unicode.IsDigit(c)
+	}
+	for i < len(in) {
+		// skip non-word runes
+		for i < len(in) {
+			c, sz := utf8.DecodeRune(in[i:])
+			if isWord(c) {
+				break
+			}
+			i += sz
+		}
+		var word []byte
+		var offs []int
+		var enc [utf8.UTFMax]byte
+		for i < len(in) {
+			c, sz := utf8.DecodeRune(in[i:])
+			if !isWord(c) {
+				break
+			}
+			offs = append(offs, len(word))
+			n := utf8.EncodeRune(enc[:], unicode.ToLower(c))
+			word = append(word, enc[:n]...)
+			i += sz
+		}
+		// Skip short words.
+		if len(offs) < bloomHashMinWordLength {
+			continue
+		}
+		return i, word, append(offs, len(word))
+	}
+	return i, nil, nil
+}
+
+// bloomHasherCRCBlocked64B8K3Unicode is bloomHasherCRCBlocked64B8K3 with
+// word fragments measured in runes, and with non-ASCII letters and digits
+// counting as word characters, so identifiers in eg. Cyrillic produce
+// probes.
+func bloomHasherCRCBlocked64B8K3Unicode(in []byte) []uint32 {
+	out := []uint32{}
+	for i := 0; i < len(in); {
+		var word []byte
+		var offs []int
+		i, word, offs = findNextUnicodeWord(i, in)
+		runes := len(offs) - 1
+		for i := 0; i <= runes-4; i++ {
+			if c, _ := utf8.DecodeRune(word[offs[i]:]); unicode.IsDigit(c) {
+				continue
+			}
+			base := crc32.Checksum(word[offs[i]:offs[i+4]], crcTab) * 512
+			for j := i + 4; j < i+8 && j <= runes; j++ {
+				h := crc32.Checksum(word[offs[i]:offs[j]], crcTab)
+				out = append(out,
+					base|h%512, base|(h>>9)%512,
+					base|(h>>18)%512,
+				)
+			}
+		}
+	}
+	return out
+}
+
+// bloomHasherCRCBlocked64B8K3SubTokens is bloomHasherCRCBlocked64B8K3
+// with additional probes for the sub-tokens of ASCII words of any length,
+// the parts between underscores: foo_bar_baz gets probes for foo, bar and
+// baz. CamelCase parts get no probes, since no query term could be tested
+// against them, see bloomQueryHasherSubTokens.
+//
+// A sub-token of a substring pattern need not be a sub-token where the
+// pattern matches: bar matches foobar. Query terms are therefore tested
+// with the probes of bloomQueryHasherSubTokens, see bloomQueryHashers.
+func bloomHasherCRCBlocked64B8K3SubTokens(in []byte) []uint32 {
+	out := bloomHasherCRCBlocked64B8K3(in)
+	isWord := func(c byte) bool {
+		return c < 128 && bloomWordTab[c/64]&(1<<(c%64)) != 0
+	}
+	for i := 0; i < len(in); {
+		for i < len(in) && !isWord(in[i]) {
+			i++
+		}
+		start := i
+		for i < len(in) && isWord(in[i]) {
+			i++
+		}
+		for _, seg := range bytes.Split(in[start:i], []byte{'_'}) {
+			out = appendSubTokenProbes(out, seg)
+		}
+	}
+	return out
+}
+
+// bloomQueryHasherSubTokens returns the probes of
+// bloomHasherCRCBlocked64B8K3 for the query term in, plus the sub-token
+// probes of the parts of in that are enclosed by underscores, such as bar
+// in foo_bar_baz. Wherever in matches, those parts are whole sub-tokens,
+// whatever the case. CamelCase parts are not probed, because a case
+// insensitive fooBar also matches foobar.
+func bloomQueryHasherSubTokens(in []byte) []uint32 {
+	out := bloomHasherCRCBlocked64B8K3(in)
+	isWord := func(c byte) bool {
+		return c < 128 && bloomWordTab[c/64]&(1<<(c%64)) != 0
+	}
+	start := -1
+	for i, c := range in {
+		switch {
+		case c == '_':
+			if start >= 0 {
+				out = appendSubTokenProbes(out, in[start:i])
+			}
+			start = i + 1
+		case !isWord(c):
+			start = -1
+		}
+	}
+	return out
+}
+
+// appendSubTokenProbes appends the probes of the sub-token tok, which are
+// hashed with a leading space so they differ from fragment probes.
+func appendSubTokenProbes(out []uint32, tok []byte) []uint32 {
+	if len(tok) == 0 || '0' <= tok[0] && tok[0] <= '9' {
+		return out
+	}
+	key := append([]byte{' '}, bytes.ToLower(tok)...)
+	base := crc32.Checksum(key, crcTab) * 512
+	h := crc32.Checksum(key[1:], crcTab)
+	return append(out,
+		base|h%512, base|(h>>9)%512,
+		base|(h>>18)%512,
+	)
+}
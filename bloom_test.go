@@ -16,6 +16,7 @@ package zoekt // import "github.com/google/zoekt"
 
 import (
 	"bytes"
+	"encoding/gob"
 	"flag"
 	"fmt"
 	"io/fs"
@@ -30,6 +31,8 @@ import (
 	"strings"
 	"sync"
 	"testing"
+
+	"github.com/google/zoekt/query"
 )
 
 var (
@@ -89,6 +92,20 @@ func TestBloomHasher(t *testing.T) {
 	}
 }
 
+func TestBloomHasherUppercaseZ(t *testing.T) {
+	if bloomWordTab['Z'/64]&(1<<('Z'%64)) == 0 {
+		t.Error("'Z' is not a word character")
+	}
+	for i, h := range bloomHashers {
+		for _, pair := range [][2]string{{"buzz", "BUZZ"}, {"XYZ", "xyz"}, {"ZZZZ zap", "zzzz ZAP"}} {
+			a, b := h([]byte(pair[0])), h([]byte(pair[1]))
+			if !reflect.DeepEqual(a, b) {
+				t.Errorf("hasher %d: hash(%q) => %v != hash(%q) => %v", i+1, pair[0], a, pair[1], b)
+			}
+		}
+	}
+}
+
 func TestBloomHasherStability(t *testing.T) {
 	want := []uint32{
 		0x41b0c462, 0x41b0c46c, 0x41b0c5a8, 0x79882c16, 0x79882c62, 0x79882d0f,
@@ -116,6 +133,149 @@ func TestBloomHasherStability(t *testing.T) {
 	}
 }
 
+func TestBloomHasherMinLength(t *testing.T) {
+	in := []byte("if (ok && x == nil) { err = fn(abc) }")
+	words := func(minLength int) []string {
+		out := []string{}
+		for i := 0; i < len(in); {
+			var s []byte
+			i, s = findNextWordLen(i, in, minLength)
+			if s != nil {
+				out = append(out, string(s))
+			}
+		}
+		return out
+	}
+	if got, want := words(4), []string{}; !reflect.DeepEqual(got, want) {
+		t.Errorf("min length 4: got %q, want %q", got, want)
+	}
+	if got, want := words(3), []string{"nil", "err", "abc"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("min length 3: got %q, want %q", got, want)
+	}
+
+	// The generic hasher at length 4 must not drift from the default one.
+	stable := []byte("nee\u212A  STAbilizAtion??")
+	if !reflect.DeepEqual(bloomHasherCRCBlocked64B8K3Len(stable, 4), bloomHasherCRCBlocked64B8K3(stable)) {
+		t.Error("bloomHasherCRCBlocked64B8K3Len(4) differs from bloomHasherCRCBlocked64B8K3")
+	}
+
+	b := makeBloomFilterWithHasher(bloomHasherCRCBlocked64B8K3Min3)
+	b.addBytes(in)
+	for _, pat := range []string{"nil", "abc", "err"} {
+		if !b.maybeHasBytes([]byte(pat)) {
+			t.Errorf("min length 3 filter is missing %q", pat)
+		}
+	}
+
+	var buf bytes.Buffer
+	w := &writer{w: &buf}
+	b.write(w)
+	dec, err := makeBloomFilterFromEncoded(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reflect.ValueOf(dec.hasher).Pointer() != reflect.ValueOf(bloomHasherCRCBlocked64B8K3Min3).Pointer() {
+		t.Error("decoded bloom filter has the wrong hasher")
+	}
+}
+
+func TestBloomHasherUnicode(t *testing.T) {
+	h := bloomHasherCRCBlocked64B8K3Unicode
+
+	for _, pair := range [][2]string{
+		{"ПеременнаяСчётчик", "переменнаясчётчик"},
+		{"GRÖẞENÄNDERUNG", "größenänderung"},
+		{"SOME inputs to the bloom filter", "some INPUTS to the Bloom filter"},
+	} {
+		a, b := h([]byte(pair[0])), h([]byte(pair[1]))
+		if len(a) == 0 {
+			t.Errorf("hasher(%q) produced no probes", pair[0])
+		}
+		if !reflect.DeepEqual(a, b) {
+			t.Errorf("hasher(%q) != hasher(%q)", pair[0], pair[1])
+		}
+	}
+
+	cyrillic := []byte("счётчик := 1")
+	if got := bloomHasherCRCBlocked64B8K3(cyrillic); len(got) != 0 {
+		t.Errorf("ASCII hasher produced %d probes for %q, want 0", len(got), cyrillic)
+	}
+	probes := h(cyrillic)
+	if len(probes) == 0 {
+		t.Fatalf("unicode hasher produced no probes for %q", cyrillic)
+	}
+
+	b := makeBloomFilterWithHasher(h)
+	b.addBytes(cyrillic)
+	if !b.maybeHasBytes([]byte("СЧЁТ")) {
+		t.Error("filter is missing upper case fragment of cyrillic word")
+	}
+	if b.maybeHasBytes([]byte("переменная")) {
+		t.Error("filter unexpectedly contains absent cyrillic word")
+	}
+
+	// ASCII words with the same fragments hash the same as the default
+	// hasher, since the runes and bytes coincide.
+	ascii := []byte("nee\u212A  STAbilizAtion??")
+	if !reflect.DeepEqual(h(ascii), bloomHasherCRCBlocked64B8K3(ascii)) {
+		t.Error("unicode hasher differs from default hasher on ASCII input")
+	}
+}
+
+func TestBloomHasherMinN(t *testing.T) {
+	for _, n := range []int{2, 5} {
+		if _, err := bloomHasherCRCBlockedMinN(n); err == nil {
+			t.Errorf("got a hasher for minimum word length %d, want error", n)
+		}
+	}
+
+	word := []byte("err")
+	def, err := bloomHasherCRCBlockedMinN(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if probes := def(word); len(probes) != 0 {
+		t.Errorf("default hasher: got probes %v for %q, want none", probes, word)
+	}
+	min3, err := bloomHasherCRCBlockedMinN(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if probes := min3(word); len(probes) == 0 {
+		t.Errorf("min 3 hasher: got no probes for %q", word)
+	}
+	if _, ok := bloomHasherIds[reflect.ValueOf(min3).Pointer()]; !ok {
+		t.Error("min 3 hasher is not registered")
+	}
+
+	b, err := NewIndexBuilder(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SetBloomMinWordLength(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Add(Document{Name: "f", Content: []byte("if err != nil {}")}); err != nil {
+		t.Fatal(err)
+	}
+	if !b.contentBloom.maybeHasBytes(word) {
+		t.Errorf("content bloom filter is missing %q", word)
+	}
+	if err := b.SetBloomMinWordLength(4); err == nil {
+		t.Error("SetBloomMinWordLength succeeded after Add")
+	}
+
+	// 3-byte patterns are tested against the filter, and only against it.
+	res := searchForTest(t, b, &query.Substring{Pattern: "fox", Content: true})
+	if len(res.Files) != 0 || res.Stats.BloomRejected != 1 {
+		t.Errorf("got %v with stats %+v, want no matches and 1 rejected", res.Files, res.Stats)
+	}
+	res = searchForTest(t, b, &query.Substring{Pattern: "err", Content: true})
+	if len(res.Files) != 1 || res.Stats.BloomAdmitted != 1 {
+		t.Errorf("got %v with stats %+v, want 1 match and 1 admitted", res.Files, res.Stats)
+	}
+}
+
 func TestBloomZero(t *testing.T) {
 	var b bloom
 	if !b.maybeHasBytes([]byte("some example strings")) {
@@ -126,6 +286,36 @@ func TestBloomZero(t *testing.T) {
 	}
 }
 
+func TestBloomQueryProbesBounded(t *testing.T) {
+	// A long DNA-like literal, as in the bloomHasherCRC comment.
+	var long []byte
+	for i := 0; len(long) < 100000; i++ {
+		long = append(long, "acgt"[i*7%4], "acgt"[i*13%4])
+	}
+	for i, h := range bloomHashers {
+		if n := len(bloomQueryProbes(h, long)); n > bloomMaxQueryProbes {
+			t.Errorf("hasher %d: got %d probes, want at most %d", i+1, n, bloomMaxQueryProbes)
+		}
+	}
+
+	// The filter must still contain the long term once added.
+	b := makeBloomFilterEmpty()
+	b.addBytes(long)
+	if !b.maybeHasBytes(long) {
+		t.Error("filter should contain the long term")
+	}
+
+	cs := CompileQuery(&query.Substring{Pattern: string(long), Content: true}).(*compiledSubstring)
+	for i, probes := range cs.bloomProbes {
+		if len(probes) > bloomMaxQueryProbes {
+			t.Errorf("compiled hasher %d: got %d probes, want at most %d", i+1, len(probes), bloomMaxQueryProbes)
+		}
+	}
+	if !cs.maybeInBloom(&b) {
+		t.Error("compiled query should match the filter")
+	}
+}
+
 func TestBloomBasic(t *testing.T) {
 	b := makeBloomFilterEmpty()
 
@@ -169,6 +359,128 @@ func TestBloomBasic(t *testing.T) {
 	}
 }
 
+func TestBloomFilterExported(t *testing.T) {
+	f := NewBloomFilter()
+
+	inp := []byte(`some different test words that will definitely be present
+	within the bloom filter`)
+	missed := []byte("somehow another sequences falsified probabilisitically")
+
+	f.Add(inp)
+
+	check := func(name string, f *BloomFilter) {
+		t.Helper()
+		for _, w := range bytes.Split(inp, []byte{' '}) {
+			if !f.MaybeContains(w) {
+				t.Errorf("%s: filter should contain %q but doesn't", name, string(w))
+			}
+		}
+		for _, w := range bytes.Split(missed, []byte{' '}) {
+			if f.MaybeContains(w) {
+				t.Errorf("%s: filter shouldn't contain %q but does", name, string(w))
+			}
+		}
+	}
+
+	check("full", f)
+	for i := 0; i < 90; i += 15 {
+		check(fmt.Sprintf("%d%% load", i), f.Shrink(float64(i)*.01))
+	}
+
+	small := f.Shrink(bloomDefaultLoad)
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(small); err != nil {
+		t.Fatal(err)
+	}
+	var dec BloomFilter
+	if err := gob.NewDecoder(&buf).Decode(&dec); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dec.b.bits, small.b.bits) {
+		t.Error("bits changed after gob round trip")
+	}
+	check("decoded", &dec)
+}
+
+func TestBloomEncodingVersions(t *testing.T) {
+	b := makeBloomFilterEmpty()
+	b.bits = b.bits[:bloomSizeTest]
+	b.addBytes([]byte("some different test words"))
+	small := b.shrinkToSize(bloomDefaultLoad)
+	if len(small.bits) == len(b.bits) {
+		t.Fatal("shrinkToSize didn't shrink")
+	}
+
+	for name, write := range map[string]func(bloom, *writer){
+		"v1": bloom.write,
+		"v2": bloom.writeV2,
+	} {
+		var buf bytes.Buffer
+		write(small, &writer{w: &buf})
+		dec, err := makeBloomFilterFromEncoded(buf.Bytes())
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(dec.bits, small.bits) {
+			t.Errorf("%s: bits changed after round trip", name)
+		}
+		if dec.base != bloomSizeBase {
+			t.Errorf("%s: got base %d, want %d", name, dec.base, bloomSizeBase)
+		}
+		for _, w := range []string{"some", "different", "test", "words"} {
+			if !dec.maybeHasBytes([]byte(w)) {
+				t.Errorf("%s: decoded filter should contain %q but doesn't", name, w)
+			}
+		}
+	}
+
+	// A filter shrunk from a different base can't be combined with ours.
+	var buf bytes.Buffer
+	other := bloom{hasher: small.hasher, bits: make([]uint8, len(small.bits)), base: 2 * len(small.bits)}
+	other.writeV2(&writer{w: &buf})
+	dec, err := makeBloomFilterFromEncoded(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dec.base != 2*len(small.bits) {
+		t.Errorf("got base %d, want %d", dec.base, 2*len(small.bits))
+	}
+	if _, err := small.union(&dec); err == nil {
+		t.Error("union of different base sizes succeeded")
+	}
+}
+
+func TestBloomEncodingCorrupt(t *testing.T) {
+	v2 := func(base, factor uint32, bits ...byte) []byte {
+		var buf bytes.Buffer
+		w := &writer{w: &buf}
+		w.Write([]byte{2, 1})
+		w.U32(base)
+		w.U32(factor)
+		w.Write(bits)
+		return buf.Bytes()
+	}
+	for name, buf := range map[string][]byte{
+		"empty":           nil,
+		"short":           {1},
+		"unknown hasher":  {1, 0xff, 0},
+		"unknown version": {3, 1, 0},
+		"short v2":        {2, 1, 0, 0, 0, 4},
+		"zero factor":     v2(4, 0, 0, 0, 0, 0),
+		"wrong factor":    v2(4, 3, 0, 0),
+	} {
+		if _, err := makeBloomFilterFromEncoded(buf); err == nil {
+			t.Errorf("%s: decoding %v succeeded", name, buf)
+		} else if !strings.HasPrefix(err.Error(), "invalid bloom filter encoding") {
+			t.Errorf("%s: unexpected error %v", name, err)
+		}
+	}
+
+	if _, err := makeBloomFilterFromEncoded(v2(4, 2, 0, 0)); err != nil {
+		t.Errorf("valid v2 encoding: %v", err)
+	}
+}
+
 func BenchmarkBloomFilterResize(b *testing.B) {
 	f := makeBloomFilterEmpty()
 
@@ -505,3 +817,296 @@ func (k *kahanSummer) add(x float64) {
 func (k *kahanSummer) avg() float64 {
 	return k.sum / float64(k.n)
 }
+
+func TestBloomUnionIntersect(t *testing.T) {
+	a := makeBloomFilterEmpty()
+	b := makeBloomFilterEmpty()
+	a.addBytes([]byte("some different test words"))
+	b.addBytes([]byte("that will definitely be present"))
+	b.addBytes([]byte("words"))
+
+	u, err := a.union(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range []string{"some", "different", "test", "words", "that", "will", "definitely", "present"} {
+		if !u.maybeHasBytes([]byte(w)) {
+			t.Errorf("union should contain %q but doesn't", w)
+		}
+	}
+
+	i, err := a.intersect(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !i.maybeHasBytes([]byte("words")) {
+		t.Errorf("intersection should contain %q but doesn't", "words")
+	}
+	if i.load() > a.load() || i.load() > b.load() {
+		t.Errorf("intersection load %f exceeds input loads %f, %f", i.load(), a.load(), b.load())
+	}
+
+	small := a.shrinkToSize(0.5)
+	if len(small.bits) == len(a.bits) {
+		t.Fatal("shrinkToSize didn't shrink")
+	}
+	if _, err := a.union(&small); err == nil {
+		t.Error("union of different sizes succeeded")
+	}
+	if _, err := a.intersect(&small); err == nil {
+		t.Error("intersect of different sizes succeeded")
+	}
+
+	other := makeBloomFilterWithHasher(bloomHasherCRCBlocked64B8K3Unicode)
+	if _, err := a.union(&other); err == nil {
+		t.Error("union of different hashers succeeded")
+	}
+	if _, err := a.intersect(&other); err == nil {
+		t.Error("intersect of different hashers succeeded")
+	}
+}
+
+func TestBloomEstimateDistinct(t *testing.T) {
+	b := makeBloomFilterEmpty()
+	b.bits = b.bits[:bloomSizeTest]
+	if got := b.EstimateDistinct(); got != 0 {
+		t.Errorf("empty filter: got estimate %f, want 0", got)
+	}
+
+	// Each 4 letter word is a single fragment.
+	n := 0
+	for _, c1 := range "abcdefghijklmnopqrstuvwxyz" {
+		for _, c2 := range "abcdefghijklmnopqrst" {
+			b.addBytes([]byte(fmt.Sprintf("w%c%cz", c1, c2)))
+			n++
+		}
+	}
+
+	got := b.EstimateDistinct()
+	if math.Abs(got-float64(n)) > 0.1*float64(n) {
+		t.Errorf("got estimate %f for %d distinct fragments (load %f)", got, n, b.load())
+	}
+}
+
+func TestDisableBloom(t *testing.T) {
+	docs := []Document{
+		{Name: "f1", Content: []byte("the quick brown fox")},
+		{Name: "f2", Content: []byte("jumps over the lazy dog")},
+	}
+	build := func(disable bool) *IndexBuilder {
+		b, err := NewIndexBuilder(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.DisableBloom = disable
+		for _, d := range docs {
+			if err := b.Add(d); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return b
+	}
+	size := func(b *IndexBuilder) int {
+		var buf bytes.Buffer
+		if err := b.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Len()
+	}
+
+	with, without := build(false), build(true)
+	if a, b := size(with), size(without); b >= a {
+		t.Errorf("got size %d without bloom filters, want less than %d", b, a)
+	}
+
+	d := searcherForTest(t, without).(*indexData)
+	if len(d.bloomContents.bits) != 0 || len(d.bloomNames.bits) != 0 {
+		t.Errorf("got bloom filters in a shard built without them")
+	}
+
+	res := searchForTest(t, without, &query.Substring{Pattern: "lazy"})
+	if len(res.Files) != 1 || res.Files[0].FileName != "f2" {
+		t.Errorf("got %v, want f2", res.Files)
+	}
+	res = searchForTest(t, without, &query.Substring{Pattern: "slow"})
+	if len(res.Files) != 0 {
+		t.Errorf("got %v, want no matches", res.Files)
+	}
+}
+
+func TestBloomStats(t *testing.T) {
+	b, err := NewIndexBuilder(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Add(Document{Name: "f1", Content: []byte("the quick brown fox")}); err != nil {
+		t.Fatal(err)
+	}
+
+	res := searchForTest(t, b, &query.Substring{Pattern: "xylophone", Content: true})
+	if res.Stats.BloomRejected == 0 {
+		t.Errorf("got stats %+v, want BloomRejected > 0", res.Stats)
+	}
+
+	res = searchForTest(t, b, &query.Substring{Pattern: "quick", Content: true})
+	if res.Stats.BloomAdmitted != 1 || res.Stats.BloomRejected != 0 {
+		t.Errorf("got stats %+v, want 1 admitted and 0 rejected", res.Stats)
+	}
+}
+
+func TestBloomHasherSubTokens(t *testing.T) {
+	h := bloomHasherCRCBlocked64B8K3SubTokens
+	if _, ok := bloomHasherIds[reflect.ValueOf(h).Pointer()]; !ok {
+		t.Fatal("sub-token hasher is not registered")
+	}
+
+	contains := func(probes, want []uint32) bool {
+		have := map[uint32]bool{}
+		for _, p := range probes {
+			have[p] = true
+		}
+		for _, p := range want {
+			if !have[p] {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, word := range []string{"foo_bar_baz", "FOO_BAR_BAZ", "x := foo_bar.Baz_qux()"} {
+		b := makeBloomFilterWithHasher(h)
+		b.addBytes([]byte(word))
+		for _, tok := range []string{"foo", "bar", "baz", "Bar"} {
+			probes := h([]byte(tok))
+			if len(probes) == 0 {
+				t.Fatalf("hasher(%q) produced no probes", tok)
+			}
+			if !b.maybeHas(probes) {
+				t.Errorf("filter of %q is missing the probes of %q", word, tok)
+			}
+		}
+		if b.maybeHas(h([]byte("qux"))) && !strings.Contains(word, "qux") {
+			t.Errorf("filter of %q unexpectedly has qux", word)
+		}
+	}
+
+	// CamelCase parts are not sub-tokens.
+	camel := makeBloomFilterWithHasher(h)
+	camel.addBytes([]byte("fooBarBaz"))
+	if camel.maybeHas(appendSubTokenProbes(nil, []byte("bar"))) {
+		t.Error("filter of fooBarBaz has the sub-token bar")
+	}
+
+	// The filter has all probes of the default hasher, and query terms
+	// are tested with those, so substrings that aren't sub-tokens are
+	// still found.
+	content := []byte("foobar := fooBarBaz")
+	if !contains(h(content), bloomHasherCRCBlocked64B8K3(content)) {
+		t.Error("sub-token hasher lacks probes of the default hasher")
+	}
+	b := makeBloomFilterWithHasher(h)
+	b.addBytes(content)
+	for _, q := range []string{"bar", "oBarB", "obar", "foobar", "rbaz"} {
+		if !b.maybeHasBytes([]byte(q)) {
+			t.Errorf("filter rejects substring %q", q)
+		}
+	}
+	if b.maybeHasBytes([]byte("quux")) {
+		t.Error("filter unexpectedly has quux")
+	}
+
+	// Parts of a query term enclosed by underscores are probed as
+	// sub-tokens, other parts are not.
+	bar := appendSubTokenProbes(nil, []byte("bar"))
+	for q, want := range map[string]bool{
+		"o_bar_b": true,
+		"(_BAR_)": true,
+		"bar_baz": false,
+		"_bar":    false,
+		"o_bar.b": false,
+	} {
+		if got := contains(bloomQueryProbes(h, []byte(q)), bar); got != want {
+			t.Errorf("query %q: got sub-token probes for bar %v, want %v", q, got, want)
+		}
+	}
+	for _, content := range []string{"foo_bar_baz", "FOO_BAR_BAZ"} {
+		b := makeBloomFilterWithHasher(h)
+		b.addBytes([]byte(content))
+		if !b.maybeHasBytes([]byte("o_bar_b")) {
+			t.Errorf("filter of %q rejects o_bar_b", content)
+		}
+	}
+}
+
+func TestBloomTargetFPR(t *testing.T) {
+	const fpr = 0.01
+	rng := rand.New(rand.NewSource(42))
+	randWord4 := func() string {
+		var w [4]byte
+		for i := range w {
+			w[i] = "abcdefghijklmnopqrstuvwxyz"[rng.Intn(26)]
+		}
+		return string(w[:])
+	}
+
+	// Each 4 letter word is a single fragment.
+	added := map[string]bool{}
+	words := func(n int) []byte {
+		var buf bytes.Buffer
+		for i := 0; i < n; i++ {
+			w := randWord4()
+			added[w] = true
+			buf.WriteString(w + " ")
+		}
+		return buf.Bytes()
+	}
+
+	build := func(content []byte) bloom {
+		t.Helper()
+		b, err := NewIndexBuilder(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.BloomTargetFPR = fpr
+		if err := b.AddFile("f", content); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := b.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		s, err := NewSearcher(&memSeeker{buf.Bytes()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.(*indexData).bloomContents
+	}
+	tiny := build(words(20))
+	huge := build(words(50000))
+
+	if len(tiny.bits)*100 > len(huge.bits) {
+		t.Errorf("tiny filter has %d bytes, huge filter %d bytes, want tiny to be much smaller", len(tiny.bits), len(huge.bits))
+	}
+	for _, b := range []bloom{tiny, huge} {
+		if bloomSizeBase%len(b.bits) != 0 {
+			t.Errorf("filter size %d doesn't divide %d", len(b.bits), bloomSizeBase)
+		}
+	}
+
+	for name, b := range map[string]bloom{"tiny": tiny, "huge": huge} {
+		fp, n := 0, 0
+		for n < 20000 {
+			w := randWord4()
+			if added[w] {
+				continue
+			}
+			n++
+			if b.maybeHasBytes([]byte(w)) {
+				fp++
+			}
+		}
+		if got := float64(fp) / float64(n); got < fpr/4 || got > 2*fpr {
+			t.Errorf("%s filter of %d bytes: got FPR %f, want about %f", name, len(b.bits), got, fpr)
+		}
+	}
+}
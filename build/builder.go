@@ -94,6 +94,16 @@ type Options struct {
 	// regardless of their size. The full pattern syntax is here:
 	// https://github.com/bmatcuk/doublestar/tree/v1#patterns.
 	LargeFiles []string
+
+	// IgnoreFiles is a slice of glob patterns, with the same syntax as
+	// LargeFiles, applied to every repository. Matching files are not
+	// indexed; they are added with a SkipReason instead.
+	IgnoreFiles []string
+
+	// BloomMinWordLength, if set, is the minimum length of the words
+	// hashed into the bloom filters of the shards. The default is 4;
+	// 3 helps repositories with many short identifiers.
+	BloomMinWordLength int
 }
 
 // HashOptions creates a hash of the options that affect an index.
@@ -105,6 +115,13 @@ func (o *Options) HashOptions() string {
 	hasher.Write([]byte(fmt.Sprintf("%d", o.SizeMax)))
 	hasher.Write([]byte(fmt.Sprintf("%q", o.LargeFiles)))
 	hasher.Write([]byte(fmt.Sprintf("%t", o.DisableCTags)))
+	// Only hash IgnoreFiles if set, so existing shards keep their hash.
+	if len(o.IgnoreFiles) > 0 {
+		hasher.Write([]byte(fmt.Sprintf("%q", o.IgnoreFiles)))
+	}
+	if o.BloomMinWordLength != 0 {
+		hasher.Write([]byte(fmt.Sprintf("%d", o.BloomMinWordLength)))
+	}
 
 	return fmt.Sprintf("%x", hasher.Sum(nil))
 }
@@ -128,6 +145,21 @@ func (f largeFilesFlag) Set(value string) error {
 	return nil
 }
 
+type ignoreFilesFlag struct{ *Options }
+
+func (f ignoreFilesFlag) String() string {
+	if f.Options == nil {
+		return ""
+	}
+	s := append([]string{""}, f.IgnoreFiles...)
+	return strings.Join(s, "-ignore_file ")
+}
+
+func (f ignoreFilesFlag) Set(value string) error {
+	f.IgnoreFiles = append(f.IgnoreFiles, value)
+	return nil
+}
+
 // Flags adds flags for build options to fs. It is the "inverse" of Args.
 func (o *Options) Flags(fs *flag.FlagSet) {
 	x := *o
@@ -139,6 +171,8 @@ func (o *Options) Flags(fs *flag.FlagSet) {
 	fs.StringVar(&o.IndexDir, "index", x.IndexDir, "directory for search indices")
 	fs.BoolVar(&o.CTagsMustSucceed, "require_ctags", x.CTagsMustSucceed, "If set, ctags calls must succeed.")
 	fs.Var(largeFilesFlag{o}, "large_file", "A glob pattern where matching files are to be index regardless of their size. You can add multiple patterns by setting this more than once.")
+	fs.Var(ignoreFilesFlag{o}, "ignore_file", "A glob pattern where matching files are not indexed in any repository. You can add multiple patterns by setting this more than once.")
+	fs.IntVar(&o.BloomMinWordLength, "bloom_min_word_length", x.BloomMinWordLength, "minimum length of the words hashed into bloom filters, 3 or 4. 0 uses the default.")
 
 	// Sourcegraph specific
 	fs.BoolVar(&o.DisableCTags, "disable_ctags", x.DisableCTags, "If set, ctags will not be called.")
@@ -176,6 +210,14 @@ func (o *Options) Args() []string {
 		args = append(args, "-large_file", a)
 	}
 
+	for _, a := range o.IgnoreFiles {
+		args = append(args, "-ignore_file", a)
+	}
+
+	if o.BloomMinWordLength != 0 {
+		args = append(args, "-bloom_min_word_length", strconv.Itoa(o.BloomMinWordLength))
+	}
+
 	// Sourcegraph specific
 	if o.DisableCTags {
 		args = append(args, "-disable_ctags")
@@ -435,6 +477,19 @@ func (o *Options) IgnoreSizeMax(name string) bool {
 	return false
 }
 
+// ignorePattern returns the first pattern in IgnoreFiles matching name,
+// or "" if there is none.
+func (o *Options) ignorePattern(name string) string {
+	for _, pattern := range o.IgnoreFiles {
+		pattern = strings.TrimSpace(pattern)
+		if m, _ := doublestar.PathMatch(pattern, name); m {
+			return pattern
+		}
+	}
+
+	return ""
+}
+
 // NewBuilder creates a new Builder instance.
 func NewBuilder(opts Options) (*Builder, error) {
 	opts.SetDefaults()
@@ -496,7 +551,9 @@ func (b *Builder) Add(doc zoekt.Document) error {
 		trigramMax = math.MaxInt64
 	}
 
-	if len(doc.Content) > b.opts.SizeMax && !allowLargeFile {
+	if pattern := b.opts.ignorePattern(doc.Name); pattern != "" {
+		doc.SkipReason = fmt.Sprintf("document matches ignore pattern %q", pattern)
+	} else if len(doc.Content) > b.opts.SizeMax && !allowLargeFile {
 		// We could pass the document on to the shardbuilder, but if
 		// we pass through a part of the source tree with binary/large
 		// files, the corresponding shard would be mostly empty, so
@@ -580,7 +637,7 @@ func (b *Builder) Finish() error {
 			}
 			repoName := b.opts.RepositoryDescription.Name
 			b.shardLog("tomb", p, repoName)
-			err := zoekt.SetTombstone(p, repoName)
+			err := zoekt.SetTombstone(p, repoName, true)
 			b.buildError = err
 			continue
 		}
@@ -780,6 +837,11 @@ func (b *Builder) newShardBuilder() (*zoekt.IndexBuilder, error) {
 	}
 	shardBuilder.IndexTime = b.indexTime
 	shardBuilder.ID = b.id
+	if b.opts.BloomMinWordLength != 0 {
+		if err := shardBuilder.SetBloomMinWordLength(b.opts.BloomMinWordLength); err != nil {
+			return nil, err
+		}
+	}
 	return shardBuilder, nil
 }
 
@@ -110,6 +110,16 @@ func TestFlags(t *testing.T) {
 		want: Options{
 			LargeFiles: []string{"*.md", "*.yaml"},
 		},
+	}, {
+		args: []string{"-ignore_file", "vendor/**", "-ignore_file", "*.min.js"},
+		want: Options{
+			IgnoreFiles: []string{"vendor/**", "*.min.js"},
+		},
+	}, {
+		args: []string{"-bloom_min_word_length", "3"},
+		want: Options{
+			BloomMinWordLength: 3,
+		},
 	}}
 
 	ignored := []cmp.Option{
@@ -227,3 +237,33 @@ func TestDontCountContentOfSkippedFiles(t *testing.T) {
 		t.Fatalf("content of skipped documents should not count towards shard size thresold")
 	}
 }
+
+func TestIgnoreFiles(t *testing.T) {
+	b, err := NewBuilder(Options{
+		RepositoryDescription: zoekt.Repository{Name: "foo"},
+		IgnoreFiles:           []string{"vendor/**", "**/*.min.js"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"main.go", "vendor/dep/dep.go", "web/app.min.js", "web/app.js"} {
+		if err := b.AddFile(name, []byte("package main")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := map[string]string{}
+	for _, d := range b.todo {
+		got[d.Name] = d.SkipReason
+	}
+	want := map[string]string{
+		"main.go":           "",
+		"vendor/dep/dep.go": `document matches ignore pattern "vendor/**"`,
+		"web/app.min.js":    `document matches ignore pattern "**/*.min.js"`,
+		"web/app.js":        "",
+	}
+	if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("mismatch (-want +got):\n%s", d)
+	}
+}
@@ -11,24 +11,7 @@ import (
 )
 
 func merge(dstDir string, names []string) error {
-	var files []zoekt.IndexFile
-	for _, fn := range names {
-		f, err := os.Open(fn)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-
-		indexFile, err := zoekt.NewIndexFile(f)
-		if err != nil {
-			return err
-		}
-		defer indexFile.Close()
-
-		files = append(files, indexFile)
-	}
-
-	_, err := zoekt.Merge(dstDir, files...)
+	_, err := zoekt.MergePaths(dstDir, names...)
 	return err
 }
 
@@ -22,15 +22,80 @@ var metricCleanupDuration = promauto.NewHistogram(prometheus.HistogramOpts{
 	Buckets: prometheus.LinearBuckets(1, 1, 10),
 })
 
+var (
+	metricCleanupShardsTrashed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "index_cleanup_shards_trashed_total",
+		Help: "The total number of shards cleanup moved into the trash",
+	})
+	metricCleanupShardsRestored = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "index_cleanup_shards_restored_total",
+		Help: "The total number of shards cleanup restored from the trash",
+	})
+	metricCleanupTmpRemoved = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "index_cleanup_tmp_removed_total",
+		Help: "The total number of stale .tmp files cleanup removed",
+	})
+	metricCleanupBytesFreed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "index_cleanup_bytes_freed_total",
+		Help: "The total size of the shards cleanup removed from the trash",
+	})
+)
+
+// cleanupOptions configures cleanup.
+type cleanupOptions struct {
+	// DryRun logs the changes cleanup would make to indexDir without
+	// making them.
+	DryRun bool
+}
+
+// perform logs the action described by format and args, and reports
+// whether it should be carried out.
+func (o cleanupOptions) perform(format string, args ...interface{}) bool {
+	if o.DryRun {
+		log.Printf("dry-run: "+format, args...)
+		return false
+	}
+	log.Printf(format, args...)
+	return true
+}
+
+// cleanupSummary lists the changes made by cleanup, or under
+// cleanupOptions.DryRun the changes it would have made.
+type cleanupSummary struct {
+	// Removed are shards deleted from the trash.
+	Removed []shard
+	// Restored are shards moved from the trash back into the index.
+	Restored []shard
+	// Trashed are shards moved from the index into the trash.
+	Trashed []shard
+	// Tombstoned are repositories marked as deleted in a compound shard.
+	Tombstoned []shard
+	// RemovedTmp are the paths of deleted .tmp files.
+	RemovedTmp []string
+
+	// BytesFreed is the size of the files of the Removed shards.
+	BytesFreed int64
+}
+
+func (s *cleanupSummary) observe() {
+	metricCleanupShardsTrashed.Add(float64(len(s.Trashed)))
+	metricCleanupShardsRestored.Add(float64(len(s.Restored)))
+	metricCleanupTmpRemoved.Add(float64(len(s.RemovedTmp)))
+	metricCleanupBytesFreed.Add(float64(s.BytesFreed))
+}
+
 // cleanup trashes shards in indexDir that do not exist in repos. For repos
 // that do not exist in indexDir, but do in indexDir/.trash it will move them
 // back into indexDir. Additionally it uses now to remove shards that have
 // been in the trash for 24 hours. It also deletes .tmp files older than 4 hours.
-func cleanup(indexDir string, repos []string, now time.Time) {
+func cleanup(indexDir string, repos []string, now time.Time, opts cleanupOptions) cleanupSummary {
 	start := time.Now()
+	var summary cleanupSummary
 	trashDir := filepath.Join(indexDir, ".trash")
-	if err := os.MkdirAll(trashDir, 0755); err != nil {
-		log.Printf("failed to create trash dir: %v", err)
+	if !opts.DryRun {
+		if err := os.MkdirAll(trashDir, 0755); err != nil {
+			log.Printf("failed to create trash dir: %v", err)
+		}
 	}
 
 	trash := getShards(trashDir)
@@ -45,7 +110,7 @@ func cleanup(indexDir string, repos []string, now time.Time) {
 		for _, shard := range shards {
 			if shard.ModTime.Before(minAge) {
 				old = true
-			} else if shard.ModTime.After(now) {
+			} else if shard.ModTime.After(now) && !opts.DryRun {
 				debug.Printf("trashed shard %s has timestamp in the future, reseting to now", shard.Path)
 				_ = os.Chtimes(shard.Path, now, now)
 			}
@@ -55,8 +120,11 @@ func cleanup(indexDir string, repos []string, now time.Time) {
 			continue
 		}
 
-		log.Printf("removing old shards from trash for %s", repo)
-		removeAll(shards...)
+		summary.BytesFreed += shardsSize(shards)
+		if opts.perform("removing old shards from trash for %s", repo) {
+			removeAll(shards...)
+		}
+		summary.Removed = append(summary.Removed, shards...)
 		delete(trash, repo)
 	}
 
@@ -71,17 +139,21 @@ func cleanup(indexDir string, repos []string, now time.Time) {
 			continue
 		}
 
-		log.Printf("restoring shards from trash for %s", repo)
-		moveAll(indexDir, shards)
-		shardsLog(indexDir, "restore", shards, repo)
+		summary.Restored = append(summary.Restored, shards...)
+		if opts.perform("restoring shards from trash for %s", repo) {
+			moveAll(indexDir, shards)
+			shardsLog(indexDir, "restore", shards, repo)
+		}
 	}
 
 	// index: Move non-existent repos into trash
 	for repo, shards := range index {
 		// Best-effort touch. If touch fails, we will just remove from the
 		// trash sooner.
-		for _, shard := range shards {
-			_ = os.Chtimes(shard.Path, now, now)
+		if !opts.DryRun {
+			for _, shard := range shards {
+				_ = os.Chtimes(shard.Path, now, now)
+			}
 		}
 
 		if tombstonesEnabled {
@@ -89,16 +161,22 @@ func cleanup(indexDir string, repos []string, now time.Time) {
 			// in 1 compound shard. Hence we check that len(shards)==1 and only consider the
 			// shard at index 0.
 			if len(shards) == 1 && strings.HasPrefix(filepath.Base(shards[0].Path), "compound-") {
-				shardsLog(indexDir, "tomb", shards, repo)
-				if err := zoekt.SetTombstone(shards[0].Path, repo); err != nil {
-					log.Printf("error setting tombstone for %s in shard %s: %s. Removing shard\n", repo, shards[0].Path, err)
-					_ = os.Remove(shards[0].Path)
+				summary.Tombstoned = append(summary.Tombstoned, shards[0])
+				if opts.perform("setting tombstone for %s in shard %s", repo, shards[0].Path) {
+					shardsLog(indexDir, "tomb", shards, repo)
+					if err := zoekt.SetTombstone(shards[0].Path, repo, true); err != nil {
+						log.Printf("error setting tombstone for %s in shard %s: %s. Removing shard\n", repo, shards[0].Path, err)
+						_ = os.Remove(shards[0].Path)
+					}
 				}
 				continue
 			}
 		}
-		moveAll(trashDir, shards)
-		shardsLog(indexDir, "remove", shards, repo)
+		summary.Trashed = append(summary.Trashed, shards...)
+		if opts.perform("moving shards to trash for %s", repo) {
+			moveAll(trashDir, shards)
+			shardsLog(indexDir, "remove", shards, repo)
+		}
 	}
 
 	// Remove old .tmp files from crashed indexer runs-- for example, if
@@ -114,12 +192,18 @@ func cleanup(indexDir string, repos []string, now time.Time) {
 				continue
 			}
 			if !st.IsDir() && st.ModTime().Before(maxAge) {
-				log.Printf("removing old tmp file: %s", f)
-				os.Remove(f)
+				summary.RemovedTmp = append(summary.RemovedTmp, f)
+				if opts.perform("removing old tmp file: %s", f) {
+					os.Remove(f)
+				}
 			}
 		}
 	}
+	if !opts.DryRun {
+		summary.observe()
+	}
 	metricCleanupDuration.Observe(time.Since(start).Seconds())
+	return summary
 }
 
 type shard struct {
@@ -222,6 +306,23 @@ func removeAll(shards ...shard) {
 	}
 }
 
+// shardsSize returns the total size of the files of shards.
+func shardsSize(shards []shard) int64 {
+	var size int64
+	for _, shard := range shards {
+		paths, err := zoekt.IndexFilePaths(shard.Path)
+		if err != nil {
+			continue
+		}
+		for _, p := range paths {
+			if fi, err := os.Stat(p); err == nil {
+				size += fi.Size()
+			}
+		}
+	}
+	return size
+}
+
 func moveAll(dstDir string, shards []shard) {
 	for i, shard := range shards {
 		paths, err := zoekt.IndexFilePaths(shard.Path)
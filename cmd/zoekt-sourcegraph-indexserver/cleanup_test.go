@@ -14,6 +14,7 @@ import (
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/zoekt"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func TestCleanup(t *testing.T) {
@@ -142,7 +143,7 @@ func TestCleanup(t *testing.T) {
 				}
 			}
 
-			cleanup(dir, tt.repos, now)
+			cleanup(dir, tt.repos, now, cleanupOptions{})
 
 			if d := cmp.Diff(tt.wantIndex, glob(filepath.Join(dir, "*.zoekt"))); d != "" {
 				t.Errorf("unexpected index (-want, +got):\n%s", d)
@@ -164,6 +165,148 @@ func TestCleanup(t *testing.T) {
 	}
 }
 
+func TestCleanupDryRun(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now().Truncate(time.Second)
+	recent := now.Add(-time.Hour)
+	old := now.Add(-25 * time.Hour)
+
+	files := map[string]struct {
+		repo  string
+		mtime time.Time
+	}{
+		"exists_v16.00000.zoekt":         {"exists", recent},
+		"trash_v16.00000.zoekt":          {"trash", recent},
+		".trash/trashed_v16.00000.zoekt": {"trashed", recent},
+		".trash/delete_v16.00000.zoekt":  {"delete", old},
+		".trash/future_v16.00000.zoekt":  {"future", now.Add(time.Hour)},
+	}
+	for name, f := range files {
+		path := filepath.Join(dir, name)
+		createEmptyShard(t, f.repo, path)
+		if err := os.Chtimes(path, f.mtime, f.mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tmp := filepath.Join(dir, "old.tmp")
+	if err := ioutil.WriteFile(tmp, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(tmp, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot := func() map[string]time.Time {
+		m := map[string]time.Time{}
+		_ = filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+			if err == nil && !fi.IsDir() {
+				m[path] = fi.ModTime()
+			}
+			return nil
+		})
+		return m
+	}
+	before := snapshot()
+
+	got := cleanup(dir, []string{"exists", "trashed"}, now, cleanupOptions{DryRun: true})
+
+	if d := cmp.Diff(before, snapshot()); d != "" {
+		t.Errorf("dry run changed the index directory (-before, +after):\n%s", d)
+	}
+
+	paths := func(shards []shard) []string {
+		var ps []string
+		for _, s := range shards {
+			ps = append(ps, filepath.Base(s.Path))
+		}
+		return ps
+	}
+	if d := cmp.Diff([]string{"delete_v16.00000.zoekt"}, paths(got.Removed)); d != "" {
+		t.Errorf("unexpected removed (-want, +got):\n%s", d)
+	}
+	if d := cmp.Diff([]string{"trashed_v16.00000.zoekt"}, paths(got.Restored)); d != "" {
+		t.Errorf("unexpected restored (-want, +got):\n%s", d)
+	}
+	if d := cmp.Diff([]string{"trash_v16.00000.zoekt"}, paths(got.Trashed)); d != "" {
+		t.Errorf("unexpected trashed (-want, +got):\n%s", d)
+	}
+	if d := cmp.Diff([]string{tmp}, got.RemovedTmp); d != "" {
+		t.Errorf("unexpected removed tmp files (-want, +got):\n%s", d)
+	}
+	if len(got.Tombstoned) != 0 {
+		t.Errorf("got tombstoned %v, want none", got.Tombstoned)
+	}
+
+	// Without DryRun the summary describes the same changes.
+	want := got
+	got = cleanup(dir, []string{"exists", "trashed"}, now, cleanupOptions{})
+	if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("summary differs from dry run (-dry, +real):\n%s", d)
+	}
+}
+
+func TestCleanupSummary(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now().Truncate(time.Second)
+	old := now.Add(-25 * time.Hour)
+
+	files := map[string]struct {
+		repo  string
+		mtime time.Time
+	}{
+		".trash/expired1_v16.00000.zoekt": {"expired1", old},
+		".trash/expired2_v16.00000.zoekt": {"expired2", old},
+		".trash/restore_v16.00000.zoekt":  {"restore", now.Add(-time.Hour)},
+	}
+	var wantBytes int64
+	for name, f := range files {
+		path := filepath.Join(dir, name)
+		createEmptyShard(t, f.repo, path)
+		if err := os.Chtimes(path, f.mtime, f.mtime); err != nil {
+			t.Fatal(err)
+		}
+		if f.mtime.Equal(old) {
+			fi, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantBytes += fi.Size()
+		}
+	}
+
+	freedBefore := testutil.ToFloat64(metricCleanupBytesFreed)
+	restoredBefore := testutil.ToFloat64(metricCleanupShardsRestored)
+
+	got := cleanup(dir, []string{"restore"}, now, cleanupOptions{})
+
+	if len(got.Removed) != 2 || len(got.Restored) != 1 || len(got.Trashed) != 0 || len(got.RemovedTmp) != 0 {
+		t.Errorf("got %d removed, %d restored, %d trashed, %d tmp removed, want 2, 1, 0, 0",
+			len(got.Removed), len(got.Restored), len(got.Trashed), len(got.RemovedTmp))
+	}
+	if got.BytesFreed != wantBytes {
+		t.Errorf("got %d bytes freed, want %d", got.BytesFreed, wantBytes)
+	}
+	if d := testutil.ToFloat64(metricCleanupBytesFreed) - freedBefore; d != float64(wantBytes) {
+		t.Errorf("bytes freed metric grew by %v, want %d", d, wantBytes)
+	}
+	if d := testutil.ToFloat64(metricCleanupShardsRestored) - restoredBefore; d != 1 {
+		t.Errorf("restored metric grew by %v, want 1", d)
+	}
+	if left := globBase(filepath.Join(dir, ".trash", "*.zoekt")); len(left) != 0 {
+		t.Errorf("got %v left in trash, want none", left)
+	}
+
+	// The shard log only records the restore, as before.
+	data, err := ioutil.ReadFile(filepath.Join(dir, "zoekt-indexserver-shard-log.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 1 || !strings.Contains(lines[0], "\trestore\trestore_v16.00000.zoekt\t") {
+		t.Errorf("unexpected shard log:\n%s", data)
+	}
+}
+
 func createEmptyShard(t *testing.T, repo, path string) {
 	t.Helper()
 
@@ -230,3 +373,45 @@ func TestRemoveIncompleteShards(t *testing.T) {
 		t.Errorf("\ngot shards: %v\nwant: %v\n", left, shards)
 	}
 }
+
+func TestGetShardsCompound(t *testing.T) {
+	dir := t.TempDir()
+
+	var paths []string
+	for _, name := range []string{"repo1", "repo2"} {
+		b, err := zoekt.NewIndexBuilder(&zoekt.Repository{Name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// merging drops repositories without documents.
+		if err := b.Add(zoekt.Document{Name: "f", Content: []byte("content")}); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(t.TempDir(), name+".zoekt")
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Write(f); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		paths = append(paths, path)
+	}
+
+	compound, err := zoekt.MergePaths(dir, paths...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := zoekt.SetTombstone(compound, "repo2", true); err != nil {
+		t.Fatal(err)
+	}
+
+	got := getShards(dir)
+	if len(got) != 1 || len(got["repo1"]) != 1 {
+		t.Fatalf("got %v, want only repo1", got)
+	}
+	if s := got["repo1"][0]; s.Repo != "repo1" || s.Path != compound {
+		t.Errorf("got %+v, want repo1 in %s", s, compound)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/zoekt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var metricCompactionShardsMerged = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "index_compaction_shards_merged_total",
+	Help: "The total number of shards the compactor merged into compound shards",
+})
+
+// Compactor merges the small shards of an index directory into compound
+// shards, which are cheaper to keep open and search. Repositories in
+// compound shards are tombstoned instead of deleted when they are
+// reindexed, so the compactor only runs if tombstones are enabled for the
+// index directory.
+type Compactor struct {
+	// IndexDir is the directory holding the shards.
+	IndexDir string
+
+	// TargetSize is the size in bytes up to which shards are merged into
+	// one compound shard.
+	TargetSize int64
+
+	// Mu, if set, is held while the compactor changes IndexDir, to
+	// protect it from concurrent changes by the builder and cleanup.
+	Mu sync.Locker
+}
+
+// Run compacts IndexDir every interval. It blocks forever.
+func (c *Compactor) Run(interval time.Duration) {
+	for range jitterTicker(interval) {
+		c.compact()
+	}
+}
+
+// compact merges groups of small shards into compound shards, and moves
+// the merged shards into the trash. It returns the paths of the compound
+// shards.
+func (c *Compactor) compact() []string {
+	if !zoekt.TombstonesEnabled(c.IndexDir) {
+		return nil
+	}
+	if c.Mu != nil {
+		c.Mu.Lock()
+		defer c.Mu.Unlock()
+	}
+
+	trashDir := filepath.Join(c.IndexDir, ".trash")
+	if err := os.MkdirAll(trashDir, 0755); err != nil {
+		log.Printf("failed to create trash dir: %v", err)
+		return nil
+	}
+
+	var compounds []string
+	for _, group := range c.candidates(getShards(c.IndexDir)) {
+		paths := make([]string, 0, len(group))
+		for _, s := range group {
+			paths = append(paths, s.Path)
+		}
+
+		compound, err := zoekt.MergePaths(c.IndexDir, paths...)
+		if err != nil {
+			log.Printf("failed to merge %d shards: %v", len(paths), err)
+			continue
+		}
+		log.Printf("merged %d shards into %s", len(paths), compound)
+		compounds = append(compounds, compound)
+		metricCompactionShardsMerged.Add(float64(len(group)))
+
+		for _, s := range group {
+			shardsLog(c.IndexDir, "upsert", []shard{{Repo: s.Repo, Path: compound}}, s.Repo)
+		}
+		moveAll(trashDir, group)
+		for _, s := range group {
+			shardsLog(c.IndexDir, "remove", []shard{s}, s.Repo)
+		}
+	}
+	return compounds
+}
+
+// candidates groups the shards to merge. Only simple shards smaller than
+// TargetSize, whose repository isn't spread over several shards, are
+// merged. Each group holds at least 2 shards, and is at most TargetSize
+// large in total.
+func (c *Compactor) candidates(index map[string][]shard) [][]shard {
+	type sizedShard struct {
+		shard
+		size int64
+	}
+	var small []sizedShard
+	for _, shards := range index {
+		if len(shards) != 1 || strings.HasPrefix(filepath.Base(shards[0].Path), "compound-") {
+			continue
+		}
+		if size := shardsSize(shards); size < c.TargetSize {
+			small = append(small, sizedShard{shards[0], size})
+		}
+	}
+	sort.Slice(small, func(i, j int) bool {
+		return small[i].Path < small[j].Path
+	})
+
+	var groups [][]shard
+	var group []shard
+	var groupSize int64
+	flush := func() {
+		if len(group) >= 2 {
+			groups = append(groups, group)
+		}
+		group = nil
+		groupSize = 0
+	}
+	for _, s := range small {
+		if groupSize+s.size > c.TargetSize {
+			flush()
+		}
+		group = append(group, s.shard)
+		groupSize += s.size
+	}
+	flush()
+	return groups
+}
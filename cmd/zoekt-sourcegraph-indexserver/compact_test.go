@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/query"
+)
+
+func createTestShard(t *testing.T, repo, path string) {
+	t.Helper()
+
+	b, err := zoekt.NewIndexBuilder(&zoekt.Repository{Name: repo})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// merging drops repositories without documents.
+	if err := b.Add(zoekt.Document{Name: "f", Content: []byte("needle in " + repo)}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := b.Write(f); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	dir := t.TempDir()
+	repos := []string{"repo1", "repo2", "repo3"}
+	for _, repo := range repos {
+		createTestShard(t, repo, filepath.Join(dir, repo+"_v16.00000.zoekt"))
+	}
+
+	c := &Compactor{IndexDir: dir, TargetSize: 1 << 20}
+
+	// Without tombstones, reindexing a repository would delete the whole
+	// compound shard.
+	if got := c.compact(); len(got) != 0 {
+		t.Fatalf("compacted %v without tombstones", got)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "RIP"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	compounds := c.compact()
+	if len(compounds) != 1 {
+		t.Fatalf("got compound shards %v, want 1", compounds)
+	}
+	if got, want := globBase(filepath.Join(dir, "*.zoekt")), []string{filepath.Base(compounds[0])}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got shards %v, want %v", got, want)
+	}
+	if got := globBase(filepath.Join(dir, ".trash", "*.zoekt")); len(got) != 3 {
+		t.Errorf("got trashed shards %v, want 3", got)
+	}
+
+	f, err := os.Open(compounds[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexFile, err := zoekt.NewIndexFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := zoekt.NewSearcher(indexFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	res, err := s.Search(context.Background(), &query.Substring{Pattern: "needle"}, &zoekt.SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, fm := range res.Files {
+		got = append(got, fm.Repository)
+	}
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, repos) {
+		t.Errorf("search found %v, want %v", got, repos)
+	}
+
+	// The compound shard is not merged again.
+	if got := c.compact(); len(got) != 0 {
+		t.Errorf("compacted %v again", got)
+	}
+}
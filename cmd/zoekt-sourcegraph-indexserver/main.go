@@ -122,6 +122,10 @@ type Server struct {
 	// repository.
 	CPUCount int
 
+	// CompactTargetSize, if positive, merges small shards into compound
+	// shards of up to this many bytes every Interval. See Compactor.
+	CompactTargetSize int64
+
 	mu            sync.Mutex
 	lastListRepos []string
 }
@@ -239,6 +243,15 @@ func (s *Server) Run(queue *Queue) {
 	// Protect the index directory from concurrent access of builder and cleanup.
 	muIndexDir := sync.Mutex{}
 
+	if s.CompactTargetSize > 0 {
+		c := &Compactor{
+			IndexDir:   s.IndexDir,
+			TargetSize: s.CompactTargetSize,
+			Mu:         &muIndexDir,
+		}
+		go c.Run(s.Interval)
+	}
+
 	// Start a goroutine which updates the queue with commits to index.
 	go func() {
 		// We update the list of indexed repos every Interval. To speed up manual
@@ -273,7 +286,7 @@ func (s *Server) Run(queue *Queue) {
 			go func() {
 				defer close(cleanupDone)
 				muIndexDir.Lock()
-				cleanup(s.IndexDir, repos, time.Now())
+				cleanup(s.IndexDir, repos, time.Now(), cleanupOptions{})
 				muIndexDir.Unlock()
 			}()
 
@@ -673,6 +686,7 @@ func main() {
 	listen := flag.String("listen", ":6072", "listen on this address.")
 	hostname := flag.String("hostname", hostnameBestEffort(), "the name we advertise to Sourcegraph when asking for the list of repositories to index. Can also be set via the NODE_NAME environment variable.")
 	cpuFraction := flag.Float64("cpu_fraction", 1.0, "use this fraction of the cores for indexing.")
+	compactTargetSize := flag.Int64("compact_target_size", 0, "if positive, merge small shards into compound shards of up to this many bytes. Requires tombstones to be enabled.")
 	dbg := flag.Bool("debug", srcLogLevelIsDebug(), "turn on more verbose logging.")
 
 	// non daemon mode for debugging/testing
@@ -680,6 +694,7 @@ func main() {
 	debugIndex := flag.String("debug-index", "", "do not start the indexserver, rather index the repositories then quit.")
 	debugShard := flag.String("debug-shard", "", "do not start the indexserver, rather print shard stats then quit.")
 	debugMeta := flag.String("debug-meta", "", "do not start the indexserver, rather print shard metadata then quit.")
+	debugCleanup := flag.Bool("debug-cleanup", false, "do not start the indexserver, rather print the changes cleanup would make to the index directory then quit.")
 
 	_ = flag.Bool("exp-git-index", true, "DEPRECATED: not read anymore. We always use zoekt-git-index now.")
 
@@ -758,6 +773,8 @@ func main() {
 		IndexDir:    *index,
 		Interval:    *interval,
 		CPUCount:    cpuCount,
+
+		CompactTargetSize: *compactTargetSize,
 	}
 
 	if *debugList {
@@ -771,6 +788,31 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *debugCleanup {
+		repos, err := s.Sourcegraph.ListRepos(context.Background(), listIndexed(s.IndexDir))
+		if err != nil {
+			log.Fatal(err)
+		}
+		summary := cleanup(s.IndexDir, repos, time.Now(), cleanupOptions{DryRun: true})
+		for _, c := range []struct {
+			action string
+			shards []shard
+		}{
+			{"remove", summary.Removed},
+			{"restore", summary.Restored},
+			{"trash", summary.Trashed},
+			{"tomb", summary.Tombstoned},
+		} {
+			for _, sh := range c.shards {
+				fmt.Printf("%s\t%s\t%s\n", c.action, sh.Path, sh.Repo)
+			}
+		}
+		for _, p := range summary.RemovedTmp {
+			fmt.Printf("remove-tmp\t%s\n", p)
+		}
+		os.Exit(0)
+	}
+
 	if *debugIndex != "" {
 		msg, err := s.forceIndex(*debugIndex)
 		log.Println(msg)
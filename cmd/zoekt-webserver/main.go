@@ -136,6 +136,8 @@ func main() {
 	templateDir := flag.String("template_dir", "", "set directory from which to load custom .html.tpl template files")
 	dumpTemplates := flag.Bool("dump_templates", false, "dump templates into --template_dir and exit.")
 	version := flag.Bool("version", false, "Print version number")
+	resultCacheSize := flag.Int("result_cache_size", 0, "cache the results of this many recent searches. 0 disables the cache.")
+	resultCacheTTL := flag.Duration("result_cache_ttl", time.Minute, "if using --result_cache_size, drop cached results after this long. 0 keeps them until evicted.")
 	flag.Parse()
 
 	if *version {
@@ -172,7 +174,13 @@ func main() {
 
 	mustRegisterDiskMonitor(*index)
 
-	searcher, err := shards.NewDirectorySearcher(*index)
+	var searcher zoekt.Streamer
+	var err error
+	if *resultCacheSize > 0 {
+		searcher, err = shards.NewDirectorySearcherWithResultCache(*index, *resultCacheSize, *resultCacheTTL)
+	} else {
+		searcher, err = shards.NewDirectorySearcher(*index)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,104 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"reflect"
+
+	"github.com/google/zoekt/query"
+)
+
+// CompileQuery prepares q for repeated searching, much like
+// regexp.Compile. The ngrams and bloom filter probes of substring atoms
+// are extracted once, instead of once per shard for every search. The
+// result is a query.Q that can be passed to Search any number of times,
+// concurrently. It only works with searchers in this process; it cannot
+// be sent over RPC.
+func CompileQuery(q query.Q) query.Q {
+	q = query.Simplify(q)
+	q = query.Map(q, query.ExpandFileContent)
+	return query.Map(q, func(q query.Q) query.Q {
+		s, ok := q.(*query.Substring)
+		if !ok || len(s.Pattern) < ngramSize {
+			return q
+		}
+		cs := newCompiledSubstring(s)
+		if len(cs.ngramOffs) == 0 {
+			return q
+		}
+		cs.caseVariants = make([][]ngram, len(cs.ngramOffs))
+		for i, o := range cs.ngramOffs {
+			cs.caseVariants[i] = generateCaseNgrams(o.ngram)
+		}
+		if len(s.Pattern) >= bloomHashMinWordLength {
+			cs.bloomProbes = make([][]uint32, len(bloomHashers))
+			for i, h := range bloomHashers {
+				cs.bloomProbes[i] = bloomQueryProbes(h, cs.patBytes)
+			}
+		}
+		return cs
+	})
+}
+
+// compiledSubstring is a query.Substring with the shard independent
+// parts of iterateNgrams precomputed.
+type compiledSubstring struct {
+	query.Substring
+
+	ngramOffs     []runeNgramOff
+	patBytes      []byte
+	lowerPatBytes []byte
+
+	// If set, the case variants of each of ngramOffs.
+	caseVariants [][]ngram
+
+	// If set, the probes for the pattern, indexed like bloomHashers.
+	bloomProbes [][]uint32
+}
+
+func newCompiledSubstring(s *query.Substring) *compiledSubstring {
+	patBytes := []byte(s.Pattern)
+	return &compiledSubstring{
+		Substring:     *s,
+		ngramOffs:     splitNGrams(patBytes),
+		patBytes:      patBytes,
+		lowerPatBytes: toLower(patBytes),
+	}
+}
+
+func (cs *compiledSubstring) String() string {
+	return cs.Substring.String()
+}
+
+func (cs *compiledSubstring) caseNgrams(i int) []ngram {
+	if cs.caseVariants != nil {
+		return cs.caseVariants[i]
+	}
+	return generateCaseNgrams(cs.ngramOffs[i].ngram)
+}
+
+// maybeInBloom tests the pattern against b, using precomputed probes if
+// they exist for the hasher of b.
+func (cs *compiledSubstring) maybeInBloom(b *bloom) bool {
+	if b.hasher == nil {
+		return true
+	}
+	if cs.bloomProbes != nil {
+		if id, ok := bloomHasherIds[reflect.ValueOf(b.hasher).Pointer()]; ok {
+			return b.maybeHas(cs.bloomProbes[id-1])
+		}
+	}
+	return b.maybeHasBytes(cs.patBytes)
+}
@@ -37,6 +37,8 @@ type contentProvider struct {
 	_nlBuf   []uint32
 	_sects   []DocumentSection
 	_sectBuf []DocumentSection
+	_diff    []uint32
+	_diffBuf []uint32
 	fileSize uint32
 }
 
@@ -50,6 +52,7 @@ func (p *contentProvider) setDocument(docID uint32) {
 	p._nl = nil
 	p._sects = nil
 	p._data = nil
+	p._diff = nil
 }
 
 func (p *contentProvider) docSections() []DocumentSection {
@@ -85,6 +88,46 @@ func (p *contentProvider) data(fileName bool) []byte {
 	return p._data
 }
 
+// isDiff returns true if the current document is a unified diff.
+func (p *contentProvider) isDiff() bool {
+	return p.id.isDiff(p.idx)
+}
+
+// diffLineKind returns '+' or '-' if the content line containing
+// offset is an added or removed line of a diff, and 0 otherwise.
+func (p *contentProvider) diffLineKind(offset uint32) byte {
+	if p._diff == nil {
+		p._diff = p.id.diffLines(p.idx, p._diffBuf)
+		p._diffBuf = p._diff
+	}
+	nl := p.newlines()
+	line := uint32(sort.Search(len(nl), func(i int) bool { return nl[i] >= offset }))
+
+	lines := p._diff
+	i := sort.Search(len(lines), func(i int) bool { return lines[i] >= 2*line })
+	switch {
+	case i == len(lines) || lines[i]/2 != line:
+		return 0
+	case lines[i]%2 == 0:
+		return '+'
+	default:
+		return '-'
+	}
+}
+
+// spansLine returns true if the size bytes of data at offset are a
+// complete line, without its "\n" or "\r\n" ending.
+func spansLine(data []byte, offset, size uint32) bool {
+	if offset > 0 && data[offset-1] != '\n' {
+		return false
+	}
+	rest := data[offset+size:]
+	if len(rest) > 0 && rest[0] == '\r' {
+		rest = rest[1:]
+	}
+	return len(rest) == 0 || rest[0] == '\n'
+}
+
 // Find offset in bytes (relative to corpus start) for an offset in
 // runes (relative to document start). If filename is set, the corpus
 // is the set of filenames, with the document being the name itself.
@@ -130,7 +173,29 @@ func (p *contentProvider) findOffset(filename bool, r uint32) uint32 {
 	return byteOff
 }
 
-func (p *contentProvider) fillMatches(ms []*candidateMatch) []LineMatch {
+// markSymbolMatches turns the content matches in ms that lie within a
+// symbol definition into symbol matches, so they are reported with
+// LineFragmentMatch.SymbolInfo.
+func (p *contentProvider) markSymbolMatches(ms []*candidateMatch) {
+	for _, m := range ms {
+		if m.fileName || m.symbol {
+			continue
+		}
+		secs := p.docSections()
+		end := m.byteOffset + m.byteMatchSz
+		j := sort.Search(len(secs), func(i int) bool {
+			return secs[i].End >= end
+		})
+		if j < len(secs) && secs[j].Start <= m.byteOffset {
+			m.symbol = true
+			m.symbolIdx = uint32(j)
+		}
+	}
+}
+
+// fillMatches returns the line matches of ms. If symbolInfo is set, the
+// fragments of symbol matches carry LineFragmentMatch.SymbolInfo.
+func (p *contentProvider) fillMatches(ms []*candidateMatch, weights *ScoreWeights, symbolInfo bool) []LineMatch {
 	var result []LineMatch
 	if ms[0].fileName {
 		// There is only "line" in a filename.
@@ -150,17 +215,60 @@ func (p *contentProvider) fillMatches(ms []*candidateMatch) []LineMatch {
 		}
 	} else {
 		ms = breakMatchesOnNewlines(ms, p.data(false))
-		result = p.fillContentMatches(ms)
+		result = p.fillContentMatches(ms, symbolInfo)
 	}
 
+	// Looking up symbols is only worth it if they change the score.
+	var secs []DocumentSection
+	if weights.SymbolMatch != 0 && !ms[0].fileName {
+		secs = p.docSections()
+	}
 	for i, m := range result {
-		result[i].Score = matchScore(nil, &m)
+		result[i].Score = matchScore(weights, secs, &m)
 	}
 
 	return result
 }
 
-func (p *contentProvider) fillContentMatches(ms []*candidateMatch) []LineMatch {
+// fillContextLines sets the n lines before and after each content match of
+// ms.
+func (p *contentProvider) fillContextLines(ms []LineMatch, n int) {
+	data := p.data(false)
+	for i := range ms {
+		m := &ms[i]
+		if m.FileName {
+			continue
+		}
+
+		// Lines before, walking backwards from the start of the match.
+		m.Before = nil
+		start := m.LineStart
+		for k := 1; k <= n && start > 0; k++ {
+			end := start - 1
+			start = bytes.LastIndexByte(data[:end], '\n') + 1
+			m.Before = append(m.Before, ContextLine{Line: data[start:end], LineNumber: m.LineNumber - k})
+		}
+		for l, r := 0, len(m.Before)-1; l < r; l, r = l+1, r-1 {
+			m.Before[l], m.Before[r] = m.Before[r], m.Before[l]
+		}
+
+		// Lines after. A match can span several lines, and a trailing
+		// newline doesn't start another line.
+		m.After = nil
+		last := m.LineNumber + bytes.Count(data[m.LineStart:m.LineEnd], []byte{'\n'})
+		end := m.LineEnd
+		for k := 1; k <= n && end+1 < len(data); k++ {
+			start := end + 1
+			end = len(data)
+			if next := bytes.IndexByte(data[start:], '\n'); next >= 0 {
+				end = start + next
+			}
+			m.After = append(m.After, ContextLine{Line: data[start:end], LineNumber: last + k})
+		}
+	}
+}
+
+func (p *contentProvider) fillContentMatches(ms []*candidateMatch, symbolInfo bool) []LineMatch {
 	var result []LineMatch
 	for len(ms) > 0 {
 		m := ms[0]
@@ -217,7 +325,7 @@ func (p *contentProvider) fillContentMatches(ms []*candidateMatch) []LineMatch {
 				LineOffset:  int(m.byteOffset) - lineStart,
 				MatchLength: int(m.byteMatchSz),
 			}
-			if m.symbol {
+			if m.symbol && symbolInfo {
 				start := p.id.fileEndSymbol[p.idx]
 				fragment.SymbolInfo = p.id.symbols.data(start + m.symbolIdx)
 				if fragment.SymbolInfo != nil {
@@ -261,9 +369,11 @@ func findSection(secs []DocumentSection, off, sz uint32) *DocumentSection {
 	return nil
 }
 
-func matchScore(secs []DocumentSection, m *LineMatch) float64 {
+// matchScore returns the score of the best fragment of m. secs are the
+// symbol sections of the document, if symbol matches are weighted.
+func matchScore(weights *ScoreWeights, secs []DocumentSection, m *LineMatch) float64 {
 	var maxScore float64
-	for _, f := range m.LineFragments {
+	for i, f := range m.LineFragments {
 		startBoundary := f.LineOffset < len(m.Line) && (f.LineOffset == 0 || byteClass(m.Line[f.LineOffset-1]) != byteClass(m.Line[f.LineOffset]))
 
 		end := int(f.LineOffset) + f.MatchLength
@@ -271,18 +381,24 @@ func matchScore(secs []DocumentSection, m *LineMatch) float64 {
 
 		score := 0.0
 		if startBoundary && endBoundary {
-			score = scoreWordMatch
+			score = scoreWordMatch + weights.WordBoundary
 		} else if startBoundary || endBoundary {
 			score = scorePartialWordMatch
 		}
+		if m.FileName {
+			score += weights.FileNameMatch
+		}
 
 		// We removed scoring based on symbol boundaries. This is due
 		// to not having a use for result scores at the moment on the
 		// sourcegraph frontend side, so we avoid incurring this
-		// computational overhead. We may reintroduce this later in
-		// the future to improve resutl ranking.
+		// computational overhead unless ScoreWeights.SymbolMatch asks
+		// for it.
+		if secs != nil && findSection(secs, f.Offset, uint32(f.MatchLength)) != nil {
+			score += weights.SymbolMatch
+		}
 
-		if score > maxScore {
+		if i == 0 || score > maxScore {
 			maxScore = score
 		}
 	}
@@ -305,7 +421,65 @@ func sortMatchesByScore(ms []LineMatch) {
 	sort.Sort(matchScoreSlice(ms))
 }
 
+type matchLineDescSlice []LineMatch
+
+func (m matchLineDescSlice) Len() int           { return len(m) }
+func (m matchLineDescSlice) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m matchLineDescSlice) Less(i, j int) bool { return m[i].LineNumber > m[j].LineNumber }
+
+// sortMatchesByLineDesc sorts matches from the end of the file to the
+// start.
+func sortMatchesByLineDesc(ms []LineMatch) {
+	sort.Stable(matchLineDescSlice(ms))
+}
+
 // Sort a slice of results.
 func SortFilesByScore(ms []FileMatch) {
 	sort.Sort(fileMatchSlice(ms))
 }
+
+// SortFilesByPath sorts ms by file name. Files with the same name keep
+// their order.
+func SortFilesByPath(ms []FileMatch) {
+	sort.SliceStable(ms, func(i, j int) bool {
+		return ms[i].FileName < ms[j].FileName
+	})
+}
+
+// SortFilesByRecency sorts ms by decreasing modification time. Files with
+// the same time keep their order.
+func SortFilesByRecency(ms []FileMatch) {
+	sort.SliceStable(ms, func(i, j int) bool {
+		return ms[i].ModTime.After(ms[j].ModTime)
+	})
+}
+
+// SortRepoMatchDensity merges entries for the same repository, drops
+// repositories without matches and sorts the rest by decreasing match
+// density.
+func SortRepoMatchDensity(rs []RepoMatchDensity) []RepoMatchDensity {
+	idx := map[string]int{}
+	var merged []RepoMatchDensity
+	for _, r := range rs {
+		if i, ok := idx[r.Repository]; ok {
+			merged[i].MatchCount += r.MatchCount
+			merged[i].Lines += r.Lines
+			continue
+		}
+		idx[r.Repository] = len(merged)
+		merged = append(merged, r)
+	}
+	out := merged[:0]
+	for _, r := range merged {
+		if r.MatchCount > 0 {
+			out = append(out, r)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if di, dj := out[i].Density(), out[j].Density(); di != dj {
+			return di > dj
+		}
+		return out[i].Repository < out[j].Repository
+	})
+	return out
+}
@@ -0,0 +1,91 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"fmt"
+	"os"
+)
+
+// Convert rewrites the shard src to dst by feeding its documents through an
+// IndexBuilder, keeping the index format version of src. Unlike copying the
+// file, this rebuilds all derived data, such as the ngram index, with the
+// current code. Repositories without documents and tombstoned repositories
+// are left out.
+func Convert(src, dst string) error {
+	return convert(src, dst, func(d *indexData) int {
+		return d.metaData.IndexFormatVersion
+	})
+}
+
+// ConvertUpgrade is like Convert, but writes dst in the newest index
+// format version, NextIndexFormatVersion. It checks that dst can be
+// loaded before returning.
+func ConvertUpgrade(src, dst string) error {
+	if err := convert(src, dst, func(*indexData) int { return NextIndexFormatVersion }); err != nil {
+		return err
+	}
+
+	f, err := os.Open(dst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	inf, err := NewIndexFile(f)
+	if err != nil {
+		return err
+	}
+	searcher, err := NewSearcher(inf)
+	if err != nil {
+		inf.Close()
+		return fmt.Errorf("%s: upgraded shard does not load: %w", dst, err)
+	}
+	defer searcher.Close()
+
+	if v := searcher.(*indexData).metaData.IndexFormatVersion; v != NextIndexFormatVersion {
+		return fmt.Errorf("%s: got index format version %d, want %d", dst, v, NextIndexFormatVersion)
+	}
+	return nil
+}
+
+// convert rewrites the shard src to dst, in the index format version
+// returned by version.
+func convert(src, dst string, version func(*indexData) int) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	inf, err := NewIndexFile(f)
+	if err != nil {
+		return err
+	}
+	defer inf.Close()
+
+	searcher, err := NewSearcher(inf)
+	if err != nil {
+		return err
+	}
+	d := searcher.(*indexData)
+
+	ib := newIndexBuilder()
+	ib.indexFormatVersion = version(d)
+	if err := mergeDocs(d, func(*Repository) (*IndexBuilder, error) { return ib, nil }, nil); err != nil {
+		return fmt.Errorf("%s: %w", src, err)
+	}
+	return builderWriteAll(dst, ib)
+}
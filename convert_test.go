@@ -0,0 +1,103 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/zoekt/query"
+)
+
+func TestConvert(t *testing.T) {
+	src := "testdata/shards/repo_v16.00000.zoekt"
+	dst := filepath.Join(t.TempDir(), filepath.Base(src))
+	if err := Convert(src, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	q := &query.Substring{Pattern: "func main", Content: true}
+	search := func(fn string) *SearchResult {
+		t.Helper()
+		searcher := searcherForPath(t, fn)
+		defer searcher.Close()
+		res, err := searcher.Search(context.Background(), q, &SearchOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	want, got := search(src), search(dst)
+	if len(want.Files) == 0 {
+		t.Fatalf("no matches for %s in %s", q, src)
+	}
+	if len(got.Files) != len(want.Files) {
+		t.Fatalf("got %d files, want %d", len(got.Files), len(want.Files))
+	}
+	for i := range want.Files {
+		if got.Files[i].FileName != want.Files[i].FileName {
+			t.Errorf("got file %q, want %q", got.Files[i].FileName, want.Files[i].FileName)
+		}
+	}
+
+	if v := got.IndexFormatVersions; len(v) != 1 || v[IndexFormatVersion] != 1 {
+		t.Errorf("got index format versions %v, want v%d", v, IndexFormatVersion)
+	}
+}
+
+func TestConvertUpgrade(t *testing.T) {
+	srcs, err := filepath.Glob("testdata/shards/*_v16.*.zoekt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(srcs) == 0 {
+		t.Fatal("no v16 shards in testdata")
+	}
+
+	for _, src := range srcs {
+		t.Run(filepath.Base(src), func(t *testing.T) {
+			dst := filepath.Join(t.TempDir(), "upgraded.zoekt")
+			if err := ConvertUpgrade(src, dst); err != nil {
+				t.Fatal(err)
+			}
+
+			q := &query.Substring{Pattern: "main", Content: true}
+			count := func(fn string) (int, map[int]int) {
+				t.Helper()
+				searcher := searcherForPath(t, fn)
+				defer searcher.Close()
+				res, err := searcher.Search(context.Background(), q, &SearchOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return res.Stats.MatchCount, res.IndexFormatVersions
+			}
+
+			want, _ := count(src)
+			got, versions := count(dst)
+			if want == 0 {
+				t.Fatalf("no matches for %s in %s", q, src)
+			}
+			if got != want {
+				t.Errorf("got %d matches, want %d", got, want)
+			}
+			if len(versions) != 1 || versions[NextIndexFormatVersion] != 1 {
+				t.Errorf("got index format versions %v, want v%d", versions, NextIndexFormatVersion)
+			}
+		})
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"path"
 	"regexp/syntax"
 	"sort"
 	"strings"
@@ -39,6 +40,19 @@ func (m *FileMatch) addScore(what string, s float64) {
 	m.Score += s
 }
 
+// SetRepositoryRank changes the repository rank of m to rank and adjusts
+// its score by the change in the shard-order component.
+func (m *FileMatch) SetRepositoryRank(rank uint16) {
+	m.addScore("rank-override", scoreShardRankFactor*(float64(rank)-float64(m.RepositoryRank))/maxUInt16)
+	m.RepositoryRank = rank
+}
+
+// tooLarge returns true if the content of docID exceeds maxSize bytes. A
+// maxSize of zero disables the check.
+func (d *indexData) tooLarge(docID uint32, maxSize int) bool {
+	return maxSize > 0 && d.boundaries[docID+1]-d.boundaries[docID] > uint32(maxSize)
+}
+
 // simplifyMultiRepo takes a query and a predicate. It returns Const(true) if all
 // repository names fulfill the predicate, Const(false) if none of them do, and q
 // otherwise.
@@ -91,19 +105,92 @@ func (d *indexData) simplify(in query.Q) query.Q {
 			return &query.Const{Value: false}
 		case *query.RepoSet:
 			return d.simplifyMultiRepo(q, func(repo *Repository) bool {
-				return r.Set[repo.Name]
+				return r.Has(repo.Name)
+			})
+		case query.RawConfig, *query.RepoRawConfig:
+			return d.simplifyMultiRepo(q, func(repo *Repository) bool {
+				return repoMatchesRawConfig(repo, q)
 			})
 		case *query.Language:
 			_, has := d.metaData.LanguageMap[r.Language]
 			if !has {
 				return &query.Const{Value: false}
 			}
+		case *query.LanguageSet:
+			for lang := range r.Set {
+				if _, has := d.metaData.LanguageMap[lang]; has {
+					return q
+				}
+			}
+			return &query.Const{Value: false}
+		case *query.FileChecksum:
+			if len(d.checksumDocs(r.Sum)) == 0 {
+				return &query.Const{Value: false}
+			}
+		case *query.Substring:
+			// query.Map doesn't descend into query.Symbol, so these
+			// search content, file names, or both. Without content,
+			// only the file name side can match.
+			if d.metaData.SymbolsOnly && !r.FileName {
+				if r.Content {
+					return &query.Const{Value: false}
+				}
+				f := *r
+				f.FileName = true
+				return &f
+			}
+		case *query.Regexp:
+			if d.metaData.SymbolsOnly && !r.FileName {
+				if r.Content {
+					return &query.Const{Value: false}
+				}
+				f := *r
+				f.FileName = true
+				return &f
+			}
+		case *compiledSubstring:
+			// CompileQuery expanded these into file name and
+			// content atoms.
+			if d.metaData.SymbolsOnly && !r.FileName {
+				return &query.Const{Value: false}
+			}
 		}
 		return q
 	})
 	return query.Simplify(eval)
 }
 
+// repoMatchesRawConfig returns whether repo matches q, which must be a
+// query.RawConfig or a *query.RepoRawConfig.
+func repoMatchesRawConfig(repo *Repository, q query.Q) bool {
+	switch r := q.(type) {
+	case query.RawConfig:
+		return uint8(r)&encodeRawConfig(repo.RawConfig) == uint8(r)
+	case *query.RepoRawConfig:
+		return repoHasRawConfig(repo, r)
+	}
+	return false
+}
+
+// repoHasRawConfig returns whether the RawConfig of repo maps q.Key to
+// q.Value.
+func repoHasRawConfig(repo *Repository, q *query.RepoRawConfig) bool {
+	v, ok := repo.RawConfig[q.Key]
+	return ok && v == q.Value
+}
+
+// simplifyForRepo evaluates the atoms of q that only depend on the
+// RawConfig of a repository against repo.
+func simplifyForRepo(q query.Q, repo *Repository) query.Q {
+	return query.Simplify(query.Map(q, func(q query.Q) query.Q {
+		switch q.(type) {
+		case query.RawConfig, *query.RepoRawConfig:
+			return &query.Const{Value: repoMatchesRawConfig(repo, q)}
+		}
+		return q
+	}))
+}
+
 func (o *SearchOptions) SetDefaults() {
 	if o.ShardMaxMatchCount == 0 {
 		// We cap the total number of matches, so overly broad
@@ -125,6 +212,17 @@ func (d *indexData) Search(ctx context.Context, q query.Q, opts *SearchOptions)
 	copyOpts := *opts
 	opts = &copyOpts
 	opts.SetDefaults()
+	// repoMatches counts the matches of each repository for
+	// RepoMatchDensity, before MaxLineMatches truncates them.
+	var repoMatches []int
+	if opts.RepoMatchDensity {
+		repoMatches = make([]int, len(d.repoMetaData))
+		defer func() {
+			if sr != nil {
+				d.addRepoMatchDensity(sr, repoMatches)
+			}
+		}()
+	}
 	importantMatchCount := 0
 
 	var res SearchResult
@@ -153,6 +251,9 @@ func (d *indexData) Search(ctx context.Context, q query.Q, opts *SearchOptions)
 		tr.Finish()
 	}()
 
+	if opts.FileNameOnly {
+		q = query.Map(q, fileNameOnly)
+	}
 	q = d.simplify(q)
 	tr.LazyLog(q, true)
 	if c, ok := q.(*query.Const); ok && !c.Value {
@@ -164,13 +265,47 @@ func (d *indexData) Search(ctx context.Context, q query.Q, opts *SearchOptions)
 		return &res, nil
 	}
 
+	// reposWant is nil if opts.RepoIDs does not restrict the search.
+	var reposWant []bool
+	if opts.RepoIDs != nil {
+		reposWant = make([]bool, len(d.repoMetaData))
+		found := false
+		for i, md := range d.repoMetaData {
+			reposWant[i] = opts.RepoIDs.Contains(md.ID)
+			found = found || reposWant[i]
+		}
+		if !found {
+			return &res, nil
+		}
+	}
+
 	q = query.Map(q, query.ExpandFileContent)
 
-	mt, err := d.newMatchTree(q)
+	mt, err := d.newMatchTree(q, matchTreeOpt{
+		ngramSkipFraction: opts.NgramSkipFraction,
+		wholeLine:         opts.WholeLine && !opts.FileNameOnly && opts.MaxFilePaths == 0,
+	})
 	if err != nil {
 		return nil, err
 	}
 
+	// Count the bloom filter outcomes before pruning removes the
+	// rejected substrings.
+	visitMatchTree(mt, func(t matchTree) {
+		st, ok := t.(*substrMatchTree)
+		if !ok {
+			return
+		}
+		if r, ok := st.matchIterator.(*ngramIterationResults); ok {
+			switch r.bloom {
+			case bloomAdmitted:
+				res.Stats.BloomAdmitted++
+			case bloomRejected:
+				res.Stats.BloomRejected++
+			}
+		}
+	})
+
 	mt, err = pruneMatchTree(mt)
 	if err != nil {
 		return nil, err
@@ -187,6 +322,15 @@ func (d *indexData) Search(ctx context.Context, q query.Q, opts *SearchOptions)
 
 	res.Stats.ShardsScanned++
 
+	// Skip tombstoned docs, docs larger than MaxFileSize and docs
+	// of repos outside of RepoIDs.
+	skipDoc := func(docID uint32) bool {
+		repo := d.repos[docID]
+		return d.repoMetaData[repo].Tombstone ||
+			d.tooLarge(docID, opts.MaxFileSize) ||
+			(reposWant != nil && !reposWant[repo])
+	}
+
 	cp := &contentProvider{
 		id:    d,
 		stats: &res.Stats,
@@ -208,8 +352,7 @@ nextFileMatch:
 		if int(nextDoc) <= lastDoc {
 			nextDoc = uint32(lastDoc + 1)
 		}
-		// Skip tombstoned docs
-		for nextDoc < docCount && d.repoMetaData[d.repos[nextDoc]].Tombstone {
+		for nextDoc < docCount && skipDoc(nextDoc) {
 			nextDoc++
 		}
 		if nextDoc >= docCount {
@@ -218,7 +361,8 @@ nextFileMatch:
 		lastDoc = int(nextDoc)
 
 		if canceled || (res.Stats.MatchCount >= opts.ShardMaxMatchCount && opts.ShardMaxMatchCount > 0) ||
-			(opts.ShardMaxImportantMatch > 0 && importantMatchCount >= opts.ShardMaxImportantMatch) {
+			(opts.ShardMaxImportantMatch > 0 && importantMatchCount >= opts.ShardMaxImportantMatch) ||
+			(opts.MaxFilePaths > 0 && len(res.Files) >= opts.MaxFilePaths) {
 			res.Stats.FilesSkipped += int(docCount - nextDoc)
 			break
 		}
@@ -245,11 +389,14 @@ nextFileMatch:
 		}
 
 		fileMatch := FileMatch{
-			Repository:   md.Name,
-			RepositoryID: md.ID,
-			FileName:     string(d.fileName(nextDoc)),
-			Checksum:     d.getChecksum(nextDoc),
-			Language:     d.languageMap[d.languages[nextDoc]],
+			Repository:     md.Name,
+			RepositoryID:   md.ID,
+			RepositoryRank: md.Rank,
+			FileName:       string(d.fileName(nextDoc)),
+			Checksum:       d.getChecksum(nextDoc),
+			Language:       d.languageMap[d.languages[nextDoc]],
+			ModTime:        d.modTime(nextDoc),
+			SkipReason:     d.skipReason(nextDoc),
 		}
 
 		if s := d.subRepos[nextDoc]; s > 0 {
@@ -270,6 +417,13 @@ nextFileMatch:
 			}
 		}
 
+		if opts.MaxFilePaths > 0 || opts.FileNameOnly {
+			d.scoreDoc(&fileMatch, nextDoc, mt, known)
+			res.Files = append(res.Files, fileMatch)
+			res.Stats.FileCount++
+			continue
+		}
+
 		atomMatchCount := 0
 		visitMatches(mt, known, func(mt matchTree) {
 			atomMatchCount++
@@ -290,12 +444,32 @@ nextFileMatch:
 					byteMatchSz:   uint32(len(nm)),
 				})
 		}
-		fileMatch.LineMatches = cp.fillMatches(finalCands)
+		if repoMatches != nil {
+			repoMatches[d.repos[nextDoc]] += len(finalCands)
+		}
+		if opts.FileMatchesOnly {
+			fileMatch.MatchCount = len(finalCands)
+			fileMatch.addScore("atom", float64(atomMatchCount)/float64(totalAtomCount)*scoreFactorAtomMatch)
+			d.scoreDoc(&fileMatch, nextDoc, mt, known)
+			res.Files = append(res.Files, fileMatch)
+			res.Stats.MatchCount += fileMatch.MatchCount
+			res.Stats.FileCount++
+			continue
+		}
+		if opts.IncludeSymbols && !opts.OmitSymbolInfo {
+			cp.markSymbolMatches(finalCands)
+		}
+		fileMatch.LineMatches = cp.fillMatches(finalCands, &opts.Weights, !opts.OmitSymbolInfo)
+		if opts.ContextLines > 0 {
+			cp.fillContextLines(fileMatch.LineMatches, opts.ContextLines)
+		}
 
 		maxFileScore := 0.0
+		maxLine := -1
 		for i := range fileMatch.LineMatches {
 			if maxFileScore < fileMatch.LineMatches[i].Score {
 				maxFileScore = fileMatch.LineMatches[i].Score
+				maxLine = i
 			}
 
 			// Order by ordering in file.
@@ -306,18 +480,33 @@ nextFileMatch:
 		// strictly dominates the in-file ordering of
 		// the matches.
 		fileMatch.addScore("fragment", maxFileScore)
+		if opts.LineScores && maxLine >= 0 {
+			// Only the best line counts towards the file score.
+			fileMatch.LineMatches[maxLine].FileScore = maxFileScore
+		}
 		fileMatch.addScore("atom", float64(atomMatchCount)/float64(totalAtomCount)*scoreFactorAtomMatch)
 
-		// Prefer earlier docs.
-		fileMatch.addScore("doc-order", scoreFileOrderFactor*(1.0-float64(nextDoc)/float64(len(d.boundaries))))
-		fileMatch.addScore("shard-order", scoreShardRankFactor*float64(md.Rank)/maxUInt16)
+		d.scoreDoc(&fileMatch, nextDoc, mt, known)
 
 		if fileMatch.Score > scoreImportantThreshold {
 			importantMatchCount++
 		}
-		fileMatch.Branches = d.gatherBranches(nextDoc, mt, known)
-		sortMatchesByScore(fileMatch.LineMatches)
-		if opts.Whole {
+		if opts.FileNameSiblings > 0 && fileMatch.LineMatches[0].FileName {
+			fileMatch.Siblings = d.siblings(nextDoc, opts.FileNameSiblings)
+		}
+		if opts.ReverseLineOrder {
+			sortMatchesByLineDesc(fileMatch.LineMatches)
+		} else {
+			sortMatchesByScore(fileMatch.LineMatches)
+		}
+		if opts.MaxLineMatches > 0 && len(fileMatch.LineMatches) > opts.MaxLineMatches {
+			fileMatch.LineMatches = fileMatch.LineMatches[:opts.MaxLineMatches]
+		}
+		if opts.ContentRange != nil {
+			if fileMatch.Content, err = d.readContentRangeClipped(nextDoc, *opts.ContentRange); err != nil {
+				return nil, err
+			}
+		} else if opts.Whole {
 			fileMatch.Content = cp.data(false)
 		}
 
@@ -326,6 +515,10 @@ nextFileMatch:
 		res.Stats.FileCount++
 	}
 	SortFilesByScore(res.Files)
+	if len(res.Files) > 0 {
+		res.Stats.ShardsWithMatches++
+		res.IndexFormatVersions = map[int]int{d.metaData.IndexFormatVersion: 1}
+	}
 
 	for _, md := range d.repoMetaData {
 		r := md
@@ -343,6 +536,72 @@ nextFileMatch:
 	return &res, nil
 }
 
+// fileNameOnly rewrites q so that it can be evaluated against file names
+// alone. Text atoms only match file names, and atoms that depend on the
+// content match nothing.
+func fileNameOnly(q query.Q) query.Q {
+	switch s := q.(type) {
+	case *query.Substring:
+		f := *s
+		f.FileName = true
+		f.Content = false
+		return &f
+	case *query.Regexp:
+		f := *s
+		f.FileName = true
+		f.Content = false
+		return &f
+	case *compiledSubstring:
+		// The ngrams and bloom probes only depend on the pattern.
+		f := *s
+		f.FileName = true
+		f.Content = false
+		return &f
+	case *query.Symbol, *query.SymbolKind, *query.DiffLine:
+		return &query.Const{Value: false}
+	}
+	return q
+}
+
+// siblings returns up to max names of other documents of the same
+// repository that are in the same directory as docID.
+func (d *indexData) siblings(docID uint32, max int) []string {
+	d.dirDocsOnce.Do(func() {
+		d.dirDocs = map[dirKey][]uint32{}
+		for i := range d.repos {
+			k := dirKey{d.repos[i], path.Dir(string(d.fileName(uint32(i))))}
+			d.dirDocs[k] = append(d.dirDocs[k], uint32(i))
+		}
+	})
+
+	var res []string
+	for _, i := range d.dirDocs[dirKey{d.repos[docID], path.Dir(string(d.fileName(docID)))}] {
+		if len(res) >= max {
+			break
+		}
+		if i != docID {
+			res = append(res, string(d.fileName(i)))
+		}
+	}
+	return res
+}
+
+// addRepoMatchDensity adds an entry for each live repository in the shard
+// to res, with the number of matches in counts, indexed like
+// d.repoMetaData.
+func (d *indexData) addRepoMatchDensity(res *SearchResult, counts []int) {
+	for i, md := range d.repoMetaData {
+		if md.Tombstone {
+			continue
+		}
+		res.RepoMatchDensity = append(res.RepoMatchDensity, RepoMatchDensity{
+			Repository: md.Name,
+			MatchCount: counts[i],
+			Lines:      d.repoListEntry[i].Stats.NewLinesCount,
+		})
+	}
+}
+
 func addRepo(res *SearchResult, repo *Repository) {
 	if res.RepoURLs == nil {
 		res.RepoURLs = map[string]string{}
@@ -435,30 +694,46 @@ func (d *indexData) branchIndex(docID uint32) int {
 	return -1
 }
 
+// scoreDoc adds the scores of fm that don't depend on its matches, and sets
+// its branches.
+func (d *indexData) scoreDoc(fm *FileMatch, docID uint32, mt matchTree, known map[matchTree]bool) {
+	md := &d.repoMetaData[d.repos[docID]]
+
+	// Prefer earlier docs.
+	fm.addScore("doc-order", scoreFileOrderFactor*(1.0-float64(docID)/float64(len(d.boundaries))))
+	fm.addScore("shard-order", scoreShardRankFactor*float64(md.Rank)/maxUInt16)
+	fm.addScore("boost", float64(d.rankBoost(docID)))
+	fm.Branches = d.gatherBranches(docID, mt, known)
+}
+
 // gatherBranches returns a list of branch names.
 func (d *indexData) gatherBranches(docID uint32, mt matchTree, known map[matchTree]bool) []string {
 	foundBranchQuery := false
 	var branches []string
 	repoIdx := d.repos[docID]
+	var queryMask uint64
 	visitMatches(mt, known, func(mt matchTree) {
 		bq, ok := mt.(*branchQueryMatchTree)
 		if ok {
 			foundBranchQuery = true
-			branches = append(branches,
-				d.branchNames[repoIdx][uint(bq.masks[repoIdx])])
+			queryMask |= bq.masks[repoIdx]
 		}
 	})
 
-	if !foundBranchQuery {
-		mask := d.fileBranchMasks[docID]
-		id := uint32(1)
-		for mask != 0 {
-			if mask&0x1 != 0 {
-				branches = append(branches, d.branchNames[repoIdx][uint(id)])
-			}
-			id <<= 1
-			mask >>= 1
+	mask := d.fileBranchMasks[docID]
+	if foundBranchQuery {
+		// Only report the branches the query asked for. A pattern
+		// can match several of them.
+		mask &= queryMask
+	}
+
+	id := uint64(1)
+	for mask != 0 {
+		if mask&0x1 != 0 {
+			branches = append(branches, d.branchNames[repoIdx][id])
 		}
+		id <<= 1
+		mask >>= 1
 	}
 	return branches
 }
@@ -491,11 +766,16 @@ func (d *indexData) List(ctx context.Context, q query.Q, opts *ListOptions) (rl
 			return true, nil
 		}
 	} else {
-		// We need to run a search per repo to decide if it is included.
+		// We need to run a search per repo to decide if it is included,
+		// unless its RawConfig decides.
 		include = func(rle *RepoListEntry) (bool, error) {
+			qRepo := simplifyForRepo(q, &rle.Repository)
+			if c, ok := qRepo.(*query.Const); ok {
+				return c.Value, nil
+			}
 			qOneRepo := query.NewAnd(
 				query.NewRepoSet(rle.Repository.Name),
-				q)
+				qRepo)
 			sr, err := d.Search(ctx, qOneRepo, &SearchOptions{
 				ShardMaxMatchCount: 1,
 				TotalMaxMatchCount: 1,
@@ -516,11 +796,34 @@ func (d *indexData) List(ctx context.Context, q query.Q, opts *ListOptions) (rl
 		l.Repos = make([]*RepoListEntry, 0, len(d.repoListEntry))
 	}
 
+	var languages []map[string]LanguageStats
+	if opts != nil && opts.Languages && !minimal {
+		languages = d.languageStats()
+	}
+
+	var fileBytes []int64
+	if opts != nil && opts.IncludeIndexBytes && !minimal {
+		if fileBytes, err = d.indexFileBytes(); err != nil {
+			return nil, err
+		}
+	}
+
 	for i := range d.repoListEntry {
 		if d.repoMetaData[i].Tombstone {
 			continue
 		}
 		rle := &d.repoListEntry[i]
+		if languages != nil || fileBytes != nil {
+			// Don't modify the shared entry.
+			cp := *rle
+			if languages != nil {
+				cp.Stats.Languages = languages[i]
+			}
+			if fileBytes != nil {
+				cp.Stats.IndexFileBytes = fileBytes[i]
+			}
+			rle = &cp
+		}
 		ok, err := include(rle)
 		if err != nil {
 			return nil, err
@@ -543,13 +846,50 @@ func (d *indexData) List(ctx context.Context, q query.Q, opts *ListOptions) (rl
 	return &l, nil
 }
 
+// indexFileBytes splits the size of the index file among the repositories
+// in the shard, the way calculateStats splits memoryUse.
+func (d *indexData) indexFileBytes() ([]int64, error) {
+	sz, err := d.file.Size()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]int64, len(d.repoMetaData))
+	if len(res) == 0 {
+		return res, nil
+	}
+	chunk := int64(sz) / int64(len(res))
+	for i := range res {
+		res[i] = chunk
+	}
+	res[0] += int64(sz) - chunk*int64(len(res))
+	return res, nil
+}
+
+// languageStats returns the breakdown of documents by language for each
+// repository in the shard.
+func (d *indexData) languageStats() []map[string]LanguageStats {
+	res := make([]map[string]LanguageStats, len(d.repoMetaData))
+	for docID := range d.languages {
+		repo := d.repos[docID]
+		if res[repo] == nil {
+			res[repo] = map[string]LanguageStats{}
+		}
+		lang := d.languageMap[d.languages[docID]]
+		ls := res[repo][lang]
+		ls.Documents++
+		ls.ContentBytes += int64(d.boundaries[docID+1] - d.boundaries[docID])
+		res[repo][lang] = ls
+	}
+	return res
+}
+
 // regexpToMatchTreeRecursive converts a regular expression to a matchTree mt. If
 // mt is equivalent to the input r, isEqual = true and the matchTree can be used
 // in place of the regex r. If singleLine = true, then the matchTree and all
 // its children only match terms on the same line. singleLine is used during
 // recursion to decide whether to return an andLineMatchTree (singleLine = true)
 // or a andMatchTree (singleLine = false).
-func (d *indexData) regexpToMatchTreeRecursive(r *syntax.Regexp, minTextSize int, fileName bool, caseSensitive bool) (mt matchTree, isEqual bool, singleLine bool, err error) {
+func (d *indexData) regexpToMatchTreeRecursive(r *syntax.Regexp, minTextSize int, fileName bool, caseSensitive bool, opt matchTreeOpt) (mt matchTree, isEqual bool, singleLine bool, err error) {
 	// TODO - we could perhaps transform Begin/EndText in '\n'?
 	// TODO - we could perhaps transform CharClass in (OrQuery )
 	// if there are just a few runes, and part of a OpConcat?
@@ -557,21 +897,21 @@ func (d *indexData) regexpToMatchTreeRecursive(r *syntax.Regexp, minTextSize int
 	case syntax.OpLiteral:
 		s := string(r.Rune)
 		if len(s) >= minTextSize {
-			mt, err := d.newSubstringMatchTree(&query.Substring{Pattern: s, FileName: fileName, CaseSensitive: caseSensitive})
+			mt, err := d.newSubstringMatchTree(&query.Substring{Pattern: s, FileName: fileName, CaseSensitive: caseSensitive}, opt)
 			return mt, true, !strings.Contains(s, "\n"), err
 		}
 	case syntax.OpCapture:
-		return d.regexpToMatchTreeRecursive(r.Sub[0], minTextSize, fileName, caseSensitive)
+		return d.regexpToMatchTreeRecursive(r.Sub[0], minTextSize, fileName, caseSensitive, opt)
 
 	case syntax.OpPlus:
-		return d.regexpToMatchTreeRecursive(r.Sub[0], minTextSize, fileName, caseSensitive)
+		return d.regexpToMatchTreeRecursive(r.Sub[0], minTextSize, fileName, caseSensitive, opt)
 
 	case syntax.OpRepeat:
 		if r.Min == 1 {
-			return d.regexpToMatchTreeRecursive(r.Sub[0], minTextSize, fileName, caseSensitive)
+			return d.regexpToMatchTreeRecursive(r.Sub[0], minTextSize, fileName, caseSensitive, opt)
 		} else if r.Min > 1 {
 			// (x){2,} can't be expressed precisely by the matchTree
-			mt, _, singleLine, err := d.regexpToMatchTreeRecursive(r.Sub[0], minTextSize, fileName, caseSensitive)
+			mt, _, singleLine, err := d.regexpToMatchTreeRecursive(r.Sub[0], minTextSize, fileName, caseSensitive, opt)
 			return mt, false, singleLine, err
 		}
 	case syntax.OpConcat, syntax.OpAlternate:
@@ -579,7 +919,7 @@ func (d *indexData) regexpToMatchTreeRecursive(r *syntax.Regexp, minTextSize int
 		isEq := true
 		singleLine = true
 		for _, sr := range r.Sub {
-			if sq, subIsEq, subSingleLine, err := d.regexpToMatchTreeRecursive(sr, minTextSize, fileName, caseSensitive); sq != nil {
+			if sq, subIsEq, subSingleLine, err := d.regexpToMatchTreeRecursive(sr, minTextSize, fileName, caseSensitive, opt); sq != nil {
 				if err != nil {
 					return nil, false, false, err
 				}
@@ -59,7 +59,7 @@ func substrMT(pattern string) matchTree {
 	d := &indexData{}
 	mt, _ := d.newSubstringMatchTree(&query.Substring{
 		Pattern: pattern,
-	})
+	}, matchTreeOpt{})
 	return mt
 }
 
@@ -118,7 +118,7 @@ func TestRegexpParse(t *testing.T) {
 		q := query.Regexp{
 			Regexp: r,
 		}
-		gotQuery, isEq, _, _ := d.regexpToMatchTreeRecursive(q.Regexp, 3, q.FileName, q.CaseSensitive)
+		gotQuery, isEq, _, _ := d.regexpToMatchTreeRecursive(q.Regexp, 3, q.FileName, q.CaseSensitive, matchTreeOpt{})
 		if !reflect.DeepEqual(c.query, gotQuery) {
 			printRegexp(t, r, 0)
 			t.Errorf("regexpToQuery(%q): got %v, want %v", c.in, gotQuery, c.query)
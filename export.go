@@ -0,0 +1,90 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+)
+
+// exportedDocument is the JSON form of a document written by
+// ExportShardJSON.
+type exportedDocument struct {
+	Repository        string
+	Name              string
+	Content           string
+	Branches          []string
+	SubRepositoryPath string `json:",omitempty"`
+	Language          string
+	Symbols           []exportedSymbol `json:",omitempty"`
+}
+
+// exportedSymbol is a symbol section of an exportedDocument. Start and
+// End are byte offsets into the content.
+type exportedSymbol struct {
+	Start, End uint32
+	Symbol
+}
+
+// ExportShardJSON writes the documents of the shard f to w as JSON, one
+// object per line. It is meant for debugging and for feeding other
+// tools; content that is not valid UTF-8 is not preserved, so the
+// output cannot be turned back into a shard. Documents of tombstoned
+// repositories are left out.
+func ExportShardJSON(f IndexFile, w io.Writer) error {
+	searcher, err := NewSearcher(f)
+	if err != nil {
+		return err
+	}
+	d := searcher.(*indexData)
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for docID := uint32(0); int(docID) < len(d.fileBranchMasks); docID++ {
+		repo := &d.repoMetaData[d.repos[docID]]
+		if repo.Tombstone {
+			continue
+		}
+
+		doc, err := d.readDocument(docID)
+		if err != nil {
+			return err
+		}
+
+		ed := exportedDocument{
+			Repository:        repo.Name,
+			Name:              doc.Name,
+			Content:           string(doc.Content),
+			Branches:          doc.Branches,
+			SubRepositoryPath: doc.SubRepositoryPath,
+			Language:          doc.Language,
+		}
+		for i, sec := range doc.Symbols {
+			sym := exportedSymbol{Start: sec.Start, End: sec.End}
+			if md := doc.SymbolsMetaData[i]; md != nil {
+				sym.Symbol = *md
+			}
+			// Like in search results, the name comes from the content.
+			sym.Sym = string(doc.Content[sec.Start:sec.End])
+			ed.Symbols = append(ed.Symbols, sym)
+		}
+
+		if err := enc.Encode(&ed); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,100 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestExportShardJSON(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "shard.zoekt")
+	b := testIndexBuilder(t, &Repository{
+		Name:     "repo",
+		Branches: []RepositoryBranch{{Name: "main"}, {Name: "dev"}},
+	},
+		Document{
+			Name:            "main.go",
+			Content:         []byte("package main\nfunc hello() {}\n"),
+			Branches:        []string{"main", "dev"},
+			Language:        "Go",
+			Symbols:         []DocumentSection{{18, 23}},
+			SymbolsMetaData: []*Symbol{{Sym: "hello", Kind: "function"}},
+		},
+		Document{
+			Name:     "README",
+			Content:  []byte("hello world"),
+			Branches: []string{"dev"},
+		})
+	if err := builderWriteAll(fn, b); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	inf, err := NewIndexFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inf.Close()
+
+	var buf bytes.Buffer
+	if err := ExportShardJSON(inf, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []exportedDocument
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var doc exportedDocument
+		if err := json.Unmarshal(scanner.Bytes(), &doc); err != nil {
+			t.Fatalf("line %q: %v", scanner.Text(), err)
+		}
+		got = append(got, doc)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []exportedDocument{{
+		Repository: "repo",
+		Name:       "main.go",
+		Content:    "package main\nfunc hello() {}\n",
+		Branches:   []string{"main", "dev"},
+		Language:   "Go",
+		Symbols: []exportedSymbol{{
+			Start:  18,
+			End:    23,
+			Symbol: Symbol{Sym: "hello", Kind: "function"},
+		}},
+	}, {
+		Repository: "repo",
+		Name:       "README",
+		Content:    "hello world",
+		Branches:   []string{"dev"},
+	}}
+	if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("-want, +got:\n%s", d)
+	}
+}
@@ -126,7 +126,7 @@ func (d *indexData) trigramHitIterator(ng ngram, caseSensitive, fileName bool) (
 		}
 
 		sec := d.ngrams.Get(v)
-		blob, err := d.readSectionBlob(sec)
+		blob, err := d.readPostings(sec)
 		if err != nil {
 			return nil, err
 		}
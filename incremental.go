@@ -0,0 +1,150 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"bytes"
+	"sort"
+)
+
+// docNgram is a trigram of a document, with its rune offsets relative to
+// the start of the document.
+type docNgram struct {
+	ngram   ngram
+	offsets []uint32
+}
+
+// previousShard is an older version of the shard being built, whose
+// tokenization AddFileIfChanged reuses for documents that did not change.
+type previousShard struct {
+	d *indexData
+
+	// docs maps repository and file name, separated by a NUL byte, to
+	// document IDs in d.
+	docs map[string]uint32
+
+	// docNgrams holds the trigrams of each document of d. It is filled on
+	// first use, since it takes a pass over all postings.
+	docNgrams [][]docNgram
+}
+
+// SetPreviousShard makes AddFileIfChanged reuse the trigrams of documents
+// in f, typically the shard that the one being built replaces. f must stay
+// open until the last call to AddFileIfChanged.
+func (b *IndexBuilder) SetPreviousShard(f IndexFile) error {
+	searcher, err := NewSearcher(f)
+	if err != nil {
+		return err
+	}
+	d := searcher.(*indexData)
+
+	docs := make(map[string]uint32, len(d.fileBranchMasks))
+	for docID := uint32(0); int(docID) < len(d.fileBranchMasks); docID++ {
+		repo := &d.repoMetaData[d.repos[docID]]
+		if repo.Tombstone {
+			continue
+		}
+		docs[repo.Name+"\x00"+string(d.fileName(docID))] = docID
+	}
+	b.previous = &previousShard{d: d, docs: docs}
+	return nil
+}
+
+// AddFileIfChanged adds doc like Add. If the shard set by SetPreviousShard
+// holds doc with the same checksum and content, its trigrams are copied
+// from there instead of being computed again. The checksum is the one
+// reported in FileMatch.Checksum. It returns true if doc was tokenized.
+func (b *IndexBuilder) AddFileIfChanged(doc Document, checksum []byte) (bool, error) {
+	ngrams, err := b.previousNgrams(&doc, checksum)
+	if err != nil {
+		return false, err
+	}
+	if ngrams == nil {
+		return true, b.Add(doc)
+	}
+	return false, b.add(doc, ngrams)
+}
+
+// previousNgrams returns the trigrams of doc in the previous shard, or nil
+// if doc must be tokenized.
+func (b *IndexBuilder) previousNgrams(doc *Document, checksum []byte) ([]docNgram, error) {
+	p := b.previous
+	if p == nil || len(b.repoList) == 0 || doc.SkipReason != "" || len(p.d.droppedNgrams) > 0 {
+		// Documents lack the ngrams dropped from the previous shard.
+		return nil, nil
+	}
+	docID, ok := p.docs[b.repoList[len(b.repoList)-1].Name+"\x00"+doc.Name]
+	if !ok || !bytes.Equal(p.d.getChecksum(docID), checksum) {
+		return nil, nil
+	}
+
+	// Comparing the content is cheap next to tokenizing it, and protects
+	// against stale or colliding checksums.
+	content, err := p.d.readContents(docID)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(content, doc.Content) {
+		return nil, nil
+	}
+
+	if p.docNgrams == nil {
+		if err := p.loadNgrams(); err != nil {
+			return nil, err
+		}
+	}
+	// A document without trigrams still skips tokenization.
+	if ngrams := p.docNgrams[docID]; ngrams != nil {
+		return ngrams, nil
+	}
+	return []docNgram{}, nil
+}
+
+// loadNgrams fills p.docNgrams from the content postings of p.d.
+func (p *previousShard) loadNgrams() error {
+	d := p.d
+	p.docNgrams = make([][]docNgram, len(d.fileBranchMasks))
+
+	var offsets []uint32
+	// Only the keys of DumpMap are exact; look up sections with Get.
+	for ng := range d.ngrams.DumpMap() {
+		blob, err := d.readSectionBlob(d.ngrams.Get(ng))
+		if err != nil {
+			return err
+		}
+		offsets = fromDeltas(blob, offsets[:0])
+
+		for len(offsets) > 0 {
+			// Documents are contiguous runs of runes, ending at
+			// fileEndRunes.
+			docID := uint32(sort.Search(len(d.fileEndRunes), func(i int) bool {
+				return d.fileEndRunes[i] > offsets[0]
+			}))
+			start := uint32(0)
+			if docID > 0 {
+				start = d.fileEndRunes[docID-1]
+			}
+			end := d.fileEndRunes[docID]
+
+			dn := docNgram{ngram: ng}
+			for len(offsets) > 0 && offsets[0] < end {
+				dn.offsets = append(dn.offsets, offsets[0]-start)
+				offsets = offsets[1:]
+			}
+			p.docNgrams[docID] = append(p.docNgrams[docID], dn)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"bytes"
+	"hash/crc64"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAddFileIfChanged(t *testing.T) {
+	repo := &Repository{Name: "repo", Branches: []RepositoryBranch{{Name: "main", Version: "v1"}}}
+	newBuilder := func() *IndexBuilder {
+		b, err := NewIndexBuilder(repo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.IndexTime = time.Unix(1, 0)
+		b.ID = "test"
+		return b
+	}
+	checksum := func(content []byte) []byte {
+		h := crc64.New(crc64.MakeTable(crc64.ISO))
+		h.Write(content)
+		return h.Sum(nil)
+	}
+
+	old := []Document{
+		{Name: "f1", Content: []byte("hello world, hello zoekt"), Branches: []string{"main"}},
+		{Name: "f2", Content: []byte("needle in a haystack"), Branches: []string{"main"}},
+		{Name: "f3", Content: []byte("héllo wörld ünicode"), Branches: []string{"main"},
+			Symbols: []DocumentSection{{0, 6}}},
+		{Name: "f4", Content: []byte("ab"), Branches: []string{"main"}},
+	}
+	fn := filepath.Join(t.TempDir(), "old.zoekt")
+	b := newBuilder()
+	for _, doc := range old {
+		if err := b.Add(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := builderWriteAll(fn, b); err != nil {
+		t.Fatal(err)
+	}
+
+	docs := []Document{
+		old[0],
+		{Name: "f2", Content: []byte("needle in a stack"), Branches: []string{"main"}},
+		old[2],
+		old[3],
+		{Name: "f5", Content: []byte("brand new file"), Branches: []string{"main"}},
+	}
+	wantTokenized := []bool{false, true, false, false, true}
+
+	f, err := os.Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	inf, err := NewIndexFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inf.Close()
+
+	incremental, fresh := newBuilder(), newBuilder()
+	if err := incremental.SetPreviousShard(inf); err != nil {
+		t.Fatal(err)
+	}
+	for i, doc := range docs {
+		tokenized, err := incremental.AddFileIfChanged(doc, checksum(doc.Content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tokenized != wantTokenized[i] {
+			t.Errorf("%s: got tokenized %v, want %v", doc.Name, tokenized, wantTokenized[i])
+		}
+		if err := fresh.Add(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A stale checksum forces tokenizing.
+	stale := newBuilder()
+	if err := stale.SetPreviousShard(inf); err != nil {
+		t.Fatal(err)
+	}
+	if tokenized, err := stale.AddFileIfChanged(old[0], checksum([]byte("other"))); err != nil || !tokenized {
+		t.Errorf("got %v, %v for stale checksum, want tokenized", tokenized, err)
+	}
+
+	var got, want bytes.Buffer
+	if err := incremental.Write(&got); err != nil {
+		t.Fatal(err)
+	}
+	if err := fresh.Write(&want); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), want.Bytes()) {
+		t.Errorf("incremental shard differs from a fresh build")
+	}
+}
@@ -18,12 +18,15 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"hash/crc64"
 	"os"
 	"reflect"
 	"regexp/syntax"
+	"sort"
 	"strings"
 	"testing"
 
+	"github.com/RoaringBitmap/roaring"
 	"github.com/kylelemons/godebug/pretty"
 
 	"github.com/google/go-cmp/cmp"
@@ -36,6 +39,7 @@ func clearScores(r *SearchResult) {
 		r.Files[i].Score = 0.0
 		for j := range r.Files[i].LineMatches {
 			r.Files[i].LineMatches[j].Score = 0.0
+			r.Files[i].LineMatches[j].FileScore = 0.0
 		}
 		r.Files[i].Checksum = nil
 		r.Files[i].Debug = ""
@@ -302,6 +306,25 @@ func TestCaseFold(t *testing.T) {
 	}
 }
 
+func TestCaseSensitiveSubstring(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte("FooBar foobar")},
+		// ---------- 0123456789012
+	)
+	sres := searchForTest(t, b, &query.Substring{
+		Pattern:       "FooBar",
+		CaseSensitive: true,
+		Content:       true,
+	})
+	if len(sres.Files) != 1 || len(sres.Files[0].LineMatches) != 1 {
+		t.Fatalf("got %v, want 1 line match", sres.Files)
+	}
+	frags := sres.Files[0].LineMatches[0].LineFragments
+	if len(frags) != 1 || frags[0].Offset != 0 {
+		t.Errorf("got fragments %+v, want 1 at offset 0", frags)
+	}
+}
+
 func TestAndSearch(t *testing.T) {
 	b, err := NewIndexBuilder(nil)
 	if err != nil {
@@ -338,6 +361,9 @@ func TestAndSearch(t *testing.T) {
 		FileCount:          1,
 		FilesConsidered:    2,
 		ShardsScanned:      1,
+		ShardsWithMatches:  1,
+		BloomAdmitted:      2, // banana and apple in content
+		BloomRejected:      2, // banana and apple in file names
 	}
 	if diff := pretty.Compare(wantStats, sres.Stats); diff != "" {
 		t.Errorf("got stats diff %s", diff)
@@ -774,6 +800,169 @@ func TestBranchVersions(t *testing.T) {
 	}
 }
 
+func TestBranchMembership(t *testing.T) {
+	// More branches than fit in 32 bits, not in sorted order.
+	r := &Repository{Name: "repo"}
+	for i := 39; i >= 0; i-- {
+		name := fmt.Sprintf("b%02d", i)
+		r.Branches = append(r.Branches, RepositoryBranch{Name: name, Version: "v-" + name})
+	}
+	var all []string
+	for _, br := range r.Branches {
+		all = append(all, br.Name)
+	}
+
+	docs := []Document{
+		{Name: "all", Content: []byte("needle"), Branches: all},
+		{Name: "low", Content: []byte("needle"), Branches: []string{"b01", "b00"}},
+		{Name: "high", Content: []byte("needle"), Branches: []string{"b00", "b39", "b33"}},
+		{Name: "one", Content: []byte("needle"), Branches: []string{"b20"}},
+	}
+	b := testIndexBuilder(t, r, docs...)
+
+	// Branches are reported in the order of Repository.Branches.
+	wantBranches := map[string][]string{
+		"all":  all,
+		"low":  {"b01", "b00"},
+		"high": {"b39", "b33", "b00"},
+		"one":  {"b20"},
+	}
+	sres := searchForTest(t, b, &query.Substring{Pattern: "needle"})
+	if len(sres.Files) != len(docs) {
+		t.Fatalf("got %d files, want %d", len(sres.Files), len(docs))
+	}
+	for _, f := range sres.Files {
+		if d := cmp.Diff(wantBranches[f.FileName], f.Branches); d != "" {
+			t.Errorf("%s: branches mismatch (-want +got):\n%s", f.FileName, d)
+		}
+	}
+
+	for branch, want := range map[string][]string{
+		"b00": {"all", "high", "low"},
+		"b01": {"all", "low"},
+		"b20": {"all", "one"},
+		"b33": {"all", "high"},
+		"b39": {"all", "high"},
+		"b10": {"all"},
+	} {
+		sres := searchForTest(t, b, query.NewAnd(
+			&query.Substring{Pattern: "needle"},
+			&query.Branch{Pattern: branch, Exact: true}))
+		var got []string
+		for _, f := range sres.Files {
+			got = append(got, f.FileName)
+			if len(f.Branches) != 1 || f.Branches[0] != branch {
+				t.Errorf("%s: %s has branches %v, want [%s]", branch, f.FileName, f.Branches, branch)
+			}
+		}
+		sort.Strings(got)
+		if d := cmp.Diff(want, got); d != "" {
+			t.Errorf("%s: files mismatch (-want +got):\n%s", branch, d)
+		}
+	}
+}
+
+func TestBranchGlob(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{
+		Branches: []RepositoryBranch{
+			{"main", "v-main"},
+			{"release-1", "v-release-1"},
+			{"release-2", "v-release-2"},
+			{"dev", "v-dev"},
+			{"release/3/hotfix", "v-release-3"},
+		},
+	},
+		Document{Name: "f1", Content: []byte("needle"), Branches: []string{"main", "release-1"}},
+		Document{Name: "f2", Content: []byte("needle"), Branches: []string{"release-1", "release-2"}},
+		Document{Name: "f3", Content: []byte("needle"), Branches: []string{"dev"}},
+		Document{Name: "f4", Content: []byte("needle"), Branches: []string{"release/3/hotfix"}})
+
+	for _, tc := range []struct {
+		branch string
+		want   map[string][]string
+	}{
+		{"release-*", map[string][]string{"f1": {"release-1"}, "f2": {"release-1", "release-2"}}},
+		{"*-2", map[string][]string{"f2": {"release-2"}}},
+		{"release", map[string][]string{"f1": {"release-1"}, "f2": {"release-1", "release-2"}, "f4": {"release/3/hotfix"}}},
+		{"dev", map[string][]string{"f3": {"dev"}}},
+		{"dev*", map[string][]string{"f3": {"dev"}}},
+		{"*dev-*", map[string][]string{}},
+		{"release/*", map[string][]string{"f4": {"release/3/hotfix"}}},
+		{"release*fix", map[string][]string{"f4": {"release/3/hotfix"}}},
+		{"rel*se*1", map[string][]string{"f1": {"release-1"}, "f2": {"release-1"}}},
+	} {
+		sres := searchForTest(t, b, query.NewAnd(
+			&query.Substring{Pattern: "needle"},
+			&query.Branch{Pattern: tc.branch}))
+		got := map[string][]string{}
+		for _, f := range sres.Files {
+			got[f.FileName] = f.Branches
+		}
+		if d := cmp.Diff(tc.want, got); d != "" {
+			t.Errorf("%s: mismatch (-want +got):\n%s", tc.branch, d)
+		}
+	}
+}
+
+func TestMaxPostingEntries(t *testing.T) {
+	for _, spill := range []bool{false, true} {
+		t.Run(fmt.Sprintf("spill=%v", spill), func(t *testing.T) {
+			b := testIndexBuilder(t, nil)
+			b.MaxPostingEntries = 10
+			if spill {
+				b.SpillDir = t.TempDir()
+				b.SpillThreshold = 1
+			}
+			for _, doc := range []Document{
+				{Name: "f1", Content: []byte("x" + strings.Repeat("a", 100) + "y")},
+				{Name: "f2", Content: []byte("some aaa text")},
+				{Name: "f3", Content: []byte("no match here")},
+			} {
+				if err := b.Add(doc); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			d := searcherForTest(t, b).(*indexData)
+			aaa := stringToNGram("aaa")
+			if _, ok := d.droppedNgrams[aaa]; !ok || len(d.droppedNgrams) != 1 {
+				t.Fatalf("got dropped ngrams %v, want only %s", d.droppedNgrams, aaa)
+			}
+			if sz := d.ngrams.Get(aaa).sz; sz != 0 {
+				t.Fatalf("got %d bytes of postings for %s, want none", sz, aaa)
+			}
+			// Readers that don't know about dropped ngrams must refuse
+			// the shard.
+			if got := d.metaData.IndexMinReaderVersion; got != droppedNgramsMinReaderVersion {
+				t.Errorf("got IndexMinReaderVersion %d, want %d", got, droppedNgramsMinReaderVersion)
+			}
+
+			for pat, want := range map[string][]string{
+				"aaaa":  {"f1"},
+				"xaaa":  {"f1"},
+				"AAAY":  {"f1"},
+				"aaa":   {"f1", "f2"},
+				"e aaa": {"f2"},
+				"aaab":  nil,
+				"match": {"f3"},
+			} {
+				res, err := d.Search(context.Background(), &query.Substring{Pattern: pat, Content: true}, &SearchOptions{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				var got []string
+				for _, f := range res.Files {
+					got = append(got, f.FileName)
+				}
+				sort.Strings(got)
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("%q: got %v, want %v", pat, got, want)
+				}
+			}
+		})
+	}
+}
+
 func mustParseRE(s string) *syntax.Regexp {
 	r, err := syntax.Parse(s, 0)
 	if err != nil {
@@ -1023,6 +1212,94 @@ func TestSymbolRank(t *testing.T) {
 	}
 }
 
+func TestSymbolsOnly(t *testing.T) {
+	var content []byte
+	var symbols []DocumentSection
+	addLine := func(line, sym string) {
+		if sym != "" {
+			start := len(content) + strings.Index(line, sym)
+			symbols = append(symbols, DocumentSection{Start: uint32(start), End: uint32(start + len(sym))})
+		}
+		content = append(content, line+"\n"...)
+	}
+	addLine("package config", "")
+	addLine("", "")
+	addLine("func parseConfig(data []byte) (*Config, error) {", "parseConfig")
+	for i := 0; i < 100; i++ {
+		addLine(fmt.Sprintf("\tif err := check(data, %d); err != nil { return nil, err }", i), "")
+	}
+	addLine("}", "")
+	addLine("type Config struct{}", "Config")
+
+	build := func(symbolsOnly bool) *IndexBuilder {
+		b, err := NewIndexBuilder(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.SymbolsOnly = symbolsOnly
+		if err := b.Add(Document{Name: "config.go", Content: content, Symbols: symbols}); err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	b := build(true)
+
+	res := searchForTest(t, b, &query.Symbol{Expr: &query.Substring{Pattern: "parseConfig"}})
+	if len(res.Files) != 1 || len(res.Files[0].LineMatches) != 1 {
+		t.Fatalf("got %v, want one symbol match", res.Files)
+	}
+	if got := res.Files[0].LineMatches[0].LineNumber; got != 3 {
+		t.Errorf("got line %d, want line 3", got)
+	}
+
+	res = searchForTest(t, b, &query.Symbol{Expr: &query.Substring{Pattern: "Config", CaseSensitive: true}})
+	var lines []int
+	for _, m := range res.Files[0].LineMatches {
+		lines = append(lines, m.LineNumber)
+	}
+	sort.Ints(lines)
+	if want := []int{3, 105}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("got lines %v, want %v", lines, want)
+	}
+
+	for _, q := range []query.Q{
+		&query.Substring{Pattern: "return nil"},
+		&query.Substring{Pattern: "parseConfig"},
+		&query.Substring{Pattern: "config.go", Content: true},
+		&query.Regexp{Regexp: mustParseRE("check.*err")},
+		CompileQuery(&query.Substring{Pattern: "return nil"}),
+	} {
+		if res := searchForTest(t, b, q); len(res.Files) != 0 {
+			t.Errorf("%s: got %v, want no content matches", q, res.Files)
+		}
+	}
+
+	// Queries that also search file names still match those, and symbols
+	// next to them are still searched.
+	for _, q := range []query.Q{
+		&query.Substring{Pattern: "config.go", FileName: true},
+		&query.Substring{Pattern: "config.go"},
+		&query.Regexp{Regexp: mustParseRE(`fig\.go`)},
+		query.NewAnd(&query.Substring{Pattern: "config"}, &query.Symbol{Expr: &query.Substring{Pattern: "parseConfig"}}),
+		CompileQuery(&query.Substring{Pattern: "config.go"}),
+	} {
+		if res := searchForTest(t, b, q); len(res.Files) != 1 {
+			t.Errorf("%s: got %d files, want 1", q, len(res.Files))
+		}
+	}
+
+	var full, reduced bytes.Buffer
+	if err := build(false).Write(&full); err != nil {
+		t.Fatal(err)
+	}
+	if err := build(true).Write(&reduced); err != nil {
+		t.Fatal(err)
+	}
+	if reduced.Len()*2 > full.Len() {
+		t.Errorf("symbols only shard has %d bytes, want less than half of %d", reduced.Len(), full.Len())
+	}
+}
+
 func TestSymbolRankRegexpUTF8(t *testing.T) {
 	t.Skip()
 
@@ -1765,6 +2042,187 @@ func TestLangShortcut(t *testing.T) {
 	}
 }
 
+func TestNegatedLanguage(t *testing.T) {
+	content := []byte("bla needle bla")
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{Name: "main.go", Language: "Go", Content: content},
+		Document{Name: "main.py", Language: "Python", Content: content},
+	)
+
+	for _, q := range []query.Q{
+		query.NewAnd(&query.Substring{Pattern: "needle"}, &query.Not{Child: &query.Language{Language: "Go"}}),
+		&query.Not{Child: &query.Language{Language: "Go"}},
+	} {
+		res := searchForTest(t, b, q)
+		if len(res.Files) != 1 || res.Files[0].FileName != "main.py" {
+			t.Errorf("%s: got %v, want main.py", q, res.Files)
+		}
+	}
+
+	q, err := query.Parse("-lang:Go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := searchForTest(t, b, q)
+	if len(res.Files) != 1 || res.Files[0].FileName != "main.py" {
+		t.Errorf("%s: got %v, want main.py", q, res.Files)
+	}
+
+	d := searcherForTest(t, b).(*indexData)
+	mt, err := d.newMatchTree(&query.Not{Child: &query.Language{Language: "Go"}}, matchTreeOpt{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := mt.(*docMatchTree); !ok {
+		t.Errorf("got match tree %s, want a document predicate", mt)
+	}
+
+	// A language absent from the shard excludes nothing.
+	res = searchForTest(t, b, &query.Not{Child: &query.Language{Language: "Rust"}})
+	if len(res.Files) != 2 {
+		t.Errorf("got %v, want 2 files", res.Files)
+	}
+}
+
+func TestLanguageSet(t *testing.T) {
+	content := []byte("bla needle bla")
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{Name: "main.go", Language: "Go", Content: content},
+		Document{Name: "main.py", Language: "Python", Content: content},
+		Document{Name: "main.rs", Language: "Rust", Content: content},
+	)
+
+	q := query.NewAnd(&query.Substring{Pattern: "needle"}, query.NewLanguageSet("Go", "Rust"))
+	res := searchForTest(t, b, q)
+	var names []string
+	for _, f := range res.Files {
+		names = append(names, f.FileName)
+	}
+	sort.Strings(names)
+	if got := strings.Join(names, " "); got != "main.go main.rs" {
+		t.Errorf("got %s, want main.go main.rs", got)
+	}
+
+	q = query.NewAnd(&query.Substring{Pattern: "needle"}, query.NewLanguageSet("fortran", "cobol"))
+	res = searchForTest(t, b, q)
+	if len(res.Files) != 0 {
+		t.Errorf("got %v, want 0 results", res.Files)
+	}
+	if res.Stats.IndexBytesLoaded > 0 {
+		t.Errorf("got IndexBytesLoaded %d, want 0", res.Stats.IndexBytesLoaded)
+	}
+}
+
+func TestIncludeSymbols(t *testing.T) {
+	content := []byte("package x\nfunc needle() {}\nvar _ = needle\n")
+	// ----------------0123456789 0123456789012
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{
+			Name:            "x.go",
+			Content:         content,
+			Symbols:         []DocumentSection{{15, 21}},
+			SymbolsMetaData: []*Symbol{{Kind: "function"}},
+		})
+	q := &query.Substring{Pattern: "needle", Content: true}
+
+	symbols := func(res *SearchResult) map[int]*Symbol {
+		got := map[int]*Symbol{}
+		for _, f := range res.Files {
+			for _, lm := range f.LineMatches {
+				for _, fr := range lm.LineFragments {
+					got[lm.LineNumber] = fr.SymbolInfo
+				}
+			}
+		}
+		return got
+	}
+
+	got := symbols(searchForTest(t, b, q, SearchOptions{IncludeSymbols: true}))
+	want := map[int]*Symbol{2: {Sym: "needle", Kind: "function"}, 3: nil}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("with IncludeSymbols: got %v, want %v", got, want)
+	}
+
+	got = symbols(searchForTest(t, b, q))
+	want = map[int]*Symbol{2: nil, 3: nil}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("without IncludeSymbols: got %v, want %v", got, want)
+	}
+
+	// OmitSymbolInfo also drops the information of symbol queries.
+	symQ := &query.Symbol{Expr: &query.Substring{Pattern: "needle"}}
+	got = symbols(searchForTest(t, b, symQ))
+	want = map[int]*Symbol{2: {Sym: "needle", Kind: "function"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("symbol query: got %v, want %v", got, want)
+	}
+	for _, tc := range []struct {
+		q    query.Q
+		want map[int]*Symbol
+	}{
+		{symQ, map[int]*Symbol{2: nil}},
+		{q, map[int]*Symbol{2: nil, 3: nil}},
+	} {
+		got = symbols(searchForTest(t, b, tc.q, SearchOptions{IncludeSymbols: true, OmitSymbolInfo: true}))
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s with OmitSymbolInfo: got %v, want %v", tc.q, got, tc.want)
+		}
+	}
+}
+
+func TestSymbolKind(t *testing.T) {
+	content := []byte("package x\nfunc needle() {}\nvar haystack = 1\n")
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{
+			Name:            "x.go",
+			Content:         content,
+			Symbols:         []DocumentSection{{15, 21}, {31, 39}},
+			SymbolsMetaData: []*Symbol{{Kind: "function"}, {Kind: "variable"}},
+		},
+		Document{Name: "y.go", Content: []byte("package y\n")})
+
+	res := searchForTest(t, b, &query.SymbolKind{Kinds: []string{"function"}})
+	if len(res.Files) != 1 || len(res.Files[0].LineMatches) != 1 {
+		t.Fatalf("got %v, want 1 line match", res.Files)
+	}
+	lm := res.Files[0].LineMatches[0]
+	if got := string(lm.Line); got != "func needle() {}" {
+		t.Errorf("got line %q, want the function", got)
+	}
+	if fr := lm.LineFragments[0]; fr.MatchLength != len("needle") {
+		t.Errorf("got fragment %+v, want a match of needle", fr)
+	}
+
+	res = searchForTest(t, b, &query.SymbolKind{Kinds: []string{"function", "variable"}})
+	if len(res.Files) != 1 || len(res.Files[0].LineMatches) != 2 {
+		t.Fatalf("got %v, want 2 line matches", res.Files)
+	}
+
+	res = searchForTest(t, b, &query.SymbolKind{Kinds: []string{"class"}})
+	if len(res.Files) != 0 {
+		t.Errorf("got %v, want no matches", res.Files)
+	}
+
+	// Kinds constrain the symbol that matches the expression, not just
+	// any symbol of the file.
+	for _, expr := range []query.Q{
+		&query.Substring{Pattern: "haystack"},
+		&query.Regexp{Regexp: mustParseRE("hay.*")},
+	} {
+		res = searchForTest(t, b, &query.Symbol{Expr: expr, Kinds: []string{"function"}})
+		if len(res.Files) != 0 {
+			t.Errorf("%s: got %v, want no matches", expr, res.Files)
+		}
+		res = searchForTest(t, b, &query.Symbol{Expr: expr, Kinds: []string{"variable"}})
+		if len(res.Files) != 1 || len(res.Files[0].LineMatches) != 1 {
+			t.Fatalf("%s: got %v, want 1 line match", expr, res.Files)
+		}
+		if got := string(res.Files[0].LineMatches[0].Line); got != "var haystack = 1" {
+			t.Errorf("%s: got line %q, want the variable", expr, got)
+		}
+	}
+}
+
 func TestNoTextMatchAtoms(t *testing.T) {
 	content := []byte("bla needle bla")
 	b := testIndexBuilder(t, &Repository{Name: "reponame"},
@@ -2090,6 +2548,50 @@ func TestSkipInvalidContent(t *testing.T) {
 	}
 }
 
+func TestSkipReason(t *testing.T) {
+	big := bytes.Repeat([]byte("needle haystack\n"), 2<<20/16)
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{Name: "big.txt", Content: big, SkipReason: "too large"},
+		Document{Name: "small.txt", Content: []byte("needle")},
+		Document{Name: "marker.txt", Content: []byte("NOT-INDEXED: a file about skipping")})
+
+	res := searchForTest(t, b, &query.Substring{Pattern: "big.txt"})
+	if len(res.Files) != 1 {
+		t.Fatalf("got %v, want 1 file", res.Files)
+	}
+	f := res.Files[0]
+	if f.SkipReason != "too large" {
+		t.Errorf("got SkipReason %q, want %q", f.SkipReason, "too large")
+	}
+
+	// The reason is reported by the searches that skip line matches too.
+	for _, opts := range []SearchOptions{{FileMatchesOnly: true}, {FileNameOnly: true}, {MaxFilePaths: 10}} {
+		res := searchForTest(t, b, &query.Substring{Pattern: "big.txt"}, opts)
+		if len(res.Files) != 1 || res.Files[0].SkipReason != "too large" {
+			t.Errorf("%+v: got %v, want big.txt skipped as too large", opts, res.Files)
+		}
+	}
+
+	// Content that looks like a skipped file's is still indexed content.
+	res = searchForTest(t, b, &query.Substring{Pattern: "skipping", Content: true})
+	if len(res.Files) != 1 || res.Files[0].SkipReason != "" {
+		t.Errorf("got %v, want marker.txt without SkipReason", res.Files)
+	}
+	for _, lm := range f.LineMatches {
+		if !lm.FileName {
+			t.Errorf("got content line match %v, want only file name matches", lm)
+		}
+	}
+
+	res = searchForTest(t, b, &query.Substring{Pattern: "needle", Content: true})
+	if len(res.Files) != 1 || res.Files[0].FileName != "small.txt" {
+		t.Fatalf("got %v, want only small.txt", res.Files)
+	}
+	if res.Files[0].SkipReason != "" {
+		t.Errorf("got SkipReason %q for indexed file", res.Files[0].SkipReason)
+	}
+}
+
 func TestCheckText(t *testing.T) {
 	for _, text := range []string{"", "simple ascii", "símplé unicödé", "\uFEFFwith utf8 'bom'", "with \uFFFD unicode replacement char"} {
 		if err := CheckText([]byte(text), 20000); err != nil {
@@ -2218,3 +2720,600 @@ func TestSearchTypeFileName(t *testing.T) {
 		})
 	wantSingleMatch(res, "f2")
 }
+
+func TestDiffLine(t *testing.T) {
+	diff := "--- a/main.go\n+++ b/main.go\n@@ -1,3 +1,3 @@\n needle context\n-needle removed\n+needle added\n"
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{Name: "change.diff", Content: []byte(diff)},
+		Document{Name: "main.go", Content: []byte("needle plain\n+needle plus\n")},
+	)
+
+	for _, tc := range []struct {
+		kind uint8
+		want []string
+	}{
+		{query.DiffLineAdded, []string{"change.diff:+needle added", "main.go:needle plain", "main.go:+needle plus"}},
+		{query.DiffLineRemoved, []string{"change.diff:-needle removed", "main.go:needle plain", "main.go:+needle plus"}},
+	} {
+		q := &query.DiffLine{
+			Kind:  tc.kind,
+			Child: &query.Substring{Pattern: "needle", Content: true},
+		}
+		res := searchForTest(t, b, q)
+
+		var got []string
+		for _, f := range res.Files {
+			for _, l := range f.LineMatches {
+				got = append(got, f.FileName+":"+string(l.Line))
+			}
+		}
+		sort.Strings(got)
+		sort.Strings(tc.want)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %q, want %q", q, got, tc.want)
+		}
+	}
+
+	// The changed lines are recorded at index time.
+	d := searcherForTest(t, b).(*indexData)
+	if got, want := d.diffLines(0, nil), []uint32{2*4 + 1, 2 * 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got diff lines %v, want %v", got, want)
+	}
+	if d.isDiff(1) {
+		t.Errorf("main.go is a diff")
+	}
+}
+
+func TestLineScores(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{Name: "f1", Content: []byte("xneedlex\nthe needle\nneedles")})
+
+	searcher := searcherForTest(t, b)
+	for _, lineScores := range []bool{false, true} {
+		res, err := searcher.Search(context.Background(),
+			&query.Substring{Pattern: "needle", Content: true},
+			&SearchOptions{LineScores: lineScores})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Files) != 1 || len(res.Files[0].LineMatches) != 3 {
+			t.Fatalf("got %v, want 1 file with 3 lines", res.Files)
+		}
+
+		f := res.Files[0]
+		var sum float64
+		for _, l := range f.LineMatches {
+			sum += l.FileScore
+		}
+
+		want := 0.0
+		if lineScores {
+			want = scoreWordMatch
+			if got := string(f.LineMatches[0].Line); got != "the needle" {
+				t.Errorf("got best line %q, want %q", got, "the needle")
+			}
+		}
+		if sum != want {
+			t.Errorf("LineScores=%v: got line score sum %f, want %f", lineScores, sum, want)
+		}
+		if sum > f.Score {
+			t.Errorf("line score sum %f exceeds file score %f", sum, f.Score)
+		}
+	}
+}
+
+func TestScoreWeights(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{Name: "a.go", Content: []byte("call needle here")},
+		Document{Name: "needle.txt", Content: []byte("nothing to see")},
+		Document{Name: "c.go", Content: []byte("func needle() {}"), Symbols: []DocumentSection{{5, 11}}})
+	searcher := searcherForTest(t, b)
+
+	q := query.NewOr(
+		&query.Substring{Pattern: "needle", Content: true},
+		&query.Substring{Pattern: "needle", FileName: true})
+	order := func(weights ScoreWeights) []string {
+		t.Helper()
+		res, err := searcher.Search(context.Background(), q, &SearchOptions{Weights: weights})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, f := range res.Files {
+			names = append(names, f.FileName)
+		}
+		return names
+	}
+
+	// Without weights, all files match a whole word, so earlier
+	// documents rank higher.
+	if got, want := order(ScoreWeights{}), []string{"a.go", "needle.txt", "c.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("no weights: got %v, want %v", got, want)
+	}
+	if got, want := order(ScoreWeights{FileNameMatch: 100}), []string{"needle.txt", "a.go", "c.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("FileNameMatch: got %v, want %v", got, want)
+	}
+	if got, want := order(ScoreWeights{SymbolMatch: 100}), []string{"c.go", "a.go", "needle.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SymbolMatch: got %v, want %v", got, want)
+	}
+	if got, want := order(ScoreWeights{WordBoundary: -scoreWordMatch, FileNameMatch: scoreWordMatch}), []string{"needle.txt", "a.go", "c.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("WordBoundary: got %v, want %v", got, want)
+	}
+}
+
+func TestRankBoost(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{Name: "util.go", Content: []byte("needle"), RankBoost: 10},
+		Document{Name: "main.go", Content: []byte("needle"), RankBoost: 100},
+		Document{Name: "other.go", Content: []byte("needle")})
+	res := searchForTest(t, b, &query.Substring{Pattern: "needle"})
+
+	var got []string
+	for _, f := range res.Files {
+		got = append(got, f.FileName)
+	}
+	if want := []string{"main.go", "util.go", "other.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestWholeLine(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{Name: "f1", Content: []byte("x := foo123\nfoo42\nfoo bar\n")},
+		Document{Name: "f2", Content: []byte("call foo7()\n")})
+	q := &query.Regexp{Regexp: mustParseRE("foo[0-9]+"), Content: true}
+
+	res := searchForTest(t, b, q)
+	if len(res.Files) != 2 {
+		t.Fatalf("without WholeLine: got %v, want 2 files", res.Files)
+	}
+
+	res = searchForTest(t, b, q, SearchOptions{WholeLine: true})
+	if len(res.Files) != 1 {
+		t.Fatalf("got %v, want 1 file", res.Files)
+	}
+	var lines []int
+	for _, m := range res.Files[0].LineMatches {
+		lines = append(lines, m.LineNumber)
+	}
+	if want := []int{2}; res.Files[0].FileName != "f1" || !reflect.DeepEqual(lines, want) {
+		t.Errorf("got matches on lines %v of %s, want lines %v of f1", lines, res.Files[0].FileName, want)
+	}
+}
+
+func TestWholeLineAnchored(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{Name: "f1", Content: []byte("ab\nxab\nabc\r\nab\r\nabc")})
+
+	for _, tc := range []struct {
+		q    query.Q
+		want []string
+	}{
+		// The leftmost match "a" of the line "ab" doesn't span it.
+		{&query.Regexp{Regexp: mustParseRE("a|ab"), Content: true}, []string{"1:ab", "4:ab"}},
+		{&query.Regexp{Regexp: mustParseRE("abc?"), Content: true}, []string{"1:ab", "3:abc", "4:ab", "5:abc"}},
+		{&query.Substring{Pattern: "abc", Content: true}, []string{"3:abc", "5:abc"}},
+		{&query.Substring{Pattern: "ab", Content: true}, []string{"1:ab", "4:ab"}},
+	} {
+		res := searchForTest(t, b, tc.q, SearchOptions{WholeLine: true})
+		var got []string
+		for _, f := range res.Files {
+			for _, m := range f.LineMatches {
+				for _, fm := range m.LineFragments {
+					got = append(got, fmt.Sprintf("%d:%s", m.LineNumber, m.Line[fm.LineOffset:fm.LineOffset+fm.MatchLength]))
+				}
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %q, want %q", tc.q, got, tc.want)
+		}
+	}
+}
+
+func TestContextLines(t *testing.T) {
+	content := []byte("needle one\ntwo\nthree\nfour\nneedle five\nsix\n\neight\nneedle nine\n")
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{Name: "f", Content: content})
+	res := searchForTest(t, b, &query.Substring{Pattern: "needle", Content: true}, SearchOptions{ContextLines: 2})
+	if len(res.Files) != 1 {
+		t.Fatalf("got %v, want 1 file", res.Files)
+	}
+
+	type context struct {
+		Line          int
+		Before, After []string
+	}
+	lines := func(cls []ContextLine, first int) []string {
+		var out []string
+		for i, cl := range cls {
+			if cl.LineNumber != first+i {
+				t.Errorf("got line number %d for %q, want %d", cl.LineNumber, cl.Line, first+i)
+			}
+			out = append(out, string(cl.Line))
+		}
+		return out
+	}
+	var got []context
+	for _, m := range res.Files[0].LineMatches {
+		got = append(got, context{
+			Line:   m.LineNumber,
+			Before: lines(m.Before, m.LineNumber-len(m.Before)),
+			After:  lines(m.After, m.LineNumber+1),
+		})
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i].Line < got[j].Line })
+
+	want := []context{
+		{Line: 1, After: []string{"two", "three"}},
+		{Line: 5, Before: []string{"three", "four"}, After: []string{"six", ""}},
+		{Line: 9, Before: []string{"", "eight"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestReverseLineOrder(t *testing.T) {
+	var content []byte
+	for i := 1; i <= 10; i++ {
+		content = append(content, fmt.Sprintf("line %d needle\n", i)...)
+	}
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{Name: "log.txt", Content: content})
+	searcher := searcherForTest(t, b)
+
+	lineNumbers := func(opts *SearchOptions) []int {
+		t.Helper()
+		res, err := searcher.Search(context.Background(), &query.Substring{Pattern: "needle"}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Files) != 1 {
+			t.Fatalf("got %v, want 1 file", res.Files)
+		}
+		var got []int
+		for _, l := range res.Files[0].LineMatches {
+			got = append(got, l.LineNumber)
+		}
+		return got
+	}
+
+	if got, want := lineNumbers(&SearchOptions{ReverseLineOrder: true}), []int{10, 9, 8, 7, 6, 5, 4, 3, 2, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := lineNumbers(&SearchOptions{ReverseLineOrder: true, MaxLineMatches: 3}), []int{10, 9, 8}; !reflect.DeepEqual(got, want) {
+		t.Errorf("capped: got %v, want %v", got, want)
+	}
+	if got := lineNumbers(&SearchOptions{MaxLineMatches: 3}); len(got) != 3 {
+		t.Errorf("capped by score: got %v, want 3 lines", got)
+	}
+}
+
+func TestQueryErrorLocation(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{Name: "f1", Content: []byte("needle haystack")})
+	searcher := searcherForTest(t, b)
+
+	bad := &query.Symbol{Expr: query.NewAnd(
+		&query.Substring{Pattern: "needle"},
+		&query.Substring{Pattern: "haystack"})}
+	q := query.NewOr(
+		&query.Substring{Pattern: "needle"},
+		query.NewAnd(&query.Substring{Pattern: "hay"}, bad))
+
+	_, err := searcher.Search(context.Background(), q, &SearchOptions{})
+	qerr, ok := err.(*query.Error)
+	if !ok {
+		t.Fatalf("got error %v (%T), want *query.Error", err, err)
+	}
+	if qerr.Q != bad {
+		t.Errorf("got node %s, want %s", qerr.Q, bad)
+	}
+	want := "second child of second child of top-level or"
+	if got := qerr.Location(); got != want {
+		t.Errorf("got location %q, want %q", got, want)
+	}
+	if !strings.Contains(err.Error(), want) {
+		t.Errorf("error %q does not mention location", err)
+	}
+}
+
+func TestMaxFileSize(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{Name: "small", Content: []byte("needle")},
+		Document{Name: "medium", Content: []byte("needle in a haystack")},
+		Document{Name: "large", Content: []byte("needle in a much, much larger haystack")})
+
+	for _, tc := range []struct {
+		max  int
+		want []string
+	}{
+		{0, []string{"large", "medium", "small"}},
+		{6, []string{"small"}},
+		{20, []string{"medium", "small"}},
+		{5, nil},
+	} {
+		res := searchForTest(t, b, &query.Substring{Pattern: "needle"}, SearchOptions{MaxFileSize: tc.max})
+		var got []string
+		for _, f := range res.Files {
+			got = append(got, f.FileName)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("MaxFileSize %d: got %v, want %v", tc.max, got, tc.want)
+		}
+	}
+}
+
+func TestMaxFilePaths(t *testing.T) {
+	var docs []Document
+	for i := 0; i < 5; i++ {
+		docs = append(docs, Document{Name: fmt.Sprintf("f%d", i), Content: []byte("needle\nneedle")})
+	}
+	b := testIndexBuilder(t, &Repository{Name: "reponame"}, docs...)
+
+	res := searchForTest(t, b, &query.Substring{Pattern: "needle", Content: true}, SearchOptions{MaxFilePaths: 2})
+	var got []string
+	for _, f := range res.Files {
+		if len(f.LineMatches) != 0 {
+			t.Errorf("%s: got line matches %v, want none", f.FileName, f.LineMatches)
+		}
+		got = append(got, f.FileName)
+	}
+	if want := []string{"f0", "f1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if res.Stats.FilesConsidered != 2 || res.Stats.FilesSkipped != 3 {
+		t.Errorf("got considered %d, skipped %d, want 2 and 3", res.Stats.FilesConsidered, res.Stats.FilesSkipped)
+	}
+}
+
+func TestFileNameOnly(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{Name: "needle.go", Content: []byte("haystack")},
+		Document{Name: "haystack.go", Content: []byte("needle")},
+		Document{Name: "needle_test.go", Content: []byte("needle")})
+
+	for _, q := range []query.Q{
+		&query.Substring{Pattern: "needle"},
+		&query.Substring{Pattern: "needle", Content: true},
+		query.NewOr(&query.Substring{Pattern: "needle"}, &query.Symbol{Expr: &query.Substring{Pattern: "needle"}}),
+		CompileQuery(&query.Substring{Pattern: "needle"}),
+		CompileQuery(&query.Substring{Pattern: "needle", Content: true}),
+	} {
+		res := searchForTest(t, b, q, SearchOptions{FileNameOnly: true})
+		var got []string
+		for _, f := range res.Files {
+			if len(f.LineMatches) != 0 {
+				t.Errorf("%s: got line matches %v, want none", f.FileName, f.LineMatches)
+			}
+			got = append(got, f.FileName)
+		}
+		sort.Strings(got)
+		if want := []string{"needle.go", "needle_test.go"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", q, got, want)
+		}
+		if res.Stats.ContentBytesLoaded != 0 {
+			t.Errorf("%s: got %d content bytes loaded, want 0", q, res.Stats.ContentBytesLoaded)
+		}
+	}
+}
+
+func TestFileMatchesOnly(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{Name: "f1", Content: []byte("needle one\nneedle two\nthree needle needle")},
+		Document{Name: "f2", Content: []byte("a needle")},
+		Document{Name: "f3", Content: []byte("haystack")})
+
+	q := &query.Substring{Pattern: "needle", Content: true}
+	files := func(res *SearchResult) []string {
+		var names []string
+		for _, f := range res.Files {
+			names = append(names, f.FileName)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	full := searchForTest(t, b, q)
+	only := searchForTest(t, b, q, SearchOptions{FileMatchesOnly: true})
+	if got, want := files(only), files(full); !reflect.DeepEqual(got, want) {
+		t.Errorf("got files %v, want %v", got, want)
+	}
+
+	counts := map[string]int{}
+	for _, f := range only.Files {
+		if len(f.LineMatches) != 0 {
+			t.Errorf("%s: got line matches %v, want none", f.FileName, f.LineMatches)
+		}
+		counts[f.FileName] = f.MatchCount
+	}
+	if want := map[string]int{"f1": 4, "f2": 1}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("got match counts %v, want %v", counts, want)
+	}
+	if only.Stats.MatchCount != 5 {
+		t.Errorf("got Stats.MatchCount %d, want 5", only.Stats.MatchCount)
+	}
+	for _, f := range full.Files {
+		if f.MatchCount != 0 {
+			t.Errorf("%s: got MatchCount %d without FileMatchesOnly, want 0", f.FileName, f.MatchCount)
+		}
+	}
+}
+
+func BenchmarkFileNameOnly(b *testing.B) {
+	ib, err := NewIndexBuilder(&Repository{Name: "reponame"})
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < 5000; i++ {
+		if err := ib.Add(Document{
+			Name:    fmt.Sprintf("dir%d/file%d.go", i%50, i),
+			Content: []byte(strings.Repeat(fmt.Sprintf("func file%d() {}\n", i), 50)),
+		}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	ib.Write(&buf)
+	searcher, err := NewSearcher(&memSeeker{buf.Bytes()})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, bb := range []struct {
+		name string
+		q    query.Q
+		opts SearchOptions
+	}{
+		{"generic", &query.Substring{Pattern: "file42", FileName: true}, SearchOptions{}},
+		{"FileNameOnly", &query.Substring{Pattern: "file42"}, SearchOptions{FileNameOnly: true}},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				if _, err := searcher.Search(context.Background(), bb.q, &bb.opts); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestRepositoryRank(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{Name: "reponame", Rank: 42},
+		Document{Name: "f1", Content: []byte("needle")})
+
+	res := searchForTest(t, b, &query.Substring{Pattern: "needle"})
+	if len(res.Files) != 1 {
+		t.Fatalf("got %v, want 1 file", res.Files)
+	}
+	if got := res.Files[0].RepositoryRank; got != 42 {
+		t.Errorf("got rank %d, want 42", got)
+	}
+}
+
+func TestSearchRepoIDs(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{ID: 7, Name: "reponame"},
+		Document{Name: "f1", Content: []byte("needle")})
+
+	for _, tc := range []struct {
+		ids  *roaring.Bitmap
+		want int
+	}{
+		{nil, 1},
+		{roaring.BitmapOf(7), 1},
+		{roaring.BitmapOf(1, 2), 0},
+	} {
+		res := searchForTest(t, b, &query.Substring{Pattern: "needle"}, SearchOptions{RepoIDs: tc.ids})
+		if len(res.Files) != tc.want {
+			t.Errorf("RepoIDs %v: got %d files, want %d", tc.ids, len(res.Files), tc.want)
+		}
+	}
+}
+
+func TestCompileQuery(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{Name: "f1", Content: []byte("the quick brown fox")},
+		Document{Name: "f2", Content: []byte("jumps over the lazy dog")},
+		Document{Name: "quick.go", Content: []byte("package quick")})
+	searcher := searcherForTest(t, b)
+
+	q := query.NewOr(
+		&query.Substring{Pattern: "quick"},
+		query.NewAnd(&query.Substring{Pattern: "lazy dog"}, &query.Not{Child: &query.Substring{Pattern: "cat"}}))
+	cq := CompileQuery(q)
+
+	search := func(q query.Q) *SearchResult {
+		res, err := searcher.Search(context.Background(), q, &SearchOptions{})
+		if err != nil {
+			t.Fatalf("Search(%s): %v", q, err)
+		}
+		return res
+	}
+
+	want := search(q)
+	for i := 0; i < 3; i++ {
+		got := search(cq)
+		if d := cmp.Diff(want.Files, got.Files); d != "" {
+			t.Fatalf("compiled run %d mismatch (-want +got):\n%s", i, d)
+		}
+	}
+
+	plain := testing.AllocsPerRun(20, func() { search(q) })
+	compiled := testing.AllocsPerRun(20, func() { search(cq) })
+	if compiled >= plain {
+		t.Errorf("compiled query allocates %f per search, uncompiled %f", compiled, plain)
+	}
+}
+
+func TestFileNameSiblings(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{Name: "reponame"},
+		Document{Name: "README.md", Content: []byte("readme")},
+		Document{Name: "cmd/needle.go", Content: []byte("package main")},
+		Document{Name: "cmd/main.go", Content: []byte("package main")},
+		Document{Name: "cmd/util.go", Content: []byte("package main")},
+		Document{Name: "cmd/sub/deep.go", Content: []byte("package sub")},
+		Document{Name: "needle.txt", Content: []byte("root file")})
+
+	for _, tc := range []struct {
+		pattern string
+		max     int
+		want    []string
+	}{
+		{"needle.go", 5, []string{"cmd/main.go", "cmd/util.go"}},
+		{"needle.go", 1, []string{"cmd/main.go"}},
+		{"needle.go", 0, nil},
+		{"needle.txt", 5, []string{"README.md"}},
+	} {
+		res := searchForTest(t, b, &query.Substring{Pattern: tc.pattern, FileName: true}, SearchOptions{FileNameSiblings: tc.max})
+		if len(res.Files) != 1 {
+			t.Fatalf("%s: got %v, want 1 file", tc.pattern, res.Files)
+		}
+		if got := res.Files[0].Siblings; !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s, max %d: got siblings %v, want %v", tc.pattern, tc.max, got, tc.want)
+		}
+	}
+
+	// Content matches don't get siblings.
+	res := searchForTest(t, b, &query.Substring{Pattern: "package main", Content: true}, SearchOptions{FileNameSiblings: 5})
+	for _, f := range res.Files {
+		if len(f.Siblings) != 0 {
+			t.Errorf("%s: got siblings %v for content match", f.FileName, f.Siblings)
+		}
+	}
+}
+
+func TestFileChecksum(t *testing.T) {
+	b := testIndexBuilder(t, nil,
+		Document{Name: "f1", Content: []byte("first file")},
+		Document{Name: "f2", Content: []byte("second file")},
+		Document{Name: "f3", Content: []byte("third file")},
+		Document{Name: "f4", Content: []byte("second file")})
+
+	h := crc64.New(crc64.MakeTable(crc64.ISO))
+	h.Write([]byte("second file"))
+	sum := h.Sum(nil)
+
+	res := searchForTest(t, b, &query.FileChecksum{Sum: sum})
+	var names []string
+	for _, f := range res.Files {
+		names = append(names, f.FileName)
+	}
+	sort.Strings(names)
+	if want := []string{"f2", "f4"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("got %v, want %v", names, want)
+	}
+
+	// Shards without the checksum are skipped before matching.
+	h.Reset()
+	h.Write([]byte("no such file"))
+	q := &query.FileChecksum{Sum: h.Sum(nil)}
+	d := searcherForTest(t, b).(*indexData)
+	if got := d.simplify(q); !reflect.DeepEqual(got, &query.Const{Value: false}) {
+		t.Errorf("got %s, want FALSE", got)
+	}
+	if res := searchForTest(t, b, q); len(res.Files) != 0 {
+		t.Fatalf("got %v, want no matches", res.Files)
+	}
+}
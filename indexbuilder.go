@@ -23,6 +23,7 @@ import (
 	"log"
 	"path/filepath"
 	"sort"
+	"strings"
 	"time"
 	"unicode/utf8"
 )
@@ -56,6 +57,17 @@ type postingsBuilder struct {
 
 	endRunes []uint32
 	endByte  uint32
+
+	// postingsSize is the number of bytes in postings.
+	postingsSize int
+	// segments are the files holding spilled postings, oldest first.
+	segments []string
+	// spillWritten is set once spilled postings were merged by Write,
+	// which removes the segments.
+	spillWritten bool
+
+	// dropped are the ngrams removed by dropCommon.
+	dropped []ngram
 }
 
 func newPostingsBuilder() *postingsBuilder {
@@ -70,6 +82,13 @@ func newPostingsBuilder() *postingsBuilder {
 // DocumentSections must correspond to rune boundaries in the UTF-8
 // data.
 func (s *postingsBuilder) newSearchableString(data []byte, byteSections []DocumentSection) (*searchableString, []DocumentSection, error) {
+	return s.addSearchableString(data, byteSections, nil)
+}
+
+// addSearchableString is newSearchableString, but if ngrams is non-nil,
+// it holds the trigrams of data from an earlier tokenization, and data is
+// only scanned for rune offsets.
+func (s *postingsBuilder) addSearchableString(data []byte, byteSections []DocumentSection, ngrams []docNgram) (*searchableString, []DocumentSection, error) {
 	dest := searchableString{
 		data: data,
 	}
@@ -107,7 +126,7 @@ func (s *postingsBuilder) newSearchableString(data []byte, byteSections []Docume
 
 		byteCount += sz
 
-		if runeIndex < 2 {
+		if runeIndex < 2 || ngrams != nil {
 			continue
 		}
 
@@ -117,10 +136,25 @@ func (s *postingsBuilder) newSearchableString(data []byte, byteSections []Docume
 
 		m := binary.PutUvarint(buf[:], uint64(newOff-lastOff))
 		s.postings[ng] = append(s.postings[ng], buf[:m]...)
+		s.postingsSize += m
 		s.lastOffsets[ng] = newOff
 	}
 	s.runeCount += runeIndex
 
+	for _, dn := range ngrams {
+		postings := s.postings[dn.ngram]
+		lastOff := s.lastOffsets[dn.ngram]
+		for _, off := range dn.offsets {
+			newOff := endRune + off
+			m := binary.PutUvarint(buf[:], uint64(newOff-lastOff))
+			postings = append(postings, buf[:m]...)
+			s.postingsSize += m
+			lastOff = newOff
+		}
+		s.postings[dn.ngram] = postings
+		s.lastOffsets[dn.ngram] = lastOff
+	}
+
 	for len(byteSectionBoundaries) > 0 && byteSectionBoundaries[0] < uint32(byteCount) {
 		return nil, nil, fmt.Errorf("no rune for section boundary at byte %d", byteSectionBoundaries[0])
 	}
@@ -146,6 +180,60 @@ func (s *postingsBuilder) newSearchableString(data []byte, byteSections []Docume
 	return &dest, runeSecs, nil
 }
 
+// dropCommon removes the postings of ngrams with more than max entries,
+// including spilled ones, and records them in s.dropped.
+func (s *postingsBuilder) dropCommon(max int) error {
+	keys := make(ngramSlice, 0, len(s.lastOffsets))
+	for k := range s.lastOffsets {
+		keys = append(keys, k)
+	}
+	sort.Sort(keys)
+
+	var readers []*segmentReader
+	defer func() {
+		for _, r := range readers {
+			r.f.Close()
+		}
+	}()
+	for _, fn := range s.segments {
+		r, err := openSegment(fn)
+		if err != nil {
+			return err
+		}
+		readers = append(readers, r)
+	}
+
+	for _, k := range keys {
+		n := postingEntries(s.postings[k])
+		for _, r := range readers {
+			p, err := r.postingsFor(k)
+			if err != nil {
+				return err
+			}
+			n += postingEntries(p)
+		}
+		if n <= max {
+			continue
+		}
+		s.postingsSize -= len(s.postings[k])
+		delete(s.postings, k)
+		delete(s.lastOffsets, k)
+		s.dropped = append(s.dropped, k)
+	}
+	return nil
+}
+
+// postingEntries returns the number of varints in the posting list p.
+func postingEntries(p []byte) int {
+	n := 0
+	for _, c := range p {
+		if c < 0x80 {
+			n++
+		}
+	}
+	return n
+}
+
 // IndexBuilder builds a single index shard.
 type IndexBuilder struct {
 	// The version we will write to disk. Sourcegraph Specific. This is to
@@ -192,12 +280,65 @@ type IndexBuilder struct {
 	// languages codes
 	languages []byte
 
+	// docID => Document.RankBoost
+	rankBoosts []uint16
+
+	// docID => Document.ModTime
+	modTimes []time.Time
+
+	// docID => Document.SkipReason
+	skipReasons []string
+
+	// docID => diffLines of the content, or nil if it is not a diff
+	diffLines [][]uint32
+
 	// IndexTime will be used as the time if non-zero. Otherwise
 	// time.Now(). This is useful for doing reproducible builds in tests.
 	IndexTime time.Time
 
 	// a sortable 20 chars long id.
 	ID string
+
+	// SpillThreshold, if positive, is the number of bytes of postings
+	// kept in memory. Beyond that, postings are written to temporary
+	// files in SpillDir, or the default temporary directory if empty,
+	// and merged back by Write. The output is identical to a build
+	// without spilling, but Write can only be called once, and removes
+	// the temporary files.
+	SpillThreshold int
+	SpillDir       string
+
+	// MaxPostingEntries, if positive, is the largest number of entries
+	// the posting list of a content ngram may have. The postings of
+	// more common ngrams are left out of the shard, and searches find
+	// their occurrences through other ngrams or by scanning content.
+	MaxPostingEntries int
+
+	// DisableBloom leaves the bloom filters out of the shard. This saves
+	// space for small shards, where the filters can make up much of the
+	// size. Searches then only use the ngram index.
+	DisableBloom bool
+
+	// BloomTargetFPR, if positive, sizes the bloom filters for this
+	// false positive rate per word fragment, based on the number of
+	// distinct fragments in the shard. Otherwise the filters are shrunk
+	// to a fixed load, which is about 0.07 false positives per fragment.
+	BloomTargetFPR float64
+
+	// TokenizeParallelism, if larger than 1, is the number of
+	// goroutines that compute the trigrams of a large document. The
+	// resulting shard is the same as with serial tokenization.
+	TokenizeParallelism int
+
+	// SymbolsOnly makes the shard store only the symbols of documents,
+	// for navigating to definitions without full-text search. Each line
+	// of a document is reduced to the symbols on it, so line numbers are
+	// kept. Symbol and file name searches work, content searches match
+	// nothing.
+	SymbolsOnly bool
+
+	// previous is the shard set by SetPreviousShard, or nil.
+	previous *previousShard
 }
 
 func (d *Repository) verify() error {
@@ -209,6 +350,22 @@ func (d *Repository) verify() error {
 	return nil
 }
 
+// SetBloomMinWordLength makes the bloom filters of the shard hash words
+// of at least n runes, instead of the default 4. It must be called before
+// documents are added.
+func (b *IndexBuilder) SetBloomMinWordLength(n int) error {
+	if len(b.contentStrings) > 0 {
+		return fmt.Errorf("SetBloomMinWordLength called after documents were added")
+	}
+	hash, err := bloomHasherCRCBlockedMinN(n)
+	if err != nil {
+		return err
+	}
+	b.contentBloom = makeBloomFilterWithHasher(hash)
+	b.nameBloom = makeBloomFilterWithHasher(hash)
+	return nil
+}
+
 // ContentSize returns the number of content bytes so far ingested.
 func (b *IndexBuilder) ContentSize() uint32 {
 	// Add the name too so we don't skip building index if we have
@@ -289,6 +446,16 @@ type Document struct {
 	// Document sections for symbols. Offsets should use bytes.
 	Symbols         []DocumentSection
 	SymbolsMetaData []*Symbol
+
+	// RankBoost is added to the score of the file when it matches, to
+	// rank files the indexer knows to be important, like entry points
+	// or READMEs, above others. For comparison, a whole word match
+	// scores 500.
+	RankBoost uint16
+
+	// ModTime is the time the file was last changed, eg. the time of
+	// the last commit touching it. It is returned in FileMatch.ModTime.
+	ModTime time.Time
 }
 
 type symbolSlice struct {
@@ -375,6 +542,8 @@ func mkSubRepoIndices(repo Repository) map[string]uint32 {
 	return subRepoIndices
 }
 
+// notIndexedMarker is prepended to Document.SkipReason to form the content
+// of documents whose content is not indexed.
 const notIndexedMarker = "NOT-INDEXED: "
 
 func (b *IndexBuilder) symbolID(sym string) uint32 {
@@ -409,6 +578,12 @@ func (b *IndexBuilder) addSymbols(symbols []*Symbol) {
 
 // Add a file which only occurs in certain branches.
 func (b *IndexBuilder) Add(doc Document) error {
+	return b.add(doc, nil)
+}
+
+// add adds doc. If ngrams is non-nil, it holds the content trigrams of doc,
+// which are then not computed again.
+func (b *IndexBuilder) add(doc Document, ngrams []docNgram) error {
 	hasher := crc64.New(crc64.MakeTable(crc64.ISO))
 
 	if idx := bytes.IndexByte(doc.Content, 0); idx >= 0 {
@@ -439,15 +614,27 @@ func (b *IndexBuilder) Add(doc Document) error {
 		return fmt.Errorf("section goes past end of content")
 	}
 
+	// The checksum is of the original content, so that it still
+	// identifies the file.
+	hasher.Write(doc.Content)
+	if b.SymbolsOnly && doc.SkipReason == "" {
+		doc.Content, doc.Symbols = symbolsOnlyContent(doc.Content, doc.Symbols)
+	}
+
 	if doc.SubRepositoryPath != "" {
 		rel, err := filepath.Rel(doc.SubRepositoryPath, doc.Name)
 		if err != nil || rel == doc.Name {
 			return fmt.Errorf("path %q must start subrepo path %q", doc.Name, doc.SubRepositoryPath)
 		}
 	}
-	b.contentBloom.addBytes(doc.Content)
-	b.nameBloom.addBytes([]byte(doc.Name))
-	docStr, runeSecs, err := b.contentPostings.newSearchableString(doc.Content, doc.Symbols)
+	if !b.DisableBloom {
+		b.contentBloom.addBytes(doc.Content)
+		b.nameBloom.addBytes([]byte(doc.Name))
+	}
+	if ngrams == nil && b.TokenizeParallelism > 1 && len(doc.Content) >= parallelTokenizeMinSize {
+		ngrams = tokenizeParallel(doc.Content, b.TokenizeParallelism)
+	}
+	docStr, runeSecs, err := b.contentPostings.addSearchableString(doc.Content, doc.Symbols, ngrams)
 	if err != nil {
 		return err
 	}
@@ -456,6 +643,15 @@ func (b *IndexBuilder) Add(doc Document) error {
 		return err
 	}
 	b.addSymbols(doc.SymbolsMetaData)
+	if b.SpillThreshold > 0 {
+		for _, p := range []*postingsBuilder{b.contentPostings, b.namePostings} {
+			if p.postingsSize > b.SpillThreshold {
+				if err := p.spill(b.SpillDir); err != nil {
+					return err
+				}
+			}
+		}
+	}
 
 	repoIdx := len(b.repoList) - 1
 	subRepoIdx, ok := b.subRepoIndices[repoIdx][doc.SubRepositoryPath]
@@ -479,8 +675,6 @@ func (b *IndexBuilder) Add(doc Document) error {
 	b.subRepos = append(b.subRepos, subRepoIdx)
 	b.repos = append(b.repos, uint16(repoIdx))
 
-	hasher.Write(doc.Content)
-
 	b.contentStrings = append(b.contentStrings, docStr)
 	b.runeDocSections = append(b.runeDocSections, runeSecs...)
 
@@ -499,10 +693,55 @@ func (b *IndexBuilder) Add(doc Document) error {
 		b.languageMap[doc.Language] = langCode
 	}
 	b.languages = append(b.languages, langCode)
+	b.rankBoosts = append(b.rankBoosts, doc.RankBoost)
+	b.modTimes = append(b.modTimes, doc.ModTime)
+	b.skipReasons = append(b.skipReasons, doc.SkipReason)
+
+	var changed []uint32
+	if !b.SymbolsOnly && doc.SkipReason == "" && isDiff(doc.Name, doc.Language) {
+		changed = diffLines(doc.Content)
+	}
+	b.diffLines = append(b.diffLines, changed)
 
 	return nil
 }
 
+// symbolsOnlyContent returns content reduced to the given symbols, which
+// must be sorted and not overlap: each line holds the symbols on it,
+// separated by spaces. It also returns the sections of the symbols in the
+// reduced content.
+func symbolsOnlyContent(content []byte, symbols []DocumentSection) ([]byte, []DocumentSection) {
+	var out []byte
+	secs := make([]DocumentSection, 0, len(symbols))
+	lineStart := 0
+	last := 0
+	for _, s := range symbols {
+		// Keep the newlines up to the symbol.
+		for _, c := range content[last:s.Start] {
+			if c == '\n' {
+				out = append(out, '\n')
+				lineStart = len(out)
+			}
+		}
+		if len(out) > lineStart {
+			out = append(out, ' ')
+		}
+		start := uint32(len(out))
+		out = append(out, content[s.Start:s.End]...)
+		secs = append(secs, DocumentSection{Start: start, End: uint32(len(out))})
+		if i := bytes.LastIndexByte(content[s.Start:s.End], '\n'); i >= 0 {
+			lineStart = int(start) + i + 1
+		}
+		last = int(s.End)
+	}
+	for _, c := range content[last:] {
+		if c == '\n' {
+			out = append(out, '\n')
+		}
+	}
+	return out, secs
+}
+
 func (b *IndexBuilder) branchMask(br string) uint64 {
 	for i, b := range b.repoList[len(b.repoList)-1].Branches {
 		if b.Name == br {
@@ -511,3 +750,33 @@ func (b *IndexBuilder) branchMask(br string) uint64 {
 	}
 	return 0
 }
+
+// isDiff returns true if a document with the given name and language is a
+// unified diff.
+func isDiff(name, language string) bool {
+	return language == "diff" || strings.HasSuffix(name, ".diff") || strings.HasSuffix(name, ".patch")
+}
+
+// diffLines returns the added and removed lines of the unified diff
+// content, counting lines from 0, as 2*line for added and 2*line+1 for
+// removed lines. File headers ("+++", "---") are not considered changes.
+func diffLines(content []byte) []uint32 {
+	lines := []uint32{}
+	for line := uint32(0); len(content) > 0; line++ {
+		l := content
+		if i := bytes.IndexByte(content, '\n'); i >= 0 {
+			l, content = content[:i], content[i+1:]
+		} else {
+			content = nil
+		}
+
+		switch {
+		case bytes.HasPrefix(l, []byte("+++")) || bytes.HasPrefix(l, []byte("---")):
+		case len(l) > 0 && l[0] == '+':
+			lines = append(lines, 2*line)
+		case len(l) > 0 && l[0] == '-':
+			lines = append(lines, 2*line+1)
+		}
+	}
+	return lines
+}
@@ -20,9 +20,10 @@ import (
 	"hash/crc64"
 	"log"
 	"math/bits"
+	"sync"
+	"sync/atomic"
+	"time"
 	"unicode/utf8"
-
-	"github.com/google/zoekt/query"
 )
 
 // indexData holds the pattern-independent data that we have to have
@@ -35,6 +36,11 @@ type indexData struct {
 
 	ngrams combinedNgramOffset
 
+	// The section holding the postings of the content ngrams, and the
+	// part of it read ahead by Prefetch (a *prefetchedPostings).
+	postings   simpleSection
+	prefetched atomic.Value
+
 	newlinesStart uint32
 	newlinesIndex []uint32
 
@@ -69,10 +75,10 @@ type indexData struct {
 	fileBranchMasks []uint64
 
 	// mask (power of 2) => name
-	branchNames []map[uint]string
+	branchNames []map[uint64]string
 
 	// name => mask (power of 2)
-	branchIDs []map[string]uint
+	branchIDs []map[string]uint64
 
 	metaData     IndexMetadata
 	repoMetaData []Repository
@@ -86,6 +92,24 @@ type indexData struct {
 	// languages for all the files.
 	languages []byte
 
+	// rank boosts for all the files, 2 bytes each, or empty if
+	// no file has one.
+	rankBoosts []byte
+
+	// modification times for all the files in Unix nanoseconds, 8 bytes
+	// each, or empty if no file has one.
+	modTimes []byte
+
+	// Document.SkipReason of all the files, or empty if no file was
+	// skipped. skipReasonIndex has an entry per file, and one more.
+	skipReasonContent []byte
+	skipReasonIndex   []uint32
+
+	// The changed lines of all the files that are diffs, or empty if no
+	// file is one. diffLinesIndex has an entry per file, and one more.
+	diffLinesContent []byte
+	diffLinesIndex   []uint32
+
 	// inverse of LanguageMap in metaData
 	languageMap map[byte]string
 
@@ -102,6 +126,29 @@ type indexData struct {
 
 	// A bloom filter over filenames.
 	bloomNames bloom
+
+	// Content ngrams that occur, but whose postings were left out.
+	droppedNgrams map[ngram]struct{}
+
+	// ngramDocCounts caches the results of ngramDocCount, keyed by
+	// ngramDocCountKey.
+	ngramDocCounts sync.Map
+
+	// dirDocs holds the documents of each directory of each repository
+	// in document order, for siblings. It is built by dirDocsOnce.
+	dirDocsOnce sync.Once
+	dirDocs     map[dirKey][]uint32
+
+	// checksumIndex holds the documents of each content checksum, for
+	// checksumDocs. It is built by checksumIndexOnce.
+	checksumIndexOnce sync.Once
+	checksumIndex     map[[crc64.Size]byte][]uint32
+}
+
+// dirKey identifies a directory of a repository in a shard.
+type dirKey struct {
+	repo uint16
+	dir  string
 }
 
 type symbolData struct {
@@ -166,6 +213,31 @@ func (d *indexData) getChecksum(idx uint32) []byte {
 	return d.checksums[start : start+crc64.Size]
 }
 
+// checksumDocs returns the documents whose content checksum is sum.
+func (d *indexData) checksumDocs(sum []byte) []uint32 {
+	if len(sum) != crc64.Size {
+		return nil
+	}
+	d.checksumIndexOnce.Do(func() {
+		d.checksumIndex = make(map[[crc64.Size]byte][]uint32, len(d.checksums)/crc64.Size)
+		for i := 0; i+crc64.Size <= len(d.checksums); i += crc64.Size {
+			var k [crc64.Size]byte
+			copy(k[:], d.checksums[i:])
+			d.checksumIndex[k] = append(d.checksumIndex[k], uint32(i/crc64.Size))
+		}
+	})
+
+	var k [crc64.Size]byte
+	copy(k[:], sum)
+	return d.checksumIndex[k]
+}
+
+// ContentChecksum returns a checksum over the checksums of all documents in
+// the shard. Shards with the same documents have the same ContentChecksum.
+func (d *indexData) ContentChecksum() uint64 {
+	return crc64.Checksum(d.checksums, crc64.MakeTable(crc64.ISO))
+}
+
 // calculates stats for files in the range [start, end).
 func (d *indexData) calculateStatsForFileRange(start, end uint32) RepoStats {
 	if start >= end {
@@ -301,13 +373,17 @@ func (d *indexData) memoryUse() int {
 		d.boundaries, d.fileNameIndex,
 		d.fileEndRunes, d.fileNameEndRunes,
 		d.fileEndSymbol, d.symbols.symKindIndex,
-		d.subRepos,
+		d.subRepos, d.skipReasonIndex, d.diffLinesIndex,
 	} {
 		sz += 4 * len(a)
 	}
 	sz += d.runeOffsets.sizeBytes()
 	sz += d.fileNameRuneOffsets.sizeBytes()
 	sz += len(d.languages)
+	sz += len(d.rankBoosts)
+	sz += len(d.modTimes)
+	sz += len(d.skipReasonContent)
+	sz += len(d.diffLinesContent)
 	sz += len(d.checksums)
 	sz += 2 * len(d.repos)
 	sz += 8 * len(d.runeDocSections)
@@ -351,6 +427,16 @@ func (data *indexData) ngramFrequency(ng ngram, filename bool) uint32 {
 	return data.ngrams.Get(ng).sz
 }
 
+// ngramDropped returns true if the postings of ng were left out of the
+// index, so that a frequency of 0 does not mean it is absent.
+func (data *indexData) ngramDropped(ng ngram, filename bool) bool {
+	if filename {
+		return false
+	}
+	_, ok := data.droppedNgrams[ng]
+	return ok
+}
+
 type ngramIterationResults struct {
 	matchIterator
 
@@ -358,8 +444,22 @@ type ngramIterationResults struct {
 	fileName      bool
 	substrBytes   []byte
 	substrLowered []byte
+
+	// bloom is the outcome of testing the substring against the bloom
+	// filter of the shard.
+	bloom bloomOutcome
 }
 
+// bloomOutcome is the result of testing a substring against a bloom
+// filter.
+type bloomOutcome int
+
+const (
+	bloomUnchecked bloomOutcome = iota
+	bloomAdmitted
+	bloomRejected
+)
+
 func (r *ngramIterationResults) String() string {
 	return fmt.Sprintf("wrapper(%v)", r.matchIterator)
 }
@@ -375,53 +475,134 @@ func (r *ngramIterationResults) candidates() []*candidateMatch {
 	return cs
 }
 
-func (d *indexData) iterateNgrams(query *query.Substring) (*ngramIterationResults, error) {
-	str := query.Pattern
+type ngramDocCountKey struct {
+	ng            ngram
+	caseSensitive bool
+}
 
-	if len(query.Pattern) >= bloomHashMinWordLength {
-		// test against appropriate content or filename bloom filters
-		pat := []byte(query.Pattern)
-		match := true
-		if query.FileName {
-			match = d.bloomNames.maybeHasBytes(pat)
-		} else {
-			match = d.bloomContents.maybeHasBytes(pat)
+// ngramDocCount returns the number of documents whose content has the
+// ngram ng. The count takes a pass over the posting lists of ng, so it is
+// cached.
+func (d *indexData) ngramDocCount(ng ngram, caseSensitive bool) (uint32, error) {
+	key := ngramDocCountKey{ng, caseSensitive}
+	if n, ok := d.ngramDocCounts.Load(key); ok {
+		return n.(uint32), nil
+	}
+
+	iter, err := d.trigramHitIterator(ng, caseSensitive, false)
+	if err != nil {
+		return 0, err
+	}
+	ends := d.fileEndRunes
+	var count, doc uint32
+	for off := iter.first(); off != maxUInt32; off = iter.first() {
+		doc = nextFileIndex(off, doc, ends)
+		if doc >= uint32(len(ends)) {
+			break
 		}
-		if !match {
+		count++
+		// Skip the other occurrences in doc.
+		iter.next(ends[doc] - 1)
+	}
+
+	d.ngramDocCounts.Store(key, count)
+	return count, nil
+}
+
+// iterateCompiledNgrams returns an iterator over the candidate matches
+// of cs, found by intersecting the posting lists of two of its ngrams.
+// It returns nil if all ngrams of cs are too common to be worth using, or
+// were dropped from the index.
+func (d *indexData) iterateCompiledNgrams(cs *compiledSubstring, opt matchTreeOpt) (*ngramIterationResults, error) {
+	query := &cs.Substring
+	str := query.Pattern
+
+	// test against appropriate content or filename bloom filters
+	b := &d.bloomContents
+	if query.FileName {
+		b = &d.bloomNames
+	}
+	bloom := bloomUnchecked
+	if len(query.Pattern) >= b.minWordLength() {
+		if !cs.maybeInBloom(b) {
 			return &ngramIterationResults{
 				matchIterator: &noMatchTree{
 					Why: "bloomfilter",
 				},
+				bloom: bloomRejected,
 			}, nil
 		}
+		if b.hasher != nil {
+			bloom = bloomAdmitted
+		}
 	}
 
 	// Find the 2 least common ngrams from the string.
-	ngramOffs := splitNGrams([]byte(query.Pattern))
+	ngramOffs := cs.ngramOffs
 	frequencies := make([]uint32, 0, len(ngramOffs))
-	for _, o := range ngramOffs {
+	for i, o := range ngramOffs {
 		var freq uint32
+		dropped := false
 		if query.CaseSensitive {
 			freq = d.ngramFrequency(o.ngram, query.FileName)
+			dropped = d.ngramDropped(o.ngram, query.FileName)
 		} else {
-			for _, v := range generateCaseNgrams(o.ngram) {
+			for _, v := range cs.caseNgrams(i) {
 				freq += d.ngramFrequency(v, query.FileName)
+				dropped = dropped || d.ngramDropped(v, query.FileName)
 			}
 		}
 
+		if dropped {
+			// Without its postings, the ngram can neither select nor
+			// rule out candidates.
+			frequencies = append(frequencies, maxUInt32)
+			continue
+		}
+
 		if freq == 0 {
 			return &ngramIterationResults{
 				matchIterator: &noMatchTree{
 					Why: "freq=0",
 				},
+				bloom: bloom,
 			}, nil
 		}
 
 		frequencies = append(frequencies, freq)
 	}
+
+	// Leave out ngrams that are in too many documents to narrow down the
+	// candidates much. If that leaves nothing, the caller scans all
+	// content instead.
+	if opt.ngramSkipFraction > 0 && !query.FileName {
+		limit := opt.ngramSkipFraction * float64(d.numDocs())
+		for i, freq := range frequencies {
+			// Every occurrence takes at least a byte of postings, so
+			// an ngram with fewer bytes is in fewer documents too.
+			if freq == maxUInt32 || float64(freq) <= limit {
+				continue
+			}
+			docs, err := d.ngramDocCount(ngramOffs[i].ngram, query.CaseSensitive)
+			if err != nil {
+				return nil, err
+			}
+			if float64(docs) > limit {
+				frequencies[i] = maxUInt32
+			}
+		}
+	}
+
 	firstI := firstMinarg(frequencies)
+	if int(firstI) == len(frequencies) {
+		return nil, nil
+	}
 	frequencies[firstI] = maxUInt32
 	lastI := lastMinarg(frequencies)
+	if frequencies[lastI] == maxUInt32 && lastI != firstI {
+		// Only one ngram is selective enough.
+		lastI = firstI
+	}
 	if firstI > lastI {
 		lastI, firstI = firstI, lastI
 	}
@@ -453,18 +634,58 @@ func (d *indexData) iterateNgrams(query *query.Substring) (*ngramIterationResult
 		iter.iter = hitIter
 	}
 
-	patBytes := []byte(query.Pattern)
-	lowerPatBytes := toLower(patBytes)
-
 	return &ngramIterationResults{
 		matchIterator: iter,
 		caseSensitive: query.CaseSensitive,
 		fileName:      query.FileName,
-		substrBytes:   patBytes,
-		substrLowered: lowerPatBytes,
+		substrBytes:   cs.patBytes,
+		substrLowered: cs.lowerPatBytes,
+		bloom:         bloom,
 	}, nil
 }
 
+// rankBoost returns the Document.RankBoost of doc.
+func (d *indexData) rankBoost(doc uint32) uint16 {
+	if len(d.rankBoosts) == 0 {
+		return 0
+	}
+	return binary.BigEndian.Uint16(d.rankBoosts[2*doc:])
+}
+
+// modTime returns the Document.ModTime of doc.
+func (d *indexData) modTime(doc uint32) time.Time {
+	if len(d.modTimes) == 0 {
+		return time.Time{}
+	}
+	nanos := int64(binary.BigEndian.Uint64(d.modTimes[8*doc:]))
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// skipReason returns the Document.SkipReason of doc.
+func (d *indexData) skipReason(doc uint32) string {
+	if len(d.skipReasonIndex) == 0 {
+		return ""
+	}
+	return string(d.skipReasonContent[d.skipReasonIndex[doc]:d.skipReasonIndex[doc+1]])
+}
+
+// isDiff returns true if doc is a unified diff.
+func (d *indexData) isDiff(doc uint32) bool {
+	return len(d.diffLinesIndex) != 0 && d.diffLinesIndex[doc+1] > d.diffLinesIndex[doc]
+}
+
+// diffLines returns the changed lines of doc, as computed by diffLines at
+// index time.
+func (d *indexData) diffLines(doc uint32, buf []uint32) []uint32 {
+	if !d.isDiff(doc) {
+		return buf[:0]
+	}
+	return fromSizedDeltas(d.diffLinesContent[d.diffLinesIndex[doc]:d.diffLinesIndex[doc+1]], buf)
+}
+
 func (d *indexData) fileName(i uint32) []byte {
 	return d.fileNameContent[d.fileNameIndex[i]:d.fileNameIndex[i+1]]
 }
@@ -135,6 +135,13 @@ type regexpMatchTree struct {
 
 	fileName bool
 
+	// if non-zero, the first byte of lines that may contain
+	// content matches in diff documents.
+	diffLine byte
+
+	// set if regexp is anchored by wholeLineRegexp.
+	wholeLine bool
+
 	// mutable
 	reEvaluated bool
 	found       []*candidateMatch
@@ -150,6 +157,13 @@ type substrMatchTree struct {
 	caseSensitive bool
 	fileName      bool
 
+	// if non-zero, the first byte of lines that may contain
+	// content matches in diff documents.
+	diffLine byte
+
+	// set if content matches must span a complete line.
+	wholeLine bool
+
 	// mutable
 	current       []*candidateMatch
 	contEvaluated bool
@@ -170,6 +184,9 @@ type symbolRegexpMatchTree struct {
 	regexp *regexp.Regexp
 	all    bool // skips regex match if .*
 
+	// kinds, if set, restricts the matches to symbols of these kinds.
+	kinds map[string]bool
+
 	reEvaluated bool
 	found       []*candidateMatch
 }
@@ -192,6 +209,13 @@ func (t *symbolRegexpMatchTree) matches(cp *contentProvider, cost int, known map
 
 	found := t.found[:0]
 	for i, sec := range sections {
+		if t.kinds != nil {
+			sym := cp.id.symbols.data(cp.id.fileEndSymbol[cp.idx] + uint32(i))
+			if sym == nil || !t.kinds[sym.Kind] {
+				continue
+			}
+		}
+
 		var idx []int
 		if t.all {
 			idx = []int{0, int(sec.End - sec.Start)}
@@ -450,6 +474,9 @@ func (t *symbolSubstrMatchTree) String() string {
 }
 
 func (t *symbolRegexpMatchTree) String() string {
+	if t.kinds != nil {
+		return fmt.Sprintf("symbol(%v, kinds=%v)", t.matchTree, t.kinds)
+	}
 	return fmt.Sprintf("symbol(%v)", t.matchTree)
 }
 
@@ -651,14 +678,23 @@ func (t *regexpMatchTree) matches(cp *contentProvider, cost int, known map[match
 	}
 
 	cp.stats.RegexpsConsidered++
-	idxs := t.regexp.FindAllIndex(cp.data(t.fileName), -1)
+	data := cp.data(t.fileName)
+	idxs := t.regexp.FindAllIndex(data, -1)
+	diff := t.diffLine != 0 && !t.fileName && cp.isDiff()
 	found := t.found[:0]
 	for _, idx := range idxs {
+		if t.wholeLine && idx[1] > idx[0] && data[idx[1]-1] == '\r' {
+			// Leave the "\r" of a "\r\n" line ending out of the match.
+			idx[1]--
+		}
 		cm := &candidateMatch{
 			byteOffset:  uint32(idx[0]),
 			byteMatchSz: uint32(idx[1] - idx[0]),
 			fileName:    t.fileName,
 		}
+		if diff && cp.diffLineKind(cm.byteOffset) != t.diffLine {
+			continue
+		}
 
 		found = append(found, cm)
 	}
@@ -742,12 +778,17 @@ func (t *substrMatchTree) matches(cp *contentProvider, cost int, known map[match
 		return false, false
 	}
 
+	diff := t.diffLine != 0 && !t.fileName && cp.isDiff()
 	pruned := t.current[:0]
 	for _, m := range t.current {
 		if m.byteOffset == 0 && m.runeOffset > 0 {
 			m.byteOffset = cp.findOffset(m.fileName, m.runeOffset)
 		}
-		if m.matchContent(cp.data(m.fileName)) {
+		if diff && cp.diffLineKind(m.byteOffset) != t.diffLine {
+			continue
+		}
+		// matchContent sets byteMatchSz, which spansLine needs.
+		if m.matchContent(cp.data(m.fileName)) && (!t.wholeLine || spansLine(cp.data(false), m.byteOffset, m.byteMatchSz)) {
 			pruned = append(pruned, m)
 		}
 	}
@@ -757,24 +798,40 @@ func (t *substrMatchTree) matches(cp *contentProvider, cost int, known map[match
 	return len(t.current) > 0, true
 }
 
-func (d *indexData) newMatchTree(q query.Q) (matchTree, error) {
+// matchTreeOpt holds the search options that change how a matchTree is
+// built.
+type matchTreeOpt struct {
+	// ngramSkipFraction is SearchOptions.NgramSkipFraction.
+	ngramSkipFraction float64
+
+	// wholeLine is SearchOptions.WholeLine. It applies to the content
+	// atoms of the query, but not to those that only narrow down the
+	// candidates of a regexp, or to symbols.
+	wholeLine bool
+}
+
+func (d *indexData) newMatchTree(q query.Q, opt matchTreeOpt) (matchTree, error) {
 	if q == nil {
 		return nil, fmt.Errorf("got nil (sub)query")
 	}
 	switch s := q.(type) {
 	case *query.Regexp:
+		wholeLine := opt.wholeLine && !s.FileName
+		subOpt := opt
+		subOpt.wholeLine = false
+
 		// RegexpToMatchTreeRecursive tries to distill a matchTree that matches a
 		// superset of the regexp. If the returned matchTree is equivalent to the
 		// original regexp, it returns true. An equivalent matchTree has the same
 		// behaviour as the original regexp and can be used instead.
 		//
-		subMT, isEq, _, err := d.regexpToMatchTreeRecursive(s.Regexp, ngramSize, s.FileName, s.CaseSensitive)
+		subMT, isEq, _, err := d.regexpToMatchTreeRecursive(s.Regexp, ngramSize, s.FileName, s.CaseSensitive, subOpt)
 		if err != nil {
 			return nil, err
 		}
 		// if the query can be used in place of the regexp
-		// return the subtree
-		if isEq {
+		// return the subtree. Whole lines need the anchored regexp.
+		if isEq && !wholeLine {
 			return subMT, nil
 		}
 
@@ -787,6 +844,10 @@ func (d *indexData) newMatchTree(q query.Q) (matchTree, error) {
 			regexp:   regexp.MustCompile(prefix + s.Regexp.String()),
 			fileName: s.FileName,
 		}
+		if wholeLine {
+			tr.regexp = wholeLineRegexp(prefix, s.Regexp.String())
+			tr.wholeLine = true
+		}
 
 		return &andMatchTree{
 			children: []matchTree{
@@ -795,46 +856,82 @@ func (d *indexData) newMatchTree(q query.Q) (matchTree, error) {
 		}, nil
 	case *query.And:
 		var r []matchTree
-		for _, ch := range s.Children {
-			ct, err := d.newMatchTree(ch)
+		for i, ch := range s.Children {
+			ct, err := d.newMatchTree(ch, opt)
 			if err != nil {
-				return nil, err
+				return nil, query.ChildError(err, s, i, ch)
 			}
 			r = append(r, ct)
 		}
 		return &andMatchTree{r}, nil
 	case *query.Or:
 		var r []matchTree
-		for _, ch := range s.Children {
-			ct, err := d.newMatchTree(ch)
+		for i, ch := range s.Children {
+			ct, err := d.newMatchTree(ch, opt)
 			if err != nil {
-				return nil, err
+				return nil, query.ChildError(err, s, i, ch)
 			}
 			r = append(r, ct)
 		}
 		return &orMatchTree{r}, nil
 	case *query.Not:
-		ct, err := d.newMatchTree(s.Child)
+		ct, err := d.newMatchTree(s.Child, opt)
+		if err != nil {
+			return nil, query.ChildError(err, s, 0, s.Child)
+		}
+		// Negating a per-document predicate, eg. -lang:go, keeps
+		// skipping over the documents that don't match.
+		if dt, ok := ct.(*docMatchTree); ok {
+			return &docMatchTree{
+				reason:  "not-" + dt.reason,
+				numDocs: dt.numDocs,
+				predicate: func(docID uint32) bool {
+					return !dt.predicate(docID)
+				},
+			}, nil
+		}
 		return &notMatchTree{
 			child: ct,
-		}, err
+		}, nil
 
 	case *query.Type:
 		if s.Type != query.TypeFileName {
 			break
 		}
 
-		ct, err := d.newMatchTree(s.Child)
+		ct, err := d.newMatchTree(s.Child, opt)
 		if err != nil {
-			return nil, err
+			return nil, query.ChildError(err, s, 0, s.Child)
 		}
 
 		return &fileNameMatchTree{
 			child: ct,
 		}, nil
 
+	case *query.DiffLine:
+		ct, err := d.newMatchTree(s.Child, opt)
+		if err != nil {
+			return nil, query.ChildError(err, s, 0, s.Child)
+		}
+
+		kind := byte('+')
+		if s.Kind == query.DiffLineRemoved {
+			kind = '-'
+		}
+		visitMatchTree(ct, func(mt matchTree) {
+			switch mt := mt.(type) {
+			case *substrMatchTree:
+				mt.diffLine = kind
+			case *regexpMatchTree:
+				mt.diffLine = kind
+			}
+		})
+		return ct, nil
+
 	case *query.Substring:
-		return d.newSubstringMatchTree(s)
+		return d.newSubstringMatchTree(s, opt)
+	case *compiledSubstring:
+		return d.newCompiledSubstringMatchTree(s, opt)
 
 	case *query.Branch:
 		masks := make([]uint64, 0, len(d.repoMetaData))
@@ -846,8 +943,8 @@ func (d *indexData) newMatchTree(q query.Q) (matchTree, error) {
 			for _, branchIDs := range d.branchIDs {
 				mask := uint64(0)
 				for nm, m := range branchIDs {
-					if (s.Exact && nm == s.Pattern) || (!s.Exact && strings.Contains(nm, s.Pattern)) {
-						mask |= uint64(m)
+					if branchMatches(s, nm) {
+						mask |= m
 					}
 				}
 				masks = append(masks, mask)
@@ -878,20 +975,67 @@ func (d *indexData) newMatchTree(q query.Q) (matchTree, error) {
 			},
 		}, nil
 
+	case *query.LanguageSet:
+		var codes [256]bool
+		for lang := range s.Set {
+			if code, ok := d.metaData.LanguageMap[lang]; ok {
+				codes[code] = true
+			}
+		}
+		return &docMatchTree{
+			reason:  "languageset",
+			numDocs: d.numDocs(),
+			predicate: func(docID uint32) bool {
+				return codes[d.languages[docID]]
+			},
+		}, nil
+
+	case *query.FileChecksum:
+		docs := map[uint32]bool{}
+		for _, docID := range d.checksumDocs(s.Sum) {
+			docs[docID] = true
+		}
+		return &docMatchTree{
+			reason:  "checksum",
+			numDocs: d.numDocs(),
+			predicate: func(docID uint32) bool {
+				return docs[docID]
+			},
+		}, nil
+
 	case *query.Symbol:
-		subMT, err := d.newMatchTree(s.Expr)
+		symOpt := opt
+		symOpt.wholeLine = false
+		subMT, err := d.newMatchTree(s.Expr, symOpt)
 		if err != nil {
-			return nil, err
+			return nil, query.ChildError(err, s, 0, s.Expr)
+		}
+
+		var kinds map[string]bool
+		if len(s.Kinds) > 0 {
+			kinds = make(map[string]bool, len(s.Kinds))
+			for _, k := range s.Kinds {
+				kinds[k] = true
+			}
 		}
 
 		if substr, ok := subMT.(*substrMatchTree); ok {
-			return &symbolSubstrMatchTree{
-				substrMatchTree: substr,
-				patternSize:     uint32(utf8.RuneCountInString(substr.query.Pattern)),
-				fileEndRunes:    d.fileEndRunes,
-				fileEndSymbol:   d.fileEndSymbol,
-				sections:        unmarshalDocSections(d.runeDocSections, nil),
-			}, nil
+			if kinds == nil {
+				return &symbolSubstrMatchTree{
+					substrMatchTree: substr,
+					patternSize:     uint32(utf8.RuneCountInString(substr.query.Pattern)),
+					fileEndRunes:    d.fileEndRunes,
+					fileEndSymbol:   d.fileEndSymbol,
+					sections:        unmarshalDocSections(d.runeDocSections, nil),
+				}, nil
+			}
+			// Only symbolRegexpMatchTree looks at the kinds of the
+			// symbols. The substring still finds the candidates.
+			subMT = &andMatchTree{
+				children: []matchTree{
+					newLiteralRegexpMatchTree(substr.query, false), &noVisitMatchTree{substr},
+				},
+			}
 		}
 
 		var regexp *regexp.Regexp
@@ -901,22 +1045,34 @@ func (d *indexData) newMatchTree(q query.Q) (matchTree, error) {
 			}
 		})
 		if regexp == nil {
-			return nil, fmt.Errorf("found %T inside query.Symbol", subMT)
+			return nil, &query.Error{Q: s, Err: fmt.Errorf("found %T inside query.Symbol", subMT)}
 		}
 
 		return &symbolRegexpMatchTree{
 			regexp:    regexp,
 			all:       regexp.String() == "(?i)(?-s:.)*",
+			kinds:     kinds,
 			matchTree: subMT,
 		}, nil
 
+	case *query.SymbolKind:
+		kinds := make(map[string]bool, len(s.Kinds))
+		for _, k := range s.Kinds {
+			kinds[k] = true
+		}
+		return &symbolRegexpMatchTree{
+			all:       true,
+			kinds:     kinds,
+			matchTree: &bruteForceMatchTree{},
+		}, nil
+
 	case *query.BranchesRepos:
 		reposBranchesWant := make([]uint64, len(d.repoMetaData))
 		for repoIdx := range d.repoMetaData {
 			var mask uint64
 			for _, br := range s.List {
 				if br.Repos.Contains(d.repoMetaData[repoIdx].ID) {
-					mask |= uint64(d.branchIDs[repoIdx][br.Branch])
+					mask |= d.branchIDs[repoIdx][br.Branch]
 				}
 			}
 			reposBranchesWant[repoIdx] = mask
@@ -939,7 +1095,7 @@ func (d *indexData) newMatchTree(q query.Q) (matchTree, error) {
 					if !ok {
 						continue
 					}
-					mask = mask | uint64(m)
+					mask = mask | m
 				}
 				reposBranchesWant[repoIdx] = mask
 			}
@@ -955,7 +1111,7 @@ func (d *indexData) newMatchTree(q query.Q) (matchTree, error) {
 	case *query.RepoSet:
 		reposWant := make([]bool, len(d.repoMetaData))
 		for repoIdx, r := range d.repoMetaData {
-			if _, ok := s.Set[r.Name]; ok {
+			if s.Has(r.Name) {
 				reposWant[repoIdx] = true
 			}
 		}
@@ -981,6 +1137,18 @@ func (d *indexData) newMatchTree(q query.Q) (matchTree, error) {
 				return reposWant[d.repos[docID]]
 			},
 		}, nil
+	case *query.RepoRawConfig:
+		reposWant := make([]bool, len(d.repoMetaData))
+		for repoIdx, r := range d.repoMetaData {
+			reposWant[repoIdx] = repoHasRawConfig(&r, s)
+		}
+		return &docMatchTree{
+			reason:  s.String(),
+			numDocs: d.numDocs(),
+			predicate: func(docID uint32) bool {
+				return reposWant[d.repos[docID]]
+			},
+		}, nil
 	case query.RawConfig:
 		return &docMatchTree{
 			reason:  s.String(),
@@ -1005,33 +1173,61 @@ func (d *indexData) filterDocs(predicate func(docID uint32) bool) []uint32 {
 	return docs
 }
 
-func (d *indexData) newSubstringMatchTree(s *query.Substring) (matchTree, error) {
+func (d *indexData) newSubstringMatchTree(s *query.Substring, opt matchTreeOpt) (matchTree, error) {
+	return d.newCompiledSubstringMatchTree(newCompiledSubstring(s), opt)
+}
+
+func (d *indexData) newCompiledSubstringMatchTree(cs *compiledSubstring, opt matchTreeOpt) (matchTree, error) {
+	s := &cs.Substring
 	st := &substrMatchTree{
 		query:         s,
 		caseSensitive: s.CaseSensitive,
 		fileName:      s.FileName,
+		wholeLine:     opt.wholeLine && !s.FileName,
 	}
 
 	if utf8.RuneCountInString(s.Pattern) < ngramSize {
-		prefix := ""
-		if !s.CaseSensitive {
-			prefix = "(?i)"
-		}
-		t := &regexpMatchTree{
-			regexp:   regexp.MustCompile(prefix + regexp.QuoteMeta(s.Pattern)),
-			fileName: s.FileName,
-		}
-		return t, nil
+		return newLiteralRegexpMatchTree(s, st.wholeLine), nil
 	}
 
-	result, err := d.iterateNgrams(s)
+	result, err := d.iterateCompiledNgrams(cs, opt)
 	if err != nil {
 		return nil, err
 	}
+	if result == nil {
+		return newLiteralRegexpMatchTree(s, st.wholeLine), nil
+	}
 	st.matchIterator = result
 	return st, nil
 }
 
+// newLiteralRegexpMatchTree returns a matchTree that finds s by scanning
+// every document, for substrings the ngram index cannot help with. If
+// wholeLine is set, s must span a complete line.
+func newLiteralRegexpMatchTree(s *query.Substring, wholeLine bool) matchTree {
+	prefix := ""
+	if !s.CaseSensitive {
+		prefix = "(?i)"
+	}
+	if wholeLine {
+		return &regexpMatchTree{
+			regexp:    wholeLineRegexp(prefix, regexp.QuoteMeta(s.Pattern)),
+			wholeLine: true,
+		}
+	}
+	return &regexpMatchTree{
+		regexp:   regexp.MustCompile(prefix + regexp.QuoteMeta(s.Pattern)),
+		fileName: s.FileName,
+	}
+}
+
+// wholeLineRegexp compiles expr, with the flags in prefix, anchored to
+// match complete lines only. A "\r" ending the line is part of the match,
+// and must be left out by the caller.
+func wholeLineRegexp(prefix, expr string) *regexp.Regexp {
+	return regexp.MustCompile(prefix + `(?m)^(?:` + expr + `)\r?$`)
+}
+
 // pruneMatchTree removes impossible branches from the matchTree, as indicated
 // by substrMatchTree having a noMatchTree and the resulting impossible and clauses and so forth.
 func pruneMatchTree(mt matchTree) (matchTree, error) {
@@ -1120,3 +1316,38 @@ func pruneMatchTree(mt matchTree) (matchTree, error) {
 	}
 	return mt, err
 }
+
+// branchMatches returns true if the branch name matches q.
+func branchMatches(q *query.Branch, name string) bool {
+	switch {
+	case q.Exact:
+		return name == q.Pattern
+	case strings.Contains(q.Pattern, "*"):
+		// Git does not allow '*' in branch names, so the pattern
+		// must be a glob.
+		return globMatch(q.Pattern, name)
+	default:
+		return strings.Contains(name, q.Pattern)
+	}
+}
+
+// globMatch reports whether name matches pattern, in which '*' matches any
+// sequence of characters. Unlike path.Match, '*' also matches '/', so
+// "release/*" matches "release/1.0/hotfix".
+func globMatch(pattern, name string) bool {
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(name, parts[0]) {
+		return false
+	}
+	name = name[len(parts[0]):]
+
+	last := len(parts) - 1
+	for _, p := range parts[1:last] {
+		i := strings.Index(name, p)
+		if i < 0 {
+			return false
+		}
+		name = name[i+len(p):]
+	}
+	return strings.HasSuffix(name, parts[last])
+}
@@ -15,7 +15,10 @@
 package zoekt
 
 import (
+	"context"
+	"fmt"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/RoaringBitmap/roaring"
@@ -177,7 +180,7 @@ func TestEquivalentQuerySkipRegexpTree(t *testing.T) {
 		}
 
 		d := &indexData{}
-		mt, err := d.newMatchTree(q)
+		mt, err := d.newMatchTree(q, matchTreeOpt{})
 		if err != nil {
 			t.Errorf("Error creating match tree from query: %s", q)
 			continue
@@ -209,7 +212,7 @@ func TestSymbolMatchRegexAll(t *testing.T) {
 		}
 
 		d := &indexData{}
-		mt, err := d.newMatchTree(q)
+		mt, err := d.newMatchTree(q, matchTreeOpt{})
 		if err != nil {
 			t.Errorf("Error creating match tree from query: %s", q)
 			continue
@@ -233,7 +236,7 @@ func TestRepoSet(t *testing.T) {
 		fileBranchMasks: []uint64{1, 1, 1, 1, 1, 1},
 		repos:           []uint16{0, 0, 1, 2, 3, 3},
 	}
-	mt, err := d.newMatchTree(&query.RepoSet{Set: map[string]bool{"r1": true, "r3": true, "r99": true}})
+	mt, err := d.newMatchTree(&query.RepoSet{Set: map[string]bool{"r1": true, "r3": true, "r99": true}}, matchTreeOpt{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -256,7 +259,7 @@ func TestRepo(t *testing.T) {
 		fileBranchMasks: []uint64{1, 1, 1, 1, 1},
 		repos:           []uint16{0, 0, 1, 0, 1},
 	}
-	mt, err := d.newMatchTree(&query.Repo{"ar"})
+	mt, err := d.newMatchTree(&query.Repo{"ar"}, matchTreeOpt{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -278,9 +281,9 @@ func TestRepoBranches(t *testing.T) {
 		repoMetaData:    []Repository{{Name: "foo"}, {Name: "bar"}},
 		fileBranchMasks: []uint64{1, 1, 1, 2, 1, 2, 1},
 		repos:           []uint16{0, 0, 1, 1, 1, 1, 1},
-		branchIDs:       []map[string]uint{{"HEAD": 1}, {"HEAD": 1, "b1": 2}},
+		branchIDs:       []map[string]uint64{{"HEAD": 1}, {"HEAD": 1, "b1": 2}},
 	}
-	mt, err := d.newMatchTree(&query.RepoBranches{Set: map[string][]string{"bar": {"b1", "b2"}}})
+	mt, err := d.newMatchTree(&query.RepoBranches{Set: map[string][]string{"bar": {"b1", "b2"}}}, matchTreeOpt{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -305,13 +308,13 @@ func TestBranchesRepos(t *testing.T) {
 		},
 		fileBranchMasks: []uint64{1, 1, 1, 2, 1, 2, 1},
 		repos:           []uint16{0, 0, 1, 1, 1, 1, 1},
-		branchIDs:       []map[string]uint{{"HEAD": 1}, {"HEAD": 1, "b1": 2}},
+		branchIDs:       []map[string]uint64{{"HEAD": 1}, {"HEAD": 1, "b1": 2}},
 	}
 
 	mt, err := d.newMatchTree(&query.BranchesRepos{List: []query.BranchRepos{
 		{Branch: "b1", Repos: roaring.BitmapOf(hash("bar"))},
 		{Branch: "b2", Repos: roaring.BitmapOf(hash("bar"))},
-	}})
+	}}, matchTreeOpt{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -329,3 +332,67 @@ func TestBranchesRepos(t *testing.T) {
 		t.Fatalf("expect %d documents, but got at least 1 more", len(want))
 	}
 }
+
+func TestNgramSkipFraction(t *testing.T) {
+	b, err := NewIndexBuilder(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := b.AddFile(fmt.Sprintf("f%d.txt", i), []byte("the end")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// "ezz" is in a single document, but occurs more often than there
+	// are documents.
+	if err := b.AddFile("needle.txt", []byte("thez "+strings.Repeat("ezz ", 20))); err != nil {
+		t.Fatal(err)
+	}
+	d := searcherForTest(t, b).(*indexData)
+	opt := matchTreeOpt{ngramSkipFraction: 0.5}
+
+	// "the" is in every document, so only "hez" selects candidates.
+	mt, err := d.newMatchTree(&query.Substring{Pattern: "thez", Content: true, CaseSensitive: true}, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, ok := mt.(*substrMatchTree)
+	if !ok {
+		t.Fatalf("got %T, want *substrMatchTree", mt)
+	}
+	iter := st.matchIterator.(*ngramIterationResults).matchIterator.(*ngramDocIterator)
+	if _, ok := iter.iter.(*distanceHitIterator); ok || iter.leftPad != 1 {
+		t.Errorf("got %T with leftPad %d, want single ngram at offset 1", iter.iter, iter.leftPad)
+	}
+
+	// The document count, not the number of occurrences, decides.
+	if got, err := d.ngramDocCount(stringToNGram("ezz"), false); err != nil || got != 1 {
+		t.Errorf("ngramDocCount(ezz): got %d, %v, want 1", got, err)
+	}
+	mt, err = d.newMatchTree(&query.Substring{Pattern: "ezz", Content: true}, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := mt.(*substrMatchTree); !ok {
+		t.Errorf("ezz: got %T, want *substrMatchTree", mt)
+	}
+
+	// With only ubiquitous ngrams, we scan the content.
+	mt, err = d.newMatchTree(&query.Substring{Pattern: "the", Content: true}, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := mt.(*regexpMatchTree); !ok {
+		t.Errorf("got %T, want *regexpMatchTree", mt)
+	}
+
+	for pat, want := range map[string]int{"thez": 1, "the": 11, "the e": 10, "ezz": 1} {
+		res, err := d.Search(context.Background(), &query.Substring{Pattern: pat, Content: true}, &SearchOptions{NgramSkipFraction: 0.5})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Files) != want {
+			t.Errorf("%q: got %d files, want %d", pat, len(res.Files), want)
+		}
+	}
+}
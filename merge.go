@@ -2,6 +2,7 @@ package zoekt
 
 import (
 	"crypto/sha1"
+	"encoding/binary"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -44,6 +45,173 @@ func Merge(dstDir string, files ...IndexFile) (fn string, _ error) {
 	return fn, nil
 }
 
+// MergePaths merges the shards at paths into a compound shard in the
+// directory dstDir, and returns the name of the compound shard.
+func MergePaths(dstDir string, paths ...string) (fn string, _ error) {
+	var files []IndexFile
+	for _, p := range paths {
+		f, err := os.Open(p)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+
+		indexFile, err := NewIndexFile(f)
+		if err != nil {
+			return "", fmt.Errorf("NewIndexFile(%s): %v", p, err)
+		}
+		defer indexFile.Close()
+
+		files = append(files, indexFile)
+	}
+
+	return Merge(dstDir, files...)
+}
+
+// SplitRepo writes the documents of the repository repoName in the shard
+// src, usually a compound shard, to the single repository shard dst. This
+// is the inverse of merging, for repositories that need to be reindexed or
+// moved on their own.
+func SplitRepo(src, dst, repoName string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	indexFile, err := NewIndexFile(f)
+	if err != nil {
+		return fmt.Errorf("NewIndexFile(%s): %v", src, err)
+	}
+	defer indexFile.Close()
+
+	searcher, err := NewSearcher(indexFile)
+	if err != nil {
+		return err
+	}
+	d := searcher.(*indexData)
+
+	repoIdx := -1
+	for i, md := range d.repoMetaData {
+		if md.Name == repoName && !md.Tombstone {
+			repoIdx = i
+			break
+		}
+	}
+	if repoIdx < 0 {
+		return fmt.Errorf("%s has no repository %q", src, repoName)
+	}
+
+	ib, err := NewIndexBuilder(&d.repoMetaData[repoIdx])
+	if err != nil {
+		return err
+	}
+	ib.SymbolsOnly = d.metaData.SymbolsOnly
+	for docID := uint32(0); docID < d.numDocs(); docID++ {
+		if int(d.repos[docID]) != repoIdx {
+			continue
+		}
+		doc, err := d.readDocument(docID)
+		if err != nil {
+			return err
+		}
+		if err := ib.Add(doc); err != nil {
+			return err
+		}
+	}
+
+	return builderWriteAll(dst, ib)
+}
+
+// EstimateMergeSize estimates the size of the compound shard MergePaths
+// would write for paths, without building it. Tombstoned repositories are
+// left out, and ngrams that occur in several inputs are counted once.
+func EstimateMergeSize(paths ...string) (int64, error) {
+	var size int64
+	ngrams := map[ngram]struct{}{}
+	nameNgrams := map[ngram]struct{}{}
+	for _, p := range paths {
+		n, err := estimateShardSize(p, ngrams, nameNgrams)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", p, err)
+		}
+		size += n
+	}
+
+	// Each distinct ngram takes up its text and an entry in the postings
+	// index.
+	size += int64(len(ngrams)+len(nameNgrams)) * (ngramEncoding + 4)
+	return size, nil
+}
+
+// estimateShardSize returns the number of bytes the live documents of the
+// shard at p add to a compound shard, not counting the ngrams, which it
+// adds to ngrams and nameNgrams instead.
+func estimateShardSize(p string, ngrams, nameNgrams map[ngram]struct{}) (int64, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	indexFile, err := NewIndexFile(f)
+	if err != nil {
+		return 0, err
+	}
+	defer indexFile.Close()
+
+	rd := &reader{r: indexFile}
+	var toc indexTOC
+	if err := rd.readTOC(&toc); err != nil {
+		return 0, err
+	}
+	d, err := rd.readIndexData(&toc)
+	if err != nil {
+		return 0, err
+	}
+
+	live := 0
+	for _, repoID := range d.repos {
+		if !d.repoMetaData[repoID].Tombstone {
+			live++
+		}
+	}
+	if live == 0 {
+		return 0, nil
+	}
+	// Most sections grow with the number of documents, so only count the
+	// share of the live ones.
+	fraction := float64(live) / float64(len(d.repos))
+
+	for sec, set := range map[simpleSection]map[ngram]struct{}{
+		toc.ngramText:     ngrams,
+		toc.nameNgramText: nameNgrams,
+	} {
+		blob, err := d.readSectionBlob(sec)
+		if err != nil {
+			return 0, err
+		}
+		for i := 0; i+ngramEncoding <= len(blob); i += ngramEncoding {
+			set[ngram(binary.BigEndian.Uint64(blob[i:]))] = struct{}{}
+		}
+	}
+
+	var size float64
+	for _, ent := range toc.sectionsTaggedList() {
+		switch ent.tag {
+		case "ngramText", "nameNgramText":
+			// Counted by EstimateMergeSize.
+		case "postings":
+			size += float64(toc.postings.data.sz) * fraction
+		case "namePostings":
+			size += float64(toc.namePostings.data.sz) * fraction
+		default:
+			size += float64(sectionSize(ent.sec)) * fraction
+		}
+	}
+	return int64(size), nil
+}
+
 func builderWriteAll(fn string, ib *IndexBuilder) error {
 	dir := filepath.Dir(fn)
 	if err := os.MkdirAll(dir, 0o700); err != nil {
@@ -84,77 +252,260 @@ func builderWriteAll(fn string, ib *IndexBuilder) error {
 }
 
 func merge(ds ...*indexData) (*IndexBuilder, error) {
-	if len(ds) == 0 {
-		return nil, fmt.Errorf("need 1 or more indexData to merge")
+	if err := canMerge(ds...); err != nil {
+		return nil, err
 	}
 
-	ib := newIndexBuilder()
-	ib.indexFormatVersion = NextIndexFormatVersion
+	ib := newMergeBuilder(ds[0].metaData.SymbolsOnly)
+	for _, d := range ds {
+		if err := mergeDocs(d, func(*Repository) (*IndexBuilder, error) { return ib, nil }, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return ib, nil
+}
+
+// MergeStreaming merges files into a compound shard in the directory
+// dstDir, like Merge, but in memory that doesn't grow with the size of the
+// inputs. Content is written from files without copying, and the content
+// postings of each input are copied to a temporary file in dstDir instead
+// of being computed again, so that only the metadata of the documents and
+// the last offset of each ngram are kept in memory. File names are short,
+// and are tokenized again. MergeStreaming closes files when it returns.
+func MergeStreaming(dstDir string, files ...IndexFile) (fn string, _ error) {
+	if len(files) == 0 {
+		return "", fmt.Errorf("need 1 or more files to merge")
+	}
 
+	ds := make([]*indexData, 0, len(files))
+	defer func() {
+		for _, d := range ds {
+			d.Close()
+		}
+	}()
+	for i, f := range files {
+		searcher, err := NewSearcher(f)
+		if err != nil {
+			for _, f := range files[i:] {
+				f.Close()
+			}
+			return "", err
+		}
+		ds = append(ds, searcher.(*indexData))
+	}
+	if err := canMerge(ds...); err != nil {
+		return "", err
+	}
+
+	dropped := map[ngram]struct{}{}
 	for _, d := range ds {
-		lastRepoID := -1
-		for docID := uint32(0); int(docID) < len(d.fileBranchMasks); docID++ {
-			repoID := int(d.repos[docID])
+		for ng := range d.droppedNgrams {
+			dropped[ng] = struct{}{}
+		}
+	}
 
-			if d.repoMetaData[repoID].Tombstone {
+	if err := os.MkdirAll(dstDir, 0o700); err != nil {
+		return "", err
+	}
+	ib := newMergeBuilder(ds[0].metaData.SymbolsOnly)
+	ib.SpillThreshold = mergeSpillThreshold
+	ib.SpillDir = dstDir
+	defer ib.contentPostings.removeSegments()
+	defer ib.namePostings.removeSegments()
+	for ng := range dropped {
+		ib.contentPostings.dropped = append(ib.contentPostings.dropped, ng)
+	}
+
+	hasher := sha1.New()
+	for _, d := range ds {
+		for _, md := range d.repoMetaData {
+			if md.Tombstone {
 				continue
 			}
+			hasher.Write([]byte(md.Name))
+			hasher.Write([]byte{0})
+		}
+
+		// starts holds the rune offset of each document of d in ib.
+		starts := make([]uint32, len(d.fileBranchMasks))
+		err := mergeDocs(d, func(*Repository) (*IndexBuilder, error) { return ib, nil }, func(docID uint32, doc Document) error {
+			starts[docID] = ib.contentPostings.runeCount
+			// The postings are copied by spillMerged below.
+			if err := ib.add(doc, []docNgram{}); err != nil {
+				return err
+			}
+			want := d.fileEndRunes[docID]
+			if docID > 0 {
+				want -= d.fileEndRunes[docID-1]
+			}
+			if got := ib.contentPostings.runeCount - starts[docID]; got != want {
+				return fmt.Errorf("%s: document %q has %d runes after merging, want %d", d.String(), doc.Name, got, want)
+			}
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+		if err := ib.contentPostings.spillMerged(dstDir, d, starts, dropped); err != nil {
+			return "", err
+		}
+	}
 
-			if repoID != lastRepoID {
-				if lastRepoID > repoID {
-					return nil, fmt.Errorf("non-contiguous repo ids in %s for document %d: old=%d current=%d", d.String(), docID, lastRepoID, repoID)
-				}
-				lastRepoID = repoID
+	fn = filepath.Join(dstDir, fmt.Sprintf("compound-%x_v%d.%05d.zoekt", hasher.Sum(nil), NextIndexFormatVersion, 0))
+	if err := builderWriteAll(fn, ib); err != nil {
+		return "", err
+	}
+	return fn, nil
+}
 
-				// TODO we are losing empty repos on merging since we only get here if
-				// there is an associated document.
+// mergeSpillThreshold is the SpillThreshold of the builder of
+// MergeStreaming, which bounds the file name postings held in memory.
+const mergeSpillThreshold = 64 << 20
 
-				if err := ib.setRepository(&d.repoMetaData[repoID]); err != nil {
-					return nil, err
-				}
-			}
+func newMergeBuilder(symbolsOnly bool) *IndexBuilder {
+	ib := newIndexBuilder()
+	ib.indexFormatVersion = NextIndexFormatVersion
+	ib.SymbolsOnly = symbolsOnly
+	return ib
+}
+
+// canMerge returns an error if ds can't be merged into one compound
+// shard: they must have a format version that merging supports, all or
+// none must store only symbols, and they must agree on the index options
+// of the repositories they share. Feature versions may differ, since the
+// documents are re-added to the compound shard.
+func canMerge(ds ...*indexData) error {
+	if len(ds) == 0 {
+		return fmt.Errorf("need 1 or more indexData to merge")
+	}
+
+	indexOptions := map[uint32]string{}
+	for _, d := range ds {
+		md := &d.metaData
+		if v := md.IndexFormatVersion; v != IndexFormatVersion && v != NextIndexFormatVersion {
+			return fmt.Errorf("%s: can't merge index format version %d", d.String(), v)
+		}
+		if md.SymbolsOnly != ds[0].metaData.SymbolsOnly {
+			return fmt.Errorf("%s and %s don't both store only symbols", d.String(), ds[0].String())
+		}
+		if err := checkIndexOptions(indexOptions, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-			doc := Document{
-				Name: string(d.fileName(docID)),
-				// Content set below since it can return an error
-				// Branches set below since it requires lookups
-				SubRepositoryPath: d.subRepoPaths[repoID][d.subRepos[docID]],
-				Language:          d.languageMap[d.languages[docID]],
-				// SkipReason not set, will be part of content from original indexer.
+// checkIndexOptions returns an error if a repository of d was seen before
+// with different index options. seen maps repository IDs to their index
+// options, and is updated with the repositories of d.
+func checkIndexOptions(seen map[uint32]string, d *indexData) error {
+	// A repository indexed with different options in different shards
+	// can't be represented by a single entry in the compound shard. Only
+	// repositories with an ID can be identified reliably.
+	for _, md := range d.repoMetaData {
+		if md.Tombstone || md.ID == 0 {
+			continue
+		}
+		if opts, ok := seen[md.ID]; ok && opts != md.IndexOptions {
+			return fmt.Errorf("repository %q (id %d) has incompatible index options %q and %q", md.Name, md.ID, opts, md.IndexOptions)
+		}
+		seen[md.ID] = md.IndexOptions
+	}
+	return nil
+}
+
+// mergeDocs adds the documents of all live repositories in d to the
+// builder returned by builderFor, which is called once per repository. If
+// add is non-nil, it is called to add each document instead of
+// IndexBuilder.Add.
+func mergeDocs(d *indexData, builderFor func(*Repository) (*IndexBuilder, error), add func(docID uint32, doc Document) error) error {
+	var ib *IndexBuilder
+	lastRepoID := -1
+	for docID := uint32(0); int(docID) < len(d.fileBranchMasks); docID++ {
+		repoID := int(d.repos[docID])
+
+		if d.repoMetaData[repoID].Tombstone {
+			continue
+		}
+
+		if repoID != lastRepoID {
+			if lastRepoID > repoID {
+				return fmt.Errorf("non-contiguous repo ids in %s for document %d: old=%d current=%d", d.String(), docID, lastRepoID, repoID)
 			}
+			lastRepoID = repoID
+
+			// TODO we are losing empty repos on merging since we only get here if
+			// there is an associated document.
 
 			var err error
-			if doc.Content, err = d.readContents(docID); err != nil {
-				return nil, err
+			if ib, err = builderFor(&d.repoMetaData[repoID]); err != nil {
+				return err
 			}
-
-			if doc.Symbols, _, err = d.readDocSections(docID, nil); err != nil {
-				return nil, err
+			if err := ib.setRepository(&d.repoMetaData[repoID]); err != nil {
+				return err
 			}
+		}
 
-			doc.SymbolsMetaData = make([]*Symbol, len(doc.Symbols))
-			for i := range doc.SymbolsMetaData {
-				doc.SymbolsMetaData[i] = d.symbols.data(d.fileEndSymbol[docID] + uint32(i))
-			}
+		doc, err := d.readDocument(docID)
+		if err != nil {
+			return err
+		}
 
-			// calculate branches
-			{
-				mask := d.fileBranchMasks[docID]
-				id := uint32(1)
-				for mask != 0 {
-					if mask&0x1 != 0 {
-						doc.Branches = append(doc.Branches, d.branchNames[repoID][uint(id)])
-					}
-					id <<= 1
-					mask >>= 1
-				}
-			}
+		if add != nil {
+			err = add(docID, doc)
+		} else {
+			err = ib.Add(doc)
+		}
+		if err != nil {
+			return err
+		}
+	}
 
-			if err := ib.Add(doc); err != nil {
-				return nil, err
+	return nil
+}
+
+// readDocument reconstructs the document docID, as it was passed to
+// IndexBuilder.Add.
+func (d *indexData) readDocument(docID uint32) (Document, error) {
+	repoID := d.repos[docID]
+	doc := Document{
+		Name: string(d.fileName(docID)),
+		// Content set below since it can return an error
+		// Branches set below since it requires lookups
+		SubRepositoryPath: d.subRepoPaths[repoID][d.subRepos[docID]],
+		Language:          d.languageMap[d.languages[docID]],
+		RankBoost:         d.rankBoost(docID),
+		ModTime:           d.modTime(docID),
+		SkipReason:        d.skipReason(docID),
+	}
+
+	var err error
+	if doc.Content, err = d.readContents(docID); err != nil {
+		return Document{}, err
+	}
+
+	if doc.Symbols, _, err = d.readDocSections(docID, nil); err != nil {
+		return Document{}, err
+	}
+
+	doc.SymbolsMetaData = make([]*Symbol, len(doc.Symbols))
+	for i := range doc.SymbolsMetaData {
+		doc.SymbolsMetaData[i] = d.symbols.data(d.fileEndSymbol[docID] + uint32(i))
+	}
+
+	// calculate branches
+	{
+		mask := d.fileBranchMasks[docID]
+		id := uint64(1)
+		for mask != 0 {
+			if mask&0x1 != 0 {
+				doc.Branches = append(doc.Branches, d.branchNames[repoID][id])
 			}
+			id <<= 1
+			mask >>= 1
 		}
 	}
 
-	return ib, nil
+	return doc, nil
 }
@@ -0,0 +1,515 @@
+package zoekt
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/zoekt/query"
+)
+
+func searcherForPath(t *testing.T, fn string) Searcher {
+	t.Helper()
+	f, err := os.Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	indexFile, err := NewIndexFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	searcher, err := NewSearcher(indexFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return searcher
+}
+
+func TestMergePaths(t *testing.T) {
+	dir := t.TempDir()
+	writeShard := func(name string, repo *Repository, docs ...Document) string {
+		t.Helper()
+		fn := filepath.Join(dir, name)
+		if err := builderWriteAll(fn, testIndexBuilder(t, repo, docs...)); err != nil {
+			t.Fatal(err)
+		}
+		return fn
+	}
+
+	a := writeShard("a.zoekt", &Repository{ID: 1, Name: "repoA", IndexOptions: "opts"},
+		Document{Name: "f1", Content: []byte("needle in a haystack"), Language: "Text"})
+	b := writeShard("b.zoekt", &Repository{ID: 2, Name: "repoB", IndexOptions: "opts"},
+		Document{Name: "f2", Content: []byte("another needle")})
+
+	fn, err := MergePaths(filepath.Join(dir, "out"), a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	searcher := searcherForPath(t, fn)
+	defer searcher.Close()
+
+	res, err := searcher.Search(context.Background(), &query.Substring{Pattern: "needle"}, &SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, fm := range res.Files {
+		got = append(got, fm.Repository+"/"+fm.FileName+":"+fm.Language)
+	}
+	sort.Strings(got)
+	if want := []string{"repoA/f1:Text", "repoB/f2:"}; strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	c := writeShard("c.zoekt", &Repository{ID: 1, Name: "repoA", IndexOptions: "other"},
+		Document{Name: "f1", Content: []byte("needle")})
+	if _, err := MergePaths(filepath.Join(dir, "out2"), a, c); err == nil || !strings.Contains(err.Error(), "incompatible index options") {
+		t.Errorf("got err %v, want incompatible index options", err)
+	}
+}
+
+func TestEstimateMergeSize(t *testing.T) {
+	dir := t.TempDir()
+	var paths []string
+	for i, name := range []string{"repoA", "repoB", "repoC"} {
+		var docs []Document
+		for j := 0; j < 20; j++ {
+			docs = append(docs, Document{
+				Name:    fmt.Sprintf("dir%d/file%d.go", j%4, j),
+				Content: []byte(strings.Repeat(fmt.Sprintf("func f%d_%d() { return %q }\n", i, j, name), 10+j)),
+			})
+		}
+		fn := filepath.Join(dir, name+".zoekt")
+		if err := builderWriteAll(fn, testIndexBuilder(t, &Repository{Name: name}, docs...)); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, fn)
+	}
+
+	check := func() {
+		t.Helper()
+		estimate, err := EstimateMergeSize(paths...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fn, err := MergePaths(t.TempDir(), paths...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := float64(estimate) / float64(fi.Size()); got < 0.9 || got > 1.1 {
+			t.Errorf("estimated %d bytes, merged shard has %d", estimate, fi.Size())
+		}
+	}
+	check()
+
+	// Tombstoned repositories are not merged.
+	compound, err := MergePaths(dir, paths[0], paths[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SetTombstone(compound, "repoB", true); err != nil {
+		t.Fatal(err)
+	}
+	paths = []string{compound, paths[2]}
+	check()
+}
+
+func TestMergeSymbols(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.zoekt")
+	b := filepath.Join(dir, "b.zoekt")
+	content := []byte("package x\nfunc needle() {}\n")
+	// ----------------0123456789 0123456789012
+	if err := builderWriteAll(a, testIndexBuilder(t, &Repository{Name: "repoA"},
+		Document{
+			Name:            "x.go",
+			Content:         content,
+			Symbols:         []DocumentSection{{15, 21}},
+			SymbolsMetaData: []*Symbol{{Sym: "needle", Kind: "function"}},
+		})); err != nil {
+		t.Fatal(err)
+	}
+	if err := builderWriteAll(b, testIndexBuilder(t, &Repository{Name: "repoB"},
+		Document{Name: "y.go", Content: []byte("needle")})); err != nil {
+		t.Fatal(err)
+	}
+
+	fn, err := MergePaths(filepath.Join(dir, "out"), b, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	searcher := searcherForPath(t, fn)
+	defer searcher.Close()
+
+	res, err := searcher.Search(context.Background(),
+		&query.Symbol{Expr: &query.Substring{Pattern: "needle"}}, &SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Files) != 1 || len(res.Files[0].LineMatches) != 1 {
+		t.Fatalf("got %v, want 1 line in 1 file", res.Files)
+	}
+	if got := res.Files[0].Repository + "/" + res.Files[0].FileName; got != "repoA/x.go" {
+		t.Errorf("got file %s, want repoA/x.go", got)
+	}
+	m := res.Files[0].LineMatches[0].LineFragments[0]
+	if m.Offset != 15 || m.MatchLength != 6 {
+		t.Errorf("got offset %d length %d, want 15 and 6", m.Offset, m.MatchLength)
+	}
+	if m.SymbolInfo == nil || *m.SymbolInfo != (Symbol{Sym: "needle", Kind: "function"}) {
+		t.Errorf("got symbol info %+v, want needle function", m.SymbolInfo)
+	}
+}
+
+func TestMergeStreaming(t *testing.T) {
+	dir := t.TempDir()
+	openFile := func(fn string) IndexFile {
+		t.Helper()
+		f, err := os.Open(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		indexFile, err := NewIndexFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return indexFile
+	}
+
+	var fns []string
+	for i, name := range []string{"repoA", "repoB", "repoC"} {
+		fn := filepath.Join(dir, name+".zoekt")
+		content := []byte(strings.Repeat("needle häystack "+name+"\n", 10*(i+1)))
+		if err := builderWriteAll(fn, testIndexBuilder(t, &Repository{Name: name},
+			Document{Name: "f1", Content: content},
+			Document{Name: "f2", Content: content[len(content)/2:]})); err != nil {
+			t.Fatal(err)
+		}
+		fns = append(fns, fn)
+	}
+
+	// The documents of repoA are left out of the compound shard of repoA
+	// and repoB, which shifts the offsets of the postings of repoB.
+	compound, err := Merge(filepath.Join(dir, "compound"), openFile(fns[0]), openFile(fns[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SetTombstone(compound, "repoA", true); err != nil {
+		t.Fatal(err)
+	}
+
+	inputs := []string{compound, fns[2], fns[0]}
+	var files []IndexFile
+	for _, fn := range inputs {
+		files = append(files, openFile(fn))
+	}
+	got, err := MergeStreaming(filepath.Join(dir, "streaming"), files...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files = files[:0]
+	for _, fn := range inputs {
+		files = append(files, openFile(fn))
+	}
+	want, err := Merge(filepath.Join(dir, "merge"), files...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Base(got) != filepath.Base(want) {
+		t.Errorf("got compound shard %s, want %s", filepath.Base(got), filepath.Base(want))
+	}
+
+	search := func(fn string, q query.Q) []string {
+		searcher := searcherForPath(t, fn)
+		defer searcher.Close()
+		res, err := searcher.Search(context.Background(), q, &SearchOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var matches []string
+		for _, fm := range res.Files {
+			for _, lm := range fm.LineMatches {
+				matches = append(matches, fmt.Sprintf("%s/%s:%d:%s", fm.Repository, fm.FileName, lm.LineNumber, lm.Line))
+			}
+		}
+		sort.Strings(matches)
+		return matches
+	}
+	for _, q := range []query.Q{
+		&query.Substring{Pattern: "needle"},
+		&query.Substring{Pattern: "äys"},
+		&query.Substring{Pattern: "repoB"},
+		&query.Substring{Pattern: "stack repoC"},
+	} {
+		gotMatches, wantMatches := search(got, q), search(want, q)
+		if len(wantMatches) == 0 {
+			t.Fatalf("%s: no matches in merged shard", q)
+		}
+		if d := cmp.Diff(wantMatches, gotMatches); d != "" {
+			t.Errorf("%s: mismatch (-want +got):\n%s", q, d)
+		}
+	}
+
+	// The copied postings must equal the ones computed by Merge.
+	postings := func(fn string) map[ngram][]uint32 {
+		searcher := searcherForPath(t, fn)
+		defer searcher.Close()
+		d := searcher.(*indexData)
+		m := map[ngram][]uint32{}
+		for ng := range d.ngrams.DumpMap() {
+			blob, err := d.readSectionBlob(d.ngrams.Get(ng))
+			if err != nil {
+				t.Fatal(err)
+			}
+			m[ng] = fromDeltas(blob, nil)
+		}
+		return m
+	}
+	if d := cmp.Diff(postings(want), postings(got)); d != "" {
+		t.Errorf("postings mismatch (-want +got):\n%s", d)
+	}
+}
+
+// BenchmarkMerge compares the peak heap use of Merge and MergeStreaming
+// on 512MB of content.
+func BenchmarkMerge(b *testing.B) {
+	const (
+		numShards = 16
+		shardSize = 32 << 20
+	)
+	dir := b.TempDir()
+	var fns []string
+	for i := 0; i < numShards; i++ {
+		ib, err := NewIndexBuilder(&Repository{Name: fmt.Sprintf("repo%d", i)})
+		if err != nil {
+			b.Fatal(err)
+		}
+		for j := 0; ib.ContentSize() < shardSize; j++ {
+			if err := ib.Add(Document{
+				Name:    fmt.Sprintf("f%d", j),
+				Content: []byte(strings.Repeat(fmt.Sprintf("line %d of file %d in repo %d\n", j, j, i), 100)),
+			}); err != nil {
+				b.Fatal(err)
+			}
+		}
+		fn := filepath.Join(dir, fmt.Sprintf("repo%d.zoekt", i))
+		if err := builderWriteAll(fn, ib); err != nil {
+			b.Fatal(err)
+		}
+		fns = append(fns, fn)
+	}
+
+	// openFiles opens the shards; MergeStreaming closes them.
+	openFiles := func() []IndexFile {
+		var files []IndexFile
+		for _, fn := range fns {
+			f, err := os.Open(fn)
+			if err != nil {
+				b.Fatal(err)
+			}
+			indexFile, err := NewIndexFile(f)
+			if err != nil {
+				b.Fatal(err)
+			}
+			files = append(files, indexFile)
+		}
+		return files
+	}
+
+	// peakHeap runs f and returns the highest heap usage seen meanwhile.
+	peakHeap := func(f func()) uint64 {
+		runtime.GC()
+		done := make(chan struct{})
+		peak := make(chan uint64)
+		go func() {
+			var max uint64
+			var ms runtime.MemStats
+			for {
+				runtime.ReadMemStats(&ms)
+				if ms.HeapAlloc > max {
+					max = ms.HeapAlloc
+				}
+				select {
+				case <-done:
+					peak <- max
+					return
+				case <-time.After(time.Millisecond):
+				}
+			}
+		}()
+		f()
+		close(done)
+		return <-peak
+	}
+
+	b.Run("Merge", func(b *testing.B) {
+		b.ReportAllocs()
+		var max uint64
+		for i := 0; i < b.N; i++ {
+			files := openFiles()
+			if p := peakHeap(func() {
+				if _, err := Merge(b.TempDir(), files...); err != nil {
+					b.Fatal(err)
+				}
+			}); p > max {
+				max = p
+			}
+			for _, f := range files {
+				f.Close()
+			}
+		}
+		b.ReportMetric(float64(max)/(1<<20), "peak-MB")
+	})
+	b.Run("MergeStreaming", func(b *testing.B) {
+		b.ReportAllocs()
+		var max uint64
+		for i := 0; i < b.N; i++ {
+			files := openFiles()
+			if p := peakHeap(func() {
+				if _, err := MergeStreaming(b.TempDir(), files...); err != nil {
+					b.Fatal(err)
+				}
+			}); p > max {
+				max = p
+			}
+		}
+		b.ReportMetric(float64(max)/(1<<20), "peak-MB")
+	})
+}
+
+func TestCanMerge(t *testing.T) {
+	shard := func(repo *Repository) *indexData {
+		t.Helper()
+		b := testIndexBuilder(t, repo, Document{Name: "f", Content: []byte("needle")})
+		return searcherForTest(t, b).(*indexData)
+	}
+
+	a := shard(&Repository{ID: 1, Name: "repoA", IndexOptions: "opts"})
+	b := shard(&Repository{ID: 2, Name: "repoB", IndexOptions: "opts"})
+	if err := canMerge(a, b); err != nil {
+		t.Fatalf("canMerge: %v", err)
+	}
+	if _, err := merge(a, b); err != nil {
+		t.Fatalf("merge: %v", err)
+	}
+
+	if err := canMerge(); err == nil {
+		t.Error("got no error merging nothing")
+	}
+
+	// Documents are re-added to the compound shard, so shards with older
+	// feature versions can be merged.
+	oldFeature := shard(&Repository{ID: 3, Name: "repoC"})
+	oldFeature.metaData.IndexFeatureVersion--
+	if err := canMerge(a, oldFeature); err != nil {
+		t.Errorf("canMerge with older feature version: %v", err)
+	}
+
+	oldFormat := shard(&Repository{ID: 4, Name: "repoD"})
+	oldFormat.metaData.IndexFormatVersion = IndexFormatVersion - 1
+	if err := canMerge(a, oldFormat); err == nil || !strings.Contains(err.Error(), "format version") {
+		t.Errorf("got err %v, want format version error", err)
+	}
+
+	symbolsOnly := shard(&Repository{ID: 5, Name: "repoE", IndexOptions: "opts"})
+	symbolsOnly.metaData.SymbolsOnly = true
+	if err := canMerge(a, symbolsOnly); err == nil || !strings.Contains(err.Error(), "only symbols") {
+		t.Errorf("got err %v, want error merging a symbols only shard", err)
+	}
+
+	otherOpts := shard(&Repository{ID: 1, Name: "repoA", IndexOptions: "other"})
+	if err := canMerge(a, otherOpts); err == nil || !strings.Contains(err.Error(), "incompatible index options") {
+		t.Errorf("got err %v, want incompatible index options", err)
+	}
+}
+
+func TestSplitRepo(t *testing.T) {
+	dir := t.TempDir()
+	repoA := &Repository{
+		ID:       1,
+		Name:     "repoA",
+		Branches: []RepositoryBranch{{Name: "main", Version: "v1"}, {Name: "dev", Version: "v2"}},
+	}
+	content := []byte("package x\nfunc needle() {}\n")
+	// ----------------0123456789 0123456789012
+	a := filepath.Join(dir, "a.zoekt")
+	if err := builderWriteAll(a, testIndexBuilder(t, repoA,
+		Document{
+			Name:            "x.go",
+			Content:         content,
+			Branches:        []string{"main", "dev"},
+			Symbols:         []DocumentSection{{15, 21}},
+			SymbolsMetaData: []*Symbol{{Sym: "needle", Kind: "function"}},
+		},
+		Document{Name: "y.go", Content: []byte("needle on dev"), Branches: []string{"dev"}, Language: "Go"},
+	)); err != nil {
+		t.Fatal(err)
+	}
+	b := filepath.Join(dir, "b.zoekt")
+	if err := builderWriteAll(b, testIndexBuilder(t, &Repository{ID: 2, Name: "repoB"},
+		Document{Name: "z.go", Content: []byte("needle in repoB")})); err != nil {
+		t.Fatal(err)
+	}
+
+	compound, err := MergePaths(filepath.Join(dir, "out"), b, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	split := filepath.Join(dir, "split.zoekt")
+	if err := SplitRepo(compound, split, "repoA"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := searcherForPath(t, a)
+	defer want.Close()
+	got := searcherForPath(t, split)
+	defer got.Close()
+
+	for _, q := range []query.Q{
+		&query.Substring{Pattern: "needle"},
+		&query.Symbol{Expr: &query.Substring{Pattern: "needle"}},
+		query.NewAnd(&query.Substring{Pattern: "needle"}, &query.Branch{Pattern: "main"}),
+		&query.Language{Language: "Go"},
+	} {
+		wantRes, err := want.Search(context.Background(), q, &SearchOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotRes, err := got.Search(context.Background(), q, &SearchOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(gotRes.Files) == 0 {
+			t.Errorf("%s: got no results", q)
+		}
+		if d := cmp.Diff(wantRes.Files, gotRes.Files); d != "" {
+			t.Errorf("%s: mismatch (-want +got):\n%s", q, d)
+		}
+	}
+
+	repos, _, err := ReadMetadataPath(split)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repos) != 1 || repos[0].Name != "repoA" || len(repos[0].Branches) != 2 {
+		t.Errorf("got repositories %v, want repoA with 2 branches", repos)
+	}
+
+	if err := SplitRepo(compound, filepath.Join(dir, "missing.zoekt"), "repoC"); err == nil {
+		t.Error("got no error splitting out a missing repository")
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"context"
+	"os"
+	"runtime"
+)
+
+// prefetchedPostings is the start of the postings section, read by
+// Prefetch.
+type prefetchedPostings struct {
+	off  uint32
+	data []byte
+}
+
+// prefetchCheckInterval is the number of bytes Prefetch touches between
+// checks for cancellation.
+const prefetchCheckInterval = 1 << 20
+
+// Prefetch reads the postings of the shard ahead of searches, so that the
+// first search after loading the shard doesn't have to wait for them to be
+// paged in. If budget is positive, at most budget bytes are read. It
+// returns the number of bytes read. Prefetch is safe to call concurrently
+// with searches.
+func (d *indexData) Prefetch(ctx context.Context, budget int64) (int64, error) {
+	sec := d.postings
+	if budget > 0 && int64(sec.sz) > budget {
+		sec.sz = uint32(budget)
+	}
+	if sec.sz == 0 {
+		return 0, nil
+	}
+
+	data, err := d.readSectionBlob(sec)
+	if err != nil {
+		return 0, err
+	}
+
+	// For a memory mapped file, data is backed by the file. Touch every
+	// page so that it is paged in.
+	pageSize := os.Getpagesize()
+	var sum byte
+	for i := 0; i < len(data); i += pageSize {
+		if i%prefetchCheckInterval < pageSize {
+			if err := ctx.Err(); err != nil {
+				return 0, err
+			}
+		}
+		sum += data[i]
+	}
+	runtime.KeepAlive(sum)
+
+	d.prefetched.Store(&prefetchedPostings{off: sec.off, data: data})
+	return int64(len(data)), nil
+}
+
+// readPostings returns the postings stored in sec, reading from the
+// prefetched postings if they cover sec.
+func (d *indexData) readPostings(sec simpleSection) ([]byte, error) {
+	if p, _ := d.prefetched.Load().(*prefetchedPostings); p != nil &&
+		sec.off >= p.off && uint64(sec.off)+uint64(sec.sz) <= uint64(p.off)+uint64(len(p.data)) {
+		start := sec.off - p.off
+		return p.data[start : start+sec.sz], nil
+	}
+	return d.readSectionBlob(sec)
+}
@@ -0,0 +1,100 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PathStep is one step from a node of a query tree to one of its
+// children.
+type PathStep struct {
+	Parent Q
+	// Index is the position of the child among the children of Parent.
+	Index int
+}
+
+// Error is an error about a single node of a query tree.
+type Error struct {
+	// Path leads from the root of the query to Q.
+	Path []PathStep
+	Q    Q
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("query: %s %s: %v", e.Location(), e.Q, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Location describes where in the query the offending node is, eg.
+// "second child of top-level or".
+func (e *Error) Location() string {
+	if len(e.Path) == 0 {
+		return "top-level query"
+	}
+	var parts []string
+	for i := len(e.Path) - 1; i >= 0; i-- {
+		parts = append(parts, ordinal(e.Path[i].Index)+" child of")
+	}
+	return strings.Join(parts, " ") + " top-level " + nodeKind(e.Path[0].Parent)
+}
+
+// ChildError records that err occurred in child, the index-th child of
+// parent. Errors that are not an *Error yet become an error about child.
+func ChildError(err error, parent Q, index int, child Q) error {
+	e, ok := err.(*Error)
+	if !ok {
+		e = &Error{Q: child, Err: err}
+	}
+	path := make([]PathStep, 0, len(e.Path)+1)
+	path = append(path, PathStep{Parent: parent, Index: index})
+	return &Error{
+		Path: append(path, e.Path...),
+		Q:    e.Q,
+		Err:  e.Err,
+	}
+}
+
+func ordinal(i int) string {
+	names := []string{"first", "second", "third", "fourth", "fifth",
+		"sixth", "seventh", "eighth", "ninth", "tenth"}
+	if i < len(names) {
+		return names[i]
+	}
+	return fmt.Sprintf("%dth", i+1)
+}
+
+func nodeKind(q Q) string {
+	switch q.(type) {
+	case *And:
+		return "and"
+	case *Or:
+		return "or"
+	case *Not:
+		return "not"
+	case *Symbol:
+		return "sym"
+	case *Type:
+		return "type"
+	case *DiffLine:
+		return "diff"
+	}
+	return fmt.Sprintf("%T", q)
+}
@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"log"
 	"regexp/syntax"
+	"strings"
 )
 
 var _ = log.Printf
@@ -159,7 +160,12 @@ func parseExpr(in []byte) (Q, int, error) {
 			return nil, 0, err
 		}
 
-		expr = &Symbol{q}
+		expr = &Symbol{Expr: q}
+	case tokSymKind:
+		if text == "" {
+			return nil, 0, fmt.Errorf("the symkind: atom must have an argument")
+		}
+		expr = &SymbolKind{Kinds: strings.Split(text, ",")}
 	case tokParenClose:
 		// Caller must consume paren.
 		expr = nil
@@ -266,9 +272,49 @@ func parseOperators(in []Q) (Q, error) {
 		return nil, fmt.Errorf("query: OR operator should have operand")
 	}
 	top.Children = append(top.Children, cur)
+	for _, ch := range top.Children {
+		and := ch.(*And)
+		and.Children = constrainSymbols(and.Children)
+	}
 	return top, nil
 }
 
+// constrainSymbols moves the kinds of a SymbolKind in qs, which are
+// and-ed together, to the Symbol queries in qs, so that
+// "sym:foo symkind:function" finds functions named foo, rather than
+// files with a symbol foo and some function. Several SymbolKind queries
+// are left alone.
+func constrainSymbols(qs []Q) []Q {
+	var kind *SymbolKind
+	hasSymbol := false
+	for _, q := range qs {
+		switch s := q.(type) {
+		case *SymbolKind:
+			if kind != nil {
+				return qs
+			}
+			kind = s
+		case *Symbol:
+			hasSymbol = true
+		}
+	}
+	if kind == nil || !hasSymbol {
+		return qs
+	}
+
+	out := qs[:0]
+	for _, q := range qs {
+		switch s := q.(type) {
+		case *SymbolKind:
+			continue
+		case *Symbol:
+			s.Kinds = kind.Kinds
+		}
+		out = append(out, q)
+	}
+	return out
+}
+
 // parseExprList parses a list of query expressions. It is the
 // workhorse of the Parse function.
 func parseExprList(in []byte) ([]Q, int, error) {
@@ -358,6 +404,7 @@ const (
 	tokSym        = 13
 	tokType       = 14
 	tokVis        = 15
+	tokSymKind    = 16
 )
 
 var tokNames = map[int]string{
@@ -374,6 +421,7 @@ var tokNames = map[int]string{
 	tokText:       "Text",
 	tokLang:       "Language",
 	tokSym:        "Symbol",
+	tokSymKind:    "SymbolKind",
 	tokType:       "Type",
 }
 
@@ -390,6 +438,7 @@ var prefixes = map[string]int{
 	"repo:":    tokRepo,
 	"lang:":    tokLang,
 	"sym:":     tokSym,
+	"symkind:": tokSymKind,
 	"t:":       tokType,
 	"type:":    tokType,
 }
@@ -84,10 +84,17 @@ func TestParseQuery(t *testing.T) {
 		{"content:abc", &Substring{Pattern: "abc", Content: true}},
 
 		{"lang:c++", &Language{"c++"}},
-		{"sym:pqr", &Symbol{&Substring{Pattern: "pqr"}}},
-		{"sym:Pqr", &Symbol{&Substring{Pattern: "Pqr", CaseSensitive: true}}},
-		{"sym:.*", &Symbol{&Regexp{Regexp: mustParseRE(".*")}}},
-		{"sym:a(b|d)e", &Symbol{&Regexp{Regexp: mustParseRE("a(b|d)e")}}},
+		{"sym:pqr", &Symbol{Expr: &Substring{Pattern: "pqr"}}},
+		{"sym:Pqr", &Symbol{Expr: &Substring{Pattern: "Pqr", CaseSensitive: true}}},
+		{"sym:.*", &Symbol{Expr: &Regexp{Regexp: mustParseRE(".*")}}},
+		{"sym:a(b|d)e", &Symbol{Expr: &Regexp{Regexp: mustParseRE("a(b|d)e")}}},
+		{"symkind:function", &SymbolKind{Kinds: []string{"function"}}},
+		{"symkind:function,class", &SymbolKind{Kinds: []string{"function", "class"}}},
+		{"sym:pqr symkind:function", &Symbol{Expr: &Substring{Pattern: "pqr"}, Kinds: []string{"function"}}},
+		{"sym:pqr symkind:function or abc", NewOr(
+			&Symbol{Expr: &Substring{Pattern: "pqr"}, Kinds: []string{"function"}},
+			&Substring{Pattern: "abc"},
+		)},
 
 		// case
 		{"abc case:yes", &Substring{Pattern: "abc", CaseSensitive: true}},
@@ -111,6 +118,7 @@ func TestParseQuery(t *testing.T) {
 		{"case:foo", nil},
 
 		{"sym:", nil},
+		{"symkind:", nil},
 		{"abc or", nil},
 		{"or abc", nil},
 		{"def or or abc", nil},
@@ -82,6 +82,74 @@ func (r RawConfig) String() string {
 	return fmt.Sprintf("rawConfig:%s", strings.Join(s, "|"))
 }
 
+// rawConfigConflicts lists flags that no repository can satisfy at the
+// same time.
+var rawConfigConflicts = []RawConfig{
+	RcOnlyPublic | RcOnlyPrivate,
+	RcOnlyForks | RcNoForks,
+	RcOnlyArchived | RcNoArchived,
+}
+
+// satisfiable returns false if r contains mutually exclusive flags.
+func (r RawConfig) satisfiable() bool {
+	for _, c := range rawConfigConflicts {
+		if r&c == c {
+			return false
+		}
+	}
+	return true
+}
+
+// ApplyRepoFilters restricts q to repositories matching flags. The flags
+// are merged with RawConfig queries at the top level of q, so the result
+// holds at most one top-level RawConfig. If the flags conflict, eg.
+// RcOnlyPublic|RcOnlyPrivate, the result matches nothing.
+func ApplyRepoFilters(q Q, flags RawConfig) Q {
+	q = Map(q, func(q Q) Q {
+		if rc, ok := q.(RawConfig); ok && !rc.satisfiable() {
+			return &Const{Value: false}
+		}
+		return q
+	})
+
+	var rest []Q
+	switch s := q.(type) {
+	case *And:
+		for _, ch := range s.Children {
+			if rc, ok := ch.(RawConfig); ok {
+				flags |= rc
+			} else {
+				rest = append(rest, ch)
+			}
+		}
+	case RawConfig:
+		flags |= s
+	default:
+		rest = append(rest, q)
+	}
+
+	if !flags.satisfiable() {
+		return &Const{Value: false}
+	}
+	if flags != 0 {
+		rest = append([]Q{flags}, rest...)
+	}
+	if len(rest) == 0 {
+		return &Const{Value: true}
+	}
+	return Simplify(NewAnd(rest...))
+}
+
+// RepoRawConfig matches repositories whose RawConfig maps Key to Value.
+type RepoRawConfig struct {
+	Key   string
+	Value string
+}
+
+func (q *RepoRawConfig) String() string {
+	return fmt.Sprintf("rawConfig:%s=%q", q.Key, q.Value)
+}
+
 // RegexpQuery is a query looking for regular expressions matches.
 type Regexp struct {
 	Regexp        *syntax.Regexp
@@ -93,12 +161,30 @@ type Regexp struct {
 // Symbol finds a string that is a symbol.
 type Symbol struct {
 	Expr Q
+
+	// Kinds, if non-empty, restricts the matches to symbols whose kind,
+	// as reported by ctags, is one of Kinds. Unlike a SymbolKind next
+	// to the Symbol, it applies to the same symbol that matches Expr.
+	Kinds []string
 }
 
 func (s *Symbol) String() string {
+	if len(s.Kinds) > 0 {
+		return fmt.Sprintf("sym:%s symkind:%s", s.Expr, strings.Join(s.Kinds, ","))
+	}
 	return fmt.Sprintf("sym:%s", s.Expr)
 }
 
+// SymbolKind matches the symbols whose kind, as reported by ctags (eg.
+// "function" or "variable"), is one of Kinds.
+type SymbolKind struct {
+	Kinds []string
+}
+
+func (s *SymbolKind) String() string {
+	return "symkind:" + strings.Join(s.Kinds, ",")
+}
+
 func (q *Regexp) String() string {
 	pref := ""
 	if q.FileName {
@@ -156,6 +242,39 @@ func (l *Language) String() string {
 	return "lang:" + l.Language
 }
 
+// LanguageSet matches documents whose language is in Set. It is
+// equivalent to an Or of Language queries.
+type LanguageSet struct {
+	Set map[string]bool
+}
+
+func (q *LanguageSet) String() string {
+	langs := make([]string, 0, len(q.Set))
+	for lang := range q.Set {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	return fmt.Sprintf("(langset %s)", strings.Join(langs, " "))
+}
+
+func NewLanguageSet(lang ...string) *LanguageSet {
+	s := &LanguageSet{Set: make(map[string]bool)}
+	for _, l := range lang {
+		s.Set[l] = true
+	}
+	return s
+}
+
+// FileChecksum matches documents whose content checksum, as reported in
+// FileMatch.Checksum, equals Sum.
+type FileChecksum struct {
+	Sum []byte
+}
+
+func (q *FileChecksum) String() string {
+	return fmt.Sprintf("checksum:%x", q.Sum)
+}
+
 type Const struct {
 	Value bool
 }
@@ -283,6 +402,18 @@ func (q *RepoBranches) UnmarshalBinary(b []byte) error {
 // used in the RPC interface for efficient checking of large repo lists.
 type RepoSet struct {
 	Set map[string]bool
+
+	// IgnoreCase matches repository names regardless of case. Set must
+	// then hold lowercase names. FoldRepoSets converts sets to this form.
+	IgnoreCase bool
+}
+
+// Has returns true if the set holds the repository called name.
+func (q *RepoSet) Has(name string) bool {
+	if q.IgnoreCase {
+		name = strings.ToLower(name)
+	}
+	return q.Set[name]
 }
 
 func (q *RepoSet) String() string {
@@ -300,6 +431,9 @@ func (q *RepoSet) String() string {
 		sort.Strings(repos)
 		detail = strings.Join(repos, " ")
 	}
+	if q.IgnoreCase {
+		detail = "case:no " + detail
+	}
 	return fmt.Sprintf("(reposet %s)", detail)
 }
 
@@ -336,6 +470,29 @@ func (q *Type) String() string {
 	}
 }
 
+const (
+	DiffLineAdded uint8 = iota
+	DiffLineRemoved
+)
+
+// DiffLine restricts content matches of Child to the added or removed
+// lines of unified diffs. Documents that are not diffs match normally.
+type DiffLine struct {
+	Child Q
+	Kind  uint8
+}
+
+func (q *DiffLine) String() string {
+	switch q.Kind {
+	case DiffLineAdded:
+		return fmt.Sprintf("(diff:added %s)", q.Child)
+	case DiffLineRemoved:
+		return fmt.Sprintf("(diff:removed %s)", q.Child)
+	default:
+		return fmt.Sprintf("(diff:UNKNOWN %s)", q.Child)
+	}
+}
+
 // Substring is the most basic query: a query for a substring.
 type Substring struct {
 	Pattern       string
@@ -493,7 +650,10 @@ func NewOr(qs ...Q) Q {
 	return &Or{Children: qs}
 }
 
-// Branch limits search to a specific branch.
+// Branch limits search to a specific branch. Unless Exact is set, Pattern
+// matches branches whose name contains it, or, if it has a '*', whose name
+// matches it as a glob, like "release-*". In the glob, '*' matches any
+// sequence of characters, including '/'.
 type Branch struct {
 	Pattern string
 
@@ -559,6 +719,9 @@ func flatten(q Q) (Q, bool) {
 	case *Type:
 		child, changed := flatten(s.Child)
 		return &Type{Child: child, Type: s.Type}, changed
+	case *DiffLine:
+		child, changed := flatten(s.Child)
+		return &DiffLine{Child: child, Kind: s.Kind}, changed
 	default:
 		return q, false
 	}
@@ -630,6 +793,12 @@ func evalConstants(q Q) Q {
 			return ch
 		}
 		return &Type{Child: ch, Type: s.Type}
+	case *DiffLine:
+		ch := evalConstants(s.Child)
+		if _, ok := ch.(*Const); ok {
+			return ch
+		}
+		return &DiffLine{Child: ch, Kind: s.Kind}
 	case *Substring:
 		if len(s.Pattern) == 0 {
 			return &Const{true}
@@ -646,6 +815,14 @@ func evalConstants(q Q) Q {
 		if len(s.Set) == 0 {
 			return &Const{true}
 		}
+	case *LanguageSet:
+		if len(s.Set) == 0 {
+			return &Const{false}
+		}
+	case *FileChecksum:
+		if len(s.Sum) == 0 {
+			return &Const{false}
+		}
 	}
 	return q
 }
@@ -674,10 +851,31 @@ func Map(q Q, f func(q Q) Q) Q {
 		q = &Not{Child: Map(s.Child, f)}
 	case *Type:
 		q = &Type{Type: s.Type, Child: Map(s.Child, f)}
+	case *DiffLine:
+		q = &DiffLine{Kind: s.Kind, Child: Map(s.Child, f)}
 	}
 	return f(q)
 }
 
+// FoldRepoSets returns q with the RepoSets replaced by sets that match
+// repository names regardless of case, so that eg. GitHub.com/Foo/Bar
+// matches the repository github.com/foo/bar.
+func FoldRepoSets(q Q) Q {
+	return Map(q, func(q Q) Q {
+		s, ok := q.(*RepoSet)
+		if !ok || s.IgnoreCase {
+			return q
+		}
+		folded := &RepoSet{Set: make(map[string]bool, len(s.Set)), IgnoreCase: true}
+		for name, v := range s.Set {
+			if v {
+				folded.Set[strings.ToLower(name)] = true
+			}
+		}
+		return folded
+	})
+}
+
 // Expand expands Substr queries into (OR file_substr content_substr)
 // queries, and the same for Regexp queries..
 func ExpandFileContent(q Q) Q {
@@ -710,6 +908,7 @@ func VisitAtoms(q Q, v func(q Q)) {
 		case *Or:
 		case *Not:
 		case *Type:
+		case *DiffLine:
 		default:
 			v(iQ)
 		}
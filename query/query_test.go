@@ -73,6 +73,10 @@ func TestSimplify(t *testing.T) {
 				&Substring{Pattern: "byte"},
 				&Not{&Substring{Pattern: "byte"}}),
 		},
+		{
+			in:   NewAnd(&Substring{Pattern: "byte"}, NewLanguageSet()),
+			want: &Const{false},
+		},
 	}
 
 	for _, c := range cases {
@@ -99,6 +103,29 @@ func TestMap(t *testing.T) {
 	}
 }
 
+func TestFoldRepoSets(t *testing.T) {
+	in := NewAnd(&Substring{Pattern: "bla"}, &Not{NewRepoSet("GitHub.com/Foo/Bar", "baz")})
+	out := NewAnd(&Substring{Pattern: "bla"}, &Not{&RepoSet{
+		Set:        map[string]bool{"github.com/foo/bar": true, "baz": true},
+		IgnoreCase: true,
+	}})
+
+	got := FoldRepoSets(in)
+	if !reflect.DeepEqual(got, out) {
+		t.Errorf("got %v, want %v", got, out)
+	}
+
+	set := got.(*And).Children[1].(*Not).Child.(*RepoSet)
+	for _, name := range []string{"github.com/foo/bar", "GITHUB.COM/FOO/BAR", "baz"} {
+		if !set.Has(name) {
+			t.Errorf("folded set doesn't have %q", name)
+		}
+	}
+	if NewRepoSet("GitHub.com/Foo/Bar").Has("github.com/foo/bar") {
+		t.Error("set without IgnoreCase matches a differently cased name")
+	}
+}
+
 func TestVisitAtoms(t *testing.T) {
 	in := NewAnd(&Substring{}, &Repo{}, &Not{&Const{}})
 	count := 0
@@ -109,3 +136,57 @@ func TestVisitAtoms(t *testing.T) {
 		t.Errorf("got %d, want 3", count)
 	}
 }
+
+func TestApplyRepoFilters(t *testing.T) {
+	for _, c := range []struct {
+		in    Q
+		flags RawConfig
+		want  string
+	}{
+		{
+			in:    &Substring{Pattern: "foo"},
+			flags: RcOnlyPublic,
+			want:  `(and rawConfig:RcOnlyPublic substr:"foo")`,
+		},
+		{
+			in:    NewAnd(RcNoForks, &Substring{Pattern: "foo"}),
+			flags: RcOnlyPublic | RcNoArchived,
+			want:  `(and rawConfig:RcOnlyPublic|RcNoForks|RcNoArchived substr:"foo")`,
+		},
+		{
+			in:    NewAnd(RcOnlyPublic, &Substring{Pattern: "foo"}, RcOnlyPublic),
+			flags: RcOnlyPublic,
+			want:  `(and rawConfig:RcOnlyPublic substr:"foo")`,
+		},
+		{
+			in:    &Const{Value: true},
+			flags: RcNoForks,
+			want:  `rawConfig:RcNoForks`,
+		},
+		{
+			in:    &Substring{Pattern: "foo"},
+			flags: 0,
+			want:  `substr:"foo"`,
+		},
+		{
+			in:    NewAnd(RcOnlyPrivate, &Substring{Pattern: "foo"}),
+			flags: RcOnlyPublic,
+			want:  `FALSE`,
+		},
+		{
+			in:    &Substring{Pattern: "foo"},
+			flags: RcOnlyForks | RcNoForks,
+			want:  `FALSE`,
+		},
+		{
+			in:    NewOr(&Substring{Pattern: "foo"}, NewAnd(RcOnlyArchived|RcNoArchived, &Substring{Pattern: "bar"})),
+			flags: RcOnlyPublic,
+			want:  `(and rawConfig:RcOnlyPublic substr:"foo")`,
+		},
+	} {
+		got := ApplyRepoFilters(c.in, c.flags)
+		if got.String() != c.want {
+			t.Errorf("ApplyRepoFilters(%s, %s): got %s, want %s", c.in, c.flags, got, c.want)
+		}
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"hash/crc64"
 	"log"
 	"os"
+	"path/filepath"
 	"sort"
 
 	"github.com/rs/xid"
@@ -39,14 +40,25 @@ type IndexFile interface {
 type reader struct {
 	r   IndexFile
 	off uint32
+
+	// size of the file, set by readTOC. Reads past it fail.
+	size uint32
 }
 
 func (r *reader) seek(off uint32) {
 	r.off = off
 }
 
+// read reads the next sz bytes.
+func (r *reader) read(sz uint32) ([]byte, error) {
+	if r.size > 0 && (r.off > r.size || sz > r.size-r.off) {
+		return nil, fmt.Errorf("file %s: read of %d bytes at offset %d is past the end of the file (size %d)", r.r.Name(), sz, r.off, r.size)
+	}
+	return r.r.Read(r.off, sz)
+}
+
 func (r *reader) U32() (uint32, error) {
-	b, err := r.r.Read(r.off, 4)
+	b, err := r.read(4)
 	r.off += 4
 	if err != nil {
 		return 0, err
@@ -55,7 +67,7 @@ func (r *reader) U32() (uint32, error) {
 }
 
 func (r *reader) U64() (uint64, error) {
-	b, err := r.r.Read(r.off, 8)
+	b, err := r.read(8)
 	r.off += 8
 	if err != nil {
 		return 0, err
@@ -64,7 +76,7 @@ func (r *reader) U64() (uint64, error) {
 }
 
 func (r *reader) ReadByte() (byte, error) {
-	b, err := r.r.Read(r.off, 1)
+	b, err := r.read(1)
 	r.off += 1
 	if err != nil {
 		return 0, err
@@ -85,7 +97,10 @@ func (r *reader) Str() (string, error) {
 	if err != nil {
 		return "", err
 	}
-	b, err := r.r.Read(r.off, uint32(slen))
+	if slen > maxUInt32 {
+		return "", fmt.Errorf("file %s: string of %d bytes at offset %d is too long", r.r.Name(), slen, r.off)
+	}
+	b, err := r.read(uint32(slen))
 	if err != nil {
 		return "", err
 	}
@@ -98,12 +113,20 @@ func (r *reader) readTOC(toc *indexTOC) error {
 	if err != nil {
 		return err
 	}
+	if sz < 8 {
+		return fmt.Errorf("file %s is too small to hold an index (size %d)", r.r.Name(), sz)
+	}
+	r.size = sz
 	r.off = sz - 8
 
 	var tocSection simpleSection
 	if err := tocSection.read(r); err != nil {
 		return err
 	}
+	// The TOC is followed by its own position, in the last 8 bytes.
+	if err := checkSection("TOC", tocSection, sz-8); err != nil {
+		return fmt.Errorf("file %s: %w", r.r.Name(), err)
+	}
 
 	r.seek(tocSection.off)
 
@@ -165,6 +188,54 @@ func (r *reader) readTOC(toc *indexTOC) error {
 			}
 		}
 	}
+
+	// Sections are written before the TOC.
+	for _, ent := range toc.sectionsTaggedList() {
+		if err := checkSectionBounds(ent.tag, ent.sec, tocSection.off); err != nil {
+			return fmt.Errorf("file %s: %w", r.r.Name(), err)
+		}
+	}
+	return nil
+}
+
+// checkSection returns an error if sec doesn't end before limit.
+func checkSection(tag string, sec simpleSection, limit uint32) error {
+	if sec.off > limit || sec.sz > limit-sec.off {
+		return fmt.Errorf("section %q at offset %d with size %d exceeds %d", tag, sec.off, sec.sz, limit)
+	}
+	return nil
+}
+
+// checkSectionBounds returns an error if any part of sec doesn't end
+// before limit, or the items of a compound section don't lie within its
+// data.
+func checkSectionBounds(tag string, sec section, limit uint32) error {
+	var cs *compoundSection
+	switch s := sec.(type) {
+	case *simpleSection:
+		return checkSection(tag, *s, limit)
+	case *compoundSection:
+		cs = s
+	case *lazyCompoundSection:
+		cs = &s.compoundSection
+	default:
+		return nil
+	}
+
+	if err := checkSection(tag, cs.data, limit); err != nil {
+		return err
+	}
+	if err := checkSection(tag+" index", cs.index, limit); err != nil {
+		return err
+	}
+	end := cs.data.off + cs.data.sz
+	prev := cs.data.off
+	for i, o := range cs.offsets {
+		if o < prev || o > end {
+			return fmt.Errorf("section %q item %d at offset %d is outside of [%d, %d]", tag, i, o, prev, end)
+		}
+		prev = o
+	}
 	return nil
 }
 
@@ -224,8 +295,8 @@ func (r *reader) readIndexData(toc *indexTOC) (*indexData, error) {
 	d := indexData{
 		file:           r.r,
 		fileNameNgrams: map[ngram][]byte{},
-		branchIDs:      []map[string]uint{},
-		branchNames:    []map[uint]string{},
+		branchIDs:      []map[string]uint64{},
+		branchNames:    []map[uint64]string{},
 	}
 
 	repos, md, err := r.readMetadata(toc)
@@ -285,10 +356,50 @@ func (r *reader) readIndexData(toc *indexTOC) (*indexData, error) {
 		return nil, err
 	}
 
+	d.rankBoosts, err = d.readSectionBlob(toc.rankBoosts)
+	if err != nil {
+		return nil, err
+	}
+	if len(d.rankBoosts) != 0 && len(d.rankBoosts) != 2*len(d.languages) {
+		return nil, fmt.Errorf("got %d bytes of rank boosts for %d documents", len(d.rankBoosts), len(d.languages))
+	}
+
+	d.modTimes, err = d.readSectionBlob(toc.modTimes)
+	if err != nil {
+		return nil, err
+	}
+	if len(d.modTimes) != 0 && len(d.modTimes) != 8*len(d.languages) {
+		return nil, fmt.Errorf("got %d bytes of modification times for %d documents", len(d.modTimes), len(d.languages))
+	}
+
+	d.skipReasonContent, err = d.readSectionBlob(toc.skipReasons.data)
+	if err != nil {
+		return nil, err
+	}
+	d.skipReasonIndex = toc.skipReasons.relativeIndex()
+	if len(d.skipReasonIndex) != 0 && len(d.skipReasonIndex) != len(d.languages)+1 {
+		return nil, fmt.Errorf("got %d skip reasons for %d documents", len(d.skipReasonIndex)-1, len(d.languages))
+	}
+
+	d.diffLinesContent, err = d.readSectionBlob(toc.diffLines.data)
+	if err != nil {
+		return nil, err
+	}
+	d.diffLinesIndex = toc.diffLines.relativeIndex()
+	if len(d.diffLinesIndex) != 0 && len(d.diffLinesIndex) != len(d.languages)+1 {
+		return nil, fmt.Errorf("got %d diff line lists for %d documents", len(d.diffLinesIndex)-1, len(d.languages))
+	}
+
 	d.ngrams, err = d.readNgrams(toc)
 	if err != nil {
 		return nil, err
 	}
+	d.postings = toc.postings.data
+
+	d.droppedNgrams, err = d.readDroppedNgrams(toc)
+	if err != nil {
+		return nil, err
+	}
 
 	if os.Getenv("ZOEKT_DISABLE_BLOOM") == "" {
 		d.bloomContents, err = d.readBloom(toc.contentBloom)
@@ -320,10 +431,10 @@ func (r *reader) readIndexData(toc *indexTOC) (*indexData, error) {
 	}
 
 	for _, md := range d.repoMetaData {
-		repoBranchIDs := make(map[string]uint, len(md.Branches))
-		repoBranchNames := make(map[uint]string, len(md.Branches))
+		repoBranchIDs := make(map[string]uint64, len(md.Branches))
+		repoBranchNames := make(map[uint64]string, len(md.Branches))
 		for j, br := range md.Branches {
-			id := uint(1) << uint(j)
+			id := uint64(1) << uint(j)
 			repoBranchIDs[br.Name] = id
 			repoBranchNames[id] = br.Name
 		}
@@ -462,6 +573,22 @@ func (d *indexData) readNgrams(toc *indexTOC) (combinedNgramOffset, error) {
 	return makeCombinedNgramOffset(ngrams, postingsIndex), nil
 }
 
+func (d *indexData) readDroppedNgrams(toc *indexTOC) (map[ngram]struct{}, error) {
+	blob, err := d.readSectionBlob(toc.droppedNgrams)
+	if err != nil {
+		return nil, err
+	}
+	if len(blob) == 0 {
+		return nil, nil
+	}
+
+	dropped := make(map[ngram]struct{}, len(blob)/ngramEncoding)
+	for i := 0; i < len(blob); i += ngramEncoding {
+		dropped[ngram(binary.BigEndian.Uint64(blob[i:i+ngramEncoding]))] = struct{}{}
+	}
+	return dropped, nil
+}
+
 func (d *indexData) readFileNameNgrams(toc *indexTOC) (map[ngram][]byte, error) {
 	nameNgramText, err := d.readSectionBlob(toc.nameNgramText)
 	if err != nil {
@@ -517,6 +644,33 @@ func (d *indexData) readContents(i uint32) ([]byte, error) {
 	})
 }
 
+// ReadContentRange returns length bytes of the content of document docID,
+// starting at byte offset start. Only the requested bytes are read, so
+// this is cheaper than reading all of the content of large documents.
+func (d *indexData) ReadContentRange(docID uint32, start, length uint32) ([]byte, error) {
+	if docID >= d.numDocs() {
+		return nil, fmt.Errorf("document %d out of range [0, %d)", docID, d.numDocs())
+	}
+	sz := d.boundaries[docID+1] - d.boundaries[docID]
+	if start > sz || length > sz-start {
+		return nil, fmt.Errorf("range [%d, %d) out of bounds for document %d of size %d", start, uint64(start)+uint64(length), docID, sz)
+	}
+	return d.readContentSlice(d.boundaries[docID]+start, length)
+}
+
+// readContentRangeClipped is ReadContentRange for r, with r cut off at
+// the end of the document.
+func (d *indexData) readContentRangeClipped(docID uint32, r ContentRange) ([]byte, error) {
+	sz := d.boundaries[docID+1] - d.boundaries[docID]
+	if r.Start > sz {
+		r.Start = sz
+	}
+	if r.Length > sz-r.Start {
+		r.Length = sz - r.Start
+	}
+	return d.ReadContentRange(docID, r.Start, r.Length)
+}
+
 func (d *indexData) readContentSlice(off uint32, sz uint32) ([]byte, error) {
 	// TODO(hanwen): cap result if it is at the end of the content
 	// section.
@@ -611,6 +765,14 @@ func ReadMetadataPathAlive(p string) ([]*Repository, *IndexMetadata, error) {
 	return alive, id, nil
 }
 
+// ShardRepositories returns the repositories of the shard at path. A
+// compound shard holds several, which may include tombstoned ones. Like
+// ReadMetadataPath, it does not read the index data.
+func ShardRepositories(path string) ([]*Repository, error) {
+	repos, _, err := ReadMetadataPath(path)
+	return repos, err
+}
+
 // ReadMetadataPath returns the metadata of index shard at p without reading
 // the index data. ReadMetadataPath is a helper for ReadMetadata which opens
 // the IndexFile at p.
@@ -648,6 +810,41 @@ func IndexFilePaths(p string) ([]string, error) {
 	return exist, nil
 }
 
+// RepoDiskUsage returns the number of bytes used by the shards in indexDir
+// per repository name. The size of a shard includes all of its
+// IndexFilePaths. A compound shard is counted in full for every repository
+// it contains, including tombstoned ones.
+func RepoDiskUsage(indexDir string) (map[string]int64, error) {
+	shards, err := filepath.Glob(filepath.Join(indexDir, "*.zoekt"))
+	if err != nil {
+		return nil, err
+	}
+
+	usage := make(map[string]int64)
+	for _, shard := range shards {
+		repos, _, err := ReadMetadataPath(shard)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", shard, err)
+		}
+		paths, err := IndexFilePaths(shard)
+		if err != nil {
+			return nil, err
+		}
+		var size int64
+		for _, p := range paths {
+			fi, err := os.Stat(p)
+			if err != nil {
+				return nil, err
+			}
+			size += fi.Size()
+		}
+		for _, repo := range repos {
+			usage[repo.Name] += size
+		}
+	}
+	return usage, nil
+}
+
 func loadIndexData(r IndexFile) (*indexData, error) {
 	rd := &reader{r: r}
 
@@ -17,6 +17,7 @@ package zoekt
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -349,3 +350,163 @@ func TestBackfillIDIsDeterministic(t *testing.T) {
 		t.Fatalf("%s != %s ", have1, have2)
 	}
 }
+
+func TestRepoDiskUsage(t *testing.T) {
+	dir := t.TempDir()
+
+	writeShard := func(name string, repo *Repository) string {
+		t.Helper()
+		b, err := NewIndexBuilder(repo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.AddFile("main.go", []byte("package "+repo.Name)); err != nil {
+			t.Fatal(err)
+		}
+		p := filepath.Join(dir, name)
+		f, err := os.Create(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if err := b.Write(f); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	size := func(p string) int64 {
+		t.Helper()
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.Size()
+	}
+
+	a0 := writeShard("a_v16.00000.zoekt", &Repository{Name: "a"})
+	a1 := writeShard("a_v16.00001.zoekt", &Repository{Name: "a"})
+	b0 := writeShard("b_v16.00000.zoekt", &Repository{Name: "b"})
+	if err := jsonMarshalMeta(&Repository{Name: "b"}, b0+".meta"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "b_v16.00001.zoekt.tmp"), []byte("partial"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := RepoDiskUsage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int64{
+		"a": size(a0) + size(a1),
+		"b": size(b0) + size(b0+".meta"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestShardRepositories(t *testing.T) {
+	dir := t.TempDir()
+	var paths []string
+	for _, r := range []*Repository{{ID: 1, Name: "repoA"}, {ID: 2, Name: "repoB"}} {
+		p := filepath.Join(dir, r.Name+".zoekt")
+		if err := builderWriteAll(p, testIndexBuilder(t, r, Document{Name: "f", Content: []byte("x")})); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, p)
+	}
+	compound, err := MergePaths(filepath.Join(dir, "out"), paths...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		path string
+		want []string
+	}{
+		{path: "testdata/shards/repo17_v17.00000.zoekt", want: []string{"repo17:0"}},
+		{path: paths[0], want: []string{"repoA:1"}},
+		{path: compound, want: []string{"repoA:1", "repoB:2"}},
+	} {
+		repos, err := ShardRepositories(c.path)
+		if err != nil {
+			t.Fatalf("%s: %v", c.path, err)
+		}
+		var got []string
+		for _, r := range repos {
+			got = append(got, fmt.Sprintf("%s:%d", r.Name, r.ID))
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.path, got, c.want)
+		}
+	}
+
+	if _, err := ShardRepositories(filepath.Join(dir, "missing.zoekt")); err == nil {
+		t.Error("got no error for a missing shard")
+	}
+}
+
+func TestReadContentRange(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{Name: "repo"},
+		Document{Name: "f1", Content: []byte("first document")},
+		Document{Name: "f2", Content: []byte("second\ndocument ✓\nthird line")},
+		Document{Name: "f3", Content: []byte{}})
+	d := searcherForTest(t, b).(*indexData)
+
+	for docID := uint32(0); docID < d.numDocs(); docID++ {
+		full, err := d.readContents(docID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for start := 0; start <= len(full); start++ {
+			for end := start; end <= len(full); end++ {
+				got, err := d.ReadContentRange(docID, uint32(start), uint32(end-start))
+				if err != nil {
+					t.Fatalf("ReadContentRange(%d, %d, %d): %v", docID, start, end-start, err)
+				}
+				if !bytes.Equal(got, full[start:end]) {
+					t.Errorf("ReadContentRange(%d, %d, %d): got %q, want %q", docID, start, end-start, got, full[start:end])
+				}
+			}
+		}
+		if _, err := d.ReadContentRange(docID, 0, uint32(len(full))+1); err == nil {
+			t.Errorf("doc %d: got no error reading past the end", docID)
+		}
+		if _, err := d.ReadContentRange(docID, uint32(len(full))+1, 0); err == nil {
+			t.Errorf("doc %d: got no error starting past the end", docID)
+		}
+	}
+
+	if _, err := d.ReadContentRange(d.numDocs(), 0, 0); err == nil {
+		t.Error("got no error for document out of range")
+	}
+}
+
+func TestNewSearcherTruncated(t *testing.T) {
+	b := testIndexBuilder(t, &Repository{Name: "repo"},
+		Document{Name: "f1", Content: []byte("first document")},
+		Document{Name: "f2", Content: []byte("second document")})
+	var buf bytes.Buffer
+	if err := b.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	for n := 0; n < len(data); n++ {
+		// memSeeker panics on reads out of range, so a missing
+		// check fails the test.
+		s, err := NewSearcher(&memSeeker{data[:n]})
+		if err == nil {
+			s.Close()
+			t.Errorf("truncated to %d of %d bytes: got no error", n, len(data))
+		}
+	}
+
+	// The TOC points past the end of the file.
+	corrupt := append([]byte{}, data...)
+	binary.BigEndian.PutUint32(corrupt[len(corrupt)-8:], uint32(len(corrupt)))
+	if _, err := NewSearcher(&memSeeker{corrupt}); err == nil {
+		t.Error("TOC out of range: got no error")
+	}
+}
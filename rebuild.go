@@ -0,0 +1,199 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// RebuildNameIndex writes a copy of the shard src to dst, with the file
+// name ngram index derived anew from the stored file names. All other
+// sections are copied as is, so a shard whose name index is damaged can
+// be repaired without reindexing the repository.
+func RebuildNameIndex(src, dst string) error {
+	replace := map[string]bool{"nameNgramText": true, "namePostings": true, "nameRuneOffsets": true, "nameEndRunes": true}
+	return rewriteShard(src, dst, replace, func(w *writer, inf IndexFile, toc, newTOC *indexTOC) error {
+		names, err := readCompoundItems(inf, &toc.fileNames)
+		if err != nil {
+			return err
+		}
+		namePostings := newPostingsBuilder()
+		for _, name := range names {
+			if _, _, err := namePostings.newSearchableString(name, nil); err != nil {
+				return err
+			}
+		}
+		writePostings(w, namePostings, &newTOC.nameNgramText, &newTOC.nameRuneOffsets, &newTOC.namePostings, &newTOC.nameEndRunes)
+		return nil
+	})
+}
+
+// RebuildBloom writes a copy of the shard src to dst, with bloom filters
+// derived anew from the stored file names and contents, using the
+// current default hasher and load. All other sections are copied as is,
+// so the content is not tokenized again.
+func RebuildBloom(src, dst string) error {
+	replace := map[string]bool{"nameBloom": true, "contentBloom": true}
+	return rewriteShard(src, dst, replace, func(w *writer, inf IndexFile, toc, newTOC *indexTOC) error {
+		for _, sec := range []struct {
+			items *compoundSection
+			bloom *simpleSection
+		}{
+			{&toc.fileNames, &newTOC.nameBloom},
+			{&toc.fileContents, &newTOC.contentBloom},
+		} {
+			items, err := readCompoundItems(inf, sec.items)
+			if err != nil {
+				return err
+			}
+			b := makeBloomFilterEmpty()
+			for _, item := range items {
+				b.addBytes(item)
+			}
+			sec.bloom.start(w)
+			b.shrinkToSize(bloomDefaultLoad).write(w)
+			sec.bloom.end(w)
+		}
+		return nil
+	})
+}
+
+// rewriteShard writes a copy of the shard src to dst. The sections whose
+// tags are in replace are not copied; rewrite writes them instead, and
+// records their location in newTOC.
+func rewriteShard(src, dst string, replace map[string]bool, rewrite func(w *writer, inf IndexFile, toc, newTOC *indexTOC) error) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	inf, err := NewIndexFile(f)
+	if err != nil {
+		return err
+	}
+	defer inf.Close()
+
+	var toc indexTOC
+	r := &reader{r: inf}
+	if err := r.readTOC(&toc); err != nil {
+		return err
+	}
+
+	out, err := ioutil.TempFile(filepath.Dir(dst), filepath.Base(dst)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		out.Close()
+		os.Remove(out.Name())
+	}()
+
+	buffered := bufio.NewWriterSize(out, 1<<20)
+	w := &writer{w: buffered}
+
+	var newTOC indexTOC
+	oldSecs := toc.sectionsTaggedList()
+	for i, ent := range newTOC.sectionsTaggedList() {
+		if replace[ent.tag] {
+			continue
+		}
+		if err := copySection(w, inf, oldSecs[i].sec, ent.sec); err != nil {
+			return fmt.Errorf("section %s: %w", ent.tag, err)
+		}
+	}
+	if err := rewrite(w, inf, &toc, &newTOC); err != nil {
+		return err
+	}
+
+	var tocSection simpleSection
+	tocSection.start(w)
+	w.writeTOC(&newTOC)
+	tocSection.end(w)
+	tocSection.write(w)
+	if w.err != nil {
+		return w.err
+	}
+
+	if err := buffered.Flush(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), dst)
+}
+
+// readCompoundItems returns the items of the compound section sec.
+func readCompoundItems(inf IndexFile, sec *compoundSection) ([][]byte, error) {
+	data, err := inf.Read(sec.data.off, sec.data.sz)
+	if err != nil {
+		return nil, err
+	}
+	index := sec.relativeIndex()
+	items := make([][]byte, 0, len(sec.offsets))
+	for i := 0; i+1 < len(index); i++ {
+		items = append(items, data[index[i]:index[i+1]])
+	}
+	return items, nil
+}
+
+// copySection copies the contents of the section src of inf to w, and
+// records their new location in dst.
+func copySection(w *writer, inf IndexFile, src, dst section) error {
+	switch src := src.(type) {
+	case *simpleSection:
+		data, err := inf.Read(src.off, src.sz)
+		if err != nil {
+			return err
+		}
+		dst := dst.(*simpleSection)
+		dst.start(w)
+		w.Write(data)
+		dst.end(w)
+	case *lazyCompoundSection:
+		offsets, err := readSectionU32(inf, src.index)
+		if err != nil {
+			return err
+		}
+		return copyCompoundSection(w, inf, &src.compoundSection, offsets, &dst.(*lazyCompoundSection).compoundSection)
+	case *compoundSection:
+		return copyCompoundSection(w, inf, src, src.offsets, dst.(*compoundSection))
+	default:
+		return fmt.Errorf("unknown section type %T", src)
+	}
+	return nil
+}
+
+// copyCompoundSection copies src, whose items start at offsets, to dst.
+// The offsets are absolute, so they move along with the data.
+func copyCompoundSection(w *writer, inf IndexFile, src *compoundSection, offsets []uint32, dst *compoundSection) error {
+	data, err := inf.Read(src.data.off, src.data.sz)
+	if err != nil {
+		return err
+	}
+	base := w.Off()
+	dst.start(w)
+	for _, o := range offsets {
+		dst.offsets = append(dst.offsets, o-src.data.off+base)
+	}
+	w.Write(data)
+	dst.end(w)
+	return nil
+}
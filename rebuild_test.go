@@ -0,0 +1,170 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/zoekt/query"
+)
+
+func TestRebuildNameIndex(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.zoekt")
+	if err := builderWriteAll(src, testIndexBuilder(t, &Repository{Name: "repo"},
+		Document{Name: "cmd/needle/main.go", Content: []byte("package main")},
+		Document{Name: "haystack.go", Content: []byte("needle")},
+		Document{Name: "docs/nöödle.md", Content: []byte("hay")})); err != nil {
+		t.Fatal(err)
+	}
+
+	search := func(fn string, q query.Q) []string {
+		t.Helper()
+		searcher := searcherForPath(t, fn)
+		defer searcher.Close()
+		res, err := searcher.Search(context.Background(), q, &SearchOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, fm := range res.Files {
+			names = append(names, fm.FileName)
+		}
+		sort.Strings(names)
+		return names
+	}
+	nameQuery := query.NewOr(
+		&query.Substring{Pattern: "needle", FileName: true},
+		&query.Substring{Pattern: "nöödle", FileName: true})
+	want := []string{"cmd/needle/main.go", "docs/nöödle.md"}
+	if got := search(src, nameQuery); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	// Overwrite the name ngrams, so file names no longer match.
+	f, err := os.Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inf, err := NewIndexFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var toc indexTOC
+	if err := (&reader{r: inf}).readTOC(&toc); err != nil {
+		t.Fatal(err)
+	}
+	inf.Close()
+	f.Close()
+
+	corrupt := filepath.Join(dir, "corrupt.zoekt")
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sec := toc.nameNgramText
+	copy(data[sec.off:sec.off+sec.sz], bytes.Repeat([]byte{0xff}, int(sec.sz)))
+	if err := ioutil.WriteFile(corrupt, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if got := search(corrupt, nameQuery); len(got) != 0 {
+		t.Fatalf("got %v on corrupt shard, want no matches", got)
+	}
+
+	fixed := filepath.Join(dir, "fixed.zoekt")
+	if err := RebuildNameIndex(corrupt, fixed); err != nil {
+		t.Fatal(err)
+	}
+	if got := search(fixed, nameQuery); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("got %v after rebuild, want %v", got, want)
+	}
+	if got, want := search(fixed, &query.Substring{Pattern: "needle", Content: true}), []string{"haystack.go"}; strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("content search: got %v, want %v", got, want)
+	}
+}
+
+func TestRebuildBloom(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.zoekt")
+	b := testIndexBuilder(t, &Repository{Name: "repo"})
+	if err := b.SetBloomMinWordLength(3); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []Document{
+		{Name: "cmd/needle/main.go", Content: []byte("package main")},
+		{Name: "haystack.go", Content: []byte("needle")},
+		{Name: "docs/nöödle.md", Content: []byte("hay")},
+	} {
+		if err := b.Add(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := builderWriteAll(src, b); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(dir, "dst.zoekt")
+	if err := RebuildBloom(src, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	hasherID := func(h bloomHash) byte {
+		return bloomHasherIds[reflect.ValueOf(h).Pointer()]
+	}
+	d := searcherForPath(t, dst).(*indexData)
+	defer d.Close()
+	want := hasherID(bloomDefaultHash)
+	if got := hasherID(d.bloomContents.hasher); got != want {
+		t.Errorf("got content bloom hasher %d, want %d", got, want)
+	}
+	if got := hasherID(d.bloomNames.hasher); got != want {
+		t.Errorf("got name bloom hasher %d, want %d", got, want)
+	}
+
+	search := func(fn string, q query.Q) []string {
+		t.Helper()
+		searcher := searcherForPath(t, fn)
+		defer searcher.Close()
+		res, err := searcher.Search(context.Background(), q, &SearchOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, fm := range res.Files {
+			names = append(names, fm.FileName)
+		}
+		sort.Strings(names)
+		return names
+	}
+	for _, q := range []query.Q{
+		&query.Substring{Pattern: "needle"},
+		&query.Substring{Pattern: "needle", Content: true},
+		&query.Substring{Pattern: "nöödle", FileName: true},
+		&query.Substring{Pattern: "package"},
+		&query.Substring{Pattern: "absent"},
+	} {
+		if got, want := search(dst, q), search(src, q); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v after rebuild, want %v", q, got, want)
+		}
+	}
+}
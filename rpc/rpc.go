@@ -128,8 +128,11 @@ func RegisterGob() {
 		gob.Register(&query.And{})
 		gob.Register(&query.Branch{})
 		gob.Register(&query.Const{})
+		gob.Register(&query.DiffLine{})
+		gob.Register(&query.FileChecksum{})
 		gob.Register(&query.GobCache{})
 		gob.Register(&query.Language{})
+		gob.Register(&query.LanguageSet{})
 		gob.Register(&query.Not{})
 		gob.Register(&query.Or{})
 		gob.Register(&query.Regexp{})
@@ -137,9 +140,11 @@ func RegisterGob() {
 		gob.Register(&query.BranchesRepos{})
 		gob.Register(&query.RepoBranches{})
 		gob.Register(&query.RepoSet{})
+		gob.Register(&query.RepoRawConfig{})
 		gob.Register(&query.Repo{})
 		gob.Register(&query.Substring{})
 		gob.Register(&query.Symbol{})
+		gob.Register(&query.SymbolKind{})
 		gob.Register(&query.Type{})
 		gob.Register(query.RawConfig(41))
 	})
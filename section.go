@@ -183,6 +183,19 @@ func (s *compoundSection) relativeIndex() []uint32 {
 	return ri
 }
 
+// sectionSize returns the number of bytes sec takes up in the file.
+func sectionSize(sec section) uint32 {
+	switch s := sec.(type) {
+	case *simpleSection:
+		return s.sz
+	case *compoundSection:
+		return s.data.sz + s.index.sz
+	case *lazyCompoundSection:
+		return s.data.sz + s.index.sz
+	}
+	return 0
+}
+
 type lazyCompoundSection struct {
 	compoundSection
 }
@@ -0,0 +1,249 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shards
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/zoekt"
+	"github.com/google/zoekt/query"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metricResultCacheHitsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "zoekt_result_cache_hits_total",
+		Help: "The number of searches answered from the result cache",
+	})
+	metricResultCacheMissesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "zoekt_result_cache_misses_total",
+		Help: "The number of searches not found in the result cache",
+	})
+)
+
+// resultCache is an LRU cache of search results, for clients that poll
+// the same query over and over. Entries expire after ttl, and all of them
+// are dropped when a shard is loaded or unloaded, since a new shard can
+// contribute matches to any query. It is safe for concurrent use.
+type resultCache struct {
+	size int
+	ttl  time.Duration
+
+	// now is time.Now, overridden in tests.
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]*list.Element
+	lru     *list.List // of *resultCacheEntry, most recently used first
+
+	// gen is incremented by purge, so that a search racing with a shard
+	// change doesn't store a stale result.
+	gen int
+
+	hits, misses int
+}
+
+type resultCacheEntry struct {
+	key     [sha256.Size]byte
+	result  *zoekt.SearchResult
+	expires time.Time
+}
+
+// newResultCache returns a cache holding up to size results for at most
+// ttl each. A zero ttl means results only expire by eviction.
+func newResultCache(size int, ttl time.Duration) *resultCache {
+	return &resultCache{
+		size:    size,
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[[sha256.Size]byte]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// resultCacheKey returns the cache key for a search. It covers the query
+// and all options that affect the result.
+func resultCacheKey(q query.Q, opts *zoekt.SearchOptions) [sha256.Size]byte {
+	o := *opts
+	// Tracing doesn't change the result.
+	o.Trace = false
+	o.SpanContext = nil
+
+	var ids []uint32
+	if o.RepoIDs != nil {
+		ids = o.RepoIDs.ToArray()
+		o.RepoIDs = nil
+	}
+
+	h := sha256.New()
+	writeQueryKey(h, q)
+	fmt.Fprintf(h, "\x00%+v\x00%v", o, ids)
+
+	var key [sha256.Size]byte
+	h.Sum(key[:0])
+	return key
+}
+
+// writeQueryKey writes a canonical encoding of q to w. Unlike q.String(),
+// which abbreviates large repository sets, it includes every field, so
+// different queries are written differently.
+func writeQueryKey(w io.Writer, q query.Q) {
+	writeChildren := func(op string, children []query.Q) {
+		fmt.Fprintf(w, "(%s", op)
+		for _, ch := range children {
+			io.WriteString(w, " ")
+			writeQueryKey(w, ch)
+		}
+		io.WriteString(w, ")")
+	}
+
+	switch s := q.(type) {
+	case *query.And:
+		writeChildren("and", s.Children)
+	case *query.Or:
+		writeChildren("or", s.Children)
+	case *query.Not:
+		writeChildren("not", []query.Q{s.Child})
+	case *query.Symbol:
+		writeChildren(fmt.Sprintf("sym %q", s.Kinds), []query.Q{s.Expr})
+	case *query.Type:
+		writeChildren(fmt.Sprintf("type:%d", s.Type), []query.Q{s.Child})
+	case *query.DiffLine:
+		writeChildren(fmt.Sprintf("diffline:%d", s.Kind), []query.Q{s.Child})
+	case *query.GobCache:
+		writeQueryKey(w, s.Q)
+	case *query.Regexp:
+		fmt.Fprintf(w, "(regexp %q %t %t %t)", s.Regexp.String(), s.FileName, s.Content, s.CaseSensitive)
+	case *query.RepoSet:
+		repos := make([]string, 0, len(s.Set))
+		for repo, ok := range s.Set {
+			if ok {
+				repos = append(repos, repo)
+			}
+		}
+		sort.Strings(repos)
+		fmt.Fprintf(w, "(reposet %t %q)", s.IgnoreCase, repos)
+	case *query.RepoBranches:
+		repos := make([]string, 0, len(s.Set))
+		for repo := range s.Set {
+			repos = append(repos, repo)
+		}
+		sort.Strings(repos)
+		io.WriteString(w, "(repobranches")
+		for _, repo := range repos {
+			fmt.Fprintf(w, " %q=%q", repo, s.Set[repo])
+		}
+		io.WriteString(w, ")")
+	case *query.BranchesRepos:
+		io.WriteString(w, "(branchesrepos")
+		for _, br := range s.List {
+			fmt.Fprintf(w, " %q=%v", br.Branch, br.Repos.ToArray())
+		}
+		io.WriteString(w, ")")
+	default:
+		// The remaining atoms have no pointer fields, so their fields
+		// identify them. fmt prints maps sorted by key.
+		fmt.Fprintf(w, "%T%+v", q, q)
+	}
+}
+
+// get returns a copy of the cached result for key, or nil. gen must be
+// passed to a subsequent put.
+func (c *resultCache) get(key [sha256.Size]byte) (sr *zoekt.SearchResult, gen int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*resultCacheEntry)
+		if c.ttl == 0 || c.now().Before(e.expires) {
+			c.lru.MoveToFront(el)
+			c.hits++
+			metricResultCacheHitsTotal.Inc()
+			return copyResult(e.result), c.gen
+		}
+		c.lru.Remove(el)
+		delete(c.entries, key)
+	}
+	c.misses++
+	metricResultCacheMissesTotal.Inc()
+	return nil, c.gen
+}
+
+// put stores a copy of sr under key, unless the cache was purged since
+// the get that returned gen.
+func (c *resultCache) put(key [sha256.Size]byte, gen int, sr *zoekt.SearchResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gen != c.gen || c.size <= 0 {
+		return
+	}
+	e := &resultCacheEntry{
+		key:     key,
+		result:  copyResult(sr),
+		expires: c.now().Add(c.ttl),
+	}
+	if el, ok := c.entries[key]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.size {
+		el := c.lru.Back()
+		c.lru.Remove(el)
+		delete(c.entries, el.Value.(*resultCacheEntry).key)
+	}
+}
+
+// purge drops all entries.
+func (c *resultCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[[sha256.Size]byte]*list.Element)
+	c.lru.Init()
+	c.gen++
+}
+
+// len returns the number of cached results.
+func (c *resultCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// copyResult returns a copy of sr that can be modified without changing
+// the slice and map fields of sr. The file matches themselves are shared.
+func copyResult(sr *zoekt.SearchResult) *zoekt.SearchResult {
+	cp := *sr
+	cp.Files = append([]zoekt.FileMatch(nil), sr.Files...)
+	cp.RepoMatchDensity = append([]zoekt.RepoMatchDensity(nil), sr.RepoMatchDensity...)
+	cp.RepoURLs = make(map[string]string, len(sr.RepoURLs))
+	for k, v := range sr.RepoURLs {
+		cp.RepoURLs[k] = v
+	}
+	cp.LineFragments = make(map[string]string, len(sr.LineFragments))
+	for k, v := range sr.LineFragments {
+		cp.LineFragments[k] = v
+	}
+	return &cp
+}
@@ -2,6 +2,12 @@ package shards
 
 import (
 	"context"
+	"log"
+	"math"
+	"path"
+	"sort"
+	"strings"
+	"sync"
 
 	"github.com/google/zoekt"
 	"github.com/google/zoekt/query"
@@ -13,6 +19,91 @@ import (
 // since they need to do cross shard operations.
 type typeRepoSearcher struct {
 	zoekt.Streamer
+
+	// reposMu guards the fields below.
+	reposMu sync.Mutex
+	// repos is the list of all repositories, or nil if it has to be
+	// recomputed. It is maintained in the background by refreshLoop.
+	repos *zoekt.RepoList
+	// reposGen is incremented by invalidate, so that a refresh racing
+	// with a shard change doesn't store a stale list.
+	reposGen int
+
+	refresh chan struct{}
+	done    chan struct{}
+}
+
+// newTypeRepoSearcher returns a typeRepoSearcher which keeps the list of
+// all repositories warm. Call invalidate when the underlying shards change.
+func newTypeRepoSearcher(s zoekt.Streamer) *typeRepoSearcher {
+	trs := &typeRepoSearcher{
+		Streamer: s,
+		refresh:  make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	go trs.refreshLoop()
+	trs.invalidate()
+	return trs
+}
+
+func (s *typeRepoSearcher) Close() {
+	if s.done != nil {
+		close(s.done)
+	}
+	s.Streamer.Close()
+}
+
+// invalidate drops the cached repository list and schedules a refresh.
+func (s *typeRepoSearcher) invalidate() {
+	s.reposMu.Lock()
+	s.repos = nil
+	s.reposGen++
+	s.reposMu.Unlock()
+
+	select {
+	case s.refresh <- struct{}{}:
+	default:
+	}
+}
+
+func (s *typeRepoSearcher) refreshLoop() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.refresh:
+		}
+		s.refreshRepos(context.Background())
+	}
+}
+
+func (s *typeRepoSearcher) refreshRepos(ctx context.Context) {
+	s.reposMu.Lock()
+	gen := s.reposGen
+	s.reposMu.Unlock()
+
+	rl, err := s.Streamer.List(ctx, &query.Const{Value: true}, nil)
+	if err != nil {
+		log.Printf("typeRepoSearcher: refreshing repository list: %v", err)
+		return
+	}
+	if rl.Incomplete {
+		return
+	}
+
+	s.reposMu.Lock()
+	if gen == s.reposGen {
+		s.repos = rl
+	}
+	s.reposMu.Unlock()
+}
+
+// cachedRepos returns the cached list of all repositories, or nil if
+// there is none.
+func (s *typeRepoSearcher) cachedRepos() *zoekt.RepoList {
+	s.reposMu.Lock()
+	defer s.reposMu.Unlock()
+	return s.repos
 }
 
 func (s *typeRepoSearcher) Search(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (sr *zoekt.SearchResult, err error) {
@@ -56,7 +147,85 @@ func (s *typeRepoSearcher) StreamSearch(ctx context.Context, q query.Q, opts *zo
 		return err
 	}
 
-	return s.Streamer.StreamSearch(ctx, q, opts, sender)
+	if opts.StreamBatchSize <= 1 {
+		return s.Streamer.StreamSearch(ctx, q, opts, sender)
+	}
+
+	b := &batchSender{sender: sender, opts: opts}
+	defer b.flush()
+	return s.Streamer.StreamSearch(ctx, q, opts, b)
+}
+
+// batchSender coalesces results until they hold opts.StreamBatchSize
+// files, or until opts.TotalMaxMatchCount is first exceeded, before
+// sending them on. Pending results are sent by flush.
+type batchSender struct {
+	sender zoekt.Sender
+	opts   *zoekt.SearchOptions
+
+	mu         sync.Mutex
+	pending    *zoekt.SearchResult
+	matchCount int
+	cutoff     bool
+}
+
+func (b *batchSender) Send(r *zoekt.SearchResult) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.matchCount += r.Stats.MatchCount
+	if b.pending == nil {
+		b.pending = &zoekt.SearchResult{}
+	}
+	mergeResult(b.pending, r)
+
+	// Results still arriving after the cutoff are batched as usual.
+	cutoff := !b.cutoff && b.opts.TotalMaxMatchCount > 0 && b.matchCount > b.opts.TotalMaxMatchCount
+	if cutoff {
+		b.cutoff = true
+	}
+	if cutoff || len(b.pending.Files) >= b.opts.StreamBatchSize {
+		b.sender.Send(b.pending)
+		b.pending = nil
+	}
+}
+
+func (b *batchSender) flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.pending != nil {
+		b.sender.Send(b.pending)
+		b.pending = nil
+	}
+}
+
+// mergeResult adds the files and stats of r to dst. The progress of dst
+// is that of r, the later result.
+func mergeResult(dst, r *zoekt.SearchResult) {
+	dst.Stats.Add(r.Stats)
+	dst.Progress = r.Progress
+	dst.Files = append(dst.Files, r.Files...)
+	dst.RepoMatchDensity = append(dst.RepoMatchDensity, r.RepoMatchDensity...)
+
+	for k, v := range r.RepoURLs {
+		if dst.RepoURLs == nil {
+			dst.RepoURLs = map[string]string{}
+		}
+		dst.RepoURLs[k] = v
+	}
+	for k, v := range r.LineFragments {
+		if dst.LineFragments == nil {
+			dst.LineFragments = map[string]string{}
+		}
+		dst.LineFragments[k] = v
+	}
+	for k, v := range r.IndexFormatVersions {
+		if dst.IndexFormatVersions == nil {
+			dst.IndexFormatVersions = map[int]int{}
+		}
+		dst.IndexFormatVersions[k] += v
+	}
 }
 
 func (s *typeRepoSearcher) List(ctx context.Context, r query.Q, opts *zoekt.ListOptions) (rl *zoekt.RepoList, err error) {
@@ -96,11 +265,34 @@ func (s *typeRepoSearcher) eval(ctx context.Context, q query.Q) (query.Q, error)
 			return q
 		}
 
+		if all := s.cachedRepos(); all != nil {
+			rs := &query.RepoSet{Set: map[string]bool{}}
+			ok := true
+			for _, r := range all.Repos {
+				var match bool
+				if match, ok = evalRepoQuery(rq.Child, &r.Repository); !ok {
+					break
+				}
+				if match {
+					rs.Set[r.Repository.Name] = true
+				}
+			}
+			if ok {
+				return rs
+			}
+		}
+
 		var rl *zoekt.RepoList
 		rl, err = s.Streamer.List(ctx, rq.Child, nil)
 		if err != nil {
 			return nil
 		}
+		// A partial list would silently drop repositories from the
+		// search.
+		if rl.Incomplete {
+			err = ctx.Err()
+			return nil
+		}
 
 		rs := &query.RepoSet{Set: make(map[string]bool, len(rl.Repos))}
 		for _, r := range rl.Repos {
@@ -110,3 +302,77 @@ func (s *typeRepoSearcher) eval(ctx context.Context, q query.Q) (query.Q, error)
 	})
 	return q, err
 }
+
+// evalRepoQuery evaluates q against the metadata of repo. ok is false if q
+// depends on more than the repository, eg. on file contents.
+func evalRepoQuery(q query.Q, repo *zoekt.Repository) (match, ok bool) {
+	switch s := q.(type) {
+	case *query.Const:
+		return s.Value, true
+	case *query.Repo:
+		return strings.Contains(repo.Name, s.Pattern), true
+	case *query.RepoSet:
+		return s.Has(repo.Name), true
+	case *query.Not:
+		match, ok = evalRepoQuery(s.Child, repo)
+		return !match, ok
+	case *query.And:
+		match = true
+		for _, ch := range s.Children {
+			m, ok := evalRepoQuery(ch, repo)
+			if !ok {
+				return false, false
+			}
+			match = match && m
+		}
+		return match, true
+	case *query.Or:
+		for _, ch := range s.Children {
+			m, ok := evalRepoQuery(ch, repo)
+			if !ok {
+				return false, false
+			}
+			match = match || m
+		}
+		return match, true
+	}
+	return false, false
+}
+
+// PathDifference returns the sorted paths of files in repository repoA
+// that have no file at the same path in repoB, on any branch. Paths are
+// compared after path.Clean, ignoring a leading slash. Only file names
+// are read from the index, not content.
+func PathDifference(ctx context.Context, s zoekt.Searcher, repoA, repoB string) ([]string, error) {
+	paths := func(repo string) (map[string]string, error) {
+		res, err := s.Search(ctx, query.NewRepoSet(repo), &zoekt.SearchOptions{
+			MaxFilePaths: math.MaxInt32,
+		})
+		if err != nil {
+			return nil, err
+		}
+		m := make(map[string]string, len(res.Files))
+		for _, f := range res.Files {
+			m[path.Clean("/"+f.FileName)] = f.FileName
+		}
+		return m, nil
+	}
+
+	a, err := paths(repoA)
+	if err != nil {
+		return nil, err
+	}
+	b, err := paths(repoB)
+	if err != nil {
+		return nil, err
+	}
+
+	var diff []string
+	for p, name := range a {
+		if _, ok := b[p]; !ok {
+			diff = append(diff, name)
+		}
+	}
+	sort.Strings(diff)
+	return diff, nil
+}
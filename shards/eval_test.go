@@ -3,10 +3,12 @@ package shards
 import (
 	"context"
 	"fmt"
+	"reflect"
 	"testing"
 
 	"github.com/google/zoekt"
 	"github.com/google/zoekt/query"
+	"github.com/google/zoekt/stream"
 )
 
 func TestSearchTypeRepo(t *testing.T) {
@@ -24,7 +26,7 @@ func TestSearchTypeRepo(t *testing.T) {
 	addShard(
 		zoekt.Document{Name: "f3", Content: []byte("another shard")})
 
-	searcher := &typeRepoSearcher{ss}
+	searcher := &typeRepoSearcher{Streamer: ss}
 	search := func(q query.Q, o ...zoekt.SearchOptions) *zoekt.SearchResult {
 		t.Helper()
 		var opts zoekt.SearchOptions
@@ -116,3 +118,145 @@ func TestSearchTypeRepo(t *testing.T) {
 		&query.Substring{Pattern: "file"}))
 	wantSingleMatch(res, "f2:8")
 }
+
+type listCounter struct {
+	zoekt.Streamer
+	lists int
+}
+
+func (s *listCounter) List(ctx context.Context, q query.Q, opts *zoekt.ListOptions) (*zoekt.RepoList, error) {
+	s.lists++
+	return s.Streamer.List(ctx, q, opts)
+}
+
+func TestTypeRepoCachedList(t *testing.T) {
+	ss := newShardedSearcher(2)
+	addRepo := func(id uint32, name string) {
+		b := testIndexBuilder(t, &zoekt.Repository{ID: id, Name: name},
+			zoekt.Document{Name: "f1", Content: []byte("needle")})
+		ss.replace(name, searcherForTest(t, b))
+	}
+	addRepo(1, "foo")
+
+	counter := &listCounter{Streamer: ss}
+	searcher := &typeRepoSearcher{Streamer: counter}
+	searcher.refreshRepos(context.Background())
+	counter.lists = 0
+
+	q := &query.Type{Type: query.TypeRepo, Child: &query.Repo{Pattern: "o"}}
+	evalSet := func() map[string]bool {
+		t.Helper()
+		got, err := searcher.eval(context.Background(), q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rs, ok := got.(*query.RepoSet)
+		if !ok {
+			t.Fatalf("got %s, want reposet", got)
+		}
+		return rs.Set
+	}
+
+	if got, want := evalSet(), map[string]bool{"foo": true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if counter.lists != 0 {
+		t.Errorf("got %d List calls, want 0", counter.lists)
+	}
+
+	// Content queries can't be answered from the cached list.
+	if _, err := searcher.eval(context.Background(), &query.Type{Type: query.TypeRepo, Child: &query.Substring{Pattern: "needle"}}); err != nil {
+		t.Fatal(err)
+	}
+	if counter.lists != 1 {
+		t.Errorf("got %d List calls, want 1", counter.lists)
+	}
+
+	addRepo(2, "bob")
+	searcher.invalidate()
+	searcher.refreshRepos(context.Background())
+	counter.lists = 0
+
+	if got, want := evalSet(), map[string]bool{"foo": true, "bob": true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after refresh: got %v, want %v", got, want)
+	}
+	if counter.lists != 0 {
+		t.Errorf("after refresh: got %d List calls, want 0", counter.lists)
+	}
+}
+
+func TestPathDifference(t *testing.T) {
+	ss := newShardedSearcher(2)
+	addRepo := func(key string, repo *zoekt.Repository, names ...string) {
+		var docs []zoekt.Document
+		for _, n := range names {
+			docs = append(docs, zoekt.Document{Name: n, Content: []byte("content")})
+		}
+		ss.replace(key, searcherForTest(t, testIndexBuilder(t, repo, docs...)))
+	}
+	fork := &zoekt.Repository{ID: 1, Name: "fork"}
+	upstream := &zoekt.Repository{ID: 2, Name: "upstream"}
+	// fork is spread over two shards.
+	addRepo("fork-1", fork, "README.md", "src/main.go", "src/patch.go")
+	addRepo("fork-2", fork, "docs//fork.md", "./LICENSE")
+	addRepo("upstream", upstream, "README.md", "src/main.go", "docs/upstream.md", "LICENSE")
+
+	got, err := PathDifference(context.Background(), ss, "fork", "upstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"docs//fork.md", "src/patch.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("fork - upstream: got %v, want %v", got, want)
+	}
+
+	got, err = PathDifference(context.Background(), ss, "upstream", "fork")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"docs/upstream.md"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("upstream - fork: got %v, want %v", got, want)
+	}
+}
+
+func TestStreamBatchSize(t *testing.T) {
+	ss := newShardedSearcher(2)
+	for i := 0; i < 10; i++ {
+		b := testIndexBuilder(t, &zoekt.Repository{ID: uint32(i + 1), Name: fmt.Sprintf("repo%d", i)},
+			zoekt.Document{Name: "f1", Content: []byte("needle")},
+			zoekt.Document{Name: "f2", Content: []byte("needle")})
+		ss.replace(fmt.Sprintf("key-%d", i), searcherForTest(t, b))
+	}
+	searcher := &typeRepoSearcher{Streamer: ss}
+
+	search := func(opts zoekt.SearchOptions) (events, files int) {
+		t.Helper()
+		err := searcher.StreamSearch(context.Background(), &query.Substring{Pattern: "needle"}, &opts, stream.SenderFunc(func(r *zoekt.SearchResult) {
+			events++
+			files += len(r.Files)
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return events, files
+	}
+
+	events1, files1 := search(zoekt.SearchOptions{StreamBatchSize: 1})
+	events50, files50 := search(zoekt.SearchOptions{StreamBatchSize: 50})
+	if files1 != 20 || files50 != 20 {
+		t.Fatalf("got %d and %d files, want 20", files1, files50)
+	}
+	// The sharded searcher sends an event for the wait time, and one per
+	// shard.
+	if events1 != 11 {
+		t.Errorf("batch size 1: got %d events, want 11", events1)
+	}
+	if events50 != 1 {
+		t.Errorf("batch size 50: got %d events, want 1", events50)
+	}
+
+	// The cutoff flushes right away.
+	events, _ := search(zoekt.SearchOptions{StreamBatchSize: 50, TotalMaxMatchCount: 3})
+	if events < 1 || events > 2 {
+		t.Errorf("with TotalMaxMatchCount: got %d events, want 1 or 2", events)
+	}
+}
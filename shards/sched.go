@@ -27,6 +27,10 @@ type scheduler interface {
 	// Exclusive blocks until an exclusive process is created. An exclusive
 	// process is the only running process. See process documentation.
 	Exclusive() *process
+
+	// Resize changes the number of searches that may run concurrently. It
+	// blocks until the searches running under the old capacity are done.
+	Resize(capacity int64)
 }
 
 // The ZOEKTSCHED environment variable controls variables within the
@@ -116,19 +120,10 @@ type multiScheduler struct {
 }
 
 func newMultiScheduler(capacity int64) *multiScheduler {
-	batchdiv := zoektSched["batchdiv"]
-	if batchdiv == 0 {
-		// Burst up to 1/4 of interactive capacity for batch.
-		batchdiv = 4
-	} else {
+	if batchdiv := zoektSched["batchdiv"]; batchdiv != 0 {
 		log.Printf("ZOEKTSCHED=batchdiv=%d specified. Batch queue size 1/%d of %d.", batchdiv, batchdiv, capacity)
 	}
 
-	batchCap := capacity / int64(batchdiv)
-	if batchCap == 0 {
-		batchCap = 1
-	}
-
 	interactiveseconds := zoektSched["interactiveseconds"]
 	if interactiveseconds == 0 {
 		interactiveseconds = 5
@@ -139,12 +134,27 @@ func newMultiScheduler(capacity int64) *multiScheduler {
 	return &multiScheduler{
 		mu:             newRWMutex(),
 		semInteractive: newSema(capacity, "interactive"),
-		semBatch:       newSema(batchCap, "batch"),
+		semBatch:       newSema(batchCapacity(capacity), "batch"),
 
 		interactiveDuration: time.Duration(interactiveseconds) * time.Second,
 	}
 }
 
+// batchCapacity returns the size of the batch queue for an interactive
+// queue of size capacity.
+func batchCapacity(capacity int64) int64 {
+	batchdiv := zoektSched["batchdiv"]
+	if batchdiv == 0 {
+		// Burst up to 1/4 of interactive capacity for batch.
+		batchdiv = 4
+	}
+	batchCap := capacity / int64(batchdiv)
+	if batchCap == 0 {
+		batchCap = 1
+	}
+	return batchCap
+}
+
 // Acquire implements scheduler.Acquire.
 func (s *multiScheduler) Acquire(ctx context.Context) (*process, error) {
 	if err := s.mu.RLock(ctx); err != nil {
@@ -205,11 +215,22 @@ func (s *multiScheduler) Exclusive() *process {
 	}
 }
 
+// Resize implements scheduler.Resize.
+func (s *multiScheduler) Resize(capacity int64) {
+	// Every process reads the semaphores while holding a read lock on mu, so
+	// while we hold the write lock no process holds or waits on them.
+	s.mu.Lock()
+	s.semInteractive = newSema(capacity, "interactive")
+	s.semBatch = newSema(batchCapacity(capacity), "batch")
+	s.mu.Unlock()
+}
+
 // semaphoreScheduler shares a single semaphore for all searches. An exclusive
 // process acquires the full semaphore. This is equivalent to how concurrency
 // is managed in upstream. It exists as a fallback while we test
 // multiScheduler.
 type semaphoreScheduler struct {
+	mu       sync.Mutex // guards throttle and capacity
 	throttle *semaphore.Weighted
 	capacity int64
 }
@@ -222,19 +243,50 @@ func (s *semaphoreScheduler) Acquire(ctx context.Context) (*process, error) {
 // Exclusive implements scheduler.Exclusive.
 func (s *semaphoreScheduler) Exclusive() *process {
 	// Won't error since context.Background won't expire.
-	proc, _ := s.acquire(context.Background(), s.capacity)
+	proc, _ := s.acquire(context.Background(), 0)
 	return proc
 }
 
+// Resize implements scheduler.Resize.
+func (s *semaphoreScheduler) Resize(capacity int64) {
+	// Holding the full old semaphore means no process is running. Waiters
+	// woken by the release notice the semaphore was replaced and retry.
+	proc := s.Exclusive()
+	s.mu.Lock()
+	s.throttle = semaphore.NewWeighted(capacity)
+	s.capacity = capacity
+	s.mu.Unlock()
+	proc.Release()
+}
+
+// acquire acquires weight from the throttle, or all of it if weight is 0.
 func (s *semaphoreScheduler) acquire(ctx context.Context, weight int64) (*process, error) {
-	if err := s.throttle.Acquire(ctx, weight); err != nil {
-		return nil, err
+	for {
+		s.mu.Lock()
+		throttle, w := s.throttle, weight
+		if w == 0 {
+			w = s.capacity
+		}
+		s.mu.Unlock()
+
+		if err := throttle.Acquire(ctx, w); err != nil {
+			return nil, err
+		}
+
+		s.mu.Lock()
+		current := throttle == s.throttle
+		s.mu.Unlock()
+		if !current {
+			throttle.Release(w)
+			continue
+		}
+
+		return &process{
+			releaseFunc: func() {
+				throttle.Release(w)
+			},
+		}, nil
 	}
-	return &process{
-		releaseFunc: func() {
-			s.throttle.Release(weight)
-		},
-	}, nil
 }
 
 // process represents a running search query or an exclusive process. When the
@@ -16,6 +16,8 @@ package shards
 
 import (
 	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"log"
 	"math"
@@ -24,11 +26,14 @@ import (
 	"runtime/debug"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/sync/errgroup"
 
+	"github.com/RoaringBitmap/roaring"
 	"github.com/google/zoekt"
 	"github.com/google/zoekt/query"
 	"github.com/google/zoekt/stream"
@@ -82,6 +87,10 @@ var (
 		Name: "zoekt_search_crashes_total",
 		Help: "Total number of search shards that had a crash",
 	})
+	metricSearchShardTimeoutsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "zoekt_search_shard_timeouts_total",
+		Help: "Total number of search shards cut off by the per shard wall time",
+	})
 	metricSearchFileCountTotal = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "zoekt_search_file_count_total",
 		Help: "Total number of files containing a match",
@@ -114,6 +123,10 @@ var (
 		Name: "zoekt_search_ngram_matches_total",
 		Help: "Total number of candidate matches as a result of searching ngrams",
 	})
+	metricSearchTenantMatchCountTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "zoekt_search_tenant_match_count_total",
+		Help: "Total number of non-overlapping matches by the tenant set with trace.WithTenant",
+	}, []string{"tenant"})
 
 	metricListRunning = promauto.NewGauge(prometheus.GaugeOpts{
 		Name: "zoekt_list_running",
@@ -177,6 +190,18 @@ type rankedShard struct {
 	// the shard file does not. So we compute a rank in getShards. We store
 	// names here to avoid the cost of List in the search request path.
 	repos []*zoekt.Repository
+
+	// identity describes the content of the shard, so that copies of the
+	// same shard under different names can be detected.
+	identity string
+
+	// key is the name the shard was loaded under. It breaks ties between
+	// shards that rank the same.
+	key string
+
+	// modTime is the modification time of the file key, if it is one.
+	// Of two duplicate shards, the newer one is kept.
+	modTime time.Time
 }
 
 type shardedSearcher struct {
@@ -188,8 +213,24 @@ type shardedSearcher struct {
 
 	shards map[string]rankedShard
 
+	// identities maps rankedShard.identity to the key in shards.
+	identities map[string]string
+
+	// suppressed maps the keys of shards that were not loaded because
+	// they duplicate a shard in shards to their identity. They are
+	// loaded again once that shard goes away.
+	suppressed map[string]string
+
 	rankedLock sync.Mutex // guards ranked
 	ranked     []rankedShard
+
+	// cache, if set, holds the results of recent searches. It is purged
+	// whenever the set of shards changes.
+	cache *resultCache
+
+	// rankOverrides holds a map[uint32]uint16 from repository ID to the
+	// rank used instead of the indexed one. See SetRankOverrides.
+	rankOverrides atomic.Value
 }
 
 func newShardedSearcher(n int64) *shardedSearcher {
@@ -203,21 +244,36 @@ func newShardedSearcher(n int64) *shardedSearcher {
 // NewDirectorySearcher returns a searcher instance that loads all
 // shards corresponding to a glob into memory.
 func NewDirectorySearcher(dir string) (zoekt.Streamer, error) {
+	return newDirectorySearcher(dir, nil)
+}
+
+// NewDirectorySearcherWithResultCache is like NewDirectorySearcher, but
+// caches the results of up to cacheSize searches for at most cacheTTL
+// each, for clients that repeat the same search. A zero cacheTTL means
+// results are only dropped by eviction or when the shards change.
+func NewDirectorySearcherWithResultCache(dir string, cacheSize int, cacheTTL time.Duration) (zoekt.Streamer, error) {
+	return newDirectorySearcher(dir, newResultCache(cacheSize, cacheTTL))
+}
+
+func newDirectorySearcher(dir string, cache *resultCache) (zoekt.Streamer, error) {
 	ss := newShardedSearcher(int64(runtime.GOMAXPROCS(0)))
+	ss.cache = cache
+	ds := &directorySearcher{
+		Streamer: ss,
+	}
+	trs := newTypeRepoSearcher(ds)
 	tl := &loader{
-		ss: ss,
+		ss:      ss,
+		changed: trs.invalidate,
 	}
 	dw, err := NewDirectoryWatcher(dir, tl)
 	if err != nil {
+		close(trs.done)
 		return nil, err
 	}
+	ds.directoryWatcher = dw
 
-	ds := &directorySearcher{
-		Streamer:         ss,
-		directoryWatcher: dw,
-	}
-
-	return &typeRepoSearcher{Streamer: ds}, nil
+	return trs, nil
 }
 
 type directorySearcher struct {
@@ -235,6 +291,9 @@ func (s *directorySearcher) Close() {
 
 type loader struct {
 	ss *shardedSearcher
+
+	// changed, if set, is called after a shard is loaded or dropped.
+	changed func()
 }
 
 func (tl *loader) load(key string) {
@@ -247,10 +306,26 @@ func (tl *loader) load(key string) {
 
 	metricShardsLoadedTotal.Inc()
 	tl.ss.replace(key, shard)
+	if tl.changed != nil {
+		tl.changed()
+	}
 }
 
 func (tl *loader) drop(key string) {
 	tl.ss.replace(key, nil)
+	if tl.changed != nil {
+		tl.changed()
+	}
+}
+
+// SetParallelism changes the number of searches that may run
+// concurrently to n. It waits for the searches that are running to
+// finish, so it is safe to call while searching.
+func (ss *shardedSearcher) SetParallelism(n int) {
+	if n < 1 {
+		n = 1
+	}
+	ss.sched.Resize(int64(n))
 }
 
 func (ss *shardedSearcher) String() string {
@@ -300,7 +375,7 @@ func selectRepoSet(shards []rankedShard, q query.Q) ([]rankedShard, query.Q) {
 		case *query.RepoSet:
 			setSize = len(setQuery.Set)
 			hasRepos = hasReposForPredicate(func(repo *zoekt.Repository) bool {
-				return setQuery.Set[repo.Name]
+				return setQuery.Has(repo.Name)
 			})
 		case *query.BranchesRepos:
 			for _, br := range setQuery.List {
@@ -402,6 +477,21 @@ func selectRepoSet(shards []rankedShard, q query.Q) ([]rankedShard, query.Q) {
 	return shards, and
 }
 
+// selectRepoIDs returns the shards which contain at least one of the
+// repositories in ids.
+func selectRepoIDs(shards []rankedShard, ids *roaring.Bitmap) []rankedShard {
+	filtered := make([]rankedShard, 0, len(shards))
+	for _, s := range shards {
+		for _, repo := range s.repos {
+			if ids.Contains(repo.ID) {
+				filtered = append(filtered, s)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
 func (ss *shardedSearcher) Search(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (sr *zoekt.SearchResult, err error) {
 	tr, ctx := trace.New(ctx, "shardedSearcher.Search", "")
 	defer func() {
@@ -411,6 +501,24 @@ func (ss *shardedSearcher) Search(ctx context.Context, q query.Q, opts *zoekt.Se
 		}
 		tr.Finish()
 	}()
+
+	var cacheKey [sha256.Size]byte
+	var cacheGen int
+	// Functions in opts can't be part of the key.
+	cache := ss.cache
+	if opts.IsTestFile != nil {
+		cache = nil
+	}
+	if cache != nil {
+		cacheKey = resultCacheKey(q, opts)
+		var cached *zoekt.SearchResult
+		if cached, cacheGen = cache.get(cacheKey); cached != nil {
+			tr.LazyPrintf("result cache hit")
+			return cached, nil
+		}
+	}
+
+	parentCtx := ctx
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
@@ -424,6 +532,14 @@ func (ss *shardedSearcher) Search(ctx context.Context, q query.Q, opts *zoekt.Se
 		},
 	}
 
+	// matchCount is the number of matches that count towards
+	// TotalMaxMatchCount.
+	matchCount := 0
+	var perRepo *repoFileCounter
+	if opts.MaxMatchesPerRepo > 0 {
+		perRepo = &repoFileCounter{max: opts.MaxMatchesPerRepo, files: map[string]int{}}
+	}
+
 	start := time.Now()
 	proc, err := ss.sched.Acquire(ctx)
 	if err != nil {
@@ -439,6 +555,7 @@ func (ss *shardedSearcher) Search(ctx context.Context, q query.Q, opts *zoekt.Se
 		defer aggregate.Unlock()
 
 		aggregate.Stats.Add(r.Stats)
+		aggregate.RepoMatchDensity = append(aggregate.RepoMatchDensity, r.RepoMatchDensity...)
 
 		if len(r.Files) > 0 {
 			aggregate.Files = append(aggregate.Files, r.Files...)
@@ -449,9 +566,24 @@ func (ss *shardedSearcher) Search(ctx context.Context, q query.Q, opts *zoekt.Se
 			for k, v := range r.LineFragments {
 				aggregate.LineFragments[k] = v
 			}
+			for k, v := range r.IndexFormatVersions {
+				if aggregate.IndexFormatVersions == nil {
+					aggregate.IndexFormatVersions = map[int]int{}
+				}
+				aggregate.IndexFormatVersions[k] += v
+			}
 		}
 
-		if cancel != nil && opts.TotalMaxMatchCount > 0 && aggregate.Stats.MatchCount > opts.TotalMaxMatchCount {
+		if perRepo != nil {
+			matchCount += perRepo.add(r)
+		} else {
+			matchCount += r.Stats.MatchCount
+		}
+		if cancel != nil && opts.TotalMaxMatchCount > 0 && matchCount > opts.TotalMaxMatchCount {
+			cancel()
+			cancel = nil
+		}
+		if cancel != nil && opts.MaxFilePaths > 0 && len(aggregate.Files) >= opts.MaxFilePaths {
 			cancel()
 			cancel = nil
 		}
@@ -460,13 +592,43 @@ func (ss *shardedSearcher) Search(ctx context.Context, q query.Q, opts *zoekt.Se
 		return nil, err
 	}
 
-	zoekt.SortFilesByScore(aggregate.Files)
+	sortFilesByScore(aggregate.Files)
+	if opts.MaxMatchesPerRepo > 0 {
+		limitFilesPerRepo(aggregate.SearchResult, opts.MaxMatchesPerRepo)
+	}
+	if opts.RepoMatchDensity {
+		aggregate.RepoMatchDensity = zoekt.SortRepoMatchDensity(aggregate.RepoMatchDensity)
+	}
 	if max := opts.MaxDocDisplayCount; max > 0 && len(aggregate.Files) > max {
 		aggregate.Files = aggregate.Files[:max]
 	}
+	if max := opts.MaxFilePaths; max > 0 && len(aggregate.Files) > max {
+		aggregate.Files = aggregate.Files[:max]
+	}
+	// Only the files that made it into the result use up content.
+	if opts.MaxContentBytes > 0 {
+		budget := &contentBudget{remaining: opts.MaxContentBytes}
+		budget.limit(aggregate.SearchResult)
+	}
+	switch opts.SortBy {
+	case zoekt.SortByFilePath:
+		zoekt.SortFilesByPath(aggregate.Files)
+	case zoekt.SortByRecency:
+		zoekt.SortFilesByRecency(aggregate.Files)
+	}
 	copyFiles(aggregate.SearchResult)
 
 	aggregate.Duration = time.Since(start)
+	// Results cut short by cancellation or a timeout would be served
+	// in place of complete ones until they expire.
+	complete := aggregate.Stats.Crashes == 0 &&
+		aggregate.Stats.ShardsSkipped == 0 &&
+		aggregate.Stats.ShardTimeouts == 0 &&
+		parentCtx.Err() == nil &&
+		(opts.MaxWallTime == 0 || aggregate.Duration < opts.MaxWallTime)
+	if cache != nil && complete {
+		cache.put(cacheKey, cacheGen, aggregate.SearchResult)
+	}
 	return aggregate.SearchResult, nil
 }
 
@@ -480,6 +642,10 @@ func (ss *shardedSearcher) StreamSearch(ctx context.Context, q query.Q, opts *zo
 		tr.Finish()
 	}()
 
+	if opts.MaxMatchesPerRepo > 0 {
+		return errors.New("MaxMatchesPerRepo is not supported for streamed results")
+	}
+
 	start := time.Now()
 	proc, err := ss.sched.Acquire(ctx)
 	if err != nil {
@@ -493,9 +659,30 @@ func (ss *shardedSearcher) StreamSearch(ctx context.Context, q query.Q, opts *zo
 		},
 	})
 
+	// Like Search, stop searching more shards once enough matches were
+	// sent. streamSearch serializes the calls to our sender.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	matchCount := 0
+
+	var budget *contentBudget
+	if opts.MaxContentBytes > 0 {
+		budget = &contentBudget{remaining: opts.MaxContentBytes}
+	}
+
 	return ss.streamSearch(ctx, proc, q, opts, stream.SenderFunc(func(event *zoekt.SearchResult) {
+		// streamSearch already dropped the files that don't belong in
+		// the result, so only the files we send use up content.
+		if budget != nil {
+			budget.limit(event)
+		}
 		copyFiles(event)
 		sender.Send(event)
+
+		matchCount += event.Stats.MatchCount
+		if opts.TotalMaxMatchCount > 0 && matchCount > opts.TotalMaxMatchCount {
+			cancel()
+		}
 	}))
 }
 
@@ -521,6 +708,10 @@ func (ss *shardedSearcher) streamSearch(ctx context.Context, proc *process, q qu
 	tr.LazyPrintf("before selectRepoSet shards:%d", len(shards))
 	shards, q = selectRepoSet(shards, q)
 	tr.LazyPrintf("after selectRepoSet shards:%d %s", len(shards), q)
+	if opts.RepoIDs != nil {
+		shards = selectRepoIDs(shards, opts.RepoIDs)
+		tr.LazyPrintf("after selectRepoIDs shards:%d", len(shards))
+	}
 
 	var childCtx context.Context
 	var cancel context.CancelFunc
@@ -534,6 +725,14 @@ func (ss *shardedSearcher) streamSearch(ctx context.Context, proc *process, q qu
 
 	mu := sync.Mutex{}
 	pendingPriorities := prioritySlice{}
+	sentTotal := false
+
+	overrides, _ := ss.rankOverrides.Load().(map[uint32]uint16)
+
+	var tenantMatchCount prometheus.Counter
+	if tenant := trace.TenantFromContext(ctx); tenant != "" {
+		tenantMatchCount = metricSearchTenantMatchCountTotal.WithLabelValues(tenant)
+	}
 
 	g, ctx := errgroup.WithContext(childCtx)
 
@@ -576,6 +775,16 @@ func (ss *shardedSearcher) streamSearch(ctx context.Context, proc *process, q qu
 					metricSearchShardsSkippedTotal.Add(float64(sr.Stats.ShardsSkipped))
 					metricSearchMatchCountTotal.Add(float64(sr.Stats.MatchCount))
 					metricSearchNgramMatchesTotal.Add(float64(sr.Stats.NgramMatches))
+					if tenantMatchCount != nil {
+						tenantMatchCount.Add(float64(sr.Stats.MatchCount))
+					}
+
+					if len(overrides) > 0 {
+						applyRankOverrides(sr, overrides)
+					}
+					if opts.ExcludeTests {
+						excludeTests(sr, opts.IsTestFile)
+					}
 
 					// MaxPendingPriority *cannot* be this result's Priority, because
 					// the priority is removed before computing max() and calling sender.Send.
@@ -598,6 +807,10 @@ func (ss *shardedSearcher) streamSearch(ctx context.Context, proc *process, q qu
 					pendingPriorities.remove(s.priority)
 					sr.Progress.MaxPendingPriority = pendingPriorities.max()
 					sr.Progress.Priority = s.priority
+					if !sentTotal {
+						sr.Stats.ShardsTotal = len(shards)
+						sentTotal = true
+					}
 					sender.Send(sr)
 					mu.Unlock()
 				}))
@@ -614,6 +827,115 @@ func (ss *shardedSearcher) streamSearch(ctx context.Context, proc *process, q qu
 	return g.Wait()
 }
 
+// sortFilesByScore sorts files by decreasing score. Shards are searched
+// concurrently, so files with the same score are ordered by repository and
+// file name to make the result independent of which shard finished first.
+func sortFilesByScore(files []zoekt.FileMatch) {
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].Score != files[j].Score {
+			return files[i].Score > files[j].Score
+		}
+		if files[i].Repository != files[j].Repository {
+			return files[i].Repository < files[j].Repository
+		}
+		return files[i].FileName < files[j].FileName
+	})
+}
+
+// contentBudget is the number of bytes of content that the shards of a
+// search may still return. It is safe for concurrent use.
+type contentBudget struct {
+	remaining int64
+}
+
+// take reports whether n more bytes fit in the budget, and if so
+// subtracts them. Once n bytes don't fit, the budget is exhausted.
+func (b *contentBudget) take(n int) bool {
+	for {
+		r := atomic.LoadInt64(&b.remaining)
+		if int64(n) > r {
+			atomic.StoreInt64(&b.remaining, 0)
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&b.remaining, r, r-int64(n)) {
+			return true
+		}
+	}
+}
+
+// limit drops the content of sr that does not fit in the budget.
+func (b *contentBudget) limit(sr *zoekt.SearchResult) {
+	for i := range sr.Files {
+		fm := &sr.Files[i]
+		if len(fm.Content) > 0 && !b.take(len(fm.Content)) {
+			fm.Content = nil
+		}
+		for l := range fm.LineMatches {
+			if len(fm.LineMatches[l].Line) > 0 && !b.take(len(fm.LineMatches[l].Line)) {
+				fm.LineMatches[l].Line = nil
+			}
+		}
+	}
+}
+
+// limitFilesPerRepo drops the files of sr after the first max of each
+// repository. sr.Files must be sorted by decreasing score, so that each
+// repository keeps its best files.
+func limitFilesPerRepo(sr *zoekt.SearchResult, max int) {
+	counts := map[string]int{}
+	removeFiles(sr, func(f *zoekt.FileMatch) bool {
+		counts[f.Repository]++
+		return counts[f.Repository] > max
+	})
+}
+
+// removeFiles drops the files of sr for which drop returns true, and
+// removes them from the file and match counts of sr.Stats.
+func removeFiles(sr *zoekt.SearchResult, drop func(*zoekt.FileMatch) bool) {
+	files := sr.Files[:0]
+	for i := range sr.Files {
+		f := &sr.Files[i]
+		if !drop(f) {
+			files = append(files, *f)
+			continue
+		}
+		sr.Stats.FileCount--
+		sr.Stats.MatchCount -= fileMatchCount(f)
+	}
+	sr.Files = files
+}
+
+// fileMatchCount returns the number of matches f adds to Stats.MatchCount.
+func fileMatchCount(f *zoekt.FileMatch) int {
+	if f.MatchCount > 0 {
+		return f.MatchCount
+	}
+	return len(f.LineMatches)
+}
+
+// repoFileCounter counts the files of each repository as shard results
+// are merged, for SearchOptions.MaxMatchesPerRepo.
+type repoFileCounter struct {
+	max   int
+	files map[string]int
+}
+
+// add counts the files of sr, and returns the number of matches in the
+// ones that are within the first max files of their repository. The
+// other files may not make it into the result, so they shouldn't count
+// towards TotalMaxMatchCount.
+func (c *repoFileCounter) add(sr *zoekt.SearchResult) int {
+	matches := 0
+	for i := range sr.Files {
+		f := &sr.Files[i]
+		c.files[f.Repository]++
+		if c.files[f.Repository] <= c.max {
+			matches += fileMatchCount(f)
+		}
+	}
+	return matches
+}
+
 func copySlice(src *[]byte) {
 	dst := make([]byte, len(*src))
 	copy(dst, *src)
@@ -626,7 +948,14 @@ func copyFiles(sr *zoekt.SearchResult) {
 		copySlice(&sr.Files[i].Content)
 		copySlice(&sr.Files[i].Checksum)
 		for l := range sr.Files[i].LineMatches {
-			copySlice(&sr.Files[i].LineMatches[l].Line)
+			lm := &sr.Files[i].LineMatches[l]
+			copySlice(&lm.Line)
+			for c := range lm.Before {
+				copySlice(&lm.Before[c].Line)
+			}
+			for c := range lm.After {
+				copySlice(&lm.After[c].Line)
+			}
 		}
 	}
 }
@@ -644,7 +973,26 @@ func searchOneShard(ctx context.Context, s zoekt.Searcher, q query.Q, opts *zoek
 		}
 	}()
 
-	ms, err := s.Search(ctx, q, opts)
+	shardCtx := ctx
+	if opts.MaxShardWallTime > 0 {
+		var cancel context.CancelFunc
+		shardCtx, cancel = context.WithTimeout(ctx, opts.MaxShardWallTime)
+		defer cancel()
+	}
+
+	ms, err := s.Search(shardCtx, q, opts)
+
+	// Only the shard deadline passed, so the search as a whole goes on.
+	if shardCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		metricSearchShardTimeoutsTotal.Inc()
+		if err != nil || ms == nil {
+			ms = &zoekt.SearchResult{}
+		}
+		ms.Stats.ShardTimeouts++
+		sender.Send(ms)
+		return nil
+	}
+
 	if err != nil {
 		return err
 	}
@@ -673,6 +1021,32 @@ func listOneShard(ctx context.Context, s zoekt.Searcher, q query.Q, opts *zoekt.
 	sink <- shardListResult{ms, err}
 }
 
+// listShards lists the repositories of shards concurrently. The returned
+// channel receives one result per shard.
+func listShards(ctx context.Context, shards []rankedShard, q query.Q, opts *zoekt.ListOptions) <-chan shardListResult {
+	all := make(chan shardListResult, len(shards))
+
+	feeder := make(chan zoekt.Searcher, len(shards))
+	for _, s := range shards {
+		feeder <- s
+	}
+	close(feeder)
+
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		go func() {
+			for s := range feeder {
+				// Don't start on more shards once the caller gave up.
+				if err := ctx.Err(); err != nil {
+					all <- shardListResult{nil, err}
+					continue
+				}
+				listOneShard(ctx, s, q, opts, all)
+			}
+		}()
+	}
+	return all
+}
+
 func (ss *shardedSearcher) List(ctx context.Context, r query.Q, opts *zoekt.ListOptions) (rl *zoekt.RepoList, err error) {
 	tr, ctx := trace.New(ctx, "shardedSearcher.List", "")
 	tr.LazyLog(r, true)
@@ -683,6 +1057,7 @@ func (ss *shardedSearcher) List(ctx context.Context, r query.Q, opts *zoekt.List
 		if rl != nil {
 			tr.LazyPrintf("repos size: %d", len(rl.Repos))
 			tr.LazyPrintf("crashes: %d", rl.Crashes)
+			tr.LazyPrintf("incomplete: %v", rl.Incomplete)
 			tr.LazyPrintf("minimal size: %d", len(rl.Minimal))
 		}
 		if err != nil {
@@ -706,23 +1081,8 @@ func (ss *shardedSearcher) List(ctx context.Context, r query.Q, opts *zoekt.List
 	tr.LazyPrintf("acquired process")
 
 	shards := ss.getShards()
-	shardCount := len(shards)
-	all := make(chan shardListResult, shardCount)
 	tr.LazyPrintf("shardCount: %d", len(shards))
-
-	feeder := make(chan zoekt.Searcher, len(shards))
-	for _, s := range shards {
-		feeder <- s
-	}
-	close(feeder)
-
-	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
-		go func() {
-			for s := range feeder {
-				listOneShard(ctx, s, r, opts, all)
-			}
-		}()
-	}
+	all := listShards(ctx, shards, r, opts)
 
 	agg := zoekt.RepoList{
 		Minimal: map[uint32]*zoekt.MinimalRepoListEntry{},
@@ -733,6 +1093,12 @@ func (ss *shardedSearcher) List(ctx context.Context, r query.Q, opts *zoekt.List
 	for range shards {
 		r := <-all
 		if r.err != nil {
+			// Like Search cutting off at its deadline, return what the
+			// shards listed so far.
+			if ctx.Err() != nil {
+				agg.Incomplete = true
+				continue
+			}
 			return nil, r.err
 		}
 
@@ -742,6 +1108,12 @@ func (ss *shardedSearcher) List(ctx context.Context, r query.Q, opts *zoekt.List
 			prev, ok := uniq[r.Repository.Name]
 			if !ok {
 				cp := *r // We need to copy because we mutate r.Stats when merging duplicates
+				if r.Stats.Languages != nil {
+					cp.Stats.Languages = make(map[string]zoekt.LanguageStats, len(r.Stats.Languages))
+					for lang, ls := range r.Stats.Languages {
+						cp.Stats.Languages[lang] = ls
+					}
+				}
 				uniq[r.Repository.Name] = &cp
 			} else {
 				prev.Stats.Add(&r.Stats)
@@ -762,13 +1134,226 @@ func (ss *shardedSearcher) List(ctx context.Context, r query.Q, opts *zoekt.List
 	}
 
 	isMinimal := opts != nil && opts.Minimal
-	if isAll && !isMinimal {
+	if isAll && !isMinimal && !agg.Incomplete {
 		reportListAllMetrics(agg.Repos)
 	}
 
 	return &agg, nil
 }
 
+// StreamList lists repositories like List, but sends the repositories of
+// each shard on the returned channel once the shard is listed, instead of
+// collecting all of them first. The channel is closed once every shard is
+// listed, listing fails or ctx is done.
+func (ss *shardedSearcher) StreamList(ctx context.Context, q query.Q, opts *zoekt.ListOptions) <-chan zoekt.StreamListEvent {
+	events := make(chan zoekt.StreamListEvent)
+	go func() {
+		defer close(events)
+		err := ss.streamList(ctx, q, opts, func(ev zoekt.StreamListEvent) bool {
+			// Don't send more events once the caller gave up, even if
+			// it is still receiving.
+			if ctx.Err() != nil {
+				return false
+			}
+			select {
+			case events <- ev:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+		if err != nil && ctx.Err() == nil {
+			events <- zoekt.StreamListEvent{Err: err}
+		}
+	}()
+	return events
+}
+
+// streamList calls send with the repositories of each shard, until send
+// returns false.
+func (ss *shardedSearcher) streamList(ctx context.Context, q query.Q, opts *zoekt.ListOptions, send func(zoekt.StreamListEvent) bool) (err error) {
+	tr, ctx := trace.New(ctx, "shardedSearcher.StreamList", "")
+	tr.LazyLog(q, true)
+	tr.LazyPrintf("opts: %s", opts)
+	metricListRunning.Inc()
+	defer func() {
+		metricListRunning.Dec()
+		if err != nil {
+			tr.LazyPrintf("error: %v", err)
+			tr.SetError(err)
+		}
+		tr.Finish()
+	}()
+
+	q = query.Simplify(q)
+
+	proc, err := ss.sched.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer proc.Release()
+
+	shards := ss.getShards()
+	tr.LazyPrintf("shardCount: %d", len(shards))
+	all := listShards(ctx, shards, q, opts)
+
+	// Minimal entries are keyed by ID, so we can drop the IDs of
+	// repositories spread over several shards as we go.
+	sent := map[uint32]bool{}
+	for range shards {
+		r := <-all
+		if r.err != nil {
+			return r.err
+		}
+
+		ev := zoekt.StreamListEvent{
+			Repos:   r.rl.Repos,
+			Crashes: r.rl.Crashes,
+		}
+		for id, e := range r.rl.Minimal {
+			if sent[id] {
+				continue
+			}
+			sent[id] = true
+			if ev.Minimal == nil {
+				ev.Minimal = map[uint32]*zoekt.MinimalRepoListEntry{}
+			}
+			ev.Minimal[id] = e
+		}
+		if len(ev.Repos) == 0 && len(ev.Minimal) == 0 && ev.Crashes == 0 {
+			continue
+		}
+		if !send(ev) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Branches returns the names of the branches of all repositories in the
+// loaded shards, deduplicated and sorted.
+func (ss *shardedSearcher) Branches(ctx context.Context) ([]string, error) {
+	proc, err := ss.sched.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer proc.Release()
+
+	seen := map[string]bool{}
+	for _, s := range ss.getShards() {
+		for _, repo := range s.repos {
+			for _, b := range repo.Branches {
+				seen[b.Name] = true
+			}
+		}
+	}
+
+	branches := make([]string, 0, len(seen))
+	for b := range seen {
+		branches = append(branches, b)
+	}
+	sort.Strings(branches)
+	return branches, nil
+}
+
+// prefetcher is implemented by shards that can read their postings ahead
+// of searches, see zoekt.indexData.Prefetch.
+type prefetcher interface {
+	Prefetch(ctx context.Context, budget int64) (int64, error)
+}
+
+// Warmup prefetches the postings of the loaded shards, highest ranked
+// first, so that the first searches after loading shards are fast. If
+// budget is positive, at most budget bytes are read, split evenly across
+// the shards; what a shard leaves of its share goes to the shards after
+// it. It returns early if ctx is done. Searches can run concurrently.
+func (ss *shardedSearcher) Warmup(ctx context.Context, budget int64) {
+	proc, err := ss.sched.Acquire(ctx)
+	if err != nil {
+		return
+	}
+	defer proc.Release()
+
+	var prefetchers []prefetcher
+	var names []string
+	for _, s := range ss.getShards() {
+		if p, ok := s.Searcher.(prefetcher); ok {
+			prefetchers = append(prefetchers, p)
+			names = append(names, s.String())
+		}
+	}
+
+	for i, p := range prefetchers {
+		if err := proc.Yield(ctx); err != nil {
+			return
+		}
+		var share int64
+		if budget > 0 {
+			share = budget / int64(len(prefetchers)-i)
+			if share == 0 {
+				return
+			}
+		}
+		n, err := p.Prefetch(ctx, share)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Warmup(%s): %v", names[i], err)
+		}
+		budget -= n
+	}
+}
+
+// ShardHealth is the result of probing a single shard.
+type ShardHealth struct {
+	// Path is the key the shard was loaded under, usually its file name.
+	Path string
+	OK   bool
+	// Err is why the shard is not OK.
+	Err error
+}
+
+// Health probes every loaded shard with a cheap List and reports which
+// shards can be read. A shard that panics is reported with an error, so
+// that corrupt shards can be found before a search trips on them. The
+// result is sorted by Path. It is nil if ctx expires before the shards
+// can be probed; shards not probed before ctx expires report ctx.Err().
+func (ss *shardedSearcher) Health(ctx context.Context) []ShardHealth {
+	proc, err := ss.sched.Acquire(ctx)
+	if err != nil {
+		return nil
+	}
+	defer proc.Release()
+
+	health := make([]ShardHealth, 0, len(ss.shards))
+	for key := range ss.shards {
+		health = append(health, ShardHealth{Path: key})
+	}
+	sort.Slice(health, func(i, j int) bool { return health[i].Path < health[j].Path })
+
+	for i := range health {
+		if err := ctx.Err(); err != nil {
+			health[i].Err = err
+			continue
+		}
+		health[i].Err = probeShard(ctx, ss.shards[health[i].Path])
+		health[i].OK = health[i].Err == nil
+	}
+	return health
+}
+
+func probeShard(ctx context.Context, s zoekt.Searcher) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("crashed shard: %s: %v", s.String(), r)
+		}
+	}()
+
+	_, err = s.List(ctx, &query.Const{Value: true}, &zoekt.ListOptions{Minimal: true})
+	return err
+}
+
 func reportListAllMetrics(repos []*zoekt.RepoListEntry) {
 	var stats zoekt.RepoStats
 	for _, r := range repos {
@@ -799,8 +1384,12 @@ func (s *shardedSearcher) getShards() []rankedShard {
 	// Holding rankedLock during the search ensures that we only perform
 	// the sort once-- any blocked goroutines would take just as long to
 	// perform the sort themselves.
+	overrides, _ := s.rankOverrides.Load().(map[uint32]uint16)
 	res := make([]rankedShard, 0, len(s.shards))
 	for _, sh := range s.shards {
+		if len(overrides) > 0 {
+			sh.priority = overriddenPriority(sh, overrides)
+		}
 		res = append(res, sh)
 	}
 	sort.Slice(res, func(i, j int) bool {
@@ -811,9 +1400,15 @@ func (s *shardedSearcher) getShards() []rankedShard {
 		if len(res[i].repos) == 0 || len(res[j].repos) == 0 {
 			// Protect against empty names which can happen if we fail to List or
 			// the shard is full of tombstones. Prefer the shard which has names.
-			return len(res[i].repos) >= len(res[j].repos)
+			if len(res[i].repos) != len(res[j].repos) {
+				return len(res[i].repos) > len(res[j].repos)
+			}
+		} else if ni, nj := res[i].repos[0].Name, res[j].repos[0].Name; ni != nj {
+			return ni < nj
 		}
-		return res[i].repos[0].Name < res[j].repos[0].Name
+		// Map iteration order is random, so without a unique key the order
+		// of equal shards would change from one call to the next.
+		return res[i].key < res[j].key
 	})
 
 	s.ranked = res
@@ -821,6 +1416,65 @@ func (s *shardedSearcher) getShards() []rankedShard {
 	return res
 }
 
+// SetRankOverrides sets the ranks to use for repositories instead of the
+// rank they were indexed with, keyed by repository ID. The scores of
+// matching files are adjusted accordingly. An override also replaces the
+// "priority" of the repository that orders the search of shards, so that
+// boosted repositories are searched before TotalMaxMatchCount cuts the
+// search short. A nil or empty map removes all overrides. ranks is
+// copied.
+func (s *shardedSearcher) SetRankOverrides(ranks map[uint32]uint16) {
+	m := make(map[uint32]uint16, len(ranks))
+	for id, rank := range ranks {
+		m[id] = rank
+	}
+
+	proc := s.sched.Exclusive()
+	s.rankOverrides.Store(m)
+	s.rankedLock.Lock()
+	s.ranked = nil
+	s.rankedLock.Unlock()
+	if s.cache != nil {
+		s.cache.purge()
+	}
+	proc.Release()
+}
+
+// applyRankOverrides rescores the files in sr whose repository has an
+// entry in overrides.
+func applyRankOverrides(sr *zoekt.SearchResult, overrides map[uint32]uint16) {
+	for i := range sr.Files {
+		if rank, ok := overrides[sr.Files[i].RepositoryID]; ok {
+			sr.Files[i].SetRepositoryRank(rank)
+		}
+	}
+}
+
+// overriddenPriority returns the priority of sh, with the ranks in
+// overrides as the priority of the repositories they have an entry for.
+func overriddenPriority(sh rankedShard, overrides map[uint32]uint16) float64 {
+	var max float64
+	for _, repo := range sh.repos {
+		p := repoPriority(repo)
+		if rank, ok := overrides[repo.ID]; ok {
+			p = float64(rank)
+		}
+		if p > max {
+			max = p
+		}
+	}
+	return max
+}
+
+// repoPriority returns the "priority" of repo from its RawConfig, or 0.
+func repoPriority(repo *zoekt.Repository) float64 {
+	if repo.RawConfig == nil {
+		return 0
+	}
+	priority, _ := strconv.ParseFloat(repo.RawConfig["priority"], 64)
+	return priority
+}
+
 func mkRankedShard(s zoekt.Searcher) rankedShard {
 	q := query.Const{Value: true}
 	result, err := s.List(context.Background(), &q, nil)
@@ -838,11 +1492,8 @@ func mkRankedShard(s zoekt.Searcher) rankedShard {
 	for i := range result.Repos {
 		repo := &result.Repos[i].Repository
 		repos = append(repos, repo)
-		if repo.RawConfig != nil {
-			priority, _ := strconv.ParseFloat(repo.RawConfig["priority"], 64)
-			if priority > maxPriority {
-				maxPriority = priority
-			}
+		if priority := repoPriority(repo); priority > maxPriority {
+			maxPriority = priority
 		}
 	}
 
@@ -850,36 +1501,127 @@ func mkRankedShard(s zoekt.Searcher) rankedShard {
 		Searcher: s,
 		repos:    repos,
 		priority: maxPriority,
+		identity: shardIdentity(s, result.Repos),
 	}
 }
 
+// shardIdentity returns a string that is equal for two shards with the
+// same content, built from the same repositories in the same indexing run.
+// It is empty if s cannot report a checksum of its content.
+func shardIdentity(s zoekt.Searcher, entries []*zoekt.RepoListEntry) string {
+	c, ok := s.(interface{ ContentChecksum() uint64 })
+	if !ok {
+		return ""
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%x\n", c.ContentChecksum())
+	for _, e := range entries {
+		fmt.Fprintf(&b, "%d %q %s %d %d %d %d", e.Repository.ID, e.Repository.Name,
+			e.IndexMetadata.ID, e.IndexMetadata.IndexTime.UnixNano(),
+			e.Stats.Documents, e.Stats.ContentBytes, e.Stats.IndexBytes)
+		for _, br := range e.Repository.Branches {
+			fmt.Fprintf(&b, " %s@%s", br.Name, br.Version)
+		}
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
 func (s *shardedSearcher) replace(key string, shard zoekt.Searcher) {
 	var ranked rankedShard
 	if shard != nil {
 		ranked = mkRankedShard(shard)
+		ranked.key = key
+		if fi, err := os.Stat(key); err == nil {
+			ranked.modTime = fi.ModTime()
+		}
 	}
 
 	proc := s.sched.Exclusive()
 
+	delete(s.suppressed, key)
 	old := s.shards[key]
+	if old.identity != "" && s.identities[old.identity] == key {
+		delete(s.identities, old.identity)
+	}
+
+	// A shard with the same content under a different name, eg. left
+	// behind by a failed rename, would double count its repositories.
+	// Only the newer of the two is searched.
+	var dup rankedShard
 	if shard == nil {
 		delete(s.shards, key)
-	} else {
+	} else if ranked.identity == "" {
 		s.shards[key] = ranked
+	} else {
+		if s.identities == nil {
+			s.identities = make(map[string]string)
+			s.suppressed = make(map[string]string)
+		}
+		winner := ranked
+		if otherKey, ok := s.identities[ranked.identity]; ok {
+			other := s.shards[otherKey]
+			if newerShard(other, ranked) {
+				winner, dup = other, ranked
+			} else {
+				dup = other
+				delete(s.shards, otherKey)
+			}
+			log.Printf("unloading %s, it duplicates %s", dup.key, winner.key)
+			s.suppressed[dup.key] = ranked.identity
+		}
+		s.identities[ranked.identity] = winner.key
+		s.shards[winner.key] = winner
+	}
+
+	// Load the duplicates of a shard that went away in its place.
+	var reload []string
+	if old.identity != "" && s.identities[old.identity] == "" {
+		for k, id := range s.suppressed {
+			if id == old.identity {
+				reload = append(reload, k)
+				delete(s.suppressed, k)
+			}
+		}
 	}
+
 	s.rankedLock.Lock()
 	s.ranked = nil
 	s.rankedLock.Unlock()
+	if s.cache != nil {
+		s.cache.purge()
+	}
 
 	proc.Release()
 
-	if old.Searcher != nil {
-		start := time.Now()
-		old.Close()
-		metricShardCloseDurationSeconds.Observe(time.Since(start).Seconds())
+	for _, closing := range []rankedShard{old, dup} {
+		if closing.Searcher != nil {
+			start := time.Now()
+			closing.Close()
+			metricShardCloseDurationSeconds.Observe(time.Since(start).Seconds())
+		}
 	}
 
 	metricShardsLoaded.Set(float64(len(s.shards)))
+
+	sort.Strings(reload)
+	for _, k := range reload {
+		shard, err := loadShard(k)
+		if err != nil {
+			log.Printf("reloading duplicate %s, err %v", k, err)
+			continue
+		}
+		s.replace(k, shard)
+	}
+}
+
+// newerShard returns true if a should be kept over its duplicate b: if
+// its file is newer, or, if that doesn't decide, its key sorts first.
+func newerShard(a, b rankedShard) bool {
+	if !a.modTime.Equal(b.modTime) {
+		return a.modTime.After(b.modTime)
+	}
+	return a.key < b.key
 }
 
 func loadShard(fn string) (zoekt.Searcher, error) {
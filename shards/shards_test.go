@@ -17,13 +17,19 @@ package shards
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"hash/fnv"
 	"log"
 	"math"
 	"os"
+	"path/filepath"
+	"reflect"
 	"runtime"
 	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -32,6 +38,10 @@ import (
 	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/google/zoekt"
 	"github.com/google/zoekt/query"
+	"github.com/google/zoekt/stream"
+	"github.com/google/zoekt/trace"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/sync/semaphore"
 )
 
 type crashSearcher struct{}
@@ -168,6 +178,187 @@ func TestOrderByShard(t *testing.T) {
 	}
 }
 
+// contentSearcher returns a file with a line match, each holding size
+// bytes of content.
+type contentSearcher struct {
+	rankSearcher
+	size int
+}
+
+func (s *contentSearcher) Search(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (*zoekt.SearchResult, error) {
+	sr, err := s.rankSearcher.Search(ctx, q, opts)
+	if err != nil || len(sr.Files) == 0 {
+		return sr, err
+	}
+	sr.Files[0].Content = bytes.Repeat([]byte("x"), s.size)
+	sr.Files[0].LineMatches = []zoekt.LineMatch{{Line: bytes.Repeat([]byte("y"), s.size)}}
+	return sr, nil
+}
+
+func TestMaxContentBytes(t *testing.T) {
+	ss := newShardedSearcher(1)
+	n := 5
+	for i := 0; i < n; i++ {
+		ss.replace(fmt.Sprintf("shard%d", i), &contentSearcher{
+			rankSearcher: rankSearcher{rank: uint16(i)},
+			size:         100,
+		})
+	}
+
+	// 10 pieces of content of 100 bytes each; only 4 fit.
+	res, err := ss.Search(context.Background(), &query.Substring{Pattern: "bla"}, &zoekt.SearchOptions{
+		Whole:           true,
+		MaxContentBytes: 450,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got int
+	for _, fm := range res.Files {
+		got += len(fm.Content)
+		for _, lm := range fm.LineMatches {
+			got += len(lm.Line)
+		}
+	}
+	if got != 400 {
+		t.Errorf("got %d bytes of content, want 400", got)
+	}
+	if len(res.Files) != n || res.Stats.MatchCount != n {
+		t.Errorf("got %d files and %d matches, want %d of each", len(res.Files), res.Stats.MatchCount, n)
+	}
+}
+
+func TestMaxContentBytesExcludeTests(t *testing.T) {
+	ss := newShardedSearcher(1)
+	content := []byte("needle" + strings.Repeat(".", 94))
+	b := testIndexBuilder(t, &zoekt.Repository{Name: "repo"},
+		zoekt.Document{Name: "main_test.go", Content: content},
+		zoekt.Document{Name: "main.go", Content: content})
+	ss.replace("repo", searcherForTest(t, b))
+
+	// The dropped test file doesn't use up the budget.
+	opts := &zoekt.SearchOptions{Whole: true, MaxContentBytes: 150, ExcludeTests: true}
+	res, err := ss.Search(context.Background(), &query.Substring{Pattern: "needle"}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Files) != 1 || res.Files[0].FileName != "main.go" || len(res.Files[0].Content) != 100 {
+		t.Fatalf("got %+v, want main.go with its content", res.Files)
+	}
+
+	var streamed []zoekt.FileMatch
+	err = ss.StreamSearch(context.Background(), &query.Substring{Pattern: "needle"}, opts, stream.SenderFunc(func(sr *zoekt.SearchResult) {
+		streamed = append(streamed, sr.Files...)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(streamed) != 1 || len(streamed[0].Content) != 100 {
+		t.Fatalf("streamed %+v, want main.go with its content", streamed)
+	}
+}
+
+// slowSearcher doesn't return until its context is done.
+type slowSearcher struct {
+	rankSearcher
+}
+
+func (s *slowSearcher) Search(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (*zoekt.SearchResult, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(10 * time.Second):
+		return nil, errors.New("slowSearcher wasn't cut off")
+	}
+}
+
+func TestMaxShardWallTime(t *testing.T) {
+	ss := newShardedSearcher(1)
+	n := 3
+	for i := 0; i < n; i++ {
+		ss.replace(fmt.Sprintf("shard%d", i), &rankSearcher{rank: uint16(i)})
+	}
+	ss.replace("slow", &slowSearcher{rankSearcher{rank: uint16(n)}})
+
+	res, err := ss.Search(context.Background(), &query.Substring{Pattern: "bla"}, &zoekt.SearchOptions{
+		MaxShardWallTime: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Files) != n {
+		t.Errorf("got %d results, want %d", len(res.Files), n)
+	}
+	if res.Stats.ShardTimeouts != 1 {
+		t.Errorf("got %d shard timeouts, want 1", res.Stats.ShardTimeouts)
+	}
+}
+
+func TestStreamSearch(t *testing.T) {
+	ss := newShardedSearcher(1)
+	for i := 0; i < 4; i++ {
+		repo := &zoekt.Repository{ID: uint32(i + 1), Name: fmt.Sprintf("repo%d", i)}
+		ss.replace(fmt.Sprintf("%d", i), searcherForTest(t, testIndexBuilder(t, repo,
+			zoekt.Document{Name: "f1", Content: []byte("needle")},
+			zoekt.Document{Name: "f2", Content: []byte("a needle in a haystack")})))
+	}
+	q := &query.Substring{Pattern: "needle", Content: true}
+
+	names := func(files []zoekt.FileMatch) []string {
+		var names []string
+		for _, f := range files {
+			names = append(names, f.Repository+"/"+f.FileName)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	var events int
+	var streamed []zoekt.FileMatch
+	err := ss.StreamSearch(context.Background(), q, &zoekt.SearchOptions{}, stream.SenderFunc(func(sr *zoekt.SearchResult) {
+		if len(sr.Files) > 0 {
+			events++
+			streamed = append(streamed, sr.Files...)
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if events < 2 {
+		t.Errorf("got %d events with files, want one per shard", events)
+	}
+
+	res, err := ss.Search(context.Background(), q, &zoekt.SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := cmp.Diff(names(res.Files), names(streamed)); d != "" {
+		t.Errorf("streamed files differ from Search (-search, +stream):\n%s", d)
+	}
+}
+
+func TestStreamSearchTotalMaxMatchCount(t *testing.T) {
+	ss := newShardedSearcher(1)
+	n := 10 * runtime.GOMAXPROCS(0)
+	for i := 0; i < n; i++ {
+		ss.replace(fmt.Sprintf("shard%d", i), &rankSearcher{rank: uint16(i)})
+	}
+
+	var files int
+	err := ss.StreamSearch(context.Background(), &query.Substring{Pattern: "bla"}, &zoekt.SearchOptions{
+		TotalMaxMatchCount: 3,
+	}, stream.SenderFunc(func(sr *zoekt.SearchResult) {
+		files += len(sr.Files)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files < 3 || files == n {
+		t.Errorf("got %d files, want at least 3 and fewer than %d", files, n)
+	}
+}
+
 func TestFilteringShardsByRepoSet(t *testing.T) {
 	ss := newShardedSearcher(1)
 
@@ -233,6 +424,91 @@ func TestFilteringShardsByRepoSet(t *testing.T) {
 			t.Fatalf("%s: got %d results, want %d", q, len(res.Files), len(repoSetNames))
 		}
 	}
+
+	res, err = ss.Search(context.Background(), sub, &zoekt.SearchOptions{RepoIDs: branchesRepos.List[0].Repos})
+	if err != nil {
+		t.Errorf("Search(%s): %v", sub, err)
+	}
+	if len(res.Files) != len(repoSetNames) {
+		t.Fatalf("RepoIDs: got %d results, want %d", len(res.Files), len(repoSetNames))
+	}
+}
+
+func TestIndexFormatVersions(t *testing.T) {
+	ss := newShardedSearcher(2)
+	for _, fn := range []string{"repo_v16.00000.zoekt", "repo17_v17.00000.zoekt"} {
+		shard, err := loadShard(filepath.Join("../testdata/shards", fn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ss.replace(fn, shard)
+	}
+	defer ss.Close()
+
+	res, err := ss.Search(context.Background(), &query.Substring{Pattern: "func main", Content: true}, &zoekt.SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int]int{16: 1, 17: 1}
+	if !reflect.DeepEqual(res.IndexFormatVersions, want) {
+		t.Errorf("got versions %v, want %v", res.IndexFormatVersions, want)
+	}
+
+	res, err = ss.Search(context.Background(), &query.Substring{Pattern: "no such needle"}, &zoekt.SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.IndexFormatVersions) != 0 {
+		t.Errorf("got versions %v for no results, want none", res.IndexFormatVersions)
+	}
+}
+
+func TestRepoMatchDensity(t *testing.T) {
+	ss := newShardedSearcher(2)
+	defer ss.Close()
+
+	lines := func(n, needles int) []byte {
+		var buf bytes.Buffer
+		for i := 0; i < n; i++ {
+			if i < needles {
+				buf.WriteString("needle\n")
+			} else {
+				buf.WriteString("haystack\n")
+			}
+		}
+		return buf.Bytes()
+	}
+	addShard := func(key string, repo *zoekt.Repository, content []byte) {
+		b := testIndexBuilder(t, repo, zoekt.Document{Name: "f", Content: content})
+		ss.replace(key, searcherForTest(t, b))
+	}
+
+	big := &zoekt.Repository{ID: 1, Name: "big"}
+	addShard("big.0", big, lines(100, 10))
+	// big spans two shards, only one of which matches.
+	addShard("big.1", big, lines(100, 0))
+	addShard("small", &zoekt.Repository{ID: 2, Name: "small"}, lines(10, 5))
+	addShard("none", &zoekt.Repository{ID: 3, Name: "none"}, lines(10, 0))
+
+	want := []zoekt.RepoMatchDensity{
+		{Repository: "small", MatchCount: 5, Lines: 10},
+		{Repository: "big", MatchCount: 10, Lines: 200},
+	}
+	// Matches are counted before MaxLineMatches truncates them, and
+	// without line matches.
+	for _, opts := range []*zoekt.SearchOptions{
+		{RepoMatchDensity: true},
+		{RepoMatchDensity: true, MaxLineMatches: 2},
+		{RepoMatchDensity: true, FileMatchesOnly: true},
+	} {
+		res, err := ss.Search(context.Background(), &query.Substring{Pattern: "needle", Content: true}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := cmp.Diff(want, res.RepoMatchDensity); d != "" {
+			t.Errorf("%+v: mismatch (-want +got):\n%s", opts, d)
+		}
+	}
 }
 
 func hash(name string) uint32 {
@@ -305,6 +581,100 @@ func TestUnloadIndex(t *testing.T) {
 	}
 }
 
+func TestDuplicateShards(t *testing.T) {
+	b := testIndexBuilder(t, &zoekt.Repository{ID: 1, Name: "repo"},
+		zoekt.Document{Name: "f1", Content: []byte("needle")})
+	var buf bytes.Buffer
+	if err := b.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	load := func() zoekt.Searcher {
+		s, err := zoekt.NewSearcher(&memSeeker{buf.Bytes()})
+		if err != nil {
+			t.Fatalf("NewSearcher: %v", err)
+		}
+		return s
+	}
+
+	ss := newShardedSearcher(1)
+	ss.replace("old", load())
+	ss.replace("new", load())
+
+	if _, ok := ss.shards["new"]; !ok || len(ss.shards) != 1 {
+		t.Fatalf("got shards %v, want only new", ss.shards)
+	}
+
+	res, err := ss.Search(context.Background(), &query.Substring{Pattern: "needle"}, &zoekt.SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Files) != 1 {
+		t.Errorf("got %d files, want 1", len(res.Files))
+	}
+
+	// Unloading the duplicate later must not affect the retained shard.
+	ss.replace("old", nil)
+	ss.replace("new", nil)
+	if len(ss.shards) != 0 || len(ss.identities) != 0 {
+		t.Errorf("got shards %v, identities %v, want none", ss.shards, ss.identities)
+	}
+}
+
+func TestDuplicateShardsReload(t *testing.T) {
+	b := testIndexBuilder(t, &zoekt.Repository{ID: 1, Name: "repo"},
+		zoekt.Document{Name: "f1", Content: []byte("needle")})
+	var buf bytes.Buffer
+	if err := b.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	older, newer := filepath.Join(dir, "a.zoekt"), filepath.Join(dir, "b.zoekt")
+	for i, fn := range []string{older, newer} {
+		if err := os.WriteFile(fn, buf.Bytes(), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		mtime := time.Now().Add(time.Duration(i-2) * time.Hour)
+		if err := os.Chtimes(fn, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ss := newShardedSearcher(1)
+	tl := &loader{ss: ss}
+	search := func() int {
+		t.Helper()
+		res, err := ss.Search(context.Background(), &query.Substring{Pattern: "needle"}, &zoekt.SearchOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(res.Files)
+	}
+
+	// The newer shard wins, whatever the load order.
+	tl.load(newer)
+	tl.load(older)
+	if _, ok := ss.shards[newer]; !ok || len(ss.shards) != 1 {
+		t.Fatalf("got shards %v, want only %s", ss.shards, newer)
+	}
+	if got := search(); got != 1 {
+		t.Errorf("got %d files, want 1", got)
+	}
+
+	// Once the newer shard goes, the duplicate is searched again.
+	tl.drop(newer)
+	if _, ok := ss.shards[older]; !ok || len(ss.shards) != 1 {
+		t.Fatalf("got shards %v after drop, want only %s", ss.shards, older)
+	}
+	if got := search(); got != 1 {
+		t.Errorf("got %d files after drop, want 1", got)
+	}
+
+	tl.drop(older)
+	if len(ss.shards) != 0 || len(ss.suppressed) != 0 {
+		t.Errorf("got shards %v, suppressed %v, want none", ss.shards, ss.suppressed)
+	}
+}
+
 func TestShardedSearcher_List(t *testing.T) {
 	repos := []*zoekt.Repository{
 		{
@@ -410,6 +780,136 @@ func TestShardedSearcher_List(t *testing.T) {
 	}
 }
 
+func TestShardedSearcher_ListDocuments(t *testing.T) {
+	repo := &zoekt.Repository{Name: "repo", Branches: []zoekt.RepositoryBranch{{Name: "main"}}}
+	doc := func(name string) zoekt.Document {
+		return zoekt.Document{Name: name, Content: []byte("content of " + name), Branches: []string{"main"}}
+	}
+
+	ss := newShardedSearcher(2)
+	ss.replace("1", searcherForTest(t, testIndexBuilder(t, repo, doc("a"), doc("b"))))
+	ss.replace("2", searcherForTest(t, testIndexBuilder(t, repo, doc("c"), doc("d"), doc("e"))))
+
+	// Without an ID, the repository is not listed minimally.
+	for _, opts := range []*zoekt.ListOptions{nil, {Minimal: true}} {
+		res, err := ss.List(context.Background(), &query.Repo{Pattern: "repo"}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Repos) != 1 {
+			t.Fatalf("%v: got %d repos, want 1", opts, len(res.Repos))
+		}
+		if got := res.Repos[0].Stats; got.Documents != 5 || got.Shards != 2 {
+			t.Errorf("%v: got %d documents in %d shards, want 5 in 2", opts, got.Documents, got.Shards)
+		}
+	}
+}
+
+func TestShardsWithMatches(t *testing.T) {
+	ss := newShardedSearcher(1)
+	for i, content := range []string{"needle", "haystack", "needle in a haystack", "hay"} {
+		repo := &zoekt.Repository{ID: uint32(i + 1), Name: fmt.Sprintf("repo%d", i)}
+		ss.replace(fmt.Sprintf("%d", i), searcherForTest(t, testIndexBuilder(t, repo,
+			zoekt.Document{Name: "f", Content: []byte(content)})))
+	}
+
+	res, err := ss.Search(context.Background(), &query.Substring{Pattern: "needle", Content: true}, &zoekt.SearchOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Stats.ShardsWithMatches != 2 {
+		t.Errorf("got %d shards with matches, want 2", res.Stats.ShardsWithMatches)
+	}
+	if res.Stats.ShardsScanned+res.Stats.ShardsSkippedFilter != 4 {
+		t.Errorf("got %d shards scanned and %d filtered, want 4 in total", res.Stats.ShardsScanned, res.Stats.ShardsSkippedFilter)
+	}
+	if res.Stats.ShardsTotal != 4 {
+		t.Errorf("got %d shards in total, want 4", res.Stats.ShardsTotal)
+	}
+}
+
+func TestListLanguages(t *testing.T) {
+	repo := &zoekt.Repository{ID: 1, Name: "repo"}
+	ss := newShardedSearcher(1)
+	ss.replace("1", searcherForTest(t, testIndexBuilder(t, repo,
+		zoekt.Document{Name: "a.go", Language: "Go", Content: []byte(strings.Repeat("x", 30))},
+		zoekt.Document{Name: "b.go", Language: "Go", Content: []byte(strings.Repeat("x", 30))})))
+	ss.replace("2", searcherForTest(t, testIndexBuilder(t, repo,
+		zoekt.Document{Name: "c.ts", Language: "TypeScript", Content: []byte(strings.Repeat("x", 30))},
+		zoekt.Document{Name: "README", Language: "Text", Content: []byte(strings.Repeat("x", 10))})))
+
+	res, err := ss.List(context.Background(), &query.Const{Value: true}, &zoekt.ListOptions{Languages: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Repos) != 1 {
+		t.Fatalf("got %d repos, want 1", len(res.Repos))
+	}
+
+	stats := res.Repos[0].Stats
+	var total int64
+	for _, ls := range stats.Languages {
+		total += ls.ContentBytes
+	}
+	got := map[string]int{}
+	for lang, ls := range stats.Languages {
+		got[lang] = int(100 * ls.ContentBytes / total)
+	}
+	want := map[string]int{"Go": 60, "TypeScript": 30, "Text": 10}
+	if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("mismatch (-want +got):\n%s", d)
+	}
+	if got := stats.Languages["Go"].Documents; got != 2 {
+		t.Errorf("got %d Go documents, want 2", got)
+	}
+
+	// Without the option, and the shards' own entries are not modified.
+	res, err = ss.List(context.Background(), &query.Const{Value: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := res.Repos[0].Stats.Languages; l != nil {
+		t.Errorf("got languages %v without ListOptions.Languages", l)
+	}
+}
+
+func TestListIndexFileBytes(t *testing.T) {
+	repo := &zoekt.Repository{ID: 1, Name: "repo"}
+	ss := newShardedSearcher(1)
+	var want int64
+	for i, content := range []string{"needle", strings.Repeat("haystack", 100)} {
+		var buf bytes.Buffer
+		if err := testIndexBuilder(t, repo, zoekt.Document{Name: fmt.Sprintf("f%d", i), Content: []byte(content)}).Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		want += int64(buf.Len())
+		searcher, err := zoekt.NewSearcher(&memSeeker{buf.Bytes()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ss.replace(fmt.Sprintf("%d", i), searcher)
+	}
+
+	res, err := ss.List(context.Background(), &query.Const{Value: true}, &zoekt.ListOptions{IncludeIndexBytes: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Repos) != 1 {
+		t.Fatalf("got %d repos, want 1", len(res.Repos))
+	}
+	if got := res.Repos[0].Stats.IndexFileBytes; got != want {
+		t.Errorf("got %d index file bytes, want %d", got, want)
+	}
+
+	res, err = ss.List(context.Background(), &query.Const{Value: true}, &zoekt.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := res.Repos[0].Stats.IndexFileBytes; got != 0 {
+		t.Errorf("got %d index file bytes without ListOptions.IncludeIndexBytes, want 0", got)
+	}
+}
+
 func testIndexBuilder(t testing.TB, repo *zoekt.Repository, docs ...zoekt.Document) *zoekt.IndexBuilder {
 	b, err := zoekt.NewIndexBuilder(repo)
 	if err != nil {
@@ -532,6 +1032,58 @@ func BenchmarkShardedSearch(b *testing.B) {
 	}
 }
 
+func BenchmarkRepoIDs(b *testing.B) {
+	ss := newShardedSearcher(int64(runtime.GOMAXPROCS(0)))
+
+	repos := reposForTest(300)
+	ids := roaring.New()
+	for i, r := range repos {
+		r.Branches = []zoekt.RepositoryBranch{{Name: "HEAD", Version: "v1"}}
+		builder := testIndexBuilder(b, r, zoekt.Document{
+			Name:     "needle.go",
+			Content:  []byte("needle haystack"),
+			Branches: []string{"HEAD"},
+		})
+		ss.replace(r.Name, searcherForTest(b, builder))
+		if i%2 == 0 {
+			ids.Add(r.ID)
+		}
+	}
+
+	ctx := context.Background()
+	needleSub := &query.Substring{Pattern: "needle"}
+
+	// selectRepoSet rewrites the query it is given, so build a fresh one
+	// for every search.
+	benchmarks := []struct {
+		name string
+		q    func() query.Q
+		opts *zoekt.SearchOptions
+	}{
+		{"BranchesRepos", func() query.Q {
+			return query.NewAnd(query.NewSingleBranchesRepos("HEAD", ids.ToArray()...), needleSub)
+		}, &zoekt.SearchOptions{}},
+		{"RepoIDs", func() query.Q { return needleSub }, &zoekt.SearchOptions{RepoIDs: ids}},
+	}
+
+	for _, bb := range benchmarks {
+		b.Run(bb.name, func(b *testing.B) {
+			b.ReportAllocs()
+
+			for n := 0; n < b.N; n++ {
+				q := bb.q()
+				res, err := ss.Search(ctx, q, bb.opts)
+				if err != nil {
+					b.Fatalf("Search(%s): %v", q, err)
+				}
+				if have, want := len(res.Files), int(ids.GetCardinality()); have != want {
+					b.Fatalf("wrong number of file results. have=%d, want=%d", have, want)
+				}
+			}
+		})
+	}
+}
+
 func TestRawQuerySearch(t *testing.T) {
 	ss := newShardedSearcher(1)
 
@@ -639,28 +1191,976 @@ func TestRawQuerySearch(t *testing.T) {
 	}
 }
 
-func TestPrioritySlice(t *testing.T) {
-	p := &prioritySlice{}
-	for step, oper := range []struct {
-		isAppend    bool
-		value       float64
-		expectedMax float64
-	}{
-		{true, 1, 1},
-		{true, 3, 3},
-		{true, 2, 3},
-		{false, 1, 3},
-		{false, 3, 2},
-		{false, 2, math.Inf(-1)},
-	} {
-		if oper.isAppend {
-			p.append(oper.value)
-		} else {
-			p.remove(oper.value)
+func TestFoldRepoSets(t *testing.T) {
+	ss := newShardedSearcher(1)
+	for _, repo := range []string{"github.com/foo/bar", "github.com/foo/baz", "github.com/other/repo"} {
+		b := testIndexBuilder(t, &zoekt.Repository{Name: repo}, zoekt.Document{Name: "f", Content: []byte("needle")})
+		ss.replace(repo, searcherForTest(t, b))
+	}
+
+	repos := func(q query.Q) []string {
+		t.Helper()
+		res, err := ss.Search(context.Background(), q, &zoekt.SearchOptions{})
+		if err != nil {
+			t.Fatal(err)
 		}
-		max := p.max()
-		if max != oper.expectedMax {
-			t.Errorf("%d: got %f, want %f", step, max, oper.expectedMax)
+		var names []string
+		for _, f := range res.Files {
+			names = append(names, f.Repository)
 		}
+		sort.Strings(names)
+		return names
+	}
+
+	q := query.NewAnd(
+		query.NewRepoSet("GitHub.com/Foo/Bar", "github.com/FOO/baz"),
+		&query.Substring{Pattern: "needle"})
+	if got := repos(q); len(got) != 0 {
+		t.Errorf("without normalization: got %v, want no repos", got)
+	}
+	if got, want := repos(query.FoldRepoSets(q)), []string{"github.com/foo/bar", "github.com/foo/baz"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("with normalization: got %v, want %v", got, want)
+	}
+}
+
+func TestStreamList(t *testing.T) {
+	ss := newShardedSearcher(1)
+	repos := reposForTest(10)
+	for i, r := range repos {
+		ss.replace(fmt.Sprintf("key-%d", i), testSearcherForRepo(t, r, 2))
+	}
+	// The first repository is spread over two shards.
+	ss.replace("key-dup", testSearcherForRepo(t, repos[0], 3))
+
+	collect := func(ctx context.Context, opts *zoekt.ListOptions) *zoekt.RepoList {
+		t.Helper()
+		agg := &zoekt.RepoList{Minimal: map[uint32]*zoekt.MinimalRepoListEntry{}}
+		uniq := map[string]*zoekt.RepoListEntry{}
+		for ev := range ss.StreamList(ctx, &query.Const{Value: true}, opts) {
+			if ev.Err != nil {
+				t.Fatal(ev.Err)
+			}
+			agg.Crashes += ev.Crashes
+			for _, r := range ev.Repos {
+				if prev, ok := uniq[r.Repository.Name]; ok {
+					prev.Stats.Add(&r.Stats)
+					continue
+				}
+				cp := *r
+				uniq[r.Repository.Name] = &cp
+				agg.Repos = append(agg.Repos, &cp)
+			}
+			for id, r := range ev.Minimal {
+				if _, ok := agg.Minimal[id]; ok {
+					t.Errorf("minimal entry %d sent twice", id)
+				}
+				agg.Minimal[id] = r
+			}
+		}
+		return agg
+	}
+
+	byName := cmpopts.SortSlices(func(a, b *zoekt.RepoListEntry) bool {
+		return a.Repository.Name < b.Repository.Name
+	})
+	for _, opts := range []*zoekt.ListOptions{{}, {Minimal: true}} {
+		want, err := ss.List(context.Background(), &query.Const{Value: true}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := collect(context.Background(), opts)
+		if diff := cmp.Diff(want, got, byName, cmpopts.EquateEmpty()); diff != "" {
+			t.Errorf("%s: mismatch (-List +StreamList):\n%s", opts, diff)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := ss.StreamList(ctx, &query.Const{Value: true}, nil)
+	if ev := <-events; len(ev.Repos) == 0 {
+		t.Fatalf("got first event %+v, want repos", ev)
+	}
+	cancel()
+	n := 0
+	for range events {
+		n++
+	}
+	// The event in flight when cancelling may still be sent.
+	if n > 1 {
+		t.Errorf("got %d events after cancelling, want at most 1", n)
+	}
+}
+
+func TestRawQueryList(t *testing.T) {
+	ss := newShardedSearcher(1)
+
+	var nextShardNum int
+	addShard := func(repo string, rawConfig map[string]string) {
+		r := &zoekt.Repository{Name: repo}
+		r.RawConfig = rawConfig
+		b := testIndexBuilder(t, r, zoekt.Document{Name: "f", Content: []byte("foo")})
+		shard := searcherForTest(t, b)
+		ss.replace(fmt.Sprintf("key-%d", nextShardNum), shard)
+		nextShardNum++
+	}
+	addShard("public", map[string]string{"public": "1", "team": "a"})
+	addShard("private_archived", map[string]string{"archived": "1"})
+	addShard("public_fork", map[string]string{"public": "1", "fork": "1", "team": "b"})
+	addShard("private", map[string]string{"team": "a"})
+
+	cases := []struct {
+		q    query.Q
+		want []string
+	}{
+		{q: query.RcOnlyPublic, want: []string{"public", "public_fork"}},
+		{q: query.RcOnlyPublic | query.RcNoForks, want: []string{"public"}},
+		{q: query.RcOnlyPrivate, want: []string{"private", "private_archived"}},
+		{q: query.RcOnlyArchived, want: []string{"private_archived"}},
+		{q: &query.RepoRawConfig{Key: "team", Value: "a"}, want: []string{"private", "public"}},
+		{q: query.NewAnd(&query.RepoRawConfig{Key: "team", Value: "a"}, query.RcOnlyPrivate), want: []string{"private"}},
+		{q: query.NewAnd(&query.Substring{Pattern: "foo"}, query.RcNoForks), want: []string{"private", "private_archived", "public"}},
+	}
+	for _, c := range cases {
+		t.Run(c.q.String(), func(t *testing.T) {
+			rl, err := ss.List(context.Background(), c.q, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, r := range rl.Repos {
+				got = append(got, r.Repository.Name)
+			}
+			sort.Strings(got)
+			if d := cmp.Diff(c.want, got); d != "" {
+				t.Fatalf("(-want, +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestPrioritySlice(t *testing.T) {
+	p := &prioritySlice{}
+	for step, oper := range []struct {
+		isAppend    bool
+		value       float64
+		expectedMax float64
+	}{
+		{true, 1, 1},
+		{true, 3, 3},
+		{true, 2, 3},
+		{false, 1, 3},
+		{false, 3, 2},
+		{false, 2, math.Inf(-1)},
+	} {
+		if oper.isAppend {
+			p.append(oper.value)
+		} else {
+			p.remove(oper.value)
+		}
+		max := p.max()
+		if max != oper.expectedMax {
+			t.Errorf("%d: got %f, want %f", step, max, oper.expectedMax)
+		}
+	}
+}
+
+func TestResultCache(t *testing.T) {
+	ss := newShardedSearcher(1)
+	ss.cache = newResultCache(10, time.Minute)
+	now := time.Now()
+	ss.cache.now = func() time.Time { return now }
+	for i := 0; i < 3; i++ {
+		ss.replace(fmt.Sprintf("shard%d", i), &rankSearcher{rank: uint16(i)})
+	}
+
+	search := func(q query.Q, opts *zoekt.SearchOptions) int {
+		t.Helper()
+		res, err := ss.Search(context.Background(), q, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(res.Files)
+	}
+	q := &query.Substring{Pattern: "bla"}
+
+	if got := search(q, &zoekt.SearchOptions{}); got != 3 {
+		t.Fatalf("got %d files, want 3", got)
+	}
+	if got := search(q, &zoekt.SearchOptions{Trace: true}); got != 3 {
+		t.Fatalf("got %d files, want 3", got)
+	}
+	if ss.cache.hits != 1 {
+		t.Errorf("got %d hits after identical search, want 1", ss.cache.hits)
+	}
+
+	// Different options need their own entry.
+	if got := search(q, &zoekt.SearchOptions{MaxDocDisplayCount: 1}); got != 1 {
+		t.Fatalf("got %d files, want 1", got)
+	}
+	if ss.cache.hits != 1 || ss.cache.len() != 2 {
+		t.Errorf("got %d hits and %d entries, want 1 and 2", ss.cache.hits, ss.cache.len())
+	}
+
+	// A new shard evicts the results it could contribute to.
+	ss.replace("shard3", &rankSearcher{rank: 3})
+	if ss.cache.len() != 0 {
+		t.Errorf("got %d entries after replace, want 0", ss.cache.len())
+	}
+	if got := search(q, &zoekt.SearchOptions{}); got != 4 {
+		t.Fatalf("got %d files after replace, want 4", got)
+	}
+	if ss.cache.hits != 1 {
+		t.Errorf("got %d hits after replace, want 1", ss.cache.hits)
+	}
+
+	// Entries expire after the TTL.
+	search(q, &zoekt.SearchOptions{})
+	if ss.cache.hits != 2 {
+		t.Errorf("got %d hits, want 2", ss.cache.hits)
+	}
+	now = now.Add(2 * time.Minute)
+	search(q, &zoekt.SearchOptions{})
+	if ss.cache.hits != 2 {
+		t.Errorf("got %d hits after expiry, want 2", ss.cache.hits)
+	}
+}
+
+type cancelSearchSearcher struct {
+	rankSearcher
+	cancel context.CancelFunc
+}
+
+func (s *cancelSearchSearcher) Search(ctx context.Context, q query.Q, opts *zoekt.SearchOptions) (*zoekt.SearchResult, error) {
+	s.cancel()
+	return s.rankSearcher.Search(ctx, q, opts)
+}
+
+func TestResultCacheIncomplete(t *testing.T) {
+	ss := newShardedSearcher(1)
+	ss.cache = newResultCache(10, time.Minute)
+	ss.replace("shard", &rankSearcher{rank: 1})
+	ss.replace("slow", &slowSearcher{rankSearcher{rank: 2}})
+	q := &query.Substring{Pattern: "bla"}
+
+	res, err := ss.Search(context.Background(), q, &zoekt.SearchOptions{MaxShardWallTime: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Stats.ShardTimeouts != 1 {
+		t.Fatalf("got %d shard timeouts, want 1", res.Stats.ShardTimeouts)
+	}
+	if n := ss.cache.len(); n != 0 {
+		t.Errorf("got %d entries after a timed out search, want 0", n)
+	}
+
+	// The search is canceled while a shard is searched.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ss.replace("slow", &cancelSearchSearcher{rankSearcher{rank: 2}, cancel})
+	if _, err := ss.Search(ctx, q, &zoekt.SearchOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := ss.cache.len(); n != 0 {
+		t.Errorf("got %d entries after a canceled search, want 0", n)
+	}
+}
+
+func TestResultCacheKey(t *testing.T) {
+	repos := func(n, skip int) []string {
+		var names []string
+		for i := 0; i < n; i++ {
+			if i != skip {
+				names = append(names, fmt.Sprintf("repo%d", i))
+			}
+		}
+		return names
+	}
+	repoBranches := func(names []string) *query.RepoBranches {
+		q := &query.RepoBranches{Set: map[string][]string{}}
+		for _, name := range names {
+			q.Set[name] = []string{"HEAD"}
+		}
+		return q
+	}
+
+	// The String of these pairs is the same, since large sets are
+	// abbreviated to their size.
+	for _, pair := range [][2]query.Q{
+		{query.NewRepoSet(repos(10, 0)...), query.NewRepoSet(repos(10, 1)...)},
+		{repoBranches(repos(10, 0)), repoBranches(repos(10, 1))},
+		{query.NewSingleBranchesRepos("HEAD", 1, 2), query.NewSingleBranchesRepos("HEAD", 1, 3)},
+	} {
+		a := query.NewAnd(pair[0], &query.Substring{Pattern: "needle"})
+		b := query.NewAnd(pair[1], &query.Substring{Pattern: "needle"})
+		if a.String() != b.String() {
+			t.Fatalf("%s and %s differ, want the same String", a, b)
+		}
+		if resultCacheKey(a, &zoekt.SearchOptions{}) == resultCacheKey(b, &zoekt.SearchOptions{}) {
+			t.Errorf("%s: got the same key for different queries", a)
+		}
+	}
+
+	// Set order doesn't matter.
+	a := query.NewRepoSet(repos(10, -1)...)
+	b := query.NewRepoSet(repos(10, -1)...)
+	if resultCacheKey(a, &zoekt.SearchOptions{}) != resultCacheKey(b, &zoekt.SearchOptions{}) {
+		t.Errorf("got different keys for the same query %s", a)
+	}
+}
+
+func TestSetParallelism(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		sched scheduler
+	}{
+		{"multiScheduler", newMultiScheduler(2)},
+		{"semaphoreScheduler", &semaphoreScheduler{throttle: semaphore.NewWeighted(2), capacity: 2}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			before := runtime.NumGoroutine()
+
+			ss := newShardedSearcher(2)
+			ss.sched = tc.sched
+			repos := reposForTest(20)
+			for _, r := range repos {
+				ss.replace(r.Name, testSearcherForRepo(t, r, 10))
+			}
+
+			ctx := context.Background()
+			done := make(chan struct{})
+			errC := make(chan error, 4)
+			var wg sync.WaitGroup
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						select {
+						case <-done:
+							return
+						default:
+						}
+						res, err := ss.Search(ctx, &query.Substring{Pattern: "needle"}, &zoekt.SearchOptions{})
+						if err != nil {
+							errC <- err
+							return
+						}
+						if len(res.Files) != len(repos) {
+							errC <- fmt.Errorf("got %d files, want %d", len(res.Files), len(repos))
+							return
+						}
+					}
+				}()
+			}
+
+			for _, n := range []int{1, 8, 3, 16, 1, 4} {
+				ss.SetParallelism(n)
+				// Reloading a shard takes an exclusive process, which must
+				// still exclude every running search.
+				r := repos[n%len(repos)]
+				ss.replace(r.Name, testSearcherForRepo(t, r, 10))
+				time.Sleep(5 * time.Millisecond)
+			}
+			close(done)
+			wg.Wait()
+			close(errC)
+			for err := range errC {
+				t.Error(err)
+			}
+
+			ss.Close()
+			deadline := time.Now().Add(time.Second)
+			for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if after := runtime.NumGoroutine(); after > before {
+				t.Errorf("got %d goroutines after searching, want at most %d", after, before)
+			}
+		})
+	}
+}
+
+func TestHealth(t *testing.T) {
+	ss := newShardedSearcher(2)
+	ss.shards = map[string]rankedShard{
+		"a": {Searcher: &rankSearcher{rank: 1}},
+		"b": {Searcher: &crashSearcher{}},
+		"c": {Searcher: &rankSearcher{rank: 2}},
+	}
+
+	health := ss.Health(context.Background())
+	var got []string
+	for _, h := range health {
+		got = append(got, fmt.Sprintf("%s:%v", h.Path, h.OK))
+		if h.OK != (h.Err == nil) {
+			t.Errorf("%s: got OK=%v with error %v", h.Path, h.OK, h.Err)
+		}
+	}
+	if want := []string{"a:true", "b:false", "c:true"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// cancelListSearcher cancels the List context if cancel is set, and
+// otherwise lists nothing until the context is done.
+type cancelListSearcher struct {
+	rankSearcher
+	cancel context.CancelFunc
+}
+
+func (s *cancelListSearcher) List(ctx context.Context, q query.Q, opts *zoekt.ListOptions) (*zoekt.RepoList, error) {
+	if s.cancel == nil {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	s.cancel()
+	return s.rankSearcher.List(ctx, q, opts)
+}
+
+func TestListCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ss := newShardedSearcher(1)
+	ss.shards = map[string]rankedShard{}
+	for _, name := range []string{"a", "b", "c"} {
+		repo := &zoekt.Repository{Name: name}
+		s := &cancelListSearcher{rankSearcher: rankSearcher{repo: repo}}
+		// Shards are listed in order of name, so a is listed first.
+		if name == "a" {
+			s.cancel = cancel
+		}
+		ss.shards[name] = rankedShard{Searcher: s, repos: []*zoekt.Repository{repo}}
+	}
+
+	rl, err := ss.List(ctx, &query.Const{Value: true}, nil)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if !rl.Incomplete {
+		t.Error("got complete list after cancel")
+	}
+	if len(rl.Repos) != 1 || rl.Repos[0].Repository.Name != "a" {
+		t.Errorf("got repos %v, want only a", rl.Repos)
+	}
+}
+
+func TestBranches(t *testing.T) {
+	ss := newShardedSearcher(1)
+	for i, branches := range [][]string{{"main", "dev"}, {"main", "release"}} {
+		repo := &zoekt.Repository{Name: fmt.Sprintf("repo%d", i)}
+		for _, br := range branches {
+			repo.Branches = append(repo.Branches, zoekt.RepositoryBranch{Name: br, Version: "v1"})
+		}
+		b := testIndexBuilder(t, repo, zoekt.Document{Name: "f", Content: []byte("x"), Branches: branches})
+		ss.replace(repo.Name, searcherForTest(t, b))
+	}
+
+	got, err := ss.Branches(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"dev", "main", "release"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestDeterministicOrder(t *testing.T) {
+	ss := newShardedSearcher(1)
+	var want []string
+	for i := 0; i < 10; i++ {
+		repo := &zoekt.Repository{Name: fmt.Sprintf("repo%d", i)}
+		b := testIndexBuilder(t, repo, zoekt.Document{Name: "f", Content: []byte("needle")})
+		ss.replace(fmt.Sprintf("shard%d", i), searcherForTest(t, b))
+		want = append(want, repo.Name)
+	}
+	// Shards that rank the same and have no repositories to order them by.
+	for i := 0; i < 10; i++ {
+		ss.replace(fmt.Sprintf("empty%d", i), &rankSearcher{})
+	}
+
+	for i := 0; i < 20; i++ {
+		res, err := ss.Search(context.Background(), &query.Substring{Pattern: "needle"}, &zoekt.SearchOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, f := range res.Files {
+			if f.Repository != "" {
+				got = append(got, f.Repository)
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("run %d: got %v, want %v", i, got, want)
+		}
+
+		ss.rankedLock.Lock()
+		ss.ranked = nil
+		ss.rankedLock.Unlock()
+		var keys []string
+		for _, s := range ss.getShards() {
+			if len(s.repos) > 0 && s.repos[0].Name == "" {
+				keys = append(keys, s.key)
+			}
+		}
+		if !sort.StringsAreSorted(keys) || len(keys) != 10 {
+			t.Fatalf("run %d: got shards %v, want 10 shards sorted by key", i, keys)
+		}
+	}
+}
+
+func TestTenantMatchCount(t *testing.T) {
+	ss := newShardedSearcher(2)
+	for i := 0; i < 3; i++ {
+		b := testIndexBuilder(t, &zoekt.Repository{Name: fmt.Sprintf("repo%d", i)},
+			zoekt.Document{Name: "f", Content: []byte("needle\nhaystack\nneedle")})
+		ss.replace(fmt.Sprintf("shard%d", i), searcherForTest(t, b))
+	}
+
+	count := func(tenant string) float64 {
+		return testutil.ToFloat64(metricSearchTenantMatchCountTotal.WithLabelValues(tenant))
+	}
+	beforeA, beforeB := count("tenant-a"), count("tenant-b")
+
+	var wg sync.WaitGroup
+	for tenant, pattern := range map[string]string{"tenant-a": "needle", "tenant-b": "haystack"} {
+		wg.Add(1)
+		go func(tenant, pattern string) {
+			defer wg.Done()
+			ctx := trace.WithTenant(context.Background(), tenant)
+			if _, err := ss.Search(ctx, &query.Substring{Pattern: pattern}, &zoekt.SearchOptions{}); err != nil {
+				t.Error(err)
+			}
+		}(tenant, pattern)
+	}
+	wg.Wait()
+
+	// Each shard has two matches for needle, and one for haystack.
+	if got := count("tenant-a") - beforeA; got != 6 {
+		t.Errorf("tenant-a: got %v matches, want 6", got)
+	}
+	if got := count("tenant-b") - beforeB; got != 3 {
+		t.Errorf("tenant-b: got %v matches, want 3", got)
+	}
+}
+
+func TestMaxMatchesPerRepo(t *testing.T) {
+	ss := newShardedSearcher(1)
+	for repo, n := range map[string]int{"big": 10, "small1": 2, "small2": 1} {
+		var docs []zoekt.Document
+		for i := 0; i < n; i++ {
+			docs = append(docs, zoekt.Document{Name: fmt.Sprintf("f%d", i), Content: []byte("needle")})
+		}
+		b := testIndexBuilder(t, &zoekt.Repository{Name: repo}, docs...)
+		ss.replace(repo, searcherForTest(t, b))
+	}
+	// The best files of big are in a second shard.
+	b := testIndexBuilder(t, &zoekt.Repository{Name: "big"},
+		zoekt.Document{Name: "best0", Content: []byte("needle"), RankBoost: 100},
+		zoekt.Document{Name: "best1", Content: []byte("needle"), RankBoost: 100})
+	ss.replace("big-best", searcherForTest(t, b))
+
+	count := func(opts *zoekt.SearchOptions) map[string]int {
+		t.Helper()
+		res, err := ss.Search(context.Background(), &query.Substring{Pattern: "needle"}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts := map[string]int{}
+		for _, f := range res.Files {
+			counts[f.Repository]++
+		}
+		return counts
+	}
+
+	if got, want := count(&zoekt.SearchOptions{}), map[string]int{"big": 12, "small1": 2, "small2": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("no limit: got %v, want %v", got, want)
+	}
+	if got, want := count(&zoekt.SearchOptions{MaxMatchesPerRepo: 2}), map[string]int{"big": 2, "small1": 2, "small2": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("MaxMatchesPerRepo: got %v, want %v", got, want)
+	}
+
+	res, err := ss.Search(context.Background(), &query.Substring{Pattern: "needle"}, &zoekt.SearchOptions{MaxMatchesPerRepo: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range res.Files {
+		if f.Repository == "big" && !strings.HasPrefix(f.FileName, "best") {
+			t.Errorf("got %s from big, want only its best files", f.FileName)
+		}
+	}
+	if res.Stats.FileCount != 5 || res.Stats.MatchCount != 5 {
+		t.Errorf("got FileCount %d and MatchCount %d, want 5 each", res.Stats.FileCount, res.Stats.MatchCount)
+	}
+
+	got := count(&zoekt.SearchOptions{MaxMatchesPerRepo: 2, MaxDocDisplayCount: 3})
+	total := 0
+	for repo, n := range got {
+		if n > 2 {
+			t.Errorf("with MaxDocDisplayCount: got %d files for %s, want at most 2", n, repo)
+		}
+		total += n
+	}
+	if total != 3 {
+		t.Errorf("with MaxDocDisplayCount: got %d files, want 3", total)
+	}
+}
+
+func TestMaxMatchesPerRepoTotalMaxMatchCount(t *testing.T) {
+	// Search one shard at a time, in order of priority.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+
+	ss := newShardedSearcher(1)
+	for _, r := range []struct {
+		name     string
+		priority string
+		files    int
+	}{
+		{"big", "3", 10},
+		{"small1", "2", 2},
+		{"small2", "1", 1},
+	} {
+		var docs []zoekt.Document
+		for i := 0; i < r.files; i++ {
+			docs = append(docs, zoekt.Document{Name: fmt.Sprintf("f%d", i), Content: []byte("needle")})
+		}
+		repo := &zoekt.Repository{Name: r.name, RawConfig: map[string]string{"priority": r.priority}}
+		ss.replace(r.name, searcherForTest(t, testIndexBuilder(t, repo, docs...)))
+	}
+
+	// Without the cap, big alone exceeds TotalMaxMatchCount. With it,
+	// only its first 2 files count, so the other repositories are
+	// searched too.
+	res, err := ss.Search(context.Background(), &query.Substring{Pattern: "needle"}, &zoekt.SearchOptions{
+		MaxMatchesPerRepo:  2,
+		TotalMaxMatchCount: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]int{}
+	for _, f := range res.Files {
+		counts[f.Repository]++
+	}
+	if want := map[string]int{"big": 2, "small1": 2, "small2": 1}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("got %v, want %v", counts, want)
+	}
+
+	err = ss.StreamSearch(context.Background(), &query.Substring{Pattern: "needle"}, &zoekt.SearchOptions{MaxMatchesPerRepo: 2},
+		stream.SenderFunc(func(*zoekt.SearchResult) {}))
+	if err == nil {
+		t.Error("StreamSearch accepted MaxMatchesPerRepo")
+	}
+}
+
+func TestExcludeTests(t *testing.T) {
+	ss := newShardedSearcher(1)
+	b := testIndexBuilder(t, &zoekt.Repository{Name: "repo"},
+		zoekt.Document{Name: "main.go", Content: []byte("needle")},
+		zoekt.Document{Name: "main_test.go", Content: []byte("needle")})
+	ss.replace("repo", searcherForTest(t, b))
+
+	files := func(opts *zoekt.SearchOptions) []string {
+		t.Helper()
+		res, err := ss.Search(context.Background(), &query.Substring{Pattern: "needle"}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, f := range res.Files {
+			names = append(names, f.FileName)
+		}
+		sort.Strings(names)
+		if res.Stats.FileCount != len(names) || res.Stats.MatchCount != len(names) {
+			t.Errorf("got FileCount %d, MatchCount %d for %d files",
+				res.Stats.FileCount, res.Stats.MatchCount, len(names))
+		}
+		return names
+	}
+
+	if got, want := files(&zoekt.SearchOptions{}), []string{"main.go", "main_test.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := files(&zoekt.SearchOptions{ExcludeTests: true}), []string{"main.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ExcludeTests: got %v, want %v", got, want)
+	}
+
+	isMain := func(name string) bool { return name == "main.go" }
+	if got, want := files(&zoekt.SearchOptions{ExcludeTests: true, IsTestFile: isMain}), []string{"main_test.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ExcludeTests with IsTestFile: got %v, want %v", got, want)
+	}
+}
+
+func TestIsTestFile(t *testing.T) {
+	for name, want := range map[string]bool{
+		"main.go":              false,
+		"main_test.go":         true,
+		"test/main.go":         true,
+		"pkg/testdata/x.txt":   true,
+		"spec/models/user.rb":  true,
+		"app/user_spec.rb":     true,
+		"src/FooTest.java":     true,
+		"src/Test.java":        true,
+		"src/Testing.java":     false,
+		"web/app.test.ts":      true,
+		"web/app.ts":           false,
+		"test_utils.py":        true,
+		"latest/main.go":       false,
+		"contest.go":           false,
+		"src/__tests__/app.js": true,
+	} {
+		if got := isTestFile(name); got != want {
+			t.Errorf("isTestFile(%q): got %v, want %v", name, got, want)
+		}
+	}
+}
+
+// countingSeeker is a memSeeker that counts calls to Read.
+type countingSeeker struct {
+	memSeeker
+	reads int64
+}
+
+func (s *countingSeeker) Read(off, sz uint32) ([]byte, error) {
+	atomic.AddInt64(&s.reads, 1)
+	return s.memSeeker.Read(off, sz)
+}
+
+func TestWarmup(t *testing.T) {
+	newShard := func() (zoekt.Searcher, *countingSeeker) {
+		b := testIndexBuilder(t, &zoekt.Repository{Name: "repo"},
+			zoekt.Document{Name: "f1", Content: []byte("needle in a haystack")},
+			zoekt.Document{Name: "f2", Content: []byte("another needle")})
+		var buf bytes.Buffer
+		if err := b.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		f := &countingSeeker{memSeeker: memSeeker{buf.Bytes()}}
+		s, err := zoekt.NewSearcher(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s, f
+	}
+
+	searchReads := func(warmup bool) int64 {
+		ss := newShardedSearcher(1)
+		s, f := newShard()
+		ss.replace("shard", s)
+		if warmup {
+			ss.Warmup(context.Background(), 0)
+		}
+
+		before := atomic.LoadInt64(&f.reads)
+		res, err := ss.Search(context.Background(), &query.Substring{Pattern: "needle"}, &zoekt.SearchOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Files) != 2 {
+			t.Fatalf("got %d files, want 2", len(res.Files))
+		}
+		return atomic.LoadInt64(&f.reads) - before
+	}
+
+	cold, warm := searchReads(false), searchReads(true)
+	if warm >= cold {
+		t.Errorf("got %d reads after Warmup, want fewer than the %d reads without", warm, cold)
+	}
+
+	// Prefetch stays within its budget.
+	s, _ := newShard()
+	n, err := s.(prefetcher).Prefetch(context.Background(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("prefetched %d bytes, want 3", n)
+	}
+
+	// Warmup gives up on a cancelled context.
+	ss := newShardedSearcher(1)
+	ss.replace("shard", s)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ss.Warmup(ctx, 0)
+}
+
+// prefetchSearcher is a rankSearcher with size bytes of postings, which
+// records the budgets passed to Prefetch.
+type prefetchSearcher struct {
+	rankSearcher
+	size    int64
+	budgets *[]int64
+}
+
+func (s *prefetchSearcher) Prefetch(ctx context.Context, budget int64) (int64, error) {
+	*s.budgets = append(*s.budgets, budget)
+	if budget > 0 && budget < s.size {
+		return budget, nil
+	}
+	return s.size, nil
+}
+
+func TestWarmupBudget(t *testing.T) {
+	var budgets []int64
+	ss := newShardedSearcher(1)
+	for i, size := range []int64{10, 100, 100} {
+		ss.replace(fmt.Sprintf("shard%d", i), &prefetchSearcher{
+			rankSearcher: rankSearcher{rank: uint16(3 - i)},
+			size:         size,
+			budgets:      &budgets,
+		})
+	}
+
+	// The share the first shard doesn't use goes to the others.
+	ss.Warmup(context.Background(), 120)
+	if want := []int64{40, 55, 55}; !reflect.DeepEqual(budgets, want) {
+		t.Errorf("got budgets %v, want %v", budgets, want)
+	}
+
+	budgets = nil
+	ss.Warmup(context.Background(), 0)
+	if want := []int64{0, 0, 0}; !reflect.DeepEqual(budgets, want) {
+		t.Errorf("without a budget: got budgets %v, want %v", budgets, want)
+	}
+}
+
+func TestSortByFilePath(t *testing.T) {
+	ss := newShardedSearcher(1)
+	for i := 1; i <= 12; i++ {
+		ss.replace(fmt.Sprintf("shard%d", i), &rankSearcher{rank: uint16(i)})
+	}
+
+	search := func(opts *zoekt.SearchOptions) []string {
+		t.Helper()
+		res, err := ss.Search(context.Background(), &query.Substring{Pattern: "bla"}, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, f := range res.Files {
+			names = append(names, f.FileName)
+		}
+		return names
+	}
+
+	got := search(&zoekt.SearchOptions{SortBy: zoekt.SortByFilePath})
+	want := []string{"f1", "f10", "f11", "f12", "f2", "f3", "f4", "f5", "f6", "f7", "f8", "f9"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// The cutoff keeps the best scored files, which are then sorted.
+	got = search(&zoekt.SearchOptions{SortBy: zoekt.SortByFilePath, MaxDocDisplayCount: 3})
+	if want := []string{"f10", "f11", "f12"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("with MaxDocDisplayCount: got %v, want %v", got, want)
+	}
+}
+
+func TestSortByRecency(t *testing.T) {
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	ss := newShardedSearcher(1)
+	for i, r := range []*zoekt.Repository{{ID: 1, Name: "repo1"}, {ID: 2, Name: "repo2"}} {
+		b := testIndexBuilder(t, r,
+			zoekt.Document{Name: "old", Content: []byte("needle"), ModTime: base.Add(time.Duration(i) * time.Hour)},
+			zoekt.Document{Name: "new", Content: []byte("needle"), ModTime: base.Add(time.Duration(i+2) * time.Hour)},
+			zoekt.Document{Name: "unknown", Content: []byte("needle")})
+		ss.replace(r.Name, searcherForTest(t, b))
+	}
+
+	res, err := ss.Search(context.Background(), &query.Substring{Pattern: "needle"}, &zoekt.SearchOptions{SortBy: zoekt.SortByRecency})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, f := range res.Files {
+		got = append(got, f.Repository+"/"+f.FileName)
+		if f.FileName == "unknown" && !f.ModTime.IsZero() {
+			t.Errorf("%s/%s: got ModTime %v, want zero", f.Repository, f.FileName, f.ModTime)
+		}
+	}
+	want := []string{"repo2/new", "repo1/new", "repo2/old", "repo1/old"}
+	if len(got) != 6 || !reflect.DeepEqual(got[:4], want) {
+		t.Errorf("got %v, want %v followed by the files without ModTime", got, want)
+	}
+	if len(res.Files) > 0 && !res.Files[0].ModTime.Equal(base.Add(3*time.Hour)) {
+		t.Errorf("got ModTime %v, want %v", res.Files[0].ModTime, base.Add(3*time.Hour))
+	}
+}
+
+func TestSetRankOverrides(t *testing.T) {
+	ss := newShardedSearcher(1)
+	ss.cache = newResultCache(10, time.Minute)
+	for _, r := range []*zoekt.Repository{
+		{ID: 1, Name: "low", Rank: 100},
+		{ID: 2, Name: "high", Rank: 200},
+	} {
+		b := testIndexBuilder(t, r, zoekt.Document{Name: "f", Content: []byte("needle")})
+		ss.replace(r.Name, searcherForTest(t, b))
+	}
+
+	search := func() []string {
+		t.Helper()
+		res, err := ss.Search(context.Background(), &query.Substring{Pattern: "needle"}, &zoekt.SearchOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var repos []string
+		for _, f := range res.Files {
+			repos = append(repos, f.Repository)
+		}
+		return repos
+	}
+
+	if got, want := search(), []string{"high", "low"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	ss.SetRankOverrides(map[uint32]uint16{1: 300})
+	if got, want := search(), []string{"low", "high"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("with override: got %v, want %v", got, want)
+	}
+
+	ss.SetRankOverrides(nil)
+	if got, want := search(), []string{"high", "low"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after clearing overrides: got %v, want %v", got, want)
+	}
+}
+
+func TestSetRankOverridesShardOrder(t *testing.T) {
+	ss := newShardedSearcher(1)
+	for _, r := range []*zoekt.Repository{
+		{ID: 1, Name: "low", Rank: 100, RawConfig: map[string]string{"priority": "100"}},
+		{ID: 2, Name: "high", Rank: 200, RawConfig: map[string]string{"priority": "200"}},
+	} {
+		b := testIndexBuilder(t, r, zoekt.Document{Name: "f", Content: []byte("needle")})
+		ss.replace(r.Name, searcherForTest(t, b))
+	}
+
+	order := func() []string {
+		var names []string
+		for _, s := range ss.getShards() {
+			names = append(names, s.repos[0].Name)
+		}
+		return names
+	}
+
+	if got, want := order(), []string{"high", "low"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	// The boosted shard is searched first, so it isn't cut off by
+	// TotalMaxMatchCount.
+	ss.SetRankOverrides(map[uint32]uint16{1: 300})
+	if got, want := order(), []string{"low", "high"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("with override: got %v, want %v", got, want)
+	}
+	if got := ss.getShards()[0].priority; got != 300 {
+		t.Errorf("got priority %v for the boosted shard, want 300", got)
+	}
+
+	ss.SetRankOverrides(nil)
+	if got, want := order(), []string{"high", "low"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after clearing overrides: got %v, want %v", got, want)
 	}
 }
@@ -0,0 +1,75 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shards
+
+import (
+	"path"
+	"strings"
+
+	"github.com/google/zoekt"
+)
+
+// testDirs are directories that only hold tests and their data.
+var testDirs = map[string]bool{
+	"test":      true,
+	"tests":     true,
+	"spec":      true,
+	"specs":     true,
+	"testdata":  true,
+	"__tests__": true,
+}
+
+// isTestFile reports whether the file at name, a path relative to the
+// repository root, holds tests. It matches files in testDirs, and the
+// naming conventions for test files of common languages.
+func isTestFile(name string) bool {
+	dir, base := path.Split(name)
+	for _, d := range strings.Split(dir, "/") {
+		if testDirs[d] {
+			return true
+		}
+	}
+
+	ext := path.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+	switch ext {
+	case ".go":
+		return strings.HasSuffix(stem, "_test")
+	case ".py":
+		return strings.HasPrefix(stem, "test_") || strings.HasSuffix(stem, "_test")
+	case ".rb":
+		return strings.HasSuffix(stem, "_test") || strings.HasSuffix(stem, "_spec")
+	case ".java", ".kt", ".scala", ".cs":
+		return strings.HasSuffix(stem, "Test") || strings.HasSuffix(stem, "Tests")
+	case ".js", ".jsx", ".ts", ".tsx", ".mjs":
+		return strings.HasSuffix(stem, ".test") || strings.HasSuffix(stem, ".spec")
+	case ".c", ".cc", ".cpp", ".h":
+		return strings.HasSuffix(stem, "_test") || strings.HasSuffix(stem, "_unittest")
+	case ".rs":
+		return stem == "tests"
+	}
+	return false
+}
+
+// excludeTests drops the test files of sr, as decided by isTest or
+// isTestFile if it is nil, and removes them from its Stats.
+func excludeTests(sr *zoekt.SearchResult, isTest func(name string) bool) {
+	if isTest == nil {
+		isTest = isTestFile
+	}
+	removeFiles(sr, func(f *zoekt.FileMatch) bool {
+		return isTest(f.FileName)
+	})
+}
@@ -0,0 +1,257 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// A spill segment holds the postings of a postingsBuilder at the time it
+// was spilled, as a sequence of records sorted by ngram:
+//
+//   ngram (uint64, big endian)
+//   length of postings (uvarint)
+//   postings
+//
+// The postings are delta encoded against the last offset of the previous
+// segment, so concatenating the postings of an ngram across all segments
+// and the in-memory remainder yields the postings of an in-memory build.
+
+// spill writes the postings accumulated so far to a new segment in dir,
+// and drops them from memory.
+func (s *postingsBuilder) spill(dir string) error {
+	if len(s.postings) == 0 {
+		return nil
+	}
+
+	f, err := ioutil.TempFile(dir, "zoekt-postings-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	keys := make(ngramSlice, 0, len(s.postings))
+	for k := range s.postings {
+		keys = append(keys, k)
+	}
+	sort.Sort(keys)
+
+	bw := bufio.NewWriter(f)
+	var buf [binary.MaxVarintLen64 + 8]byte
+	for _, k := range keys {
+		binary.BigEndian.PutUint64(buf[:], uint64(k))
+		n := binary.PutUvarint(buf[8:], uint64(len(s.postings[k])))
+		bw.Write(buf[:8+n])
+		bw.Write(s.postings[k])
+	}
+	if err := bw.Flush(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	s.segments = append(s.segments, f.Name())
+	s.postings = map[ngram][]byte{}
+	s.postingsSize = 0
+	return nil
+}
+
+// removeSegments deletes the spilled segments.
+func (s *postingsBuilder) removeSegments() {
+	for _, fn := range s.segments {
+		os.Remove(fn)
+	}
+	s.segments = nil
+}
+
+// segmentReader reads the records of a spill segment in order.
+type segmentReader struct {
+	f *os.File
+	r *bufio.Reader
+
+	// ngram and postings hold the current record, unless done is set.
+	ngram    ngram
+	postings []byte
+	done     bool
+}
+
+func openSegment(fn string) (*segmentReader, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	r := &segmentReader{f: f, r: bufio.NewReader(f)}
+	if err := r.next(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *segmentReader) next() error {
+	var buf [8]byte
+	if _, err := io.ReadFull(r.r, buf[:]); err == io.EOF {
+		r.done = true
+		return nil
+	} else if err != nil {
+		return err
+	}
+	sz, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return err
+	}
+	r.ngram = ngram(binary.BigEndian.Uint64(buf[:]))
+	r.postings = make([]byte, sz)
+	_, err = io.ReadFull(r.r, r.postings)
+	return err
+}
+
+// postingsFor returns the postings of ng in this segment, and advances past
+// them. Calls must be in increasing ngram order. Records for smaller ngrams,
+// which were dropped since, are skipped.
+func (r *segmentReader) postingsFor(ng ngram) ([]byte, error) {
+	for !r.done && r.ngram < ng {
+		if err := r.next(); err != nil {
+			return nil, err
+		}
+	}
+	if r.done || r.ngram != ng {
+		return nil, nil
+	}
+	p := r.postings
+	return p, r.next()
+}
+
+var errPostingsSpilled = errors.New("postings were spilled and already written")
+
+// writeSpilledPostings writes the postings items for keys, merging the
+// spilled segments with the postings in memory.
+func writeSpilledPostings(w *writer, s *postingsBuilder, keys ngramSlice, postings *compoundSection) error {
+	var readers []*segmentReader
+	defer func() {
+		for _, r := range readers {
+			r.f.Close()
+		}
+	}()
+	for _, fn := range s.segments {
+		r, err := openSegment(fn)
+		if err != nil {
+			return err
+		}
+		readers = append(readers, r)
+	}
+
+	var item []byte
+	for _, k := range keys {
+		item = item[:0]
+		for _, r := range readers {
+			p, err := r.postingsFor(k)
+			if err != nil {
+				return err
+			}
+			item = append(item, p...)
+		}
+		item = append(item, s.postings[k]...)
+		postings.addItem(w, item)
+	}
+	return nil
+}
+
+// spillMerged writes the content postings of d to a new segment, as if the
+// live documents of d had been added to s, with the rune offsets of their
+// content starting at starts. The postings of ngrams in skip are left out.
+func (s *postingsBuilder) spillMerged(dir string, d *indexData, starts []uint32, skip map[ngram]struct{}) error {
+	dump := d.ngrams.DumpMap()
+	keys := make(ngramSlice, 0, len(dump))
+	for k := range dump {
+		if _, ok := skip[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Sort(keys)
+
+	f, err := ioutil.TempFile(dir, "zoekt-postings-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	bw := bufio.NewWriter(f)
+	var buf [binary.MaxVarintLen64 + 8]byte
+	var offsets []uint32
+	var postings []byte
+	for _, k := range keys {
+		// Only the keys of DumpMap are exact; look up sections with Get.
+		blob, err := d.readSectionBlob(d.ngrams.Get(k))
+		if err != nil {
+			os.Remove(f.Name())
+			return err
+		}
+		offsets = fromDeltas(blob, offsets[:0])
+
+		postings = postings[:0]
+		lastOff := s.lastOffsets[k]
+		for len(offsets) > 0 {
+			docID := uint32(sort.Search(len(d.fileEndRunes), func(i int) bool {
+				return d.fileEndRunes[i] > offsets[0]
+			}))
+			start := uint32(0)
+			if docID > 0 {
+				start = d.fileEndRunes[docID-1]
+			}
+			end := d.fileEndRunes[docID]
+			live := !d.repoMetaData[d.repos[docID]].Tombstone
+
+			for ; len(offsets) > 0 && offsets[0] < end; offsets = offsets[1:] {
+				if !live {
+					continue
+				}
+				newOff := starts[docID] + offsets[0] - start
+				m := binary.PutUvarint(buf[:], uint64(newOff-lastOff))
+				postings = append(postings, buf[:m]...)
+				lastOff = newOff
+			}
+		}
+		if len(postings) == 0 {
+			continue
+		}
+		s.lastOffsets[k] = lastOff
+
+		binary.BigEndian.PutUint64(buf[:], uint64(k))
+		n := binary.PutUvarint(buf[8:], uint64(len(postings)))
+		bw.Write(buf[:8+n])
+		bw.Write(postings)
+	}
+	if err := bw.Flush(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	s.segments = append(s.segments, f.Name())
+	return nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSpillPostings(t *testing.T) {
+	build := func(spillDir string, threshold int) *IndexBuilder {
+		b := testIndexBuilder(t, &Repository{Name: "repo"})
+		b.IndexTime = time.Unix(1, 0)
+		b.ID = "id"
+		b.SpillDir = spillDir
+		b.SpillThreshold = threshold
+		for i := 0; i < 50; i++ {
+			if err := b.Add(Document{
+				Name:    fmt.Sprintf("dir%d/file%d.go", i%3, i),
+				Content: []byte(fmt.Sprintf("package p%d\n\nfunc needle%d() { return \"héllo wörld\" }\n", i%7, i)),
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return b
+	}
+
+	var want bytes.Buffer
+	if err := build("", 0).Write(&want); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	b := build(dir, 64)
+	if n := len(b.contentPostings.segments); n < 2 {
+		t.Fatalf("got %d content segments, want several", n)
+	}
+	if n := len(b.namePostings.segments); n < 2 {
+		t.Fatalf("got %d name segments, want several", n)
+	}
+
+	var got bytes.Buffer
+	if err := b.Write(&got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), want.Bytes()) {
+		t.Errorf("spilled build differs from in-memory build")
+	}
+
+	if left, _ := filepath.Glob(filepath.Join(dir, "*")); len(left) != 0 {
+		t.Errorf("got spill files %v after Write, want none", left)
+	}
+	if err := b.Write(&bytes.Buffer{}); err != errPostingsSpilled {
+		t.Errorf("second Write: got %v, want %v", err, errPostingsSpilled)
+	}
+}
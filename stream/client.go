@@ -69,6 +69,7 @@ func (c *Client) StreamSearch(ctx context.Context, q query.Q, opts *zoekt.Search
 	req.Header.Set("Cache-Control", "no-cache")
 	req.Header.Set("Connection", "keep-alive")
 	req.Header.Set("Transfer-Encoding", "chunked")
+	req.Header.Set(keepAliveHeader, "1")
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
@@ -98,6 +99,9 @@ func (c *Client) StreamSearch(ctx context.Context, q query.Q, opts *zoekt.Search
 			}
 		case eventDone:
 			return nil
+		case eventKeepAlive, eventProgress:
+			// These keep the connection busy; a Sender has no use for them.
+			continue
 		default:
 			return fmt.Errorf("unknown event type")
 		}
@@ -3,10 +3,17 @@
 package stream
 
 import (
+	"compress/gzip"
 	"encoding/gob"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/zoekt"
 	"github.com/google/zoekt/query"
@@ -22,16 +29,47 @@ const (
 	eventMatches eventType = iota
 	eventError
 	eventDone
+	eventKeepAlive
+	eventProgress
 )
 
 func (e eventType) string() string {
-	return []string{"eventMatches", "eventError", "eventDone"}[e]
+	return []string{"eventMatches", "eventError", "eventDone", "eventKeepAlive", "eventProgress"}[e]
 }
 
+// MarshalJSON encodes e by name, for streams in the NDJSON format.
+func (e eventType) MarshalJSON() ([]byte, error) {
+	return json.Marshal(e.string())
+}
+
+// UnmarshalJSON is the inverse of MarshalJSON.
+func (e *eventType) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		return err
+	}
+	for t := eventMatches; t <= eventProgress; t++ {
+		if t.string() == name {
+			*e = t
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown event type %q", name)
+}
+
+// defaultKeepAlive is how long the server lets a stream idle before it sends
+// a keepalive event. Proxies tend to drop connections idle for a minute.
+const defaultKeepAlive = 15 * time.Second
+
+// keepAliveHeader is the request header with which clients ask for keepalive
+// and progress events. Clients that don't send it may not know these
+// events, so they don't get any.
+const keepAliveHeader = "X-Zoekt-Keep-Alive"
+
 // Server returns an http.Handler which is the server side of StreamSearch.
 func Server(searcher zoekt.Streamer) http.Handler {
 	registerGob()
-	return &handler{Searcher: searcher}
+	return &handler{Searcher: searcher, KeepAlive: defaultKeepAlive}
 }
 
 type searchArgs struct {
@@ -44,8 +82,23 @@ type searchReply struct {
 	Data  interface{}
 }
 
+// progress is the data of an eventProgress event.
+type progress struct {
+	// ShardsSearched is the number of shards that have reported back.
+	ShardsSearched int
+
+	// ShardsTotal is the number of shards being searched, or 0 if the
+	// searcher does not tell.
+	ShardsTotal int
+}
+
 type handler struct {
 	Searcher zoekt.Streamer
+
+	// KeepAlive is how long the stream may be idle before a keepalive and a
+	// progress event are sent, to clients that ask for them with
+	// keepAliveHeader. If 0, no keepalive events are sent.
+	KeepAlive time.Duration
 }
 
 func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -61,11 +114,12 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	args.Q = query.RPCUnwrap(args.Q)
 
-	eventWriter, err := newEventStreamWriter(w)
+	eventWriter, err := newEventStreamWriter(w, r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	defer eventWriter.close()
 
 	// Always send a done event in the end.
 	defer func() {
@@ -75,10 +129,13 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}()
 
-	// mu protects aggStats and concurrent writes to the stream.
+	// mu protects aggStats, prog, idle and concurrent writes to the stream.
 	mu := sync.Mutex{}
 	aggStats := zoekt.Stats{}
+	prog := progress{}
+	idle := true
 	send := func(zsr *zoekt.SearchResult) {
+		idle = false
 		err := eventWriter.event(eventMatches, zsr)
 		if err != nil {
 			_ = eventWriter.event(eventError, err)
@@ -86,14 +143,29 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if h.KeepAlive > 0 && wantsKeepAlive(r) {
+		stop := runEvery(h.KeepAlive, func() {
+			mu.Lock()
+			defer mu.Unlock()
+			if idle {
+				_ = eventWriter.keepAlive(prog)
+			}
+			idle = true
+		})
+		defer stop()
+	}
+
 	err = h.Searcher.StreamSearch(ctx, args.Q, args.Opts, SenderFunc(func(event *zoekt.SearchResult) {
 		mu.Lock()
 		defer mu.Unlock()
 
+		prog.ShardsSearched += event.Stats.ShardsScanned + event.Stats.ShardsSkippedFilter
+		prog.ShardsTotal += event.Stats.ShardsTotal
+
 		// We don't want to send events over the wire if they just contain stats and no
 		// file matches. Hence, in case we didn't find any results, we will just
 		// aggregate the stats.
-		if len(event.Files) == 0 {
+		if len(event.Files) == 0 && len(event.RepoMatchDensity) == 0 {
 			aggStats.Add(event.Stats)
 			return
 		}
@@ -118,33 +190,117 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// encoder is implemented by *gob.Encoder and *json.Encoder.
+type encoder interface {
+	Encode(v interface{}) error
+}
+
 type eventStreamWriter struct {
-	enc   *gob.Encoder
+	enc   encoder
 	flush func()
+
+	// close finishes the stream. It is a no-op unless the stream is
+	// compressed.
+	close func() error
 }
 
-func newEventStreamWriter(w http.ResponseWriter) (*eventStreamWriter, error) {
+func newEventStreamWriter(w http.ResponseWriter, r *http.Request) (*eventStreamWriter, error) {
 	flusher, ok := w.(http.Flusher)
 	if !ok {
 		return nil, errors.New("http flushing not supported")
 	}
 
-	w.Header().Set("Content-Type", "application/x-gob-stream")
+	// Clients that cannot decode gob may ask for newline delimited JSON,
+	// with one searchReply per line.
+	contentType := "application/x-gob-stream"
+	newEncoder := func(w io.Writer) encoder { return gob.NewEncoder(w) }
+	if wantsNDJSON(r) {
+		contentType = "application/x-ndjson"
+		newEncoder = func(w io.Writer) encoder { return json.NewEncoder(w) }
+	}
+
+	w.Header().Set("Content-Type", contentType)
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 	w.Header().Set("Transfer-Encoding", "chunked")
+	w.Header().Add("Vary", "Accept-Encoding")
 
 	// This informs nginx to not buffer. With buffering search responses will
 	// be delayed until buffers get full, leading to worst case latency of the
 	// full time a search takes to complete.
 	w.Header().Set("X-Accel-Buffering", "no")
 
+	if !acceptsGzip(r) {
+		return &eventStreamWriter{
+			enc:   newEncoder(w),
+			flush: flusher.Flush,
+			close: func() error { return nil },
+		}, nil
+	}
+
+	// Line contents compress well. Every event is flushed through the
+	// gzip writer, so clients still see events as they happen.
+	w.Header().Set("Content-Encoding", "gzip")
+	gz := gzip.NewWriter(w)
 	return &eventStreamWriter{
-		enc:   gob.NewEncoder(w),
-		flush: flusher.Flush,
+		enc: newEncoder(gz),
+		flush: func() {
+			_ = gz.Flush()
+			flusher.Flush()
+		},
+		close: func() error {
+			err := gz.Close()
+			flusher.Flush()
+			return err
+		},
 	}, nil
 }
 
+// wantsNDJSON returns true if r asks for a stream of newline delimited JSON,
+// either with the format=ndjson URL parameter or in its Accept header.
+func wantsNDJSON(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "ndjson" {
+		return true
+	}
+	for _, typ := range strings.Split(r.Header.Get("Accept"), ",") {
+		if i := strings.IndexByte(typ, ';'); i >= 0 {
+			typ = typ[:i]
+		}
+		if strings.TrimSpace(typ) == "application/x-ndjson" {
+			return true
+		}
+	}
+	return false
+}
+
+// wantsKeepAlive returns true if r asks for keepalive events, either in
+// keepAliveHeader or with the keepalive=1 URL parameter.
+func wantsKeepAlive(r *http.Request) bool {
+	return r.Header.Get(keepAliveHeader) == "1" || r.URL.Query().Get("keepalive") == "1"
+}
+
+// acceptsGzip returns true if the Accept-Encoding header of r allows a gzip
+// encoded response.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params := enc, ""
+		if i := strings.IndexByte(enc, ';'); i >= 0 {
+			name, params = enc[:i], enc[i+1:]
+		}
+		if name = strings.TrimSpace(name); name != "gzip" && name != "*" {
+			continue
+		}
+		// A quality of 0 means "not acceptable".
+		if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+			if q, err := strconv.ParseFloat(params[len("q="):], 64); err == nil && q == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
 func (e *eventStreamWriter) event(event eventType, data interface{}) error {
 	// Because gob does not support serializing errors, we send error.Error() and
 	// recreate the error on the client-side.
@@ -161,11 +317,45 @@ func (e *eventStreamWriter) event(event eventType, data interface{}) error {
 	return nil
 }
 
+// keepAlive sends a keepalive event followed by a progress event, so that
+// proxies see traffic on the connection and clients can render progress.
+func (e *eventStreamWriter) keepAlive(prog progress) error {
+	if err := e.event(eventKeepAlive, nil); err != nil {
+		return err
+	}
+	return e.event(eventProgress, &prog)
+}
+
+// runEvery calls tick every interval until stop is called. Once stop
+// returns, tick is not running and will not be called again.
+func runEvery(interval time.Duration, tick func()) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ticker.C:
+				tick()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+		<-stopped
+	}
+}
+
 var once sync.Once
 
 func registerGob() {
 	once.Do(func() {
 		gob.Register(&zoekt.SearchResult{})
+		gob.Register(&progress{})
 	})
 	rpc.RegisterGob()
 }
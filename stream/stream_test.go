@@ -2,12 +2,16 @@ package stream
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/gob"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/zoekt"
@@ -161,10 +165,312 @@ func TestEventStreamWriter(t *testing.T) {
 	}
 }
 
+func TestEventStreamGzip(t *testing.T) {
+	q := mustParse("hello")
+	h := &handler{Searcher: adapter{&mockSearcher.MockSearcher{
+		WantSearch: q,
+		SearchResult: &zoekt.SearchResult{
+			Files: []zoekt.FileMatch{{FileName: "bin.go"}},
+		},
+	}}}
+	registerGob()
+
+	for _, acceptEncoding := range []string{"", "gzip", "deflate, gzip;q=0"} {
+		t.Run(acceptEncoding, func(t *testing.T) {
+			body := new(bytes.Buffer)
+			if err := gob.NewEncoder(body).Encode(&searchArgs{Q: q}); err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest("POST", DefaultSSEPath, body)
+			if acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", acceptEncoding)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			var r io.Reader = rec.Body
+			wantGzip := acceptEncoding == "gzip"
+			if got := rec.Header().Get("Content-Encoding") == "gzip"; got != wantGzip {
+				t.Fatalf("got gzip encoding %v, want %v", got, wantGzip)
+			}
+			if wantGzip {
+				gz, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				r = gz
+			}
+
+			var got []string
+			dec := gob.NewDecoder(r)
+			for {
+				reply := new(searchReply)
+				if err := dec.Decode(reply); err != nil {
+					t.Fatal(err)
+				}
+				if reply.Event == eventDone {
+					break
+				}
+				sr, ok := reply.Data.(*zoekt.SearchResult)
+				if reply.Event != eventMatches || !ok {
+					t.Fatalf("got event %s with %v, want matches", reply.Event.string(), reply.Data)
+				}
+				for _, f := range sr.Files {
+					got = append(got, f.FileName)
+				}
+			}
+			if d := cmp.Diff([]string{"bin.go"}, got); d != "" {
+				t.Errorf("mismatch (-want +got):\n%s", d)
+			}
+		})
+	}
+}
+
+func TestEventStreamNDJSON(t *testing.T) {
+	q := mustParse("hello")
+	h := &handler{Searcher: adapter{&mockSearcher.MockSearcher{
+		WantSearch: q,
+		SearchResult: &zoekt.SearchResult{
+			Files: []zoekt.FileMatch{{
+				FileName:   "bin.go",
+				Repository: "repo",
+				LineMatches: []zoekt.LineMatch{{
+					Line:       []byte("hello world"),
+					LineNumber: 1,
+					LineFragments: []zoekt.LineFragmentMatch{{
+						LineOffset:  0,
+						MatchLength: 5,
+					}},
+				}},
+			}},
+			Stats: zoekt.Stats{FileCount: 1, MatchCount: 1},
+		},
+	}}}
+	registerGob()
+
+	serve := func(target, accept string) *httptest.ResponseRecorder {
+		body := new(bytes.Buffer)
+		if err := gob.NewEncoder(body).Encode(&searchArgs{Q: q}); err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("POST", target, body)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	var want []searchReply
+	dec := gob.NewDecoder(serve(DefaultSSEPath, "").Body)
+	for {
+		var reply searchReply
+		if err := dec.Decode(&reply); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, reply)
+		if reply.Event == eventDone {
+			break
+		}
+	}
+
+	for _, tc := range []struct{ target, accept string }{
+		{target: DefaultSSEPath + "?format=ndjson"},
+		{target: DefaultSSEPath, accept: "application/json, application/x-ndjson;q=0.9"},
+	} {
+		rec := serve(tc.target, tc.accept)
+		if got := rec.Header().Get("Content-Type"); got != "application/x-ndjson" {
+			t.Fatalf("got Content-Type %q, want application/x-ndjson", got)
+		}
+
+		var got []searchReply
+		dec := json.NewDecoder(rec.Body)
+		for dec.More() {
+			var raw struct {
+				Event eventType
+				Data  json.RawMessage
+			}
+			if err := dec.Decode(&raw); err != nil {
+				t.Fatal(err)
+			}
+			reply := searchReply{Event: raw.Event}
+			if raw.Event == eventMatches {
+				sr := new(zoekt.SearchResult)
+				if err := json.Unmarshal(raw.Data, sr); err != nil {
+					t.Fatal(err)
+				}
+				reply.Data = sr
+			}
+			got = append(got, reply)
+		}
+		if d := cmp.Diff(want, got); d != "" {
+			t.Errorf("%s %s: mismatch (-gob +ndjson):\n%s", tc.target, tc.accept, d)
+		}
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	q := mustParse("hello")
+	h := &handler{
+		Searcher: stallingStreamer{
+			delay: 100 * time.Millisecond,
+			result: &zoekt.SearchResult{
+				Files: []zoekt.FileMatch{{FileName: "bin.go"}},
+				Stats: zoekt.Stats{ShardsScanned: 1},
+			},
+		},
+		KeepAlive: 10 * time.Millisecond,
+	}
+	registerGob()
+
+	events := func(keepAlive bool) []eventType {
+		t.Helper()
+		body := new(bytes.Buffer)
+		if err := gob.NewEncoder(body).Encode(&searchArgs{Q: q}); err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("POST", DefaultSSEPath, body)
+		if keepAlive {
+			req.Header.Set(keepAliveHeader, "1")
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		var got []eventType
+		dec := gob.NewDecoder(rec.Body)
+		for {
+			reply := new(searchReply)
+			if err := dec.Decode(reply); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, reply.Event)
+			if reply.Event == eventProgress {
+				if _, ok := reply.Data.(*progress); !ok {
+					t.Fatalf("got progress data %T, want *progress", reply.Data)
+				}
+			}
+			if reply.Event == eventDone {
+				return got
+			}
+		}
+	}
+
+	// Clients that don't ask for keepalives may not understand them.
+	if d := cmp.Diff([]eventType{eventMatches, eventDone}, events(false)); d != "" {
+		t.Fatalf("without %s: mismatch (-want +got):\n%s", keepAliveHeader, d)
+	}
+
+	got := events(true)
+	if len(got) < 4 || got[0] != eventKeepAlive || got[1] != eventProgress {
+		t.Fatalf("got events %v, want keepalive and progress first", got)
+	}
+	if got[len(got)-2] != eventMatches {
+		t.Fatalf("got events %v, want matches before done", got)
+	}
+
+	// The client skips keepalives.
+	s := httptest.NewServer(h)
+	defer s.Close()
+	var files []string
+	err := NewClient(s.URL, nil).StreamSearch(context.Background(), q, nil, SenderFunc(func(sr *zoekt.SearchResult) {
+		for _, f := range sr.Files {
+			files = append(files, f.FileName)
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := cmp.Diff([]string{"bin.go"}, files); d != "" {
+		t.Errorf("mismatch (-want +got):\n%s", d)
+	}
+}
+
+func TestStreamPartialContent(t *testing.T) {
+	var content bytes.Buffer
+	for i := 0; i < 20000; i++ {
+		if i == 10000 {
+			content.WriteString("the needle is here\n")
+			continue
+		}
+		fmt.Fprintf(&content, "haystack line %d\n", i)
+	}
+	b, err := zoekt.NewIndexBuilder(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Add(zoekt.Document{Name: "big.txt", Content: content.Bytes()}); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := b.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	searcher, err := zoekt.NewSearcher(&memSeeker{buf.Bytes()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer searcher.Close()
+
+	s := httptest.NewServer(&handler{Searcher: adapter{searcher}})
+	defer s.Close()
+	cl := NewClient(s.URL, nil)
+
+	search := func(q query.Q, opts *zoekt.SearchOptions) []zoekt.FileMatch {
+		t.Helper()
+		var files []zoekt.FileMatch
+		err := cl.StreamSearch(context.Background(), q, opts, SenderFunc(func(sr *zoekt.SearchResult) {
+			files = append(files, sr.Files...)
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 1 {
+			t.Fatalf("got %d files, want 1", len(files))
+		}
+		return files
+	}
+
+	// Initially, only the matched line and its context are sent.
+	f := search(&query.Substring{Pattern: "needle", Content: true}, &zoekt.SearchOptions{ContextLines: 2})[0]
+	if len(f.Content) != 0 {
+		t.Errorf("got %d bytes of content, want none", len(f.Content))
+	}
+	if len(f.LineMatches) != 1 {
+		t.Fatalf("got %d line matches, want 1", len(f.LineMatches))
+	}
+	lm := f.LineMatches[0]
+	sent := len(lm.Line)
+	for _, c := range append(lm.Before, lm.After...) {
+		sent += len(c.Line)
+	}
+	if sent > 100 {
+		t.Errorf("got %d bytes of lines for a %d byte file, want only the matched region", sent, content.Len())
+	}
+
+	// A follow-up fetches more of the file around the match.
+	q := &query.FileChecksum{Sum: f.Checksum}
+	start := uint32(lm.LineStart) - 1000
+	got := search(q, &zoekt.SearchOptions{ContentRange: &zoekt.ContentRange{Start: start, Length: 2000}})[0].Content
+	if want := content.Bytes()[start : start+2000]; !bytes.Equal(got, want) {
+		t.Errorf("got content %q, want %q", got, want)
+	}
+
+	// Ranges are cut off at the end of the file.
+	end := uint32(content.Len())
+	got = search(q, &zoekt.SearchOptions{ContentRange: &zoekt.ContentRange{Start: end - 10, Length: 100}})[0].Content
+	if want := content.Bytes()[end-10:]; !bytes.Equal(got, want) {
+		t.Errorf("got content %q, want %q", got, want)
+	}
+	if got := search(q, &zoekt.SearchOptions{ContentRange: &zoekt.ContentRange{Start: end + 1, Length: 100}})[0].Content; len(got) != 0 {
+		t.Errorf("got content %q past the end, want none", got)
+	}
+}
+
 func TestServerError(t *testing.T) {
 	serverError := fmt.Errorf("zoekt server error")
 	h := func(w http.ResponseWriter, r *http.Request) {
-		esw, err := newEventStreamWriter(w)
+		esw, err := newEventStreamWriter(w, r)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -195,6 +501,23 @@ func (c streamerChan) Send(result *zoekt.SearchResult) {
 	c <- result
 }
 
+type memSeeker struct {
+	data []byte
+}
+
+func (s *memSeeker) Close() {}
+func (s *memSeeker) Read(off, sz uint32) ([]byte, error) {
+	return s.data[off : off+sz], nil
+}
+
+func (s *memSeeker) Size() (uint32, error) {
+	return uint32(len(s.data)), nil
+}
+
+func (s *memSeeker) Name() string {
+	return "memSeeker"
+}
+
 type adapter struct {
 	zoekt.Searcher
 }
@@ -207,3 +530,20 @@ func (a adapter) StreamSearch(ctx context.Context, q query.Q, opts *zoekt.Search
 	sender.Send(sr)
 	return nil
 }
+
+// stallingStreamer sends result after delay.
+type stallingStreamer struct {
+	zoekt.Searcher
+	delay  time.Duration
+	result *zoekt.SearchResult
+}
+
+func (s stallingStreamer) StreamSearch(ctx context.Context, q query.Q, opts *zoekt.SearchOptions, sender zoekt.Sender) error {
+	select {
+	case <-time.After(s.delay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	sender.Send(s.result)
+	return nil
+}
@@ -42,7 +42,9 @@ const IndexFormatVersion = 16
 // 9: Store ctags metadata & bump default max file size
 // 10: Compound shards; more flexible TOC format.
 // 11: Bloom filters for file names & contents
-const FeatureVersion = 11
+// 12: Dropped ngrams, see IndexBuilder.MaxPostingEntries
+// 13: Changed lines of diffs, see query.DiffLine
+const FeatureVersion = 13
 
 // WriteMinFeatureVersion and ReadMinFeatureVersion constrain forwards and backwards
 // compatibility. For example, if a new way to encode filenameNgrams on disk is
@@ -64,6 +66,11 @@ const WriteMinFeatureVersion = 10
 // load a file with a FeatureVersion below it.
 const ReadMinFeatureVersion = 8
 
+// droppedNgramsMinReaderVersion is the IndexMinReaderVersion of files
+// with dropped ngrams. Older readers don't know that the ngrams still
+// occur, and would find no matches for them.
+const droppedNgramsMinReaderVersion = 12
+
 // 17: compound shard (multi repo)
 const NextIndexFormatVersion = 17
 
@@ -98,6 +105,27 @@ type indexTOC struct {
 	contentBloom simpleSection
 	nameBloom    simpleSection
 
+	// droppedNgrams lists the content ngrams whose postings were left
+	// out, see IndexBuilder.MaxPostingEntries.
+	droppedNgrams simpleSection
+
+	// rankBoosts holds Document.RankBoost for each document, or is
+	// empty if no document has one.
+	rankBoosts simpleSection
+
+	// modTimes holds Document.ModTime for each document in Unix
+	// nanoseconds, or is empty if no document has one.
+	modTimes simpleSection
+
+	// skipReasons holds Document.SkipReason for each document, or is
+	// empty if the content of all documents was indexed.
+	skipReasons compoundSection
+
+	// diffLines holds the changed lines of each document that is a
+	// unified diff, see diffLines, and an empty item for other
+	// documents. It is empty if no document is a diff.
+	diffLines compoundSection
+
 	repos simpleSection
 }
 
@@ -181,6 +209,11 @@ func (t *indexTOC) sectionsTaggedList() []taggedSection {
 		{"repos", &t.repos},
 		{"nameBloom", &t.nameBloom},
 		{"contentBloom", &t.contentBloom},
+		{"droppedNgrams", &t.droppedNgrams},
+		{"rankBoosts", &t.rankBoosts},
+		{"modTimes", &t.modTimes},
+		{"skipReasons", &t.skipReasons},
+		{"diffLines", &t.diffLines},
 	}
 }
 
@@ -0,0 +1,119 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"sync"
+	"unicode/utf8"
+)
+
+// parallelTokenizeMinSize is the smallest document, in bytes, that
+// IndexBuilder.TokenizeParallelism splits up. Smaller documents don't
+// amortize the cost of merging.
+var parallelTokenizeMinSize = 1 << 20
+
+// tokenizeParallel returns the trigrams of data, computed by splitting
+// data into n chunks that are tokenized concurrently. The result is the
+// same as that of a serial tokenization: the offsets of each trigram are
+// rune offsets relative to the start of data, in increasing order.
+func tokenizeParallel(data []byte, n int) []docNgram {
+	// Split at bytes that start a rune. A serial decode of data stops
+	// at all of those, even in invalid UTF-8, so each chunk decodes to
+	// the same runes it would in a serial pass.
+	bounds := []int{0}
+	for i := 1; i < n; i++ {
+		b := i * len(data) / n
+		if b < bounds[len(bounds)-1] {
+			b = bounds[len(bounds)-1]
+		}
+		for b < len(data) && !utf8.RuneStart(data[b]) {
+			b++
+		}
+		if b > bounds[len(bounds)-1] && b < len(data) {
+			bounds = append(bounds, b)
+		}
+	}
+	bounds = append(bounds, len(data))
+	chunks := len(bounds) - 1
+
+	// The rune offset of each chunk.
+	runeStarts := make([]uint32, chunks+1)
+	var wg sync.WaitGroup
+	for i := 0; i < chunks; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			runeStarts[i+1] = uint32(utf8.RuneCount(data[bounds[i]:bounds[i+1]]))
+		}(i)
+	}
+	wg.Wait()
+	for i := 1; i <= chunks; i++ {
+		runeStarts[i] += runeStarts[i-1]
+	}
+
+	// Each chunk holds the trigrams starting in it, which may end in
+	// the next chunk.
+	maps := make([]map[ngram][]uint32, chunks)
+	for i := 0; i < chunks; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			maps[i] = tokenizeChunk(data[bounds[i]:], bounds[i+1]-bounds[i], runeStarts[i])
+		}(i)
+	}
+	wg.Wait()
+
+	// Appending the offsets of the chunks in order keeps them sorted.
+	var order []ngram
+	merged := map[ngram][]uint32{}
+	for _, m := range maps {
+		for ng, offs := range m {
+			if _, ok := merged[ng]; !ok {
+				order = append(order, ng)
+			}
+			merged[ng] = append(merged[ng], offs...)
+		}
+	}
+
+	ngrams := make([]docNgram, 0, len(order))
+	for _, ng := range order {
+		ngrams = append(ngrams, docNgram{ngram: ng, offsets: merged[ng]})
+	}
+	return ngrams
+}
+
+// tokenizeChunk returns the offsets of the trigrams of data that start in
+// its first size bytes. runeStart is the rune offset of data.
+func tokenizeChunk(data []byte, size int, runeStart uint32) map[ngram][]uint32 {
+	m := map[ngram][]uint32{}
+	var runeGram [ngramSize]rune
+	var byteGram [ngramSize]int
+	off := 0
+	for i := uint32(0); off < len(data); i++ {
+		c, sz := utf8.DecodeRune(data[off:])
+		runeGram[0], runeGram[1], runeGram[2] = runeGram[1], runeGram[2], c
+		byteGram[0], byteGram[1], byteGram[2] = byteGram[1], byteGram[2], off
+		off += sz
+		if i < ngramSize-1 {
+			continue
+		}
+		if byteGram[0] >= size {
+			break
+		}
+		ng := runesToNGram(runeGram)
+		m[ng] = append(m[ng], runeStart+i-(ngramSize-1))
+	}
+	return m
+}
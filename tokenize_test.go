@@ -0,0 +1,97 @@
+// Copyright 2021 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package zoekt
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// randomContent returns n bytes of text mixing ASCII, multi-byte runes
+// and invalid UTF-8.
+func randomContent(n int) []byte {
+	r := rand.New(rand.NewSource(1))
+	words := []string{"foo", "bar", "héllo", "世界", "\xe2\x82", "\xff", "\n", " ", "x"}
+	var b bytes.Buffer
+	for b.Len() < n {
+		b.WriteString(words[r.Intn(len(words))])
+	}
+	return b.Bytes()
+}
+
+func TestTokenizeParallel(t *testing.T) {
+	defer func(old int) { parallelTokenizeMinSize = old }(parallelTokenizeMinSize)
+	parallelTokenizeMinSize = 0
+
+	docs := []Document{
+		{Name: "empty", Content: []byte{}},
+		{Name: "short", Content: []byte("ab")},
+		{Name: "small", Content: []byte("héllo wörld")},
+		{Name: "large", Content: randomContent(100000)},
+	}
+	build := func(parallelism int) (*IndexBuilder, []byte) {
+		b, err := NewIndexBuilder(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.IndexTime = time.Unix(1, 0)
+		b.ID = "test"
+		b.TokenizeParallelism = parallelism
+		for _, d := range docs {
+			if err := b.Add(d); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var buf bytes.Buffer
+		if err := b.Write(&buf); err != nil {
+			t.Fatal(err)
+		}
+		return b, buf.Bytes()
+	}
+
+	serial, serialShard := build(1)
+	for _, n := range []int{2, 3, 7, 64} {
+		parallel, parallelShard := build(n)
+		if !reflect.DeepEqual(serial.contentPostings.postings, parallel.contentPostings.postings) {
+			t.Errorf("parallelism %d: postings differ from serial tokenization", n)
+		}
+		if !bytes.Equal(serialShard, parallelShard) {
+			t.Errorf("parallelism %d: shard differs from serial tokenization", n)
+		}
+	}
+}
+
+func BenchmarkTokenizeParallel(b *testing.B) {
+	content := randomContent(50 << 20)
+	for _, n := range []int{1, 4} {
+		b.Run(fmt.Sprintf("parallelism=%d", n), func(b *testing.B) {
+			b.SetBytes(int64(len(content)))
+			for i := 0; i < b.N; i++ {
+				ib, err := NewIndexBuilder(nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+				ib.TokenizeParallelism = n
+				if err := ib.Add(Document{Name: "large", Content: content}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
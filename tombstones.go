@@ -16,8 +16,11 @@ func TombstonesEnabled(dir string) bool {
 
 var mockRepos []*Repository
 
-// SetTombstone idempotently sets a tombstone for repoName in .meta.
-func SetTombstone(shardPath string, repoName string) error {
+// SetTombstone idempotently sets or, if tombstoned is false, clears the
+// tombstone of repoName in the .meta file of the shard at shardPath.
+// Searchers opened on the shard afterwards skip tombstoned repositories,
+// without the content of the shard being rewritten.
+func SetTombstone(shardPath string, repoName string, tombstoned bool) error {
 	var repos []*Repository
 	var err error
 
@@ -32,7 +35,7 @@ func SetTombstone(shardPath string, repoName string) error {
 
 	for _, repo := range repos {
 		if repo.Name == repoName {
-			repo.Tombstone = true
+			repo.Tombstone = tombstoned
 		}
 	}
 
@@ -1,14 +1,20 @@
 package zoekt
 
 import (
+	"context"
 	"encoding/json"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"testing"
+
+	"github.com/google/zoekt/query"
 )
 
 func TestSetTombstone(t *testing.T) {
 	mockRepos = mkRepos("r1", "r2", "r3")
+	defer func() { mockRepos = nil }()
 
 	readMeta := func(shard string) []byte {
 		blob, err := os.ReadFile(shard + ".meta")
@@ -21,7 +27,7 @@ func TestSetTombstone(t *testing.T) {
 	dir := t.TempDir()
 	ghostShard := filepath.Join(dir, "test.zoekt")
 
-	SetTombstone(ghostShard, "r2")
+	SetTombstone(ghostShard, "r2", true)
 
 	blob := readMeta(ghostShard)
 	gotRepos := []*Repository{}
@@ -39,7 +45,7 @@ func TestSetTombstone(t *testing.T) {
 		t.Fatal("r3 should have been alive")
 	}
 
-	SetTombstone(ghostShard, "r1")
+	SetTombstone(ghostShard, "r1", true)
 
 	blob = readMeta(ghostShard)
 	gotRepos = nil
@@ -65,3 +71,58 @@ func mkRepos(repoNames ...string) []*Repository {
 	}
 	return ret
 }
+
+func TestSetTombstoneCompound(t *testing.T) {
+	dir := t.TempDir()
+	var paths []string
+	for _, name := range []string{"repoA", "repoB"} {
+		p := filepath.Join(dir, name+".zoekt")
+		if err := builderWriteAll(p, testIndexBuilder(t, &Repository{Name: name}, Document{Name: "f", Content: []byte("needle")})); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, p)
+	}
+	compound, err := MergePaths(filepath.Join(dir, "out"), paths...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repos := func() (searched, listed []string) {
+		t.Helper()
+		s := searcherForPath(t, compound)
+		defer s.Close()
+		res, err := s.Search(context.Background(), &query.Substring{Pattern: "needle"}, &SearchOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range res.Files {
+			searched = append(searched, f.Repository)
+		}
+		rl, err := s.List(context.Background(), &query.Const{Value: true}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range rl.Repos {
+			listed = append(listed, r.Repository.Name)
+		}
+		sort.Strings(searched)
+		sort.Strings(listed)
+		return searched, listed
+	}
+
+	if err := SetTombstone(compound, "repoB", true); err != nil {
+		t.Fatal(err)
+	}
+	searched, listed := repos()
+	if want := []string{"repoA"}; !reflect.DeepEqual(searched, want) || !reflect.DeepEqual(listed, want) {
+		t.Errorf("with tombstone: searched %v, listed %v, want %v", searched, listed, want)
+	}
+
+	if err := SetTombstone(compound, "repoB", false); err != nil {
+		t.Fatal(err)
+	}
+	searched, listed = repos()
+	if want := []string{"repoA", "repoB"}; !reflect.DeepEqual(searched, want) || !reflect.DeepEqual(listed, want) {
+		t.Errorf("without tombstone: searched %v, listed %v, want %v", searched, listed, want)
+	}
+}
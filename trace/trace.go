@@ -43,6 +43,10 @@ func (t Tracer) New(ctx context.Context, family, title string) (*Trace, context.
 		tr.LazyPrintf("parent: %s", parent.family)
 		trace.family = parent.family + " > " + family
 	}
+	if tenant := TenantFromContext(ctx); tenant != "" {
+		span.SetTag("tenant", tenant)
+		tr.LazyPrintf("tenant: %s", tenant)
+	}
 	return trace, ContextWithTrace(ctx, trace)
 }
 
@@ -119,6 +123,21 @@ func TraceFromContext(ctx context.Context) *Trace {
 	return tr
 }
 
+const tenantKey = traceContextKey("tenant")
+
+// WithTenant returns a context that attributes the work done for it, such
+// as searches, to tenant. Traces started from it are tagged with tenant.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey, tenant)
+}
+
+// TenantFromContext returns the tenant set with WithTenant, or "" if
+// there is none.
+func TenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey).(string)
+	return tenant
+}
+
 // fieldsStringer lazily marshals a slice of log.Field into a string for
 // printing in net/trace.
 type fieldsStringer []log.Field
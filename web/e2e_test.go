@@ -30,6 +30,7 @@ import (
 
 	"github.com/google/zoekt"
 	"github.com/google/zoekt/query"
+	"github.com/google/zoekt/stream"
 )
 
 // TODO(hanwen): cut & paste from ../ . Should create internal test
@@ -514,3 +515,52 @@ func TestHealthz(t *testing.T) {
 		t.Fatal("empty result in response")
 	}
 }
+
+func TestStreamSymbols(t *testing.T) {
+	b, err := zoekt.NewIndexBuilder(&zoekt.Repository{
+		Name: "name",
+	})
+	if err != nil {
+		t.Fatalf("NewIndexBuilder: %v", err)
+	}
+	if err := b.Add(zoekt.Document{
+		Name:            "f.go",
+		Content:         []byte("package main\nfunc carry() {}\n"),
+		Symbols:         []zoekt.DocumentSection{{Start: 18, End: 23}},
+		SymbolsMetaData: []*zoekt.Symbol{{Kind: "function", Parent: "main", ParentKind: "package"}},
+	}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+
+	srv := Server{
+		Searcher: searcherForTest(t, b),
+		Top:      Top,
+		RPC:      true,
+	}
+	mux, err := NewMux(&srv)
+	if err != nil {
+		t.Fatalf("NewMux: %v", err)
+	}
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	var got []*zoekt.Symbol
+	q := &query.Symbol{Expr: &query.Substring{Pattern: "carry"}}
+	err = stream.NewClient(ts.URL, nil).StreamSearch(context.Background(), q, &zoekt.SearchOptions{}, stream.SenderFunc(func(sr *zoekt.SearchResult) {
+		for _, fm := range sr.Files {
+			for _, lm := range fm.LineMatches {
+				for _, frag := range lm.LineFragments {
+					got = append(got, frag.SymbolInfo)
+				}
+			}
+		}
+	}))
+	if err != nil {
+		t.Fatalf("StreamSearch: %v", err)
+	}
+
+	want := []*zoekt.Symbol{{Sym: "carry", Kind: "function", Parent: "main", ParentKind: "package"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got symbols %+v, want %+v", got, want)
+	}
+}
@@ -68,8 +68,13 @@ func (s *compoundSection) writeMap(w *writer, m map[string]uint32) {
 
 func writePostings(w *writer, s *postingsBuilder, ngramText *simpleSection,
 	charOffsets *simpleSection, postings *compoundSection, endRunes *simpleSection) {
-	keys := make(ngramSlice, 0, len(s.postings))
-	for k := range s.postings {
+	if s.spillWritten && w.err == nil {
+		w.err = errPostingsSpilled
+	}
+
+	// lastOffsets has an entry for each ngram, also the spilled ones.
+	keys := make(ngramSlice, 0, len(s.lastOffsets))
+	for k := range s.lastOffsets {
 		keys = append(keys, k)
 	}
 	sort.Sort(keys)
@@ -83,8 +88,16 @@ func writePostings(w *writer, s *postingsBuilder, ngramText *simpleSection,
 	ngramText.end(w)
 
 	postings.start(w)
-	for _, k := range keys {
-		postings.addItem(w, s.postings[k])
+	if len(s.segments) > 0 {
+		if err := writeSpilledPostings(w, s, keys, postings); err != nil && w.err == nil {
+			w.err = err
+		}
+		s.removeSegments()
+		s.spillWritten = true
+	} else {
+		for _, k := range keys {
+			postings.addItem(w, s.postings[k])
+		}
 	}
 	postings.end(w)
 
@@ -97,6 +110,14 @@ func writePostings(w *writer, s *postingsBuilder, ngramText *simpleSection,
 	endRunes.end(w)
 }
 
+// shrinkBloom shrinks bl for writing, according to BloomTargetFPR.
+func (b *IndexBuilder) shrinkBloom(bl *bloom) bloom {
+	if b.BloomTargetFPR > 0 {
+		return bl.shrinkToFPR(b.BloomTargetFPR)
+	}
+	return bl.shrinkToSize(bloomDefaultLoad)
+}
+
 func (b *IndexBuilder) Write(out io.Writer) error {
 	next := b.indexFormatVersion == NextIndexFormatVersion
 
@@ -139,16 +160,37 @@ func (b *IndexBuilder) Write(out io.Writer) error {
 	}
 	toc.fileSections.end(w)
 
+	// Without bloom filters, the sections are left empty, which readers
+	// take as a filter that matches everything.
 	toc.nameBloom.start(w)
-	b.nameBloom.shrinkToSize(bloomDefaultLoad).write(w)
+	if !b.DisableBloom {
+		b.shrinkBloom(&b.nameBloom).write(w)
+	}
 	toc.nameBloom.end(w)
 
 	toc.contentBloom.start(w)
-	b.contentBloom.shrinkToSize(bloomDefaultLoad).write(w)
+	if !b.DisableBloom {
+		b.shrinkBloom(&b.contentBloom).write(w)
+	}
 	toc.contentBloom.end(w)
 
+	if b.MaxPostingEntries > 0 && !b.contentPostings.spillWritten {
+		if err := b.contentPostings.dropCommon(b.MaxPostingEntries); err != nil {
+			return err
+		}
+	}
 	writePostings(w, b.contentPostings, &toc.ngramText, &toc.runeOffsets, &toc.postings, &toc.fileEndRunes)
 
+	dropped := b.contentPostings.dropped
+	sort.Sort(ngramSlice(dropped))
+	toc.droppedNgrams.start(w)
+	for _, ng := range dropped {
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], uint64(ng))
+		w.Write(buf[:])
+	}
+	toc.droppedNgrams.end(w)
+
 	// names.
 	toc.fileNames.writeStrings(w, b.nameStrings)
 
@@ -166,6 +208,79 @@ func (b *IndexBuilder) Write(out io.Writer) error {
 	w.Write(b.languages)
 	toc.languages.end(w)
 
+	// Most shards don't boost any document, so leave the section empty
+	// for them.
+	boosted := false
+	for _, boost := range b.rankBoosts {
+		if boost != 0 {
+			boosted = true
+			break
+		}
+	}
+	toc.rankBoosts.start(w)
+	if boosted {
+		for _, boost := range b.rankBoosts {
+			var buf [2]byte
+			binary.BigEndian.PutUint16(buf[:], boost)
+			w.Write(buf[:])
+		}
+	}
+	toc.rankBoosts.end(w)
+
+	hasModTimes := false
+	for _, t := range b.modTimes {
+		if !t.IsZero() {
+			hasModTimes = true
+			break
+		}
+	}
+	toc.modTimes.start(w)
+	if hasModTimes {
+		for _, t := range b.modTimes {
+			// The zero time has no Unix nanoseconds, so it is stored as 0.
+			var nanos int64
+			if !t.IsZero() {
+				nanos = t.UnixNano()
+			}
+			w.U64(uint64(nanos))
+		}
+	}
+	toc.modTimes.end(w)
+
+	skipped := false
+	for _, r := range b.skipReasons {
+		if r != "" {
+			skipped = true
+			break
+		}
+	}
+	toc.skipReasons.start(w)
+	if skipped {
+		for _, r := range b.skipReasons {
+			toc.skipReasons.addItem(w, []byte(r))
+		}
+	}
+	toc.skipReasons.end(w)
+
+	hasDiffs := false
+	for _, l := range b.diffLines {
+		if l != nil {
+			hasDiffs = true
+			break
+		}
+	}
+	toc.diffLines.start(w)
+	if hasDiffs {
+		for _, l := range b.diffLines {
+			var item []byte
+			if l != nil {
+				item = toSizedDeltas(l)
+			}
+			toc.diffLines.addItem(w, item)
+		}
+	}
+	toc.diffLines.end(w)
+
 	toc.runeDocSections.start(w)
 	w.Write(marshalDocSections(b.runeDocSections))
 	toc.runeDocSections.end(w)
@@ -181,15 +296,21 @@ func (b *IndexBuilder) Write(out io.Writer) error {
 		indexTime = time.Now()
 	}
 
+	minReaderVersion := WriteMinFeatureVersion
+	if len(dropped) > 0 {
+		minReaderVersion = droppedNgramsMinReaderVersion
+	}
+
 	if err := b.writeJSON(&IndexMetadata{
 		IndexFormatVersion:    b.indexFormatVersion,
 		IndexTime:             indexTime,
 		IndexFeatureVersion:   b.featureVersion,
-		IndexMinReaderVersion: WriteMinFeatureVersion,
+		IndexMinReaderVersion: minReaderVersion,
 		PlainASCII:            b.contentPostings.isPlainASCII && b.namePostings.isPlainASCII,
 		LanguageMap:           b.languageMap,
 		ZoektVersion:          Version,
 		ID:                    b.ID,
+		SymbolsOnly:           b.SymbolsOnly,
 	}, &toc.metaData, w); err != nil {
 		return err
 	}